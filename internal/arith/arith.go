@@ -0,0 +1,461 @@
+package arith
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Variables gives an expression access to shell variables
+type Variables interface {
+	Get(name string) string
+	Set(name, value string) error
+}
+
+// maxVariableDepth limits how many times a variable whose value is the name
+// of another variable is followed, so that x=y y=x is an error rather than
+// a hang
+const maxVariableDepth = 100
+
+// Eval evaluates a shell arithmetic expression using 64-bit integers. It
+// supports the C operators, from the comma operator down to unary ones:
+// assignment (=, +=, -=, *=, /=, %=, <<=, >>=, &=, ^=, |=), ?:, ||, &&, |,
+// ^, &, == and !=, comparisons, shifts, + and -, *, / and %, ** for powers,
+// unary !, ~, - and +, and ++ and -- before or after a variable. Variables
+// that are unset or empty count as zero. An empty expression is zero.
+func Eval(expr string, vars Variables) (int64, error) {
+	tokens, err := tokenize(expr)
+	if err != nil {
+		return 0, err
+	}
+	if len(tokens) == 0 {
+		return 0, nil
+	}
+
+	p := &parser{tokens: tokens, vars: vars}
+	value, err := p.comma()
+	if err != nil {
+		return 0, err
+	}
+	if p.pos < len(p.tokens) {
+		return 0, p.unexpected()
+	}
+	return value, nil
+}
+
+// Operators, longest first so that tokenize finds the longest match
+var operators = []string{
+	"<<=", ">>=",
+	"**", "++", "--", "+=", "-=", "*=", "/=", "%=", "&=", "^=", "|=",
+	"<<", ">>", "<=", ">=", "==", "!=", "&&", "||",
+	"+", "-", "*", "/", "%", "(", ")", "!", "~", "<", ">", "=", "&", "|", "^", "?", ":", ",",
+}
+
+// tokenize splits an expression into numbers, names and operators
+func tokenize(expr string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(expr); {
+		c := expr[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			i++
+		case isNameChar(c, true) || (c >= '0' && c <= '9'):
+			// Numbers take letters too, for hex such as 0xff
+			end := i + 1
+			for end < len(expr) && isNameChar(expr[end], false) {
+				end++
+			}
+			tokens = append(tokens, expr[i:end])
+			i = end
+		default:
+			op := ""
+			for _, candidate := range operators {
+				if strings.HasPrefix(expr[i:], candidate) {
+					op = candidate
+					break
+				}
+			}
+			if op == "" {
+				return nil, fmt.Errorf("syntax error: invalid arithmetic operator (error token is \"%s\")", expr[i:])
+			}
+			tokens = append(tokens, op)
+			i += len(op)
+		}
+	}
+	return tokens, nil
+}
+
+func isNameChar(c byte, first bool) bool {
+	if c == '_' || (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') {
+		return true
+	}
+	return !first && c >= '0' && c <= '9'
+}
+
+// isName reports whether token is a variable name rather than a number or
+// operator
+func isName(token string) bool {
+	return isNameChar(token[0], true)
+}
+
+// parser evaluates an expression as it parses it, by recursive descent with
+// one method for each level of precedence
+type parser struct {
+	tokens []string
+	pos    int
+	vars   Variables
+
+	// Greater than zero while parsing an operand that &&, || or ?: has
+	// short-circuited, whose assignments and errors must not take effect
+	skip int
+}
+
+// peek returns the next token, or "" at the end of the expression
+func (p *parser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+// unexpected returns the error for the token at the current position
+func (p *parser) unexpected() error {
+	if p.pos >= len(p.tokens) {
+		return errors.New("syntax error: operand expected")
+	}
+	return fmt.Errorf("syntax error in expression (error token is \"%s\")", strings.Join(p.tokens[p.pos:], " "))
+}
+
+// comma parses expressions separated by commas, whose value is the last
+func (p *parser) comma() (int64, error) {
+	value, err := p.assignment()
+	for err == nil && p.peek() == "," {
+		p.pos++
+		value, err = p.assignment()
+	}
+	return value, err
+}
+
+// assignment parses NAME = value and the compound assignments such as
+// NAME += value, which group from the right
+func (p *parser) assignment() (int64, error) {
+	if p.pos+1 < len(p.tokens) && isName(p.tokens[p.pos]) && isAssignment(p.tokens[p.pos+1]) {
+		name, op := p.tokens[p.pos], p.tokens[p.pos+1]
+		p.pos += 2
+		value, err := p.assignment()
+		if err != nil {
+			return 0, err
+		}
+		if op != "=" {
+			current, err := p.get(name, 0)
+			if err != nil {
+				return 0, err
+			}
+			if value, err = p.apply(strings.TrimSuffix(op, "="), current, value); err != nil {
+				return 0, err
+			}
+		}
+		return value, p.set(name, value)
+	}
+	return p.conditional()
+}
+
+func isAssignment(token string) bool {
+	switch token {
+	case "=", "+=", "-=", "*=", "/=", "%=", "<<=", ">>=", "&=", "^=", "|=":
+		return true
+	}
+	return false
+}
+
+// conditional parses cond ? a : b, evaluating only the branch it takes
+func (p *parser) conditional() (int64, error) {
+	cond, err := p.binary(0)
+	if err != nil || p.peek() != "?" {
+		return cond, err
+	}
+	p.pos++
+
+	a, err := p.branch(cond == 0, p.comma)
+	if err != nil {
+		return 0, err
+	}
+	if p.peek() != ":" {
+		return 0, p.unexpected()
+	}
+	p.pos++
+	b, err := p.branch(cond != 0, p.conditional)
+	if err != nil {
+		return 0, err
+	}
+
+	if cond != 0 {
+		return a, nil
+	}
+	return b, nil
+}
+
+// branch parses an operand with parse, only evaluating it for real if skip
+// is false
+func (p *parser) branch(skip bool, parse func() (int64, error)) (int64, error) {
+	if skip {
+		p.skip++
+		defer func() { p.skip-- }()
+	}
+	return parse()
+}
+
+// Binary operators from lowest to highest precedence. Each level groups
+// from the left.
+var binaryLevels = [][]string{
+	{"||"},
+	{"&&"},
+	{"|"},
+	{"^"},
+	{"&"},
+	{"==", "!="},
+	{"<", "<=", ">", ">="},
+	{"<<", ">>"},
+	{"+", "-"},
+	{"*", "/", "%"},
+}
+
+// binary parses the binary operators at level and above
+func (p *parser) binary(level int) (int64, error) {
+	if level == len(binaryLevels) {
+		return p.power()
+	}
+	operand := func() (int64, error) { return p.binary(level + 1) }
+
+	left, err := operand()
+	if err != nil {
+		return 0, err
+	}
+	for slices.Contains(binaryLevels[level], p.peek()) {
+		op := p.tokens[p.pos]
+		p.pos++
+
+		// && and || only evaluate their right operand if they need it
+		var right int64
+		switch op {
+		case "&&":
+			right, err = p.branch(left == 0, operand)
+			left = boolValue(left != 0 && right != 0)
+		case "||":
+			right, err = p.branch(left != 0, operand)
+			left = boolValue(left != 0 || right != 0)
+		default:
+			if right, err = operand(); err == nil {
+				left, err = p.apply(op, left, right)
+			}
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	return left, nil
+}
+
+// power parses a ** b, which groups from the right
+func (p *parser) power() (int64, error) {
+	base, err := p.unary()
+	if err != nil || p.peek() != "**" {
+		return base, err
+	}
+	p.pos++
+	exponent, err := p.power()
+	if err != nil {
+		return 0, err
+	}
+	return p.apply("**", base, exponent)
+}
+
+// unary parses the prefix operators
+func (p *parser) unary() (int64, error) {
+	switch op := p.peek(); op {
+	case "!", "~", "-", "+":
+		p.pos++
+		value, err := p.unary()
+		if err != nil {
+			return 0, err
+		}
+		switch op {
+		case "!":
+			return boolValue(value == 0), nil
+		case "~":
+			return ^value, nil
+		case "-":
+			return -value, nil
+		}
+		return value, nil
+	case "++", "--":
+		p.pos++
+		if !isName(p.peek()) {
+			return 0, p.unexpected()
+		}
+		name := p.tokens[p.pos]
+		p.pos++
+		value, err := p.get(name, 0)
+		if err != nil {
+			return 0, err
+		}
+		value = step(value, op)
+		return value, p.set(name, value)
+	}
+	return p.primary()
+}
+
+// primary parses a number, a variable with an optional ++ or -- after it,
+// or a parenthesized expression
+func (p *parser) primary() (int64, error) {
+	token := p.peek()
+	switch {
+	case token == "(":
+		p.pos++
+		value, err := p.comma()
+		if err != nil {
+			return 0, err
+		}
+		switch p.peek() {
+		case ")":
+			p.pos++
+			return value, nil
+		case "":
+			return 0, errors.New("missing ')'")
+		}
+		return 0, p.unexpected()
+	case token == "":
+		return 0, p.unexpected()
+	case isName(token):
+		p.pos++
+		value, err := p.get(token, 0)
+		if err != nil {
+			return 0, err
+		}
+		if op := p.peek(); op == "++" || op == "--" {
+			p.pos++
+			return value, p.set(token, step(value, op))
+		}
+		return value, nil
+	case token[0] >= '0' && token[0] <= '9':
+		p.pos++
+		value, err := strconv.ParseInt(token, 0, 64)
+		if err != nil {
+			return 0, fmt.Errorf("%s: invalid number", token)
+		}
+		return value, nil
+	}
+	return 0, p.unexpected()
+}
+
+// get returns the value of a variable. A variable holding the name of
+// another variable takes that one's value.
+func (p *parser) get(name string, depth int) (int64, error) {
+	if depth > maxVariableDepth {
+		return 0, fmt.Errorf("%s: expression recursion level exceeded", name)
+	}
+
+	value := strings.TrimSpace(p.vars.Get(name))
+	switch {
+	case value == "":
+		return 0, nil
+	case isNameChar(value[0], true):
+		for i := 1; i < len(value); i++ {
+			if !isNameChar(value[i], false) {
+				return 0, fmt.Errorf("%s: invalid number", value)
+			}
+		}
+		return p.get(value, depth+1)
+	}
+
+	n, err := strconv.ParseInt(value, 0, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%s: invalid number", value)
+	}
+	return n, nil
+}
+
+// set assigns a variable, unless the expression it is in is being skipped
+func (p *parser) set(name string, value int64) error {
+	if p.skip > 0 {
+		return nil
+	}
+	return p.vars.Set(name, strconv.FormatInt(value, 10))
+}
+
+// apply applies a binary operator
+func (p *parser) apply(op string, a, b int64) (int64, error) {
+	switch op {
+	case "+":
+		return a + b, nil
+	case "-":
+		return a - b, nil
+	case "*":
+		return a * b, nil
+	case "/", "%":
+		if b == 0 {
+			if p.skip > 0 {
+				return 0, nil
+			}
+			return 0, errors.New("division by 0")
+		}
+		if op == "/" {
+			return a / b, nil
+		}
+		return a % b, nil
+	case "**":
+		if b < 0 {
+			return 0, errors.New("exponent less than 0")
+		}
+		// Exponentiation by squaring
+		result := int64(1)
+		for ; b > 0; b >>= 1 {
+			if b&1 == 1 {
+				result *= a
+			}
+			a *= a
+		}
+		return result, nil
+	case "<<":
+		return a << uint64(b), nil
+	case ">>":
+		return a >> uint64(b), nil
+	case "&":
+		return a & b, nil
+	case "|":
+		return a | b, nil
+	case "^":
+		return a ^ b, nil
+	case "==":
+		return boolValue(a == b), nil
+	case "!=":
+		return boolValue(a != b), nil
+	case "<":
+		return boolValue(a < b), nil
+	case "<=":
+		return boolValue(a <= b), nil
+	case ">":
+		return boolValue(a > b), nil
+	case ">=":
+		return boolValue(a >= b), nil
+	}
+	return 0, fmt.Errorf("%s: unknown operator", op)
+}
+
+// step applies ++ or -- to value
+func step(value int64, op string) int64 {
+	if op == "++" {
+		return value + 1
+	}
+	return value - 1
+}
+
+// boolValue converts a condition to 1 or 0
+func boolValue(b bool) int64 {
+	if b {
+		return 1
+	}
+	return 0
+}
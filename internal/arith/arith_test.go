@@ -0,0 +1,103 @@
+package arith
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// mapVars stores variables in a map
+type mapVars map[string]string
+
+func (v mapVars) Get(name string) string {
+	return v[name]
+}
+
+func (v mapVars) Set(name, value string) error {
+	v[name] = value
+	return nil
+}
+
+func TestEval(t *testing.T) {
+	tests := []struct {
+		expr string
+		want int64
+	}{
+		{"", 0},
+		{"3 + 4", 7},
+		{"2 + 3 * 4", 14},
+		{"(2 + 3) * 4", 20},
+		{"7 / 2", 3},
+		{"-7 % 3", -1},
+		{"2 ** 10", 1024},
+		{"2 ** 3 ** 2", 512},
+		{"-x + 1", -9},
+		{"!0 + !5 + ~0", 0},
+		{"1 << 4 | 1", 17},
+		{"6 & 3 ^ 1", 3},
+		{"x > 5 && x <= 10", 1},
+		{"x == 3 || 0", 0},
+		{"x ? 1 : 2", 1},
+		{"unset + 1", 1},
+		{"0x10 + 010", 24},
+		{"name + 1", 11},
+		{"1, 2, 3", 3},
+	}
+	for _, tt := range tests {
+		vars := mapVars{"x": "10", "name": "x"}
+		got, err := Eval(tt.expr, vars)
+		assert.NoError(t, err, tt.expr)
+		assert.Equal(t, tt.want, got, tt.expr)
+	}
+}
+
+func TestEvalAssignment(t *testing.T) {
+	vars := mapVars{"i": "5"}
+
+	value, err := Eval("x = 3 + 4", vars)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(7), value)
+	assert.Equal(t, "7", vars["x"])
+
+	value, _ = Eval("i++", vars)
+	assert.Equal(t, int64(5), value, "post-increment gives the old value")
+	assert.Equal(t, "6", vars["i"])
+	value, _ = Eval("--i", vars)
+	assert.Equal(t, int64(5), value, "pre-decrement gives the new value")
+	assert.Equal(t, "5", vars["i"])
+
+	Eval("x += 3, x *= 2, x -= 1", vars)
+	assert.Equal(t, "19", vars["x"])
+	Eval("a = b = 4", vars)
+	assert.Equal(t, "4", vars["a"])
+	assert.Equal(t, "4", vars["b"])
+
+	// Short-circuited operands aren't evaluated
+	Eval("0 && (y = 1)", vars)
+	Eval("1 || (y = 1)", vars)
+	Eval("1 ? (z = 1) : (y = 1)", vars)
+	Eval("0 && 1 / 0", vars)
+	assert.NotContains(t, vars, "y")
+	assert.Equal(t, "1", vars["z"])
+}
+
+func TestEvalErrors(t *testing.T) {
+	vars := mapVars{"bad": "1x", "loop": "loop"}
+	errorCases := map[string]string{
+		"1 / 0":   "division by 0",
+		"5 % 0":   "division by 0",
+		"2 ** -1": "exponent less than 0",
+		"3 +":     "syntax error: operand expected",
+		"(1 + 2":  "missing ')'",
+		"1 2":     "syntax error in expression (error token is \"2\")",
+		"1 @ 2":   "syntax error: invalid arithmetic operator (error token is \"@ 2\")",
+		"08":      "08: invalid number",
+		"bad":     "1x: invalid number",
+		"loop":    "loop: expression recursion level exceeded",
+		"++1":     "syntax error in expression (error token is \"1\")",
+	}
+	for expr, want := range errorCases {
+		_, err := Eval(expr, vars)
+		assert.EqualError(t, err, want, expr)
+	}
+}
@@ -1,26 +1,73 @@
 package builtins
 
 import (
+	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
+	"math"
 	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
+	"github.com/apriljarosz/gosh/internal/arith"
+	"github.com/apriljarosz/gosh/internal/dirstack"
+	"github.com/apriljarosz/gosh/internal/glob"
 	"github.com/apriljarosz/gosh/internal/history"
 	"github.com/apriljarosz/gosh/internal/jobs"
+	"github.com/apriljarosz/gosh/internal/shell"
 )
 
-var builtinCommands = map[string]func([]string) bool{
-	"exit":    exitCommand,
-	"cd":      cdCommand,
-	"pwd":     pwdCommand,
-	"help":    helpCommand,
-	"env":     envCommand,
-	"history": historyCommand,
-	"jobs":    jobsCommand,
-	"fg":      fgCommand,
-	"bg":      bgCommand,
+// builtinFunc is the signature of a builtin command. Builtins read from
+// stdin and write to stdout and stderr rather than the process's standard
+// streams so that they can be redirected. Builtins in a pipeline run at the
+// same time, so each records its exit status in status, which starts at 0,
+// rather than in $?. They return false if the shell should exit.
+type builtinFunc func(args []string, stdin io.Reader, stdout, stderr io.Writer, status *int) bool
+
+var builtinCommands = map[string]builtinFunc{
+	"exit":     exitCommand,
+	"cd":       cdCommand,
+	"pwd":      pwdCommand,
+	"help":     helpCommand,
+	"env":      envCommand,
+	"history":  historyCommand,
+	"jobs":     jobsCommand,
+	"fg":       fgCommand,
+	"bg":       bgCommand,
+	"export":   exportCommand,
+	"disown":   disownCommand,
+	"kill":     killCommand,
+	"trap":     trapCommand,
+	"read":     readCommand,
+	"version":  versionCommand,
+	"pushd":    pushdCommand,
+	"popd":     popdCommand,
+	"dirs":     dirsCommand,
+	"nohup":    nohupCommand,
+	"set":      setCommand,
+	"return":   returnCommand,
+	"break":    breakCommand,
+	"continue": continueCommand,
+	"tee":      teeCommand,
+	"cat":      catCommand,
+	"seq":      seqCommand,
+	"grep":     grepCommand,
+	"let":      letCommand,
+	"timeout":  timeoutCommand,
+	"complete": completeCommand,
+	"alias":    aliasCommand,
+	"unalias":  unaliasCommand,
 }
 
 // Global history instance - will be set by main
@@ -39,192 +86,2164 @@ func SetJobManager(jm *jobs.JobManager) {
 	globalJobManager = jm
 }
 
+// Terminal size reader - will be set by main
+var globalWindowSize func() (cols, rows int)
+
+// SetWindowSize sets the function used to read the terminal's size
+func SetWindowSize(size func() (cols, rows int)) {
+	globalWindowSize = size
+}
+
+// fileIsTerminal reports whether f is a terminal - set by main, and
+// replaceable in tests
+var fileIsTerminal = func(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// SetTerminalCheck sets how builtins tell whether a file is a terminal. A
+// character device alone isn't enough, since /dev/null is one too.
+func SetTerminalCheck(isTerminal func(f *os.File) bool) {
+	fileIsTerminal = isTerminal
+}
+
+// nonTerminalFile returns stream if it's a file other than a terminal, and
+// nil otherwise
+func nonTerminalFile(stream interface{}) *os.File {
+	f, ok := stream.(*os.File)
+	if !ok || fileIsTerminal(f) {
+		return nil
+	}
+	return f
+}
+
+// Build information - will be set by main
+var (
+	buildVersion = "dev"
+	buildCommit  = "unknown"
+)
+
+// SetVersion sets the build version and commit reported by version
+func SetVersion(version, commit string) {
+	buildVersion = version
+	buildCommit = commit
+}
+
+// VersionString describes the build version, commit and Go version
+func VersionString() string {
+	return fmt.Sprintf("gosh version %s (commit %s, %s)", buildVersion, buildCommit, runtime.Version())
+}
+
+// Hooks for detecting the terminal, replaceable in tests
+var (
+	stdoutIsTerminal = func() bool {
+		info, err := os.Stdout.Stat()
+		return err == nil && info.Mode()&os.ModeCharDevice != 0
+	}
+	terminalHeight = getTerminalHeight
+)
+
+// writePaged buffers the output produced by write and sends it through
+// $PAGER (default less) when stdout is the terminal and the output is taller
+// than the terminal. Otherwise, or if GOSH_PAGER=0, it goes straight to
+// stdout.
+func writePaged(stdout io.Writer, write func(w io.Writer)) {
+	var buf bytes.Buffer
+	write(&buf)
+
+	if os.Getenv("GOSH_PAGER") == "0" || stdout != io.Writer(os.Stdout) || !stdoutIsTerminal() ||
+		bytes.Count(buf.Bytes(), []byte("\n")) < terminalHeight() {
+		stdout.Write(buf.Bytes())
+		return
+	}
+
+	// A PAGER of nothing but spaces is treated as unset
+	fields := strings.Fields(os.Getenv("PAGER"))
+	if len(fields) == 0 {
+		fields = []string{"less"}
+	}
+
+	cmd := exec.Command(fields[0], fields[1:]...)
+	cmd.Stdin = &buf
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		// Fall back to printing directly if the pager can't be started
+		if _, ok := err.(*exec.ExitError); !ok {
+			os.Stdout.Write(buf.Bytes())
+		}
+	}
+}
+
+// getTerminalHeight returns the number of rows in the terminal, falling
+// back to $LINES and then to 24 when main hasn't said how to ask it
+func getTerminalHeight() int {
+	if globalWindowSize != nil {
+		_, rows := globalWindowSize()
+		return rows
+	}
+	if lines, err := strconv.Atoi(os.Getenv("LINES")); err == nil && lines > 0 {
+		return lines
+	}
+	return 24
+}
+
 // IsBuiltin checks if a command is a builtin
 func IsBuiltin(command string) bool {
 	_, exists := builtinCommands[command]
 	return exists
 }
 
-// Execute runs a builtin command
+// Names returns the names of all builtin commands, sorted
+func Names() []string {
+	names := make([]string, 0, len(builtinCommands))
+	for name := range builtinCommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Execute runs a builtin command on the shell's standard streams, setting
+// $? to its exit status
 // Returns false if the shell should exit
 func Execute(command string, args []string) bool {
-	if fn, exists := builtinCommands[command]; exists {
-		return fn(args)
+	status, ok := ExecuteIO(command, args, shell.IO{})
+	shell.SetExitStatus(status)
+	return ok
+}
+
+// ExecuteIO runs a builtin command with the given streams, such as the
+// targets of the command's redirections. Any stream left nil is the
+// shell's own. It returns the command's exit status, leaving $? for the
+// caller to set; until then $? is that of the command before.
+// Returns false if the shell should exit
+func ExecuteIO(command string, args []string, streams shell.IO) (int, bool) {
+	fn, exists := builtinCommands[command]
+	if !exists {
+		return 0, true
 	}
-	return true
+	if streams.In == nil {
+		streams.In = shell.Stdin()
+	}
+	if streams.Out == nil {
+		streams.Out = shell.Stdout()
+	}
+	if streams.Err == nil {
+		streams.Err = shell.Stderr()
+	}
+
+	// Builtins succeed unless they say otherwise
+	status := 0
+	ok := fn(args, streams.In, streams.Out, streams.Err, &status)
+	return status, ok
 }
 
-func exitCommand(args []string) bool {
-	fmt.Println("Goodbye!")
+// exitCommand ends the shell with status n, or that of the last command run
+// if n isn't given. In a command substitution it ends only the substitution.
+func exitCommand(args []string, stdin io.Reader, stdout, stderr io.Writer, status *int) bool {
+	*status = shell.ExitStatus()
+	if len(args) > 0 {
+		n, err := strconv.Atoi(args[0])
+		if err != nil {
+			fmt.Fprintf(stderr, "exit: %s: numeric argument required\n", args[0])
+			n = 2
+		}
+		*status = n & 0xff
+	}
+
+	if !shell.Subshell() {
+		fmt.Fprintln(stdout, "Goodbye!")
+	}
 	return false
 }
 
-func cdCommand(args []string) bool {
-	var dir string
+// openNohupOutput opens nohup.out for appending in the current directory,
+// or in the home directory if that fails
+func openNohupOutput() (*os.File, string, error) {
+	path := "nohup.out"
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err == nil {
+		return file, path, nil
+	}
+
+	home, homeErr := os.UserHomeDir()
+	if homeErr != nil {
+		return nil, "", err
+	}
+	path = filepath.Join(home, "nohup.out")
+	file, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	return file, path, err
+}
+
+// Exit status of nohup when it can't start the command at all, as GNU
+// nohup uses it
+const nohupFailed = 125
+
+// nohupCommand starts a command in its own session with SIGHUP ignored, so
+// it keeps running after the terminal or the shell goes away. Output that
+// would go to the terminal is appended to nohup.out instead.
+//
+// The command outlives nohup, so it's only ever given files: input from
+// anything other than a file comes from /dev/null, and output to anything
+// other than a file goes to nohup.out as if it were the terminal.
+func nohupCommand(args []string, stdin io.Reader, stdout, stderr io.Writer, status *int) bool {
 	if len(args) == 0 {
-		// Change to home directory
-		home, err := os.UserHomeDir()
+		fmt.Fprintln(stderr, "nohup: usage: nohup command [args...]")
+		*status = nohupFailed
+		return true
+	}
+
+	cmd := shell.Command(args[0], args[1:]...)
+	// A new session has no controlling terminal to send it a hangup
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+
+	input := nonTerminalFile(stdin)
+	if input == nil {
+		devNull, err := os.Open(os.DevNull)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "cd: %v\n", err)
+			fmt.Fprintf(stderr, "nohup: %v\n", err)
+			*status = nohupFailed
 			return true
 		}
-		dir = home
-	} else {
-		dir = args[0]
+		defer devNull.Close()
+		input = devNull
 	}
+	cmd.Stdin = input
 
-	err := os.Chdir(dir)
+	output := nonTerminalFile(stdout)
+	if output == nil {
+		nohupOut, path, err := openNohupOutput()
+		if err != nil {
+			fmt.Fprintf(stderr, "nohup: can't open nohup.out: %v\n", err)
+			*status = nohupFailed
+			return true
+		}
+		defer nohupOut.Close()
+		fmt.Fprintf(stderr, "nohup: appending output to '%s'\n", path)
+		output = nohupOut
+	}
+	cmd.Stdout = output
+
+	cmd.Stderr = output
+	if errOut := nonTerminalFile(stderr); errOut != nil {
+		cmd.Stderr = errOut
+	}
+
+	// An ignored signal stays ignored in the child after exec, so ignore
+	// SIGHUP just while starting it, then put back the shell's own handling
+	signal.Ignore(syscall.SIGHUP)
+	err := cmd.Start()
+	shell.UnignoreSignal(syscall.SIGHUP)
+	shell.ReapplyTrap(syscall.SIGHUP)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "cd: %v\n", err)
+		fmt.Fprintf(stderr, "nohup: %s: %v\n", args[0], err)
+		*status = shell.CommandStatus(err)
+		return true
+	}
+
+	// Track it as a job so that it is reaped when it exits. The job number
+	// goes to stderr so it doesn't end up in redirected output.
+	if globalJobManager != nil {
+		job := globalJobManager.AddJob(cmd, strings.Join(args, " "))
+		fmt.Fprintf(stderr, "[%d] %d\n", job.ID, job.PID)
+	} else {
+		fmt.Fprintf(stderr, "[%d] %d\n", 1, cmd.Process.Pid)
 	}
 	return true
 }
 
-func historyCommand(args []string) bool {
-	if globalHistory == nil {
-		fmt.Fprintf(os.Stderr, "history: history not available\n")
-		return true
+// timeoutGrace is how long a timed-out command has to exit after SIGTERM
+// before it is sent SIGKILL
+const timeoutGrace = 5 * time.Second
+
+// Exit statuses used by timeout, as GNU timeout uses them
+const (
+	timeoutExpired = 124 // the command ran out of time
+	timeoutFailed  = 125 // timeout itself failed
+)
+
+// parseTimeout parses a duration in seconds, which may be fractional and
+// may end in s, m, h or d for seconds, minutes, hours or days
+func parseTimeout(value string) (time.Duration, error) {
+	unit := time.Second
+	number := value
+	if n := len(value); n > 0 {
+		switch value[n-1] {
+		case 's':
+			number = value[:n-1]
+		case 'm':
+			unit, number = time.Minute, value[:n-1]
+		case 'h':
+			unit, number = time.Hour, value[:n-1]
+		case 'd':
+			unit, number = 24*time.Hour, value[:n-1]
+		}
 	}
 
-	commands := globalHistory.GetAll()
-	if len(commands) == 0 {
+	seconds, err := strconv.ParseFloat(number, 64)
+	if err != nil || seconds < 0 || math.IsInf(seconds, 0) || math.IsNaN(seconds) {
+		return 0, fmt.Errorf("invalid time interval '%s'", value)
+	}
+	return time.Duration(seconds * float64(unit)), nil
+}
+
+// timeoutCommand runs a command and sends its process group SIGTERM if it
+// is still running after the given time, then SIGKILL if it hasn't exited
+// timeoutGrace later. The status is 124 if the command timed out, and the
+// command's own status otherwise. A duration of 0 means no time limit.
+func timeoutCommand(args []string, stdin io.Reader, stdout, stderr io.Writer, status *int) bool {
+	if len(args) < 2 {
+		fmt.Fprintln(stderr, "timeout: usage: timeout duration command [args...]")
+		*status = timeoutFailed
 		return true
 	}
 
-	// Default to showing last 20 commands
-	numToShow := 20
-	if len(args) > 0 {
-		if n, err := strconv.Atoi(args[0]); err == nil && n > 0 {
-			numToShow = n
-		}
+	limit, err := parseTimeout(args[0])
+	if err != nil {
+		fmt.Fprintf(stderr, "timeout: %v\n", err)
+		*status = timeoutFailed
+		return true
 	}
 
-	// Show the last numToShow commands
-	start := len(commands) - numToShow
-	if start < 0 {
-		start = 0
+	cmd := shell.Command(args[1], args[2:]...)
+	// Its own process group lets the signals reach anything it starts too
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = stdin, stdout, stderr
+	// Don't wait forever for input that nothing will read once it's killed
+	cmd.WaitDelay = timeoutGrace
+
+	if err := cmd.Start(); err != nil {
+		fmt.Fprintf(stderr, "timeout: %s: %v\n", args[1], err)
+		*status = shell.CommandStatus(err)
+		return true
 	}
 
-	for i := start; i < len(commands); i++ {
-		fmt.Printf("%4d  %s\n", i+1, commands[i])
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+
+	var expired <-chan time.Time
+	if limit > 0 {
+		timer := time.NewTimer(limit)
+		defer timer.Stop()
+		expired = timer.C
 	}
 
+	select {
+	case err := <-done:
+		*status = shell.CommandStatus(err)
+	case <-expired:
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGTERM)
+		select {
+		case <-done:
+		case <-time.After(timeoutGrace):
+			syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+			<-done
+		}
+		*status = timeoutExpired
+	}
 	return true
 }
 
-func pwdCommand(args []string) bool {
-	pwd, err := os.Getwd()
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "pwd: %v\n", err)
-		return true
+// completeCommand sets how the arguments of the named commands are
+// completed: with the words given to -W, directories (-d) and files (-f).
+// -r removes the named commands' completions, and -p or no arguments at
+// all print them in a form that can be run again.
+func completeCommand(args []string, stdin io.Reader, stdout, stderr io.Writer, status *int) bool {
+	var spec shell.CompletionSpec
+	list, remove := len(args) == 0, false
+
+	for len(args) > 0 && strings.HasPrefix(args[0], "-") && args[0] != "-" {
+		flags := args[0][1:]
+		args = args[1:]
+		if flags == "-" {
+			break
+		}
+		for i, flag := range flags {
+			switch flag {
+			case 'p':
+				list = true
+			case 'r':
+				remove = true
+			case 'd':
+				spec.Dirs = true
+			case 'f':
+				spec.Files = true
+			case 'W':
+				if i != len(flags)-1 || len(args) == 0 {
+					fmt.Fprintln(stderr, "complete: -W: option requires an argument")
+					*status = 2
+					return true
+				}
+				spec.Words = append(spec.Words, strings.Fields(args[0])...)
+				args = args[1:]
+			default:
+				fmt.Fprintf(stderr, "complete: -%c: invalid option\n", flag)
+				fmt.Fprintln(stderr, "complete: usage: complete [-pr] [-df] [-W words] name ...")
+				*status = 2
+				return true
+			}
+		}
+	}
+
+	switch {
+	case remove:
+		if len(args) == 0 {
+			args = shell.CompletionCommands()
+		}
+		for _, name := range args {
+			shell.RemoveCompletion(name)
+		}
+	case list:
+		if len(args) == 0 {
+			args = shell.CompletionCommands()
+		}
+		for _, name := range args {
+			spec, ok := shell.LookupCompletion(name)
+			if !ok {
+				fmt.Fprintf(stderr, "complete: %s: no completion specification\n", name)
+				*status = 1
+				continue
+			}
+			fmt.Fprintln(stdout, formatCompletion(name, spec))
+		}
+	case len(args) == 0:
+		fmt.Fprintln(stderr, "complete: usage: complete [-pr] [-df] [-W words] name ...")
+		*status = 2
+	default:
+		for _, name := range args {
+			shell.SetCompletion(name, spec)
+		}
 	}
-	fmt.Println(pwd)
 	return true
 }
 
-func helpCommand(args []string) bool {
-	fmt.Println("gosh - Go Shell")
-	fmt.Println("Built-in commands:")
-	fmt.Println("  cd [dir]      - Change directory")
-	fmt.Println("  pwd           - Print working directory")
-	fmt.Println("  env [VAR=val] - Show or set environment variables")
-	fmt.Println("  history [n]   - Show command history")
-	fmt.Println("  jobs          - Show active jobs")
-	fmt.Println("  fg <job_id>   - Bring job to foreground")
-	fmt.Println("  bg <job_id>   - Send job to background")
-	fmt.Println("  help          - Show this help")
-	fmt.Println("  exit          - Exit the shell")
-	return true
+// formatCompletion returns the complete command that sets spec for name
+func formatCompletion(name string, spec shell.CompletionSpec) string {
+	parts := []string{"complete"}
+	if spec.Dirs {
+		parts = append(parts, "-d")
+	}
+	if spec.Files {
+		parts = append(parts, "-f")
+	}
+	if len(spec.Words) > 0 {
+		parts = append(parts, "-W", shellQuote(strings.Join(spec.Words, " ")))
+	}
+	return strings.Join(append(parts, name), " ")
 }
 
-func envCommand(args []string) bool {
-	if len(args) == 0 {
-		// Show all environment variables
-		environ := os.Environ()
-		sort.Strings(environ)
-		for _, env := range environ {
-			fmt.Println(env)
+func setCommand(args []string, stdin io.Reader, stdout, stderr io.Writer, status *int) bool {
+	// With no option name, list the options and whether they're on
+	if len(args) == 0 || (len(args) == 1 && (args[0] == "-o" || args[0] == "+o")) {
+		for _, name := range shell.OptionNames() {
+			state := "off"
+			if shell.Option(name) {
+				state = "on"
+			}
+			fmt.Fprintf(stdout, "%-15s %s\n", name, state)
 		}
 		return true
 	}
 
-	// Set environment variables
-	for _, arg := range args {
-		if strings.Contains(arg, "=") {
-			parts := strings.SplitN(arg, "=", 2)
-			if len(parts) == 2 {
-				err := os.Setenv(parts[0], parts[1])
-				if err != nil {
-					fmt.Fprintf(os.Stderr, "env: %v\n", err)
-				}
-			}
-		} else {
-			// Show specific variable
-			value := os.Getenv(arg)
-			if value != "" {
-				fmt.Printf("%s=%s\n", arg, value)
-			}
+	for i := 0; i < len(args); i++ {
+		flag := args[i]
+		if flag == "-e" || flag == "+e" {
+			shell.SetOption("errexit", flag == "-e")
+			continue
+		}
+		if flag == "-u" || flag == "+u" {
+			shell.SetOption("nounset", flag == "-u")
+			continue
+		}
+		if (flag != "-o" && flag != "+o") || i+1 >= len(args) {
+			fmt.Fprintf(stderr, "set: %s: invalid option\n", flag)
+			fmt.Fprintln(stderr, "usage: set [-e | +e] [-u | +u] [-o | +o] [option]")
+			return true
+		}
+		i++
+		if err := shell.SetOption(args[i], flag == "-o"); err != nil {
+			fmt.Fprintf(stderr, "set: %v\n", err)
+			return true
 		}
 	}
-
 	return true
 }
 
-func jobsCommand(args []string) bool {
-	if globalJobManager == nil {
-		fmt.Fprintf(os.Stderr, "jobs: job manager not available\n")
+// returnCommand stops the running function. The function's status is n, or
+// that of the last command run if n isn't given.
+func returnCommand(args []string, stdin io.Reader, stdout, stderr io.Writer, status *int) bool {
+	if shell.CallDepth() == 0 {
+		fmt.Fprintln(stderr, "return: can only return from a function")
+		*status = 1
 		return true
 	}
 
-	globalJobManager.PrintJobs()
+	*status = shell.ExitStatus()
+	if len(args) > 0 {
+		n, err := strconv.Atoi(args[0])
+		if err != nil {
+			fmt.Fprintf(stderr, "return: %s: numeric argument required\n", args[0])
+			n = 2
+		}
+		*status = n & 0xff
+	}
+
+	shell.RequestControl(shell.ControlReturn, 0)
 	return true
 }
 
-func fgCommand(args []string) bool {
-	if globalJobManager == nil {
-		fmt.Fprintf(os.Stderr, "fg: job manager not available\n")
+func breakCommand(args []string, stdin io.Reader, stdout, stderr io.Writer, status *int) bool {
+	return requestLoopControl("break", shell.ControlBreak, args, stderr, status)
+}
+
+func continueCommand(args []string, stdin io.Reader, stdout, stderr io.Writer, status *int) bool {
+	return requestLoopControl("continue", shell.ControlContinue, args, stderr, status)
+}
+
+// requestLoopControl asks the running loops to break or continue. args may
+// give the number of enclosing loops it applies to, which defaults to one.
+func requestLoopControl(name string, control shell.Control, args []string, stderr io.Writer, status *int) bool {
+	if shell.LoopDepth() == 0 {
+		fmt.Fprintf(stderr, "%s: only meaningful in a loop\n", name)
+		*status = 1
 		return true
 	}
 
+	levels := 1
+	if len(args) > 0 {
+		n, err := strconv.Atoi(args[0])
+		if err != nil || n < 1 {
+			fmt.Fprintf(stderr, "%s: %s: loop count out of range\n", name, args[0])
+			*status = 1
+			return true
+		}
+		levels = n
+	}
+
+	shell.RequestControl(control, min(levels, shell.LoopDepth()))
+	return true
+}
+
+// endOfInput reports whether err from reading a builtin's input means there
+// is no more of it: EOF, or a read cut short by Ctrl+C in a pipeline
+func endOfInput(err error) bool {
+	return err == io.EOF || errors.Is(err, os.ErrDeadlineExceeded)
+}
+
+// runSystemCommand runs the program in PATH that a builtin stands in for,
+// for options the builtin doesn't support. It reports false if there is
+// no such program.
+func runSystemCommand(name string, args []string, stdin io.Reader, stdout, stderr io.Writer, status *int) bool {
+	if _, err := shell.LookPath(name); err != nil {
+		return false
+	}
+	cmd := shell.Command(name, args...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = stdin, stdout, stderr
+	*status = shell.CommandStatus(cmd.Run())
+	return true
+}
+
+// catCommand copies each named file to stdout in turn, or stdin if there are
+// none or the name is -. A file that can't be read is reported and the rest
+// are still copied. Options such as -n are left to the system's cat.
+func catCommand(args []string, stdin io.Reader, stdout, stderr io.Writer, status *int) bool {
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "-") && arg != "-" {
+			if !runSystemCommand("cat", args, stdin, stdout, stderr, status) {
+				fmt.Fprintf(stderr, "cat: %s: invalid option\n", arg)
+				fmt.Fprintln(stderr, "usage: cat [file...]")
+				*status = 1
+			}
+			return true
+		}
+	}
+
+	if len(args) == 0 {
+		args = []string{"-"}
+	}
+
+	for _, name := range args {
+		if name == "-" {
+			if _, err := io.Copy(stdout, stdin); err != nil && !endOfInput(err) {
+				fmt.Fprintf(stderr, "cat: %v\n", err)
+				*status = 1
+			}
+			continue
+		}
+
+		file, err := os.Open(name)
+		if err != nil {
+			fmt.Fprintf(stderr, "cat: %v\n", err)
+			*status = 1
+			continue
+		}
+		_, err = io.Copy(stdout, file)
+		file.Close()
+		if err != nil {
+			fmt.Fprintf(stderr, "cat: %v\n", err)
+			*status = 1
+		}
+	}
+	return true
+}
+
+// grepCommand prints the lines of the named files, or stdin, that match a
+// basic regular expression. Like grep, the status is 0 if any lines were
+// printed, 1 if none were and 2 on an error. Options other than -i, -v and
+// -n, and patterns that can't be translated, are left to the system's grep.
+func grepCommand(args []string, stdin io.Reader, stdout, stderr io.Writer, status *int) bool {
+	allArgs := args
+	var ignoreCase, invert, number bool
+	for len(args) > 0 && strings.HasPrefix(args[0], "-") && args[0] != "-" {
+		option := args[0]
+		args = args[1:]
+		if option == "--" {
+			break
+		}
+		for _, c := range option[1:] {
+			switch c {
+			case 'i':
+				ignoreCase = true
+			case 'v':
+				invert = true
+			case 'n':
+				number = true
+			default:
+				if runSystemCommand("grep", allArgs, stdin, stdout, stderr, status) {
+					return true
+				}
+				fmt.Fprintf(stderr, "grep: invalid option -- '%c'\n", c)
+				fmt.Fprintln(stderr, "usage: grep [-inv] pattern [file...]")
+				*status = 2
+				return true
+			}
+		}
+	}
 	if len(args) == 0 {
-		fmt.Fprintf(os.Stderr, "fg: usage: fg <job_id>\n")
+		fmt.Fprintln(stderr, "usage: grep [-inv] pattern [file...]")
+		*status = 2
 		return true
 	}
 
-	jobID, err := strconv.Atoi(args[0])
+	pattern, err := translateBRE(args[0])
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "fg: invalid job ID: %s\n", args[0])
+		if runSystemCommand("grep", allArgs, stdin, stdout, stderr, status) {
+			return true
+		}
+		fmt.Fprintf(stderr, "grep: %v\n", err)
+		*status = 2
 		return true
 	}
-
-	err = globalJobManager.BringToForeground(jobID)
+	if ignoreCase {
+		pattern = "(?i)" + pattern
+	}
+	re, err := regexp.Compile(pattern)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "fg: %v\n", err)
+		fmt.Fprintf(stderr, "grep: %v\n", err)
+		*status = 2
+		return true
+	}
+
+	files := args[1:]
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+
+	w := bufio.NewWriter(stdout)
+	matched, failed := false, false
+	for _, name := range files {
+		// With several files, each line says which one it came from
+		prefix := ""
+		if len(files) > 1 {
+			prefix = name + ":"
+			if name == "-" {
+				prefix = "(standard input):"
+			}
+		}
+
+		var found bool
+		var err error
+		if name == "-" {
+			found, err = grepLines(w, stdin, re, invert, number, prefix, !isRegularFile(stdin))
+		} else {
+			file, openErr := os.Open(name)
+			if openErr != nil {
+				fmt.Fprintf(stderr, "grep: %v\n", openErr)
+				failed = true
+				continue
+			}
+			found, err = grepLines(w, file, re, invert, number, prefix, !isRegularFile(file))
+			file.Close()
+		}
+		matched = matched || found
+		if errors.Is(err, errWriteFailed) {
+			// The reader at the other end of a pipe has finished
+			failed = true
+			break
+		}
+		if err != nil {
+			fmt.Fprintf(stderr, "grep: %s: %v\n", name, err)
+			failed = true
+		}
 	}
 
+	if err := w.Flush(); err != nil {
+		failed = true
+	}
+	switch {
+	case failed:
+		*status = 2
+	case matched:
+		*status = 0
+	default:
+		*status = 1
+	}
 	return true
 }
 
-func bgCommand(args []string) bool {
-	if globalJobManager == nil {
-		fmt.Fprintf(os.Stderr, "bg: job manager not available\n")
-		return true
+// errWriteFailed is returned by grepLines when its output can't be written
+var errWriteFailed = errors.New("write failed")
+
+// errBackReference is returned by translateBRE for a pattern that refers
+// back to a group, which Go's regular expressions can't match
+var errBackReference = errors.New("back-references are not supported")
+
+// translateBRE rewrites a POSIX basic regular expression, with GNU's \|, \+
+// and \? extensions, in the syntax of Go's regexp package. In a basic
+// expression ( ) { } | + and ? are literal unless escaped, * is literal at
+// the start, and ^ and $ are anchors only at the ends.
+func translateBRE(pattern string) (string, error) {
+	var out strings.Builder
+	// At the start of the pattern or of a group or alternative
+	start := true
+	for i := 0; i < len(pattern); i++ {
+		atStart := start
+		start = false
+		switch c := pattern[i]; c {
+		case '\\':
+			i++
+			if i == len(pattern) {
+				return "", errors.New("trailing backslash (\\)")
+			}
+			switch c = pattern[i]; {
+			case c == '(' || c == '|':
+				out.WriteByte(c)
+				start = true
+			case strings.IndexByte("){}+?", c) >= 0:
+				out.WriteByte(c)
+			case c >= '1' && c <= '9':
+				return "", errBackReference
+			case strings.IndexByte("wWsSbB", c) >= 0:
+				out.WriteString(pattern[i-1 : i+1])
+			case c == '<' || c == '>':
+				return "", fmt.Errorf("\\%c is not supported", c)
+			default:
+				out.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+			}
+		case '*':
+			if atStart {
+				out.WriteString(`\*`)
+			} else {
+				out.WriteByte(c)
+			}
+		case '^':
+			if atStart {
+				out.WriteByte(c)
+				start = true
+			} else {
+				out.WriteString(`\^`)
+			}
+		case '$':
+			rest := pattern[i+1:]
+			if rest == "" || strings.HasPrefix(rest, `\)`) || strings.HasPrefix(rest, `\|`) {
+				out.WriteByte(c)
+			} else {
+				out.WriteString(`\$`)
+			}
+		case '[':
+			end := bracketEnd(pattern, i)
+			if end < 0 {
+				return "", errors.New("brackets ([ ]) not balanced")
+			}
+			// A backslash in brackets is just a backslash
+			out.WriteString(strings.ReplaceAll(pattern[i:end+1], `\`, `\\`))
+			i = end
+		case '(', ')', '{', '}', '|', '+', '?':
+			out.WriteByte('\\')
+			out.WriteByte(c)
+		default:
+			out.WriteByte(c)
+		}
 	}
+	return out.String(), nil
+}
 
-	if len(args) == 0 {
-		fmt.Fprintf(os.Stderr, "bg: usage: bg <job_id>\n")
-		return true
+// bracketEnd returns the index of the ] that closes the bracket expression
+// starting at pattern[start], or -1 if there isn't one. A ] first in the
+// list, or in a class such as [:digit:], doesn't close it.
+func bracketEnd(pattern string, start int) int {
+	i := start + 1
+	if i < len(pattern) && pattern[i] == '^' {
+		i++
+	}
+	if i < len(pattern) && pattern[i] == ']' {
+		i++
+	}
+	for ; i < len(pattern); i++ {
+		switch {
+		case pattern[i] == ']':
+			return i
+		case strings.HasPrefix(pattern[i:], "[:"):
+			end := strings.Index(pattern[i+2:], ":]")
+			if end < 0 {
+				return -1
+			}
+			i += end + 3
+		}
 	}
+	return -1
+}
 
-	jobID, err := strconv.Atoi(args[0])
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "bg: invalid job ID: %s\n", args[0])
-		return true
+// isRegularFile reports whether r is a regular file, which can be read to
+// its end without waiting for more to be written
+func isRegularFile(r io.Reader) bool {
+	file, ok := r.(*os.File)
+	if !ok {
+		return false
 	}
+	info, err := file.Stat()
+	return err == nil && info.Mode().IsRegular()
+}
 
-	err = globalJobManager.SendToBackground(jobID)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "bg: %v\n", err)
+// grepLines writes the lines of input that match re, or with invert those
+// that don't, to w, each after prefix and with number its line number. With
+// flush each line is written out as it's found, for input such as tail -f's
+// that arrives over time. It reports whether any lines were written.
+func grepLines(w *bufio.Writer, input io.Reader, re *regexp.Regexp, invert, number bool, prefix string, flush bool) (bool, error) {
+	matched := false
+	reader := bufio.NewReader(input)
+	for n := 1; ; n++ {
+		line, err := reader.ReadString('\n')
+		line = strings.TrimSuffix(line, "\n")
+		if (line != "" || err == nil) && re.MatchString(line) != invert {
+			matched = true
+			out := prefix
+			if number {
+				out += strconv.Itoa(n) + ":"
+			}
+			_, werr := w.WriteString(out + line + "\n")
+			if werr == nil && flush {
+				werr = w.Flush()
+			}
+			if werr != nil {
+				return matched, errWriteFailed
+			}
+		}
+		if endOfInput(err) {
+			return matched, nil
+		}
+		if err != nil {
+			return matched, err
+		}
+	}
+}
+
+// teeCommand copies stdin to stdout and to each of the named files. An
+// output that can't be written is dropped and the rest are still written;
+// a pipe whose reader has gone, such as head's, is dropped quietly.
+func teeCommand(args []string, stdin io.Reader, stdout, stderr io.Writer, status *int) bool {
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if len(args) > 0 && args[0] == "-a" {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+		args = args[1:]
+	}
+
+	writers := []io.Writer{stdout}
+	for _, name := range args {
+		file, err := os.OpenFile(name, flags, 0666)
+		if err != nil {
+			fmt.Fprintf(stderr, "tee: %v\n", err)
+			*status = 1
+			continue
+		}
+		defer file.Close()
+		writers = append(writers, file)
+	}
+
+	buf := make([]byte, 32*1024)
+	for len(writers) > 0 {
+		n, err := stdin.Read(buf)
+		if n > 0 {
+			live := writers[:0]
+			for _, w := range writers {
+				if _, err := w.Write(buf[:n]); err != nil {
+					if !errors.Is(err, syscall.EPIPE) {
+						fmt.Fprintf(stderr, "tee: %v\n", err)
+						*status = 1
+					}
+					continue
+				}
+				live = append(live, w)
+			}
+			writers = live
+		}
+
+		if endOfInput(err) {
+			break
+		}
+		if err != nil {
+			fmt.Fprintf(stderr, "tee: %v\n", err)
+			*status = 1
+			break
+		}
+	}
+	return true
+}
+
+// seqCommand prints the numbers from first to last, one per line. first and
+// step default to 1; a negative step counts down.
+func seqCommand(args []string, stdin io.Reader, stdout, stderr io.Writer, status *int) bool {
+	if len(args) < 1 || len(args) > 3 {
+		fmt.Fprintln(stderr, "usage: seq [first [step]] last")
+		*status = 1
+		return true
+	}
+
+	numbers := make([]int, len(args))
+	for i, arg := range args {
+		n, err := strconv.Atoi(arg)
+		if err != nil {
+			fmt.Fprintf(stderr, "seq: invalid number: %s\n", arg)
+			*status = 1
+			return true
+		}
+		numbers[i] = n
+	}
+
+	first, step, last := 1, 1, numbers[len(numbers)-1]
+	if len(numbers) > 1 {
+		first = numbers[0]
+	}
+	if len(numbers) == 3 {
+		step = numbers[1]
+	}
+	if step == 0 {
+		fmt.Fprintln(stderr, "seq: step must not be zero")
+		*status = 1
+		return true
+	}
+
+	// Stop as soon as a write fails, which usually means the reader at the
+	// other end of a pipe has finished
+	w := bufio.NewWriter(stdout)
+	for n := first; (step > 0 && n <= last) || (step < 0 && n >= last); n += step {
+		if _, err := fmt.Fprintln(w, n); err != nil {
+			*status = 1
+			return true
+		}
+	}
+	if err := w.Flush(); err != nil {
+		*status = 1
+	}
+	return true
+}
+
+// shellVariables gives arithmetic expressions access to shell variables
+type shellVariables struct{}
+
+func (shellVariables) Get(name string) string {
+	return shell.GetVar(name)
+}
+
+func (shellVariables) Set(name, value string) error {
+	return shell.SetVar(name, value)
+}
+
+// letCommand evaluates each argument as an arithmetic expression. As in
+// bash, its status is 1 if the last expression is zero, so let can be used
+// as a condition.
+func letCommand(args []string, stdin io.Reader, stdout, stderr io.Writer, status *int) bool {
+	if len(args) == 0 {
+		fmt.Fprintln(stderr, "let: expression expected")
+		*status = 1
+		return true
+	}
+
+	var value int64
+	for _, arg := range args {
+		var err error
+		if value, err = arith.Eval(arg, shellVariables{}); err != nil {
+			fmt.Fprintf(stderr, "let: %s: %v\n", arg, err)
+			*status = 1
+			return true
+		}
+	}
+
+	if value == 0 {
+		*status = 1
+	}
+	return true
+}
+
+func versionCommand(args []string, stdin io.Reader, stdout, stderr io.Writer, status *int) bool {
+	fmt.Fprintln(stdout, VersionString())
+	return true
+}
+
+// maxDirHistory is the number of recently visited directories kept for
+// cd -- and cd -N
+const maxDirHistory = 20
+
+// Recently visited directories, most recent first
+var dirHistory []string
+
+// rememberDir moves dir to the front of the directory history, dropping the
+// oldest entry if the history is full
+func rememberDir(dir string) {
+	for i, d := range dirHistory {
+		if d == dir {
+			dirHistory = append(dirHistory[:i], dirHistory[i+1:]...)
+			break
+		}
+	}
+	dirHistory = append([]string{dir}, dirHistory...)
+	if len(dirHistory) > maxDirHistory {
+		dirHistory = dirHistory[:maxDirHistory]
+	}
+}
+
+// RecentDirs returns the recently visited directories, most recent first
+func RecentDirs() []string {
+	return slices.Clone(dirHistory)
+}
+
+func cdCommand(args []string, stdin io.Reader, stdout, stderr io.Writer, status *int) bool {
+	var dir string
+	if len(args) == 0 {
+		// Change to home directory
+		home, err := os.UserHomeDir()
+		if err != nil {
+			fmt.Fprintf(stderr, "cd: %v\n", err)
+			return true
+		}
+		dir = home
+	} else {
+		dir = args[0]
+	}
+
+	// cd -- lists recent directories, and cd -N (or cd - for -1) goes to one
+	if dir == "--" {
+		for i, d := range dirHistory {
+			fmt.Fprintf(stdout, "%2d  %s\n", i, d)
+		}
+		return true
+	}
+	if dir == "-" {
+		dir = "-1"
+	}
+	if n, err := strconv.Atoi(dir); err == nil && n < 0 {
+		if -n >= len(dirHistory) {
+			fmt.Fprintf(stderr, "cd: %s: no such entry in directory history\n", dir)
+			return true
+		}
+		dir = dirHistory[-n]
+	}
+
+	previous, _ := os.Getwd()
+	err := os.Chdir(dir)
+	if err != nil && os.Getenv("GOSH_CDSPELL") == "1" {
+		// Try correcting a minor misspelling of the directory name
+		if corrected, ok := correctDirSpelling(dir); ok {
+			fmt.Fprintln(stdout, corrected)
+			err = os.Chdir(corrected)
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "cd: %v\n", err)
+		return true
+	}
+
+	updatePWD(previous, dir)
+
+	if previous != "" {
+		rememberDir(previous)
+	}
+	if cwd, err := os.Getwd(); err == nil {
+		rememberDir(cwd)
+	}
+	return true
+}
+
+// Directory stack used by pushd, popd and dirs
+var dirStack = dirstack.New()
+
+// isStackPosition reports whether arg is a stack position such as +1 or -0
+// rather than a directory name
+func isStackPosition(arg string) bool {
+	if len(arg) < 2 || (arg[0] != '+' && arg[0] != '-') {
+		return false
+	}
+	_, err := strconv.Atoi(arg[1:])
+	return err == nil
+}
+
+// changedDir updates $PWD and the directory history after a directory stack
+// operation has moved away from previous
+func changedDir(previous string) {
+	cwd, err := os.Getwd()
+	if err != nil {
+		return
+	}
+	updatePWD(previous, cwd)
+	if previous != "" {
+		rememberDir(previous)
+	}
+	rememberDir(cwd)
+}
+
+// printDirStack prints the directory stack on one line, or numbered one per
+// line if verbose
+func printDirStack(stdout, stderr io.Writer, name string, verbose bool) {
+	entries, err := dirStack.Entries()
+	if err != nil {
+		fmt.Fprintf(stderr, "%s: %v\n", name, err)
+		return
+	}
+
+	if verbose {
+		for i, dir := range entries {
+			fmt.Fprintf(stdout, "%2d  %s\n", i, dir)
+		}
+		return
+	}
+	fmt.Fprintln(stdout, strings.Join(entries, " "))
+}
+
+func pushdCommand(args []string, stdin io.Reader, stdout, stderr io.Writer, status *int) bool {
+	if len(args) > 1 {
+		fmt.Fprintln(stderr, "pushd: too many arguments")
+		return true
+	}
+
+	previous, _ := os.Getwd()
+	var err error
+	switch {
+	case len(args) == 0:
+		// Swap the top two directories
+		err = dirStack.Swap()
+	case isStackPosition(args[0]):
+		// Rotate the stack so the given entry is on top
+		var n int
+		n, err = dirStack.Index(args[0])
+		if err == nil {
+			err = dirStack.Rotate(n)
+		}
+	default:
+		err = dirStack.Push(args[0])
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "pushd: %v\n", err)
+		return true
+	}
+
+	changedDir(previous)
+	printDirStack(stdout, stderr, "pushd", false)
+	return true
+}
+
+func popdCommand(args []string, stdin io.Reader, stdout, stderr io.Writer, status *int) bool {
+	if len(args) > 0 {
+		fmt.Fprintln(stderr, "popd: too many arguments")
+		return true
+	}
+
+	previous, _ := os.Getwd()
+	if err := dirStack.Pop(); err != nil {
+		fmt.Fprintf(stderr, "popd: %v\n", err)
+		return true
+	}
+
+	changedDir(previous)
+	printDirStack(stdout, stderr, "popd", false)
+	return true
+}
+
+func dirsCommand(args []string, stdin io.Reader, stdout, stderr io.Writer, status *int) bool {
+	verbose := false
+	for _, arg := range args {
+		switch arg {
+		case "-c":
+			dirStack.Clear()
+			return true
+		case "-v":
+			verbose = true
+		default:
+			fmt.Fprintf(stderr, "dirs: %s: invalid option\n", arg)
+			fmt.Fprintln(stderr, "usage: dirs [-c | -v]")
+			return true
+		}
+	}
+
+	printDirStack(stdout, stderr, "dirs", verbose)
+	return true
+}
+
+// updatePWD sets $PWD after changing from previous to dir, keeping any
+// symlinks in the path as they were written, and $OLDPWD to previous
+func updatePWD(previous, dir string) {
+	logical := dir
+	if !filepath.IsAbs(logical) {
+		logical = filepath.Join(previous, logical)
+	}
+	logical = filepath.Clean(logical)
+
+	// The lexical path can differ from where we really are, such as after
+	// cd .. out of a symlinked directory
+	if !isCurrentDir(logical) {
+		cwd, err := os.Getwd()
+		if err != nil {
+			return
+		}
+		logical, err = filepath.EvalSymlinks(cwd)
+		if err != nil {
+			return
+		}
+	}
+
+	if previous != "" {
+		os.Setenv("OLDPWD", previous)
+	}
+	os.Setenv("PWD", logical)
+}
+
+// isCurrentDir reports whether path names the current directory
+func isCurrentDir(path string) bool {
+	pathInfo, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	dotInfo, err := os.Stat(".")
+	return err == nil && os.SameFile(pathInfo, dotInfo)
+}
+
+// correctDirSpelling fixes path components that don't exist by looking for
+// a single sibling directory one transposition, insertion or deletion away.
+// It only succeeds when every missing component has exactly one such match.
+func correctDirSpelling(path string) (string, bool) {
+	parts := strings.Split(path, "/")
+	current := "."
+	if filepath.IsAbs(path) {
+		current = "/"
+	}
+
+	changed := false
+	for i, part := range parts {
+		if part == "" || part == "." || part == ".." {
+			current = filepath.Join(current, part)
+			continue
+		}
+
+		if info, err := os.Stat(filepath.Join(current, part)); err != nil || !info.IsDir() {
+			entries, err := os.ReadDir(current)
+			if err != nil {
+				return "", false
+			}
+
+			match := ""
+			for _, entry := range entries {
+				if entry.IsDir() && isSingleTypo(part, entry.Name()) {
+					if match != "" {
+						return "", false // Ambiguous
+					}
+					match = entry.Name()
+				}
+			}
+			if match == "" {
+				return "", false
+			}
+			parts[i] = match
+			changed = true
+		}
+
+		current = filepath.Join(current, parts[i])
+	}
+
+	return strings.Join(parts, "/"), changed
+}
+
+// isSingleTypo reports whether typed differs from name by exactly one
+// transposition of adjacent characters, one inserted character or one
+// deleted character
+func isSingleTypo(typed, name string) bool {
+	a, b := []rune(typed), []rune(name)
+
+	switch len(a) - len(b) {
+	case 0:
+		// Transposition
+		i := 0
+		for i < len(a) && a[i] == b[i] {
+			i++
+		}
+		return i+1 < len(a) && a[i] == b[i+1] && a[i+1] == b[i] &&
+			string(a[i+2:]) == string(b[i+2:])
+	case 1:
+		// Extra character typed
+		a, b = b, a
+		fallthrough
+	case -1:
+		// Character missing from what was typed
+		i := 0
+		for i < len(a) && a[i] == b[i] {
+			i++
+		}
+		return string(a[i:]) == string(b[i+1:])
+	}
+	return false
+}
+
+func historyCommand(args []string, stdin io.Reader, stdout, stderr io.Writer, status *int) bool {
+	if globalHistory == nil {
+		fmt.Fprintf(stderr, "history: history not available\n")
+		return true
+	}
+
+	// history --stat [n] shows the n most used commands
+	if len(args) > 0 && args[0] == "--stat" {
+		numToShow := 10
+		if len(args) > 1 {
+			n, err := strconv.Atoi(args[1])
+			if err != nil || n <= 0 {
+				fmt.Fprintf(stderr, "history: %s: numeric argument required\n", args[1])
+				*status = 2
+				return true
+			}
+			numToShow = n
+		}
+		for _, stat := range topCommands(globalHistory.CommandFrequency(), numToShow) {
+			fmt.Fprintf(stdout, "%5d  %s\n", stat.count, stat.name)
+		}
+		return true
+	}
+
+	commands := globalHistory.GetAll()
+
+	// history --dir shows only commands run in the current directory
+	if len(args) > 0 && args[0] == "--dir" {
+		cwd, err := os.Getwd()
+		if err == nil {
+			commands, err = globalHistory.GetDirHistory(cwd)
+		}
+		if err != nil {
+			fmt.Fprintf(stderr, "history: %v\n", err)
+			return true
+		}
+		args = args[1:]
+	}
+
+	if len(commands) == 0 {
+		return true
+	}
+
+	// history -g PATTERN shows the commands matching a glob pattern, and a
+	// non-numeric argument the commands containing it
+	var match func(command string) bool
+	if len(args) > 0 && args[0] == "-g" {
+		if len(args) < 2 {
+			fmt.Fprintln(stderr, "history: -g: pattern expected")
+			*status = 2
+			return true
+		}
+		pattern := args[1]
+		match = func(command string) bool { return glob.Match(pattern, command) }
+	} else if len(args) > 0 {
+		if _, err := strconv.Atoi(args[0]); err != nil {
+			text := args[0]
+			match = func(command string) bool { return strings.Contains(command, text) }
+		}
+	}
+	if match != nil {
+		// Matches keep their numbers, so they can be rerun with !N. With
+		// --dir the numbers are positions in the directory's own history,
+		// which !N doesn't use.
+		writePaged(stdout, func(w io.Writer) {
+			for i, command := range commands {
+				if match(command) {
+					fmt.Fprintf(w, "%4d  %s\n", i+1, command)
+				}
+			}
+		})
+		return true
+	}
+
+	// Default to showing last 20 commands
+	numToShow := 20
+	if len(args) > 0 {
+		if n, err := strconv.Atoi(args[0]); err == nil && n > 0 {
+			numToShow = n
+		}
+	}
+
+	// Show the last numToShow commands
+	start := len(commands) - numToShow
+	if start < 0 {
+		start = 0
+	}
+
+	writePaged(stdout, func(w io.Writer) {
+		for i := start; i < len(commands); i++ {
+			fmt.Fprintf(w, "%4d  %s\n", i+1, commands[i])
+		}
+	})
+
+	return true
+}
+
+// commandStat is a command name and the number of times it was run
+type commandStat struct {
+	name  string
+	count int
+}
+
+// topCommands returns the n most frequent commands in counts, most used
+// first, with ties in name order
+func topCommands(counts map[string]int, n int) []commandStat {
+	stats := make([]commandStat, 0, len(counts))
+	for name, count := range counts {
+		stats = append(stats, commandStat{name, count})
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].count != stats[j].count {
+			return stats[i].count > stats[j].count
+		}
+		return stats[i].name < stats[j].name
+	})
+	return stats[:min(n, len(stats))]
+}
+
+func pwdCommand(args []string, stdin io.Reader, stdout, stderr io.Writer, status *int) bool {
+	physical := false
+	for _, arg := range args {
+		switch arg {
+		case "-L":
+			physical = false
+		case "-P":
+			physical = true
+		default:
+			fmt.Fprintf(stderr, "pwd: %s: invalid option\n", arg)
+			fmt.Fprintln(stderr, "usage: pwd [-L | -P]")
+			return true
+		}
+	}
+
+	// The logical path is $PWD, as long as it's still accurate
+	if pwd := os.Getenv("PWD"); !physical && filepath.IsAbs(pwd) && isCurrentDir(pwd) {
+		fmt.Fprintln(stdout, pwd)
+		return true
+	}
+
+	pwd, err := os.Getwd()
+	if err == nil {
+		pwd, err = filepath.EvalSymlinks(pwd)
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "pwd: %v\n", err)
+		return true
+	}
+	fmt.Fprintln(stdout, pwd)
+	return true
+}
+
+// helpEntries lists the builtins in the order help shows them, with their
+// usage and a one-line description
+var helpEntries = []struct {
+	name, usage, description string
+}{
+	{"cd", "cd [dir]", "Change directory (-- lists recent, -N goes back)"},
+	{"pwd", "pwd [-L|-P]", "Print working directory"},
+	{"pushd", "pushd [dir]", "Push a directory onto the stack (+N/-N rotates)"},
+	{"popd", "popd", "Pop the top directory off the stack"},
+	{"dirs", "dirs [-c|-v]", "Show or clear the directory stack"},
+	{"env", "env [-i|-q] [VAR=val...] [command]", "Show or set environment variables (-i runs command with only the given ones, -q quotes values)"},
+	{"export", "export [VAR]", "Export variables to the environment"},
+	{"history", "history [n | text | -g pattern | --stat [n]]", "Show or search command history (--dir for this directory, --stat for the most used commands)"},
+	{"jobs", "jobs [-t] [--json]", "Show active jobs (-t for time running, --json for all jobs as JSON)"},
+	{"fg", "fg [%job]", "Bring job to foreground"},
+	{"bg", "bg [%job]", "Send job to background"},
+	{"disown", "disown [%n]", "Remove a job from the job table (-a for all)"},
+	{"kill", "kill [%job]", "Send a signal to a job or process (-l to list)"},
+	{"trap", "trap cmd sig", "Run a command on a signal or EXIT (-p to list)"},
+	{"read", "read [-r] VAR", "Read a line from stdin into variables"},
+	{"set", "set [-eu] [-o opt]", "Turn a shell option on (+o turns it off, -e stops a script when a command fails, -u makes unset variables an error)"},
+	{"return", "return [n]", "Return from a function with status n"},
+	{"break", "break [n]", "Leave the innermost n loops"},
+	{"continue", "continue [n]", "Start the next iteration of the nth loop out"},
+	{"tee", "tee [-a] file", "Copy stdin to stdout and files (-a appends)"},
+	{"cat", "cat [file...]", "Copy files, or stdin, to stdout"},
+	{"let", "let expr...", "Evaluate arithmetic, such as let i++ or x+=2"},
+	{"seq", "seq [first [step]] last", "Print a sequence of numbers"},
+	{"grep", "grep [-inv] pattern [file...]", "Print lines matching a pattern (-i ignores case, -n numbers lines, -v inverts)"},
+	{"nohup", "nohup cmd", "Run a command in the background, immune to hangups"},
+	{"timeout", "timeout secs cmd", "Run a command, killing it if it takes too long"},
+	{"alias", "alias [name[=value]...]", "Define or show aliases (a value ending in a space expands the next word too)"},
+	{"unalias", "unalias [-a] name...", "Remove aliases (-a removes them all)"},
+	{"complete", "complete [-pr] [-df] [-W words] name", "Set how a command's arguments complete (-W words, -d dirs, -f files)"},
+	{"version", "version", "Show version information"},
+	{"help", "help", "Show this help"},
+	{"exit", "exit", "Exit the shell"},
+}
+
+// Descriptions returns the one-line description of each builtin, keyed by
+// name
+func Descriptions() map[string]string {
+	descriptions := make(map[string]string, len(helpEntries))
+	for _, entry := range helpEntries {
+		descriptions[entry.name] = entry.description
+	}
+	return descriptions
+}
+
+func helpCommand(args []string, stdin io.Reader, stdout, stderr io.Writer, status *int) bool {
+	fmt.Fprintln(stdout, "gosh - Go Shell")
+	fmt.Fprintln(stdout, "Built-in commands:")
+	for _, entry := range helpEntries {
+		fmt.Fprintf(stdout, "  %-13s - %s\n", entry.usage, entry.description)
+	}
+	return true
+}
+
+// Characters that never need quoting
+const shellSafeChars = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789@%+=:,./-_"
+
+// shellQuote returns s in a form the shell reads back as s: unchanged if it
+// holds nothing the shell treats specially, and otherwise in single quotes,
+// with each single quote in it closing the quotes, escaped, and reopening
+// them
+func shellQuote(s string) string {
+	if s != "" && strings.Trim(s, shellSafeChars) == "" {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// formatVariable returns NAME=value for an environment entry, with the
+// value quoted by shellQuote if quote is set
+func formatVariable(env string, quote bool) string {
+	name, value, _ := strings.Cut(env, "=")
+	if quote {
+		value = shellQuote(value)
+	}
+	return name + "=" + value
+}
+
+func envCommand(args []string, stdin io.Reader, stdout, stderr io.Writer, status *int) bool {
+	if len(args) > 0 && (args[0] == "-i" || args[0] == "-") {
+		return envCleanCommand(args[1:], stdin, stdout, stderr, status)
+	}
+
+	// env -q quotes values so that the output can be run again
+	quote := len(args) > 0 && args[0] == "-q"
+	if quote {
+		args = args[1:]
+	}
+
+	if len(args) == 0 {
+		// Show all environment variables
+		environ := os.Environ()
+		sort.Strings(environ)
+		writePaged(stdout, func(w io.Writer) {
+			for _, env := range environ {
+				fmt.Fprintln(w, formatVariable(env, quote))
+			}
+		})
+		return true
+	}
+
+	// Set environment variables
+	for _, arg := range args {
+		if strings.Contains(arg, "=") {
+			parts := strings.SplitN(arg, "=", 2)
+			if len(parts) == 2 {
+				err := os.Setenv(parts[0], parts[1])
+				if err != nil {
+					fmt.Fprintf(stderr, "env: %v\n", err)
+				}
+			}
+		} else {
+			// Show specific variable
+			value := os.Getenv(arg)
+			if value != "" {
+				fmt.Fprintln(stdout, formatVariable(arg+"="+value, quote))
+			}
+		}
+	}
+
+	return true
+}
+
+// envCleanCommand runs a command with an empty environment apart from the
+// NAME=value assignments before it, as env -i does. With no command it
+// prints that environment instead.
+func envCleanCommand(args []string, stdin io.Reader, stdout, stderr io.Writer, status *int) bool {
+	env := []string{}
+	for len(args) > 0 {
+		name, _, ok := strings.Cut(args[0], "=")
+		if !ok || name == "" {
+			break
+		}
+		env = append(env, args[0])
+		args = args[1:]
+	}
+
+	if len(args) == 0 {
+		for _, assignment := range env {
+			fmt.Fprintln(stdout, assignment)
+		}
+		return true
+	}
+
+	cmd := shell.Command(args[0], args[1:]...)
+	cmd.Env = env
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = stdin, stdout, stderr
+
+	if err := cmd.Start(); err != nil {
+		fmt.Fprintf(stderr, "env: %s: %v\n", args[0], err)
+		*status = shell.CommandStatus(err)
+		return true
+	}
+	*status = shell.CommandStatus(cmd.Wait())
+	return true
+}
+
+// aliasCommand defines the aliases given as name=value, and shows those
+// given by name, or all of them with no arguments, in a form that can be
+// run again
+func aliasCommand(args []string, stdin io.Reader, stdout, stderr io.Writer, status *int) bool {
+	if len(args) == 0 || (len(args) == 1 && args[0] == "-p") {
+		for _, name := range shell.AliasNames() {
+			value, _ := shell.LookupAlias(name)
+			fmt.Fprintf(stdout, "alias %s=%s\n", name, shellQuote(value))
+		}
+		*status = 0
+		return true
+	}
+
+	for _, arg := range args {
+		if name, value, ok := strings.Cut(arg, "="); ok {
+			if !validAliasName(name) {
+				fmt.Fprintf(stderr, "alias: `%s': invalid alias name\n", name)
+				*status = 1
+				continue
+			}
+			shell.SetAlias(name, value)
+			continue
+		}
+
+		value, ok := shell.LookupAlias(arg)
+		if !ok {
+			fmt.Fprintf(stderr, "alias: %s: not found\n", arg)
+			*status = 1
+			continue
+		}
+		fmt.Fprintf(stdout, "alias %s=%s\n", arg, shellQuote(value))
+	}
+	return true
+}
+
+// validAliasName reports whether name can be used for an alias: it can't
+// be empty or contain blanks, quotes, slashes or characters the shell
+// treats specially
+func validAliasName(name string) bool {
+	return name != "" && !strings.ContainsAny(name, " \t\n/$`'\"\\|&;()<>=")
+}
+
+// unaliasCommand removes the named aliases, or all of them with -a
+func unaliasCommand(args []string, stdin io.Reader, stdout, stderr io.Writer, status *int) bool {
+	if len(args) == 0 {
+		fmt.Fprintln(stderr, "usage: unalias [-a] name...")
+		*status = 2
+		return true
+	}
+	if args[0] == "-a" {
+		for _, name := range shell.AliasNames() {
+			shell.UnsetAlias(name)
+		}
+		*status = 0
+		return true
+	}
+
+	for _, name := range args {
+		if !shell.UnsetAlias(name) {
+			fmt.Fprintf(stderr, "unalias: %s: not found\n", name)
+			*status = 1
+		}
+	}
+	return true
+}
+
+func exportCommand(args []string, stdin io.Reader, stdout, stderr io.Writer, status *int) bool {
+	if len(args) == 0 || (len(args) == 1 && args[0] == "-p") {
+		// List exported variables
+		environ := os.Environ()
+		sort.Strings(environ)
+		for _, env := range environ {
+			fmt.Fprintf(stdout, "export %s\n", formatVariable(env, true))
+		}
+		return true
+	}
+
+	for _, arg := range args {
+		if name, value, ok := shell.ParseAssignment(arg); ok {
+			shell.UnsetVar(name)
+			if err := os.Setenv(name, value); err != nil {
+				fmt.Fprintf(stderr, "export: %v\n", err)
+			}
+			continue
+		}
+
+		if !shell.IsValidName(arg) {
+			fmt.Fprintf(stderr, "export: `%s': not a valid identifier\n", arg)
+			continue
+		}
+
+		if err := shell.Export(arg); err != nil {
+			fmt.Fprintf(stderr, "export: %v\n", err)
+		}
+	}
+
+	return true
+}
+
+func jobsCommand(args []string, stdin io.Reader, stdout, stderr io.Writer, status *int) bool {
+	if globalJobManager == nil {
+		fmt.Fprintf(stderr, "jobs: job manager not available\n")
+		return true
+	}
+
+	var opts jobs.PrintOptions
+	asJSON := false
+	for _, arg := range args {
+		switch arg {
+		case "-t":
+			opts.Elapsed = true
+		case "--json":
+			asJSON = true
+		default:
+			fmt.Fprintf(stderr, "jobs: %s: invalid option\n", arg)
+			fmt.Fprintln(stderr, "usage: jobs [-t] [--json]")
+			return true
+		}
+	}
+
+	if asJSON {
+		data, err := globalJobManager.MarshalJobs()
+		if err != nil {
+			fmt.Fprintf(stderr, "jobs: %v\n", err)
+			*status = 1
+			return true
+		}
+		fmt.Fprintf(stdout, "%s\n", data)
+		return true
+	}
+
+	globalJobManager.PrintJobs(stdout, opts)
+	return true
+}
+
+func fgCommand(args []string, stdin io.Reader, stdout, stderr io.Writer, status *int) bool {
+	if globalJobManager == nil {
+		fmt.Fprintf(stderr, "fg: job manager not available\n")
+		return true
+	}
+
+	job, ok := resolveJobArg("fg", args, stderr)
+	if !ok {
+		return true
+	}
+
+	err := globalJobManager.BringToForeground(job.ID)
+	if err != nil {
+		fmt.Fprintf(stderr, "fg: %v\n", err)
+	}
+
+	return true
+}
+
+func bgCommand(args []string, stdin io.Reader, stdout, stderr io.Writer, status *int) bool {
+	if globalJobManager == nil {
+		fmt.Fprintf(stderr, "bg: job manager not available\n")
+		return true
+	}
+
+	job, ok := resolveJobArg("bg", args, stderr)
+	if !ok {
+		return true
+	}
+
+	err := globalJobManager.SendToBackground(job.ID)
+	if err != nil {
+		fmt.Fprintf(stderr, "bg: %v\n", err)
+	}
+
+	return true
+}
+
+// resolveJobArg resolves the job spec in args[0], or the current job if no
+// spec is given. Errors are reported on behalf of the named builtin.
+func resolveJobArg(name string, args []string, stderr io.Writer) (*jobs.Job, bool) {
+	spec := "%+"
+	if len(args) > 0 {
+		spec = args[0]
+	}
+
+	job, err := globalJobManager.ResolveSpec(spec)
+	if err != nil {
+		if len(args) == 0 {
+			fmt.Fprintf(stderr, "%s: current: no such job\n", name)
+		} else {
+			fmt.Fprintf(stderr, "%s: %v\n", name, err)
+		}
+		return nil, false
+	}
+	return job, true
+}
+
+func disownCommand(args []string, stdin io.Reader, stdout, stderr io.Writer, status *int) bool {
+	if globalJobManager == nil {
+		fmt.Fprintf(stderr, "disown: job manager not available\n")
+		return true
+	}
+
+	if len(args) == 0 {
+		if job, ok := resolveJobArg("disown", args, stderr); ok {
+			globalJobManager.Disown(job.ID)
+		}
+		return true
+	}
+
+	for _, arg := range args {
+		if arg == "-a" {
+			globalJobManager.DisownAll()
+			continue
+		}
+
+		job, ok := resolveJobArg("disown", []string{arg}, stderr)
+		if !ok {
+			continue
+		}
+		globalJobManager.Disown(job.ID)
+	}
+
+	return true
+}
+
+// signalTable maps signal names, without the SIG prefix, to signals. It is
+// shared by kill and anything else that accepts a signal argument.
+var signalTable = map[string]syscall.Signal{
+	"HUP":    syscall.SIGHUP,
+	"INT":    syscall.SIGINT,
+	"QUIT":   syscall.SIGQUIT,
+	"ILL":    syscall.SIGILL,
+	"TRAP":   syscall.SIGTRAP,
+	"ABRT":   syscall.SIGABRT,
+	"BUS":    syscall.SIGBUS,
+	"FPE":    syscall.SIGFPE,
+	"KILL":   syscall.SIGKILL,
+	"USR1":   syscall.SIGUSR1,
+	"SEGV":   syscall.SIGSEGV,
+	"USR2":   syscall.SIGUSR2,
+	"PIPE":   syscall.SIGPIPE,
+	"ALRM":   syscall.SIGALRM,
+	"TERM":   syscall.SIGTERM,
+	"CHLD":   syscall.SIGCHLD,
+	"CONT":   syscall.SIGCONT,
+	"STOP":   syscall.SIGSTOP,
+	"TSTP":   syscall.SIGTSTP,
+	"TTIN":   syscall.SIGTTIN,
+	"TTOU":   syscall.SIGTTOU,
+	"URG":    syscall.SIGURG,
+	"XCPU":   syscall.SIGXCPU,
+	"XFSZ":   syscall.SIGXFSZ,
+	"VTALRM": syscall.SIGVTALRM,
+	"PROF":   syscall.SIGPROF,
+	"WINCH":  syscall.SIGWINCH,
+	"IO":     syscall.SIGIO,
+	"SYS":    syscall.SIGSYS,
+}
+
+// parseSignal parses a signal given by name (TERM, SIGTERM, term) or by
+// number (15).
+func parseSignal(s string) (syscall.Signal, error) {
+	if n, err := strconv.Atoi(s); err == nil {
+		for _, sig := range signalTable {
+			if int(sig) == n {
+				return sig, nil
+			}
+		}
+		return 0, fmt.Errorf("%s: invalid signal specification", s)
+	}
+
+	name := strings.TrimPrefix(strings.ToUpper(s), "SIG")
+	if sig, ok := signalTable[name]; ok {
+		return sig, nil
+	}
+	return 0, fmt.Errorf("%s: invalid signal specification", s)
+}
+
+// signalName returns the name of sig without the SIG prefix
+func signalName(sig syscall.Signal) string {
+	for name, s := range signalTable {
+		if s == sig {
+			return name
+		}
+	}
+	return strconv.Itoa(int(sig))
+}
+
+// listSignals prints every known signal as "N) SIGNAME", ordered by number
+func listSignals(stdout io.Writer) {
+	sigs := make([]syscall.Signal, 0, len(signalTable))
+	for _, sig := range signalTable {
+		sigs = append(sigs, sig)
+	}
+	sort.Slice(sigs, func(i, j int) bool { return sigs[i] < sigs[j] })
+
+	for _, sig := range sigs {
+		fmt.Fprintf(stdout, "%2d) SIG%s\n", int(sig), signalName(sig))
+	}
+}
+
+func killCommand(args []string, stdin io.Reader, stdout, stderr io.Writer, status *int) bool {
+	sig := syscall.SIGTERM
+
+	if len(args) > 0 && args[0] == "-l" {
+		if len(args) == 1 {
+			listSignals(stdout)
+			return true
+		}
+		for _, arg := range args[1:] {
+			s, err := parseSignal(arg)
+			if err != nil {
+				fmt.Fprintf(stderr, "kill: %v\n", err)
+				continue
+			}
+			fmt.Fprintln(stdout, signalName(s))
+		}
+		return true
+	}
+
+	if len(args) > 0 && args[0] == "-s" {
+		if len(args) < 2 {
+			fmt.Fprintf(stderr, "kill: -s: option requires an argument\n")
+			return true
+		}
+		s, err := parseSignal(args[1])
+		if err != nil {
+			fmt.Fprintf(stderr, "kill: %v\n", err)
+			return true
+		}
+		sig = s
+		args = args[2:]
+	} else if len(args) > 0 && len(args[0]) > 1 && args[0][0] == '-' {
+		s, err := parseSignal(args[0][1:])
+		if err != nil {
+			fmt.Fprintf(stderr, "kill: %v\n", err)
+			return true
+		}
+		sig = s
+		args = args[1:]
+	}
+
+	if len(args) == 0 {
+		fmt.Fprintf(stderr, "usage: kill [-s sigspec | -signum | -sigspec] pid | %%job ... or kill -l [sigspec]\n")
+		return true
+	}
+
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "%") {
+			if globalJobManager == nil {
+				fmt.Fprintf(stderr, "kill: job manager not available\n")
+				continue
+			}
+			job, err := globalJobManager.ResolveSpec(arg)
+			if err != nil {
+				fmt.Fprintf(stderr, "kill: %v\n", err)
+				continue
+			}
+			if err := syscall.Kill(-job.PGID, sig); err != nil {
+				fmt.Fprintf(stderr, "kill: %s: %v\n", arg, err)
+				continue
+			}
+			// A stopped job has to be continued to act on the signal
+			state, _ := globalJobManager.JobState(job.ID)
+			if state == jobs.JobStopped && (sig == syscall.SIGTERM || sig == syscall.SIGHUP) {
+				syscall.Kill(-job.PGID, syscall.SIGCONT)
+			}
+			continue
+		}
+
+		pid, err := strconv.Atoi(arg)
+		if err != nil {
+			fmt.Fprintf(stderr, "kill: %s: arguments must be process or job IDs\n", arg)
+			continue
+		}
+		if err := syscall.Kill(pid, sig); err != nil {
+			fmt.Fprintf(stderr, "kill: (%d) - %v\n", pid, err)
+		}
+	}
+
+	return true
+}
+
+// parseTrapSignal parses a signal argument to trap, which also accepts the
+// EXIT pseudo-signal
+func parseTrapSignal(s string) (syscall.Signal, error) {
+	if strings.EqualFold(s, "EXIT") || s == "0" {
+		return shell.ExitTrap, nil
+	}
+
+	sig, err := parseSignal(s)
+	if err != nil {
+		return 0, err
+	}
+	if sig == syscall.SIGKILL || sig == syscall.SIGSTOP {
+		return 0, fmt.Errorf("%s: signal cannot be trapped", s)
+	}
+	return sig, nil
+}
+
+// printTraps prints the registered traps in a form that can be read back in
+func printTraps(stdout io.Writer) {
+	for _, sig := range shell.TrapSignals() {
+		command, ok := shell.GetTrap(sig)
+		if !ok {
+			continue
+		}
+
+		name := "EXIT"
+		if sig != shell.ExitTrap {
+			name = "SIG" + signalName(sig)
+		}
+		quoted := "'" + strings.ReplaceAll(command, "'", `'\''`) + "'"
+		fmt.Fprintf(stdout, "trap -- %s %s\n", quoted, name)
+	}
+}
+
+func trapCommand(args []string, stdin io.Reader, stdout, stderr io.Writer, status *int) bool {
+	if len(args) == 0 || (len(args) == 1 && args[0] == "-p") {
+		printTraps(stdout)
+		return true
+	}
+
+	// trap SIG (with no command) resets SIG, the same as trap - SIG
+	command, sigArgs := args[0], args[1:]
+	reset := command == "-"
+	if len(args) == 1 {
+		reset, sigArgs = true, args
+	}
+
+	for _, arg := range sigArgs {
+		sig, err := parseTrapSignal(arg)
+		if err != nil {
+			fmt.Fprintf(stderr, "trap: %v\n", err)
+			continue
+		}
+
+		if reset {
+			shell.ClearTrap(sig)
+		} else {
+			shell.SetTrap(sig, command)
+		}
+	}
+
+	return true
+}
+
+// readLine reads a single line from r without reading past its end, so that
+// whatever follows is left for the next reader of a shared stream. ok is
+// false if r was already at EOF.
+func readLine(r io.Reader) (line string, ok bool) {
+	var buf []byte
+	b := make([]byte, 1)
+	for {
+		n, err := r.Read(b)
+		if n > 0 {
+			if b[0] == '\n' {
+				return string(buf), true
+			}
+			buf = append(buf, b[0])
+		}
+		if err != nil {
+			return string(buf), len(buf) > 0
+		}
+	}
+}
+
+func readCommand(args []string, stdin io.Reader, stdout, stderr io.Writer, status *int) bool {
+	raw := false
+	if len(args) > 0 && args[0] == "-r" {
+		raw = true
+		args = args[1:]
+	}
+
+	names := args
+	if len(names) == 0 {
+		names = []string{"REPLY"}
+	}
+	for _, name := range names {
+		if !shell.IsValidName(name) {
+			fmt.Fprintf(stderr, "read: `%s': not a valid identifier\n", name)
+			return true
+		}
+	}
+
+	line, ok := readLine(stdin)
+	if !ok {
+		return true
+	}
+
+	// Without -r a backslash escapes the next character, and a trailing
+	// backslash continues the line
+	if !raw {
+		var b strings.Builder
+		for {
+			i := 0
+			for ; i < len(line); i++ {
+				if line[i] == '\\' {
+					if i+1 == len(line) {
+						break
+					}
+					i++
+				}
+				b.WriteByte(line[i])
+			}
+			if i == len(line) {
+				break
+			}
+			next, ok := readLine(stdin)
+			if !ok {
+				break
+			}
+			line = next
+		}
+		line = b.String()
+	}
+
+	// Split into fields; the last name gets the rest of the line
+	rest := strings.TrimSpace(line)
+	for i, name := range names {
+		value := rest
+		if i < len(names)-1 {
+			rest = ""
+			if idx := strings.IndexAny(value, " \t"); idx >= 0 {
+				value, rest = value[:idx], strings.TrimLeft(value[idx+1:], " \t")
+			}
+		}
+		if err := shell.SetVar(name, value); err != nil {
+			fmt.Fprintf(stderr, "read: %v\n", err)
+		}
 	}
 
 	return true
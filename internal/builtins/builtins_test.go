@@ -1,12 +1,24 @@
 package builtins
 
 import (
+	"bufio"
 	"bytes"
+	"fmt"
 	"io"
 	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"runtime"
 	"strings"
+	"syscall"
 	"testing"
+	"time"
 
+	"github.com/apriljarosz/gosh/internal/dirstack"
+	"github.com/apriljarosz/gosh/internal/history"
+	"github.com/apriljarosz/gosh/internal/jobs"
+	"github.com/apriljarosz/gosh/internal/shell"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -23,7 +35,8 @@ func TestIsBuiltin(t *testing.T) {
 		{"history", true},
 		{"ls", false},
 		{"echo", false},
-		{"grep", false},
+		{"grep", true},
+		{"sed", false},
 		{"", false},
 	}
 
@@ -77,13 +90,14 @@ func TestExecute(t *testing.T) {
 }
 
 func TestPwdCommand(t *testing.T) {
+	var status int
 	// Capture stdout
 	oldStdout := os.Stdout
 	r, w, _ := os.Pipe()
 	os.Stdout = w
 
 	// Execute pwd command
-	result := pwdCommand([]string{})
+	result := pwdCommand([]string{}, os.Stdin, os.Stdout, os.Stderr, &status)
 
 	// Restore stdout
 	w.Close()
@@ -104,6 +118,7 @@ func TestPwdCommand(t *testing.T) {
 }
 
 func TestCdCommand(t *testing.T) {
+	var status int
 	// Save current directory
 	originalDir, _ := os.Getwd()
 	defer os.Chdir(originalDir) // Restore at end
@@ -142,7 +157,7 @@ func TestCdCommand(t *testing.T) {
 			r, w, _ := os.Pipe()
 			os.Stderr = w
 
-			result := cdCommand(tt.args)
+			result := cdCommand(tt.args, os.Stdin, os.Stdout, os.Stderr, &status)
 
 			w.Close()
 			os.Stderr = oldStderr
@@ -164,12 +179,13 @@ func TestCdCommand(t *testing.T) {
 }
 
 func TestHelpCommand(t *testing.T) {
+	var status int
 	// Capture stdout
 	oldStdout := os.Stdout
 	r, w, _ := os.Pipe()
 	os.Stdout = w
 
-	result := helpCommand([]string{})
+	result := helpCommand([]string{}, os.Stdin, os.Stdout, os.Stderr, &status)
 
 	w.Close()
 	os.Stdout = oldStdout
@@ -189,6 +205,7 @@ func TestHelpCommand(t *testing.T) {
 }
 
 func TestEnvCommand(t *testing.T) {
+	var status int
 	// Set up test environment variables
 	os.Setenv("TEST_ENV_VAR", "test_value")
 	os.Setenv("ANOTHER_VAR", "another_value")
@@ -239,7 +256,7 @@ func TestEnvCommand(t *testing.T) {
 			os.Stdout = wOut
 			os.Stderr = wErr
 
-			result := envCommand(tt.args)
+			result := envCommand(tt.args, os.Stdin, os.Stdout, os.Stderr, &status)
 
 			wOut.Close()
 			wErr.Close()
@@ -279,13 +296,49 @@ func TestEnvCommand(t *testing.T) {
 	}
 }
 
+func TestEnvCleanCommand(t *testing.T) {
+	var status int
+	t.Setenv("GOSH_ENV_OUTER", "outer")
+	sh, err := exec.LookPath("sh")
+	assert.NoError(t, err)
+
+	var stdout, stderr bytes.Buffer
+	envCommand([]string{"-i", "FOO=bar", "EMPTY=", sh, "-c", "echo \"$FOO\"; echo \"${EMPTY-unset}\"; echo \"${GOSH_ENV_OUTER-unset}\""}, os.Stdin, &stdout, &stderr, &status)
+	assert.Equal(t, "bar\n\nunset\n", stdout.String())
+	assert.Empty(t, stderr.String())
+	assert.Equal(t, 0, status)
+
+	// Nothing else reaches the command, and the shell's own environment is
+	// left alone
+	stdout.Reset()
+	envCommand([]string{"-i", "FOO=bar", sh, "-c", "env"}, os.Stdin, &stdout, &stderr, &status)
+	assert.NotContains(t, stdout.String(), "GOSH_ENV_OUTER")
+	assert.Contains(t, stdout.String(), "FOO=bar\n")
+	assert.Empty(t, os.Getenv("FOO"))
+
+	// The command's exit status is env's
+	envCommand([]string{"-i", sh, "-c", "exit 3"}, os.Stdin, &stdout, &stderr, &status)
+	assert.Equal(t, 3, status)
+
+	// Without a command, the environment it would have is printed
+	stdout.Reset()
+	envCommand([]string{"-i", "A=1", "B=2"}, os.Stdin, &stdout, &stderr, &status)
+	assert.Equal(t, "A=1\nB=2\n", stdout.String())
+
+	stderr.Reset()
+	envCommand([]string{"-i", "gosh-no-such-command"}, os.Stdin, &stdout, &stderr, &status)
+	assert.Contains(t, stderr.String(), "env: gosh-no-such-command: ")
+	assert.Equal(t, 127, status)
+}
+
 func TestEnvCommandShowAll(t *testing.T) {
+	var status int
 	// Capture stdout
 	oldStdout := os.Stdout
 	r, w, _ := os.Pipe()
 	os.Stdout = w
 
-	result := envCommand([]string{})
+	result := envCommand([]string{}, os.Stdin, os.Stdout, os.Stderr, &status)
 
 	w.Close()
 	os.Stdout = oldStdout
@@ -310,12 +363,13 @@ func TestEnvCommandShowAll(t *testing.T) {
 }
 
 func TestExitCommand(t *testing.T) {
+	var status int
 	// Capture stdout
 	oldStdout := os.Stdout
 	r, w, _ := os.Pipe()
 	os.Stdout = w
 
-	result := exitCommand([]string{})
+	result := exitCommand([]string{}, os.Stdin, os.Stdout, os.Stderr, &status)
 
 	w.Close()
 	os.Stdout = oldStdout
@@ -329,12 +383,13 @@ func TestExitCommand(t *testing.T) {
 }
 
 func TestHistoryCommand(t *testing.T) {
+	var status int
 	// Test with no history set
 	oldStderr := os.Stderr
 	r, w, _ := os.Pipe()
 	os.Stderr = w
 
-	result := historyCommand([]string{})
+	result := historyCommand([]string{}, os.Stdin, os.Stdout, os.Stderr, &status)
 
 	w.Close()
 	os.Stderr = oldStderr
@@ -346,3 +401,1295 @@ func TestHistoryCommand(t *testing.T) {
 	assert.True(t, result)
 	assert.Contains(t, errorOutput, "history not available")
 }
+
+func TestShellQuote(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"plain", "plain"},
+		{"/usr/bin:/bin", "/usr/bin:/bin"},
+		{"", "''"},
+		{"two words", "'two words'"},
+		{"it's", `'it'\''s'`},
+		{`say "hi"`, `'say "hi"'`},
+		{"line1\nline2", "'line1\nline2'"},
+		{"$HOME and *", "'$HOME and *'"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			assert.Equal(t, tt.expected, shellQuote(tt.input))
+		})
+	}
+}
+
+func TestEnvCommandQuoted(t *testing.T) {
+	var status int
+	t.Setenv("GOSH_QUOTED_VAR", "it's a\nvalue")
+
+	var stdout bytes.Buffer
+	envCommand([]string{"-q", "GOSH_QUOTED_VAR"}, os.Stdin, &stdout, os.Stderr, &status)
+	assert.Equal(t, "GOSH_QUOTED_VAR='it'\\''s a\nvalue'\n", stdout.String())
+
+	stdout.Reset()
+	envCommand([]string{"-q"}, os.Stdin, &stdout, os.Stderr, &status)
+	assert.Contains(t, stdout.String(), "GOSH_QUOTED_VAR='it'\\''s a\nvalue'\n")
+
+	// Without -q values are shown as they are
+	stdout.Reset()
+	envCommand([]string{"GOSH_QUOTED_VAR"}, os.Stdin, &stdout, os.Stderr, &status)
+	assert.Equal(t, "GOSH_QUOTED_VAR=it's a\nvalue\n", stdout.String())
+
+	// export -p always quotes
+	stdout.Reset()
+	exportCommand([]string{"-p"}, os.Stdin, &stdout, os.Stderr, &status)
+	assert.Contains(t, stdout.String(), "export GOSH_QUOTED_VAR='it'\\''s a\nvalue'\n")
+}
+
+func TestExportCommand(t *testing.T) {
+	var status int
+	defer shell.UnsetVar("GOSH_LOCAL_VAR")
+	defer shell.UnsetVar("GOSH_ASSIGNED_VAR")
+
+	// A plain assignment creates a local that isn't in the environment
+	shell.SetVar("GOSH_LOCAL_VAR", "local_value")
+	_, inEnv := os.LookupEnv("GOSH_LOCAL_VAR")
+	assert.False(t, inEnv)
+
+	// export promotes it to the environment
+	result := exportCommand([]string{"GOSH_LOCAL_VAR"}, os.Stdin, os.Stdout, os.Stderr, &status)
+	assert.True(t, result)
+	assert.Equal(t, "local_value", os.Getenv("GOSH_LOCAL_VAR"))
+	assert.False(t, shell.IsLocal("GOSH_LOCAL_VAR"))
+
+	// export NAME=value sets and exports in one step
+	exportCommand([]string{"GOSH_ASSIGNED_VAR=assigned"}, os.Stdin, os.Stdout, os.Stderr, &status)
+	assert.Equal(t, "assigned", os.Getenv("GOSH_ASSIGNED_VAR"))
+}
+
+func TestExportCommandInvalidName(t *testing.T) {
+	var status int
+	oldStderr := os.Stderr
+	r, w, _ := os.Pipe()
+	os.Stderr = w
+
+	result := exportCommand([]string{"1INVALID"}, os.Stdin, os.Stdout, os.Stderr, &status)
+
+	w.Close()
+	os.Stderr = oldStderr
+
+	var buf bytes.Buffer
+	io.Copy(&buf, r)
+
+	assert.True(t, result)
+	assert.Contains(t, buf.String(), "not a valid identifier")
+}
+
+func TestExportCommandList(t *testing.T) {
+	var status int
+	t.Setenv("GOSH_LISTED_VAR", "listed")
+
+	oldStdout := os.Stdout
+	r, w, _ := os.Pipe()
+	os.Stdout = w
+
+	result := exportCommand([]string{}, os.Stdin, os.Stdout, os.Stderr, &status)
+
+	w.Close()
+	os.Stdout = oldStdout
+
+	var buf bytes.Buffer
+	io.Copy(&buf, r)
+
+	assert.True(t, result)
+	assert.Contains(t, buf.String(), "export GOSH_LISTED_VAR=listed")
+}
+
+// withFakeTerminal makes writePaged believe stdout is a terminal of the
+// given height and uses tee as the pager, so paged output lands in a file
+func withFakeTerminal(t *testing.T, height int) string {
+	pagerFile := filepath.Join(t.TempDir(), "paged.txt")
+	t.Setenv("PAGER", "tee "+pagerFile)
+	t.Setenv("GOSH_PAGER", "")
+
+	oldIsTerminal, oldHeight := stdoutIsTerminal, terminalHeight
+	stdoutIsTerminal = func() bool { return true }
+	terminalHeight = func() int { return height }
+	t.Cleanup(func() {
+		stdoutIsTerminal, terminalHeight = oldIsTerminal, oldHeight
+	})
+
+	return pagerFile
+}
+
+func captureStdout(fn func()) string {
+	oldStdout := os.Stdout
+	r, w, _ := os.Pipe()
+	os.Stdout = w
+
+	fn()
+
+	w.Close()
+	os.Stdout = oldStdout
+
+	var buf bytes.Buffer
+	io.Copy(&buf, r)
+	return buf.String()
+}
+
+func TestWritePaged(t *testing.T) {
+	longOutput := func(w io.Writer) {
+		for i := 0; i < 10; i++ {
+			fmt.Fprintf(w, "line %d\n", i)
+		}
+	}
+
+	t.Run("pages output taller than the terminal", func(t *testing.T) {
+		pagerFile := withFakeTerminal(t, 5)
+
+		output := captureStdout(func() { writePaged(os.Stdout, longOutput) })
+
+		paged, err := os.ReadFile(pagerFile)
+		assert.NoError(t, err)
+		assert.Contains(t, string(paged), "line 9")
+		assert.Equal(t, string(paged), output)
+	})
+
+	t.Run("short output bypasses the pager", func(t *testing.T) {
+		pagerFile := withFakeTerminal(t, 50)
+
+		output := captureStdout(func() { writePaged(os.Stdout, longOutput) })
+
+		assert.NoFileExists(t, pagerFile)
+		assert.Contains(t, output, "line 9")
+	})
+
+	t.Run("piped output bypasses the pager", func(t *testing.T) {
+		pagerFile := withFakeTerminal(t, 5)
+		stdoutIsTerminal = func() bool { return false }
+
+		output := captureStdout(func() { writePaged(os.Stdout, longOutput) })
+
+		assert.NoFileExists(t, pagerFile)
+		assert.Contains(t, output, "line 0")
+	})
+
+	t.Run("GOSH_PAGER=0 disables paging", func(t *testing.T) {
+		pagerFile := withFakeTerminal(t, 5)
+		t.Setenv("GOSH_PAGER", "0")
+
+		output := captureStdout(func() { writePaged(os.Stdout, longOutput) })
+
+		assert.NoFileExists(t, pagerFile)
+		assert.Contains(t, output, "line 9")
+	})
+
+	t.Run("a blank PAGER falls back to less", func(t *testing.T) {
+		withFakeTerminal(t, 5)
+		t.Setenv("PAGER", "  ")
+
+		output := captureStdout(func() { writePaged(os.Stdout, longOutput) })
+
+		assert.Contains(t, output, "line 9")
+	})
+}
+
+func TestHistoryCommandPaged(t *testing.T) {
+	var status int
+	t.Setenv("HOME", t.TempDir())
+	hist := history.New()
+	for i := 0; i < 10; i++ {
+		hist.Add(fmt.Sprintf("echo %d", i))
+	}
+	SetHistory(hist)
+	defer SetHistory(nil)
+
+	pagerFile := withFakeTerminal(t, 5)
+	captureStdout(func() { historyCommand([]string{}, os.Stdin, os.Stdout, os.Stderr, &status) })
+
+	paged, err := os.ReadFile(pagerFile)
+	assert.NoError(t, err)
+	assert.Contains(t, string(paged), "   1  echo 0")
+	assert.Contains(t, string(paged), "  10  echo 9")
+}
+
+func TestHistoryStat(t *testing.T) {
+	var status int
+	t.Setenv("HOME", t.TempDir())
+	hist := history.New()
+	for _, command := range []string{"git status", "ls", "make", "git commit", "ls -l", "git push", "cd /tmp", "make test"} {
+		hist.Add(command)
+	}
+	SetHistory(hist)
+	defer SetHistory(nil)
+
+	history := func(args ...string) (string, string) {
+		var stdout, stderr bytes.Buffer
+		historyCommand(args, os.Stdin, &stdout, &stderr, &status)
+		return stdout.String(), stderr.String()
+	}
+
+	// Most used first, with ties in name order
+	stdout, _ := history("--stat")
+	assert.Equal(t, "    3  git\n    2  ls\n    2  make\n    1  cd\n", stdout)
+	stdout, _ = history("--stat", "2")
+	assert.Equal(t, "    3  git\n    2  ls\n", stdout)
+
+	_, stderr := history("--stat", "x")
+	assert.Equal(t, "history: x: numeric argument required\n", stderr)
+	assert.Equal(t, 2, status)
+}
+
+func TestHistorySearch(t *testing.T) {
+	var status int
+	t.Setenv("HOME", t.TempDir())
+	hist := history.New()
+	for _, command := range []string{"git status", "ls -l", "git commit -m 'x'", "make", "git push", "10"} {
+		hist.Add(command)
+	}
+	SetHistory(hist)
+	defer SetHistory(nil)
+
+	history := func(args ...string) string {
+		var stdout bytes.Buffer
+		historyCommand(args, os.Stdin, &stdout, os.Stderr, &status)
+		return stdout.String()
+	}
+
+	// Matches keep their original numbers
+	assert.Equal(t, "   1  git status\n   3  git commit -m 'x'\n   5  git push\n", history("git"))
+	assert.Equal(t, "   3  git commit -m 'x'\n   5  git push\n", history("-g", "git [cp]*"))
+	assert.Equal(t, "   2  ls -l\n", history("-g", "*-l"))
+	assert.Empty(t, history("svn"))
+
+	// A number is still a count
+	assert.Equal(t, "   5  git push\n   6  10\n", history("2"))
+
+	var stderr bytes.Buffer
+	status, _ = ExecuteIO("history", []string{"-g"}, shell.IO{Out: io.Discard, Err: &stderr})
+	assert.Equal(t, "history: -g: pattern expected\n", stderr.String())
+	assert.Equal(t, 2, status)
+}
+
+func TestDisownCommand(t *testing.T) {
+	var status int
+	jm := jobs.NewJobManager()
+	SetJobManager(jm)
+	defer SetJobManager(nil)
+
+	var cmds []*exec.Cmd
+	for i := 0; i < 3; i++ {
+		cmd := exec.Command("sleep", "5")
+		assert.NoError(t, cmd.Start())
+		defer cmd.Process.Kill()
+		jm.AddJob(cmd, "sleep 5")
+		cmds = append(cmds, cmd)
+	}
+
+	// Explicit job spec
+	assert.True(t, disownCommand([]string{"%1"}, os.Stdin, os.Stdout, os.Stderr, &status))
+	assert.Nil(t, jm.GetJob(1))
+
+	// Bare disown targets the current (most recent) job
+	assert.True(t, disownCommand([]string{}, os.Stdin, os.Stdout, os.Stderr, &status))
+	assert.Nil(t, jm.GetJob(3))
+	assert.NotNil(t, jm.GetJob(2))
+
+	// -a removes everything
+	assert.True(t, disownCommand([]string{"-a"}, os.Stdin, os.Stdout, os.Stderr, &status))
+	assert.Empty(t, jm.GetJobs())
+
+	// Processes are still running
+	for _, cmd := range cmds {
+		assert.NoError(t, cmd.Process.Signal(syscall.Signal(0)))
+	}
+}
+
+func TestIsSingleTypo(t *testing.T) {
+	tests := []struct {
+		typed, name string
+		expected    bool
+	}{
+		{"Documnets", "Documents", true},  // transposition
+		{"Documets", "Documents", true},   // deletion
+		{"Docuuments", "Documents", true}, // insertion
+		{"Documents", "Documents", false}, // identical
+		{"Dokuments", "Documents", false}, // substitution
+		{"Docmunets", "Documents", false}, // two edits
+		{"xyz", "Documents", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.typed, func(t *testing.T) {
+			assert.Equal(t, tt.expected, isSingleTypo(tt.typed, tt.name))
+		})
+	}
+}
+
+func TestCdCommandSpellCorrection(t *testing.T) {
+	var status int
+	originalDir, _ := os.Getwd()
+	defer os.Chdir(originalDir)
+
+	tempDir, _ := filepath.EvalSymlinks(t.TempDir())
+	os.MkdirAll(filepath.Join(tempDir, "Documents", "Projects"), 0755)
+	os.Chdir(tempDir)
+
+	t.Run("corrects with GOSH_CDSPELL=1", func(t *testing.T) {
+		t.Setenv("GOSH_CDSPELL", "1")
+		defer os.Chdir(tempDir)
+
+		output := captureStdout(func() { cdCommand([]string{"Documnets/Porjects"}, os.Stdin, os.Stdout, os.Stderr, &status) })
+
+		assert.Equal(t, "Documents/Projects\n", output)
+		cwd, _ := os.Getwd()
+		assert.Equal(t, filepath.Join(tempDir, "Documents", "Projects"), cwd)
+	})
+
+	t.Run("no close match still fails", func(t *testing.T) {
+		t.Setenv("GOSH_CDSPELL", "1")
+
+		oldStderr := os.Stderr
+		r, w, _ := os.Pipe()
+		os.Stderr = w
+		cdCommand([]string{"xyz"}, os.Stdin, os.Stdout, os.Stderr, &status)
+		w.Close()
+		os.Stderr = oldStderr
+
+		var buf bytes.Buffer
+		io.Copy(&buf, r)
+		assert.Contains(t, buf.String(), "cd:")
+
+		cwd, _ := os.Getwd()
+		assert.Equal(t, tempDir, cwd)
+	})
+
+	t.Run("disabled by default", func(t *testing.T) {
+		t.Setenv("GOSH_CDSPELL", "")
+
+		oldStderr := os.Stderr
+		_, w, _ := os.Pipe()
+		os.Stderr = w
+		cdCommand([]string{"Documnets"}, os.Stdin, os.Stdout, os.Stderr, &status)
+		w.Close()
+		os.Stderr = oldStderr
+
+		cwd, _ := os.Getwd()
+		assert.Equal(t, tempDir, cwd)
+	})
+}
+
+func TestFgBgDefaultToCurrentJob(t *testing.T) {
+	var status int
+	jm := jobs.NewJobManager()
+	SetJobManager(jm)
+	defer SetJobManager(nil)
+
+	captureStderr := func(fn func()) string {
+		oldStderr := os.Stderr
+		r, w, _ := os.Pipe()
+		os.Stderr = w
+		fn()
+		w.Close()
+		os.Stderr = oldStderr
+		var buf bytes.Buffer
+		io.Copy(&buf, r)
+		return buf.String()
+	}
+
+	// No jobs at all
+	output := captureStderr(func() { fgCommand([]string{}, os.Stdin, os.Stdout, os.Stderr, &status) })
+	assert.Contains(t, output, "fg: current: no such job")
+
+	long := exec.Command("sleep", "5")
+	assert.NoError(t, long.Start())
+	defer long.Process.Kill()
+	longJob := jm.AddJob(long, "sleep 5")
+
+	short := exec.Command("sleep", "0.1")
+	assert.NoError(t, short.Start())
+	shortJob := jm.AddJob(short, "sleep 0.1")
+
+	// Bare bg works on the current job without complaint
+	output = captureStderr(func() { bgCommand([]string{}, os.Stdin, os.Stdout, os.Stderr, &status) })
+	assert.Empty(t, output)
+
+	// %+ and %- name the current and previous jobs in both builtins
+	for _, spec := range []string{"%+", "%-", "%%", "%1"} {
+		output = captureStderr(func() { bgCommand([]string{spec}, os.Stdin, os.Stdout, os.Stderr, &status) })
+		assert.Empty(t, output, spec)
+	}
+	output = captureStderr(func() { fgCommand([]string{"%+"}, os.Stdin, os.Stdout, os.Stderr, &status) })
+	assert.Empty(t, output)
+	assert.Equal(t, jobs.JobDone, jm.GetJob(shortJob.ID).State)
+
+	// With the short job done, there is no previous job left
+	output = captureStderr(func() { fgCommand([]string{"%-"}, os.Stdin, os.Stdout, os.Stderr, &status) })
+	assert.Contains(t, output, "fg: %-: no such job")
+
+	short = exec.Command("sleep", "0.1")
+	assert.NoError(t, short.Start())
+	shortJob = jm.AddJob(short, "sleep 0.1")
+
+	// Bare fg waits for the current (most recent) job
+	output = captureStderr(func() { fgCommand([]string{}, os.Stdin, os.Stdout, os.Stderr, &status) })
+	assert.Empty(t, output)
+	assert.Equal(t, jobs.JobDone, jm.GetJob(shortJob.ID).State)
+	assert.Equal(t, jobs.JobRunning, jm.GetJob(longJob.ID).State)
+
+	// Specs are resolved too
+	output = captureStderr(func() { bgCommand([]string{"%9"}, os.Stdin, os.Stdout, os.Stderr, &status) })
+	assert.Contains(t, output, "bg: %9: no such job")
+}
+
+func TestParseSignal(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected syscall.Signal
+	}{
+		{"TERM", syscall.SIGTERM},
+		{"SIGTERM", syscall.SIGTERM},
+		{"term", syscall.SIGTERM},
+		{"SigInt", syscall.SIGINT},
+		{"KILL", syscall.SIGKILL},
+		{"9", syscall.SIGKILL},
+		{"15", syscall.SIGTERM},
+		{"hup", syscall.SIGHUP},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			sig, err := parseSignal(tt.input)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, sig)
+		})
+	}
+
+	for _, bad := range []string{"", "NOPE", "SIG", "999", "-1"} {
+		_, err := parseSignal(bad)
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestKillCommand(t *testing.T) {
+	var status int
+	t.Run("list", func(t *testing.T) {
+		output := captureStdout(func() { killCommand([]string{"-l"}, os.Stdin, os.Stdout, os.Stderr, &status) })
+		for _, name := range []string{"SIGHUP", "SIGINT", "SIGKILL", "SIGTERM", "SIGSTOP", "SIGCONT"} {
+			assert.Contains(t, output, name)
+		}
+		assert.Contains(t, output, " 9) SIGKILL")
+		assert.Contains(t, output, "15) SIGTERM")
+	})
+
+	t.Run("list single", func(t *testing.T) {
+		output := captureStdout(func() { killCommand([]string{"-l", "9"}, os.Stdin, os.Stdout, os.Stderr, &status) })
+		assert.Equal(t, "KILL\n", output)
+	})
+
+	t.Run("pid and job", func(t *testing.T) {
+		jm := jobs.NewJobManager()
+		SetJobManager(jm)
+		defer SetJobManager(nil)
+
+		byPID := exec.Command("sleep", "5")
+		assert.NoError(t, byPID.Start())
+		defer byPID.Process.Kill()
+
+		assert.True(t, killCommand([]string{"-KILL", fmt.Sprint(byPID.Process.Pid)}, os.Stdin, os.Stdout, os.Stderr, &status))
+		err := byPID.Wait()
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "killed")
+
+		byJob := exec.Command("sleep", "5")
+		byJob.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+		assert.NoError(t, byJob.Start())
+		defer byJob.Process.Kill()
+		job := jm.AddJob(byJob, "sleep 5")
+
+		assert.True(t, killCommand([]string{"-s", "term", "%1"}, os.Stdin, os.Stdout, os.Stderr, &status))
+		assert.Eventually(t, func() bool {
+			return jm.GetJob(job.ID).State == jobs.JobDone
+		}, 2*time.Second, 10*time.Millisecond)
+	})
+}
+
+func TestTrapCommand(t *testing.T) {
+	var status int
+	defer shell.ClearTrap(shell.ExitTrap)
+	defer shell.ClearTrap(syscall.SIGHUP)
+
+	// Register
+	assert.True(t, trapCommand([]string{"echo bye", "EXIT"}, os.Stdin, os.Stdout, os.Stderr, &status))
+	assert.True(t, trapCommand([]string{"echo hup", "SIGHUP"}, os.Stdin, os.Stdout, os.Stderr, &status))
+
+	command, ok := shell.GetTrap(shell.ExitTrap)
+	assert.True(t, ok)
+	assert.Equal(t, "echo bye", command)
+	command, ok = shell.GetTrap(syscall.SIGHUP)
+	assert.True(t, ok)
+	assert.Equal(t, "echo hup", command)
+
+	// List
+	output := captureStdout(func() { trapCommand([]string{"-p"}, os.Stdin, os.Stdout, os.Stderr, &status) })
+	assert.Equal(t, "trap -- 'echo bye' EXIT\ntrap -- 'echo hup' SIGHUP\n", output)
+
+	// Quotes in commands are escaped
+	trapCommand([]string{"echo 'it'", "exit"}, os.Stdin, os.Stdout, os.Stderr, &status)
+	output = captureStdout(func() { trapCommand([]string{}, os.Stdin, os.Stdout, os.Stderr, &status) })
+	assert.Contains(t, output, `trap -- 'echo '\''it'\''' EXIT`)
+
+	// Clear
+	assert.True(t, trapCommand([]string{"-", "HUP"}, os.Stdin, os.Stdout, os.Stderr, &status))
+	_, ok = shell.GetTrap(syscall.SIGHUP)
+	assert.False(t, ok)
+
+	// Untrappable and unknown signals are rejected
+	trapCommand([]string{"echo nope", "KILL", "BOGUS"}, os.Stdin, os.Stdout, os.Stderr, &status)
+	assert.Equal(t, []syscall.Signal{shell.ExitTrap}, shell.TrapSignals())
+}
+
+func TestVersionCommand(t *testing.T) {
+	var status int
+	SetVersion("1.2.3", "abc1234")
+	defer SetVersion("dev", "unknown")
+
+	output := captureStdout(func() { assert.True(t, versionCommand([]string{}, os.Stdin, os.Stdout, os.Stderr, &status)) })
+	assert.Equal(t, "gosh version 1.2.3 (commit abc1234, "+runtime.Version()+")\n", output)
+}
+
+func TestExecuteIO(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+
+	_, ok := ExecuteIO("pwd", []string{}, shell.IO{Out: &stdout, Err: &stderr})
+	assert.True(t, ok)
+	cwd, _ := os.Getwd()
+	assert.Equal(t, cwd+"\n", stdout.String())
+
+	ExecuteIO("cd", []string{"/nonexistent/gosh/dir"}, shell.IO{Out: &stdout, Err: &stderr})
+	assert.Contains(t, stderr.String(), "cd: ")
+}
+
+func TestExecuteShellIO(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	saved := shell.CurrentIO()
+	defer shell.SetIO(saved)
+	shell.SetIO(shell.IO{In: strings.NewReader("typed\n"), Out: &stdout, Err: &stderr})
+	defer shell.UnsetVar("GOSH_IO_LINE")
+
+	assert.True(t, Execute("pwd", []string{}))
+	cwd, _ := os.Getwd()
+	assert.Equal(t, cwd+"\n", stdout.String())
+
+	Execute("read", []string{"GOSH_IO_LINE"})
+	assert.Equal(t, "typed", shell.GetVar("GOSH_IO_LINE"))
+
+	Execute("cd", []string{"/nonexistent/gosh/dir"})
+	assert.Contains(t, stderr.String(), "cd: ")
+
+	// Streams given to ExecuteIO win over the shell's
+	var own bytes.Buffer
+	ExecuteIO("pwd", []string{}, shell.IO{Out: &own})
+	assert.Equal(t, cwd+"\n", own.String())
+	assert.Equal(t, cwd+"\n", stdout.String())
+}
+
+func TestReadCommand(t *testing.T) {
+	var status int
+	defer shell.UnsetVar("REPLY")
+	defer shell.UnsetVar("GOSH_READ_A")
+	defer shell.UnsetVar("GOSH_READ_B")
+
+	tests := []struct {
+		name     string
+		args     []string
+		input    string
+		expected map[string]string
+	}{
+		{"reply", []string{}, "hello world\nnext\n", map[string]string{"REPLY": "hello world"}},
+		{"fields", []string{"GOSH_READ_A", "GOSH_READ_B"}, "one  two three\n", map[string]string{"GOSH_READ_A": "one", "GOSH_READ_B": "two three"}},
+		{"missing fields", []string{"GOSH_READ_A", "GOSH_READ_B"}, "only\n", map[string]string{"GOSH_READ_A": "only", "GOSH_READ_B": ""}},
+		{"no trailing newline", []string{"GOSH_READ_A"}, "last", map[string]string{"GOSH_READ_A": "last"}},
+		{"escapes", []string{"GOSH_READ_A"}, `a\ b\\c` + "\n", map[string]string{"GOSH_READ_A": `a b\c`}},
+		{"continuation", []string{"GOSH_READ_A"}, "one \\\ntwo\n", map[string]string{"GOSH_READ_A": "one two"}},
+		{"raw", []string{"-r", "GOSH_READ_A"}, `a\ b` + "\n", map[string]string{"GOSH_READ_A": `a\ b`}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.True(t, readCommand(tt.args, strings.NewReader(tt.input), os.Stdout, os.Stderr, &status))
+			for name, value := range tt.expected {
+				assert.Equal(t, value, shell.GetVar(name), name)
+			}
+		})
+	}
+
+	// Only the first line is consumed
+	input := strings.NewReader("first\nsecond\n")
+	readCommand([]string{"GOSH_READ_A"}, input, os.Stdout, os.Stderr, &status)
+	readCommand([]string{"GOSH_READ_B"}, input, os.Stdout, os.Stderr, &status)
+	assert.Equal(t, "first", shell.GetVar("GOSH_READ_A"))
+	assert.Equal(t, "second", shell.GetVar("GOSH_READ_B"))
+}
+
+func TestCdDirHistory(t *testing.T) {
+	var status int
+	origDir, _ := os.Getwd()
+	defer os.Chdir(origDir)
+	defer func() { dirHistory = nil }()
+	dirHistory = nil
+
+	// Visit a, b and c in turn, recording the resolved paths
+	base := t.TempDir()
+	var visited []string
+	for _, name := range []string{"a", "b", "c"} {
+		dir := filepath.Join(base, name)
+		assert.NoError(t, os.Mkdir(dir, 0755))
+		cdCommand([]string{dir}, os.Stdin, os.Stdout, os.Stderr, &status)
+		cwd, _ := os.Getwd()
+		visited = append(visited, cwd)
+	}
+
+	var stdout bytes.Buffer
+	cdCommand([]string{"--"}, os.Stdin, &stdout, os.Stderr, &status)
+	assert.Equal(t, fmt.Sprintf(" 0  %s\n 1  %s\n 2  %s\n 3  %s\n", visited[2], visited[1], visited[0], origDir), stdout.String())
+
+	// -2 jumps back to a, which becomes the most recent entry
+	cdCommand([]string{"-2"}, os.Stdin, os.Stdout, os.Stderr, &status)
+	cwd, _ := os.Getwd()
+	assert.Equal(t, visited[0], cwd)
+	assert.Equal(t, []string{visited[0], visited[2], visited[1], origDir}, dirHistory)
+
+	// - goes back to the previous directory
+	cdCommand([]string{"-"}, os.Stdin, os.Stdout, os.Stderr, &status)
+	cwd, _ = os.Getwd()
+	assert.Equal(t, visited[2], cwd)
+
+	// Out of range entries are an error
+	var stderr bytes.Buffer
+	cdCommand([]string{"-9"}, os.Stdin, os.Stdout, &stderr, &status)
+	assert.Contains(t, stderr.String(), "cd: -9: no such entry in directory history")
+
+	// The history is bounded
+	for i := 0; i < maxDirHistory+5; i++ {
+		dir := filepath.Join(base, fmt.Sprintf("d%d", i))
+		assert.NoError(t, os.Mkdir(dir, 0755))
+		cdCommand([]string{dir}, os.Stdin, os.Stdout, os.Stderr, &status)
+	}
+	assert.Len(t, dirHistory, maxDirHistory)
+}
+
+func TestPwdLogicalAndPhysical(t *testing.T) {
+	var status int
+	origDir, _ := os.Getwd()
+	defer os.Chdir(origDir)
+	t.Setenv("PWD", os.Getenv("PWD"))
+	t.Setenv("OLDPWD", os.Getenv("OLDPWD"))
+	defer func() { dirHistory = nil }()
+
+	base, err := filepath.EvalSymlinks(t.TempDir())
+	assert.NoError(t, err)
+	real := filepath.Join(base, "real")
+	link := filepath.Join(base, "link")
+	assert.NoError(t, os.Mkdir(real, 0755))
+	assert.NoError(t, os.Symlink(real, link))
+
+	cdCommand([]string{link}, os.Stdin, os.Stdout, os.Stderr, &status)
+
+	tests := []struct {
+		args     []string
+		expected string
+	}{
+		{[]string{}, link},
+		{[]string{"-L"}, link},
+		{[]string{"-P"}, real},
+		{[]string{"-L", "-P"}, real},
+	}
+
+	for _, tt := range tests {
+		var stdout bytes.Buffer
+		pwdCommand(tt.args, os.Stdin, &stdout, os.Stderr, &status)
+		assert.Equal(t, tt.expected+"\n", stdout.String(), "pwd %v", tt.args)
+	}
+
+	// A stale $PWD is ignored in favor of the real directory
+	os.Setenv("PWD", origDir)
+	var stdout bytes.Buffer
+	pwdCommand([]string{"-L"}, os.Stdin, &stdout, os.Stderr, &status)
+	assert.Equal(t, real+"\n", stdout.String())
+
+	// Leaving the symlinked directory with .. follows the real parent
+	cdCommand([]string{link}, os.Stdin, os.Stdout, os.Stderr, &status)
+	cdCommand([]string{".."}, os.Stdin, os.Stdout, os.Stderr, &status)
+	assert.Equal(t, base, os.Getenv("PWD"))
+	assert.Equal(t, link, os.Getenv("OLDPWD"))
+}
+
+func TestDirStackCommands(t *testing.T) {
+	var status int
+	origDir, _ := os.Getwd()
+	defer os.Chdir(origDir)
+	t.Setenv("PWD", "")
+	t.Setenv("OLDPWD", "")
+	defer func() { dirStack = dirstack.New(); dirHistory = nil }()
+	dirStack = dirstack.New()
+
+	base, _ := filepath.EvalSymlinks(t.TempDir())
+	a, b := filepath.Join(base, "a"), filepath.Join(base, "b")
+	assert.NoError(t, os.Mkdir(a, 0755))
+	assert.NoError(t, os.Mkdir(b, 0755))
+
+	var stdout bytes.Buffer
+	pushdCommand([]string{a}, os.Stdin, &stdout, os.Stderr, &status)
+	pushdCommand([]string{b}, os.Stdin, &stdout, os.Stderr, &status)
+	assert.Equal(t, a+" "+origDir+"\n"+b+" "+a+" "+origDir+"\n", stdout.String())
+	assert.Equal(t, b, os.Getenv("PWD"))
+
+	stdout.Reset()
+	dirsCommand([]string{"-v"}, os.Stdin, &stdout, os.Stderr, &status)
+	assert.Equal(t, fmt.Sprintf(" 0  %s\n 1  %s\n 2  %s\n", b, a, origDir), stdout.String())
+
+	// pushd +2 rotates the original directory to the top
+	stdout.Reset()
+	pushdCommand([]string{"+2"}, os.Stdin, &stdout, os.Stderr, &status)
+	assert.Equal(t, origDir+" "+b+" "+a+"\n", stdout.String())
+
+	var stderr bytes.Buffer
+	pushdCommand([]string{"+5"}, os.Stdin, io.Discard, &stderr, &status)
+	assert.Equal(t, "pushd: +5: directory stack index out of range\n", stderr.String())
+
+	dirsCommand([]string{"-c"}, os.Stdin, io.Discard, os.Stderr, &status)
+	stdout.Reset()
+	dirsCommand(nil, os.Stdin, &stdout, os.Stderr, &status)
+	assert.Equal(t, origDir+"\n", stdout.String())
+
+	stderr.Reset()
+	popdCommand(nil, os.Stdin, io.Discard, &stderr, &status)
+	assert.Equal(t, "popd: directory stack empty\n", stderr.String())
+}
+
+func TestDescriptions(t *testing.T) {
+	descriptions := Descriptions()
+	assert.Equal(t, "Print working directory", descriptions["pwd"])
+
+	// Every builtin is documented in help
+	for name := range builtinCommands {
+		assert.NotEmpty(t, descriptions[name], "%s has no description", name)
+	}
+}
+
+func TestNohupCommand(t *testing.T) {
+	var status int
+	origDir, _ := os.Getwd()
+	defer os.Chdir(origDir)
+	dir := t.TempDir()
+	os.Chdir(dir)
+
+	oldJobManager := globalJobManager
+	defer func() { globalJobManager = oldJobManager }()
+	jm := jobs.NewJobManager()
+	globalJobManager = jm
+
+	// The command survives a SIGHUP and runs in its own session
+	outFile := filepath.Join(dir, "out.txt")
+	output, err := os.Create(outFile)
+	assert.NoError(t, err)
+	defer output.Close()
+
+	var stderr bytes.Buffer
+	nohupCommand([]string{"sh", "-c", "kill -HUP $$; sleep 0.1; echo survived"}, os.Stdin, output, &stderr, &status)
+	job := jm.GetJob(1)
+	if assert.NotNil(t, job) {
+		assert.Equal(t, fmt.Sprintf("[1] %d\n", job.PID), stderr.String())
+		pgid, err := syscall.Getpgid(job.PID)
+		if err == nil {
+			assert.Equal(t, job.PID, pgid, "nohup should start a new session")
+		}
+	}
+	assert.Eventually(t, func() bool {
+		content, _ := os.ReadFile(outFile)
+		return string(content) == "survived\n"
+	}, 3*time.Second, 20*time.Millisecond)
+	assert.False(t, signal.Ignored(syscall.SIGHUP), "the shell shouldn't keep ignoring SIGHUP")
+
+	// No nohup.out is created unless output would go to the terminal
+	_, err = os.Stat("nohup.out")
+	assert.True(t, os.IsNotExist(err))
+
+	oldIsTerminal := fileIsTerminal
+	defer func() { fileIsTerminal = oldIsTerminal }()
+	fileIsTerminal = func(f *os.File) bool { return f == output }
+
+	stderr.Reset()
+	nohupCommand([]string{"echo", "to nohup.out"}, os.Stdin, output, &stderr, &status)
+	assert.Contains(t, stderr.String(), "nohup: appending output to 'nohup.out'\n")
+	assert.Eventually(t, func() bool {
+		content, _ := os.ReadFile("nohup.out")
+		return string(content) == "to nohup.out\n"
+	}, 3*time.Second, 20*time.Millisecond)
+
+	// Output that isn't going to a file can't outlive nohup either
+	fileIsTerminal = func(f *os.File) bool { return false }
+	os.Remove("nohup.out")
+	var stdout bytes.Buffer
+	stderr.Reset()
+	nohupCommand([]string{"sh", "-c", "echo out; echo err >&2"}, strings.NewReader(""), &stdout, &stderr, &status)
+	assert.Contains(t, stderr.String(), "nohup: appending output to 'nohup.out'\n")
+	assert.Eventually(t, func() bool {
+		content, _ := os.ReadFile("nohup.out")
+		return string(content) == "out\nerr\n"
+	}, 3*time.Second, 20*time.Millisecond)
+	assert.Empty(t, stdout.String())
+
+	stderr.Reset()
+	status = 0
+	nohupCommand(nil, os.Stdin, output, &stderr, &status)
+	assert.Equal(t, "nohup: usage: nohup command [args...]\n", stderr.String())
+	assert.Equal(t, 125, status)
+
+	status = 0
+	nohupCommand([]string{"gosh-no-such-command"}, os.Stdin, output, io.Discard, &status)
+	assert.Equal(t, 127, status)
+}
+
+func TestSetCommand(t *testing.T) {
+	var status int
+	defer shell.SetOption("dotglob", false)
+	defer shell.SetOption("errexit", false)
+	defer shell.SetOption("nounset", false)
+	t.Setenv("GOSH_DOTGLOB", "")
+	t.Setenv("GOSH_ERREXIT", "")
+	t.Setenv("GOSH_NOUNSET", "")
+	t.Setenv("GOSH_NULLGLOB", "")
+
+	setCommand([]string{"-o", "dotglob"}, os.Stdin, os.Stdout, os.Stderr, &status)
+	assert.True(t, shell.Option("dotglob"))
+
+	var stdout bytes.Buffer
+	setCommand([]string{"-o"}, os.Stdin, &stdout, os.Stderr, &status)
+	assert.Equal(t, "dotglob         on\nerrexit         off\nnounset         off\nnullglob        off\n", stdout.String())
+
+	setCommand([]string{"+o", "dotglob"}, os.Stdin, os.Stdout, os.Stderr, &status)
+	assert.False(t, shell.Option("dotglob"))
+
+	// -e is short for -o errexit
+	setCommand([]string{"-e"}, os.Stdin, os.Stdout, os.Stderr, &status)
+	assert.True(t, shell.Option("errexit"))
+	setCommand([]string{"+e"}, os.Stdin, os.Stdout, os.Stderr, &status)
+	assert.False(t, shell.Option("errexit"))
+
+	// and -u for -o nounset
+	setCommand([]string{"-u"}, os.Stdin, os.Stdout, os.Stderr, &status)
+	assert.True(t, shell.Option("nounset"))
+	setCommand([]string{"+u"}, os.Stdin, os.Stdout, os.Stderr, &status)
+	assert.False(t, shell.Option("nounset"))
+
+	var stderr bytes.Buffer
+	setCommand([]string{"-o", "bogus"}, os.Stdin, os.Stdout, &stderr, &status)
+	assert.Equal(t, "set: bogus: invalid option name\n", stderr.String())
+}
+
+func TestTeeCommand(t *testing.T) {
+	var status int
+	dir := t.TempDir()
+	first := filepath.Join(dir, "first.txt")
+	second := filepath.Join(dir, "second.txt")
+
+	var stdout bytes.Buffer
+	teeCommand([]string{first, second}, strings.NewReader("one\ntwo\n"), &stdout, os.Stderr, &status)
+	assert.Equal(t, "one\ntwo\n", stdout.String())
+	for _, name := range []string{first, second} {
+		content, err := os.ReadFile(name)
+		assert.NoError(t, err)
+		assert.Equal(t, "one\ntwo\n", string(content))
+	}
+
+	// -a appends instead of truncating
+	teeCommand([]string{"-a", first}, strings.NewReader("three\n"), io.Discard, os.Stderr, &status)
+	content, _ := os.ReadFile(first)
+	assert.Equal(t, "one\ntwo\nthree\n", string(content))
+
+	// A file that can't be opened is reported, but the rest still get the
+	// input
+	var stderr bytes.Buffer
+	stdout.Reset()
+	teeCommand([]string{filepath.Join(dir, "missing", "x"), second}, strings.NewReader("four\n"), &stdout, &stderr, &status)
+	assert.Contains(t, stderr.String(), "tee: ")
+	assert.Equal(t, 1, status)
+	assert.Equal(t, "four\n", stdout.String())
+	content, _ = os.ReadFile(second)
+	assert.Equal(t, "four\n", string(content))
+
+	// Once stdout's reader has gone, the files still get the rest, and
+	// the closed pipe isn't reported
+	r, w, err := os.Pipe()
+	assert.NoError(t, err)
+	r.Close()
+	defer w.Close()
+	stderr.Reset()
+	status = 0
+	input := io.MultiReader(strings.NewReader("five\n"), strings.NewReader("six\n"))
+	teeCommand([]string{first}, input, w, &stderr, &status)
+	assert.Empty(t, stderr.String())
+	assert.Equal(t, 0, status)
+	content, _ = os.ReadFile(first)
+	assert.Equal(t, "five\nsix\n", string(content))
+}
+
+func TestCatCommand(t *testing.T) {
+	var status int
+	dir := t.TempDir()
+	first := filepath.Join(dir, "first.txt")
+	second := filepath.Join(dir, "second.txt")
+	assert.NoError(t, os.WriteFile(first, []byte("one\n"), 0644))
+	assert.NoError(t, os.WriteFile(second, []byte("two\n"), 0644))
+
+	var stdout bytes.Buffer
+	catCommand([]string{first, second}, strings.NewReader(""), &stdout, os.Stderr, &status)
+	assert.Equal(t, "one\ntwo\n", stdout.String())
+	assert.Equal(t, 0, status)
+
+	// With no files, or -, stdin is copied
+	stdout.Reset()
+	catCommand(nil, strings.NewReader("piped\n"), &stdout, os.Stderr, &status)
+	assert.Equal(t, "piped\n", stdout.String())
+	stdout.Reset()
+	catCommand([]string{first, "-", second}, strings.NewReader("piped\n"), &stdout, os.Stderr, &status)
+	assert.Equal(t, "one\npiped\ntwo\n", stdout.String())
+
+	// A file that can't be read is reported, and the rest are still copied
+	var stderr bytes.Buffer
+	stdout.Reset()
+	catCommand([]string{filepath.Join(dir, "missing"), dir, second}, strings.NewReader(""), &stdout, &stderr, &status)
+	assert.Contains(t, stderr.String(), "cat: open "+filepath.Join(dir, "missing"))
+	assert.Contains(t, stderr.String(), "is a directory")
+	assert.Equal(t, "two\n", stdout.String())
+	assert.Equal(t, 1, status)
+
+	// Options are left to the system's cat, if there is one
+	stdout.Reset()
+	stderr.Reset()
+	catCommand([]string{"-n", first}, strings.NewReader(""), &stdout, &stderr, &status)
+	assert.Equal(t, "     1\tone\n", stdout.String())
+	assert.Equal(t, 0, status)
+	t.Setenv("PATH", dir)
+	stdout.Reset()
+	catCommand([]string{"-n", first}, strings.NewReader(""), &stdout, &stderr, &status)
+	assert.Empty(t, stdout.String())
+	assert.Equal(t, "cat: -n: invalid option\nusage: cat [file...]\n", stderr.String())
+	assert.Equal(t, 1, status)
+}
+
+func TestGrepCommand(t *testing.T) {
+	var status int
+	input := "apple pie\nBanana split\ncherry tart\napple crumble"
+	var stdout, stderr bytes.Buffer
+	grep := func(args ...string) {
+		stdout.Reset()
+		stderr.Reset()
+		status, _ = ExecuteIO("grep", args, shell.IO{In: strings.NewReader(input), Out: &stdout, Err: &stderr})
+	}
+
+	// Other options are left to the system's grep, if there is one
+	grep("-c", "apple")
+	assert.Equal(t, "2\n", stdout.String())
+	assert.Equal(t, 0, status)
+	grep("-l", "nothing")
+	assert.Equal(t, 1, status)
+	// As are back-references, which can't be translated
+	grep(`\(p\)\1`)
+	assert.Equal(t, "apple pie\napple crumble\n", stdout.String())
+	assert.Equal(t, 0, status)
+	t.Setenv("PATH", t.TempDir())
+	grep(`\(p\)\1`)
+	assert.Equal(t, "grep: back-references are not supported\n", stderr.String())
+	assert.Equal(t, 2, status)
+	grep("-c", "apple")
+	assert.Equal(t, "grep: invalid option -- 'c'\nusage: grep [-inv] pattern [file...]\n", stderr.String())
+	assert.Equal(t, 2, status)
+
+	// Lines are matched by regular expression, and a line with no final
+	// newline gets one
+	grep("^apple")
+	assert.Equal(t, "apple pie\napple crumble\n", stdout.String())
+	assert.Equal(t, 0, status)
+	grep("a.t")
+	assert.Equal(t, "cherry tart\n", stdout.String())
+
+	// Patterns are basic expressions, where ( | { + and ? are literal
+	// unless escaped, as is * at the start
+	grep(`apple\|cherry`)
+	assert.Equal(t, "apple pie\ncherry tart\napple crumble\n", stdout.String())
+	grep(`\(an\)\{2\}`)
+	assert.Equal(t, "Banana split\n", stdout.String())
+	grep(`^[[:lower:]]\+ t`)
+	assert.Equal(t, "cherry tart\n", stdout.String())
+	grep("pie(")
+	assert.Equal(t, 1, status)
+	grep("*")
+	assert.Equal(t, 1, status)
+	grep(`t$\|^B`)
+	assert.Equal(t, "Banana split\ncherry tart\n", stdout.String())
+
+	// A pattern that isn't a valid expression is an error
+	grep(`pie\(`)
+	assert.Empty(t, stdout.String())
+	assert.Equal(t, "grep: error parsing regexp: missing closing ): `pie(`\n", stderr.String())
+	assert.Equal(t, 2, status)
+
+	grep("-v", "apple")
+	assert.Equal(t, "Banana split\ncherry tart\n", stdout.String())
+	grep("banana")
+	assert.Empty(t, stdout.String())
+	assert.Equal(t, 1, status)
+	grep("-i", "banana")
+	assert.Equal(t, "Banana split\n", stdout.String())
+	assert.Equal(t, 0, status)
+	grep("-n", "tart")
+	assert.Equal(t, "3:cherry tart\n", stdout.String())
+	grep("-vin", "APPLE")
+	assert.Equal(t, "2:Banana split\n3:cherry tart\n", stdout.String())
+	grep("--", "-x")
+	assert.Equal(t, 1, status)
+
+	// Files are read instead of stdin, named when there are several
+	dir := t.TempDir()
+	first := filepath.Join(dir, "first.txt")
+	second := filepath.Join(dir, "second.txt")
+	assert.NoError(t, os.WriteFile(first, []byte("one\ntwo\n"), 0644))
+	assert.NoError(t, os.WriteFile(second, []byte("three\n"), 0644))
+	grep("o", first)
+	assert.Equal(t, "one\ntwo\n", stdout.String())
+	grep("-n", "t", first, second)
+	assert.Equal(t, first+":2:two\n"+second+":1:three\n", stdout.String())
+
+	// Errors give status 2, even when other files match
+	grep("t", filepath.Join(dir, "missing"), second)
+	assert.Contains(t, stderr.String(), "grep: open "+filepath.Join(dir, "missing"))
+	assert.Equal(t, second+":three\n", stdout.String())
+	assert.Equal(t, 2, status)
+	grep()
+	assert.Equal(t, "usage: grep [-inv] pattern [file...]\n", stderr.String())
+	assert.Equal(t, 2, status)
+}
+
+func TestGrepPassesLinesOn(t *testing.T) {
+	// Lines from a pipe are written as they match, not when it closes
+	inRead, inWrite, err := os.Pipe()
+	assert.NoError(t, err)
+	defer inWrite.Close()
+	outRead, outWrite, err := os.Pipe()
+	assert.NoError(t, err)
+	defer outRead.Close()
+
+	done := make(chan int)
+	go func() {
+		status, _ := ExecuteIO("grep", []string{"b"}, shell.IO{In: inRead, Out: outWrite, Err: io.Discard})
+		outWrite.Close()
+		done <- status
+	}()
+
+	_, err = inWrite.WriteString("apple\nbanana\n")
+	assert.NoError(t, err)
+	assert.NoError(t, outRead.SetReadDeadline(time.Now().Add(2*time.Second)))
+	line, err := bufio.NewReader(outRead).ReadString('\n')
+	assert.NoError(t, err)
+	assert.Equal(t, "banana\n", line)
+
+	inWrite.Close()
+	assert.Equal(t, 0, <-done)
+	inRead.Close()
+}
+
+func TestAliasCommand(t *testing.T) {
+	var status int
+	defer shell.UnsetAlias("ll")
+	defer shell.UnsetAlias("sudo")
+
+	var stdout, stderr bytes.Buffer
+	run := func(name string, args ...string) {
+		stdout.Reset()
+		stderr.Reset()
+		status, _ = ExecuteIO(name, args, shell.IO{Out: &stdout, Err: &stderr})
+	}
+
+	run("alias", "ll=ls -l", "sudo=sudo ")
+	value, ok := shell.LookupAlias("sudo")
+	assert.True(t, ok)
+	assert.Equal(t, "sudo ", value)
+
+	// Aliases are shown so that they can be run again
+	run("alias")
+	assert.Equal(t, "alias ll='ls -l'\nalias sudo='sudo '\n", stdout.String())
+	run("alias", "ll", "missing")
+	assert.Equal(t, "alias ll='ls -l'\n", stdout.String())
+	assert.Equal(t, "alias: missing: not found\n", stderr.String())
+	assert.Equal(t, 1, status)
+	run("alias", "a/b=x")
+	assert.Equal(t, "alias: `a/b': invalid alias name\n", stderr.String())
+
+	run("unalias", "ll", "missing")
+	assert.Equal(t, "unalias: missing: not found\n", stderr.String())
+	_, ok = shell.LookupAlias("ll")
+	assert.False(t, ok)
+	run("unalias", "-a")
+	assert.Empty(t, shell.AliasNames())
+	assert.Equal(t, 0, status)
+}
+
+func TestCompleteCommand(t *testing.T) {
+	var status int
+	defer shell.RemoveCompletion("myservice")
+	defer shell.RemoveCompletion("mytool")
+
+	var stdout, stderr bytes.Buffer
+	run := func(args ...string) {
+		stdout.Reset()
+		stderr.Reset()
+		status, _ = ExecuteIO("complete", args, shell.IO{Out: &stdout, Err: &stderr})
+	}
+
+	run("-W", "start stop restart", "myservice")
+	spec, ok := shell.LookupCompletion("myservice")
+	assert.True(t, ok)
+	assert.Equal(t, []string{"start", "stop", "restart"}, spec.Words)
+
+	run("-d", "-W", "it's", "mytool")
+	spec, _ = shell.LookupCompletion("mytool")
+	assert.Equal(t, shell.CompletionSpec{Words: []string{"it's"}, Dirs: true}, spec)
+
+	// Specs print as the commands that set them
+	run("-p", "myservice", "mytool")
+	assert.Equal(t, "complete -W 'start stop restart' myservice\ncomplete -d -W 'it'\\''s' mytool\n", stdout.String())
+	run()
+	assert.Contains(t, stdout.String(), "complete -W 'start stop restart' myservice\n")
+
+	run("-p", "gosh-no-such-command")
+	assert.Equal(t, "complete: gosh-no-such-command: no completion specification\n", stderr.String())
+	assert.Equal(t, 1, status)
+
+	run("-r", "mytool")
+	_, ok = shell.LookupCompletion("mytool")
+	assert.False(t, ok)
+
+	run("-W")
+	assert.Equal(t, "complete: -W: option requires an argument\n", stderr.String())
+	assert.Equal(t, 2, status)
+	run("-x", "mytool")
+	assert.Contains(t, stderr.String(), "complete: -x: invalid option")
+	assert.Equal(t, 2, status)
+	run("-d")
+	assert.Contains(t, stderr.String(), "complete: usage:")
+}
+
+func TestSeqCommand(t *testing.T) {
+	var status int
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"3"}, "1\n2\n3\n"},
+		{[]string{"2", "4"}, "2\n3\n4\n"},
+		{[]string{"0", "5", "10"}, "0\n5\n10\n"},
+		{[]string{"1", "2", "6"}, "1\n3\n5\n"},
+		{[]string{"3", "-1", "1"}, "3\n2\n1\n"},
+		{[]string{"5", "1"}, ""},
+	}
+	for _, tt := range tests {
+		var stdout bytes.Buffer
+		shell.SetExitStatus(1)
+		status, _ = ExecuteIO("seq", tt.args, shell.IO{Out: &stdout})
+		assert.Equal(t, tt.want, stdout.String(), tt.args)
+		assert.Equal(t, 0, status, tt.args)
+	}
+
+	errorCases := map[string][]string{
+		"seq: invalid number: x\n":         {"x"},
+		"seq: invalid number: 1.5\n":       {"1", "1.5", "3"},
+		"seq: step must not be zero\n":     {"1", "0", "3"},
+		"usage: seq [first [step]] last\n": {},
+	}
+	for want, args := range errorCases {
+		var stdout, stderr bytes.Buffer
+		seqCommand(args, os.Stdin, &stdout, &stderr, &status)
+		assert.Equal(t, want, stderr.String())
+		assert.Empty(t, stdout.String())
+		assert.Equal(t, 1, status)
+	}
+	shell.SetExitStatus(0)
+}
+
+func TestLetCommand(t *testing.T) {
+	var status int
+	defer shell.UnsetVar("x")
+	defer shell.UnsetVar("i")
+	defer shell.SetExitStatus(0)
+
+	status, _ = ExecuteIO("let", []string{"x = 3 + 4"}, shell.IO{})
+	assert.Equal(t, "7", shell.GetVar("x"))
+	assert.Equal(t, 0, status)
+
+	// Increments start from zero for an unset variable
+	status, _ = ExecuteIO("let", []string{"i++"}, shell.IO{})
+	assert.Equal(t, "1", shell.GetVar("i"))
+	assert.Equal(t, 1, status, "i++ gives the old value, 0")
+	status, _ = ExecuteIO("let", []string{"i++", "i--", "++i"}, shell.IO{})
+	assert.Equal(t, "2", shell.GetVar("i"))
+	assert.Equal(t, 0, status)
+
+	status, _ = ExecuteIO("let", []string{"x += 3", "x *= 2"}, shell.IO{})
+	assert.Equal(t, "20", shell.GetVar("x"))
+
+	// The status is 1 when the last expression is zero
+	status, _ = ExecuteIO("let", []string{"x - 20"}, shell.IO{})
+	assert.Equal(t, 1, status)
+	status, _ = ExecuteIO("let", []string{"x > 5"}, shell.IO{})
+	assert.Equal(t, 0, status)
+
+	var stderr bytes.Buffer
+	status, _ = ExecuteIO("let", []string{"x / 0"}, shell.IO{Err: &stderr})
+	assert.Equal(t, "let: x / 0: division by 0\n", stderr.String())
+	assert.Equal(t, 1, status)
+}
+
+func TestTimeoutCommand(t *testing.T) {
+	var status int
+	// A command that runs too long is killed with status 124
+	start := time.Now()
+	var stdout, stderr bytes.Buffer
+	status, _ = ExecuteIO("timeout", []string{"1", "sleep", "5"}, shell.IO{Out: &stdout, Err: &stderr})
+	assert.Equal(t, 124, status)
+	assert.Less(t, time.Since(start), 4*time.Second)
+	assert.Empty(t, stderr.String())
+
+	// One that finishes in time keeps its own status and output
+	status, _ = ExecuteIO("timeout", []string{"5", "sleep", "0"}, shell.IO{Out: &stdout, Err: &stderr})
+	assert.Equal(t, 0, status)
+	status, _ = ExecuteIO("timeout", []string{"0.5s", "sh", "-c", "echo hi; exit 3"}, shell.IO{Out: &stdout, Err: &stderr})
+	assert.Equal(t, 3, status)
+	assert.Equal(t, "hi\n", stdout.String())
+
+	// Fractional seconds
+	start = time.Now()
+	status, _ = ExecuteIO("timeout", []string{"0.2", "sleep", "5"}, shell.IO{Out: &stdout, Err: &stderr})
+	assert.Equal(t, 124, status)
+	assert.Less(t, time.Since(start), 4*time.Second)
+
+	errorCases := []struct {
+		args   []string
+		want   string
+		status int
+	}{
+		{[]string{"1"}, "timeout: usage: timeout duration command [args...]\n", 125},
+		{[]string{"soon", "true"}, "timeout: invalid time interval 'soon'\n", 125},
+		{[]string{"-1", "true"}, "timeout: invalid time interval '-1'\n", 125},
+		{[]string{"1", "no-such-command-gosh"}, "timeout: no-such-command-gosh: exec: \"no-such-command-gosh\": executable file not found in $PATH\n", 127},
+	}
+	for _, tt := range errorCases {
+		var stderr bytes.Buffer
+		status, _ = ExecuteIO("timeout", tt.args, shell.IO{Out: &stdout, Err: &stderr})
+		assert.Equal(t, tt.want, stderr.String(), tt.args)
+		assert.Equal(t, tt.status, status, tt.args)
+	}
+}
@@ -0,0 +1,133 @@
+package dirstack
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+var (
+	// ErrEmpty is returned when popping from a stack with no saved directories
+	ErrEmpty = errors.New("directory stack empty")
+
+	// ErrNoOther is returned when swapping with no saved directory to swap with
+	ErrNoOther = errors.New("no other directory")
+)
+
+// Stack is the directory stack used by pushd, popd and dirs. The top of the
+// stack is always the current directory; Stack stores the directories below
+// it, most recently pushed first.
+type Stack struct {
+	dirs []string
+}
+
+// New creates an empty directory stack
+func New() *Stack {
+	return &Stack{}
+}
+
+// Entries returns the whole stack, starting with the current directory
+func (s *Stack) Entries() ([]string, error) {
+	cwd, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+	return append([]string{cwd}, s.dirs...), nil
+}
+
+// Len returns the number of entries in the stack, including the current
+// directory
+func (s *Stack) Len() int {
+	return len(s.dirs) + 1
+}
+
+// Push changes to dir and pushes the previous directory onto the stack
+func (s *Stack) Push(dir string) error {
+	cwd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	if err := os.Chdir(dir); err != nil {
+		return err
+	}
+	s.dirs = append([]string{cwd}, s.dirs...)
+	return nil
+}
+
+// Pop removes the top of the stack and changes to the directory below it
+func (s *Stack) Pop() error {
+	if len(s.dirs) == 0 {
+		return ErrEmpty
+	}
+	if err := os.Chdir(s.dirs[0]); err != nil {
+		return err
+	}
+	s.dirs = s.dirs[1:]
+	return nil
+}
+
+// Swap exchanges the top two entries, changing to the directory that was
+// second
+func (s *Stack) Swap() error {
+	if len(s.dirs) == 0 {
+		return ErrNoOther
+	}
+	cwd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	if err := os.Chdir(s.dirs[0]); err != nil {
+		return err
+	}
+	s.dirs[0] = cwd
+	return nil
+}
+
+// Rotate rotates the stack so that entry n becomes the top, changing to
+// that directory. Entries above n move to the bottom in order.
+func (s *Stack) Rotate(n int) error {
+	entries, err := s.Entries()
+	if err != nil {
+		return err
+	}
+	if n < 0 || n >= len(entries) {
+		return fmt.Errorf("%d: directory stack index out of range", n)
+	}
+	if n == 0 {
+		return nil
+	}
+
+	rotated := append(entries[n:], entries[:n]...)
+	if err := os.Chdir(rotated[0]); err != nil {
+		return err
+	}
+	s.dirs = rotated[1:]
+	return nil
+}
+
+// Clear removes every entry except the current directory
+func (s *Stack) Clear() {
+	s.dirs = nil
+}
+
+// Index converts a stack position such as "+2" or "-0" into an index from
+// the top of the stack. +N counts from the top, starting at zero, and -N
+// counts from the bottom.
+func (s *Stack) Index(spec string) (int, error) {
+	if len(spec) < 2 || (spec[0] != '+' && spec[0] != '-') {
+		return 0, fmt.Errorf("%s: invalid stack position", spec)
+	}
+	n, err := strconv.Atoi(spec[1:])
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%s: invalid stack position", spec)
+	}
+	if n >= s.Len() {
+		return 0, fmt.Errorf("%s: directory stack index out of range", spec)
+	}
+
+	if spec[0] == '-' {
+		return s.Len() - 1 - n, nil
+	}
+	return n, nil
+}
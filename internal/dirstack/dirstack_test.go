@@ -0,0 +1,106 @@
+package dirstack
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// makeDirs creates the named directories in a temp dir and returns their
+// resolved paths
+func makeDirs(t *testing.T, names ...string) []string {
+	base, err := filepath.EvalSymlinks(t.TempDir())
+	assert.NoError(t, err)
+
+	var dirs []string
+	for _, name := range names {
+		dir := filepath.Join(base, name)
+		assert.NoError(t, os.Mkdir(dir, 0755))
+		dirs = append(dirs, dir)
+	}
+	return dirs
+}
+
+func cwd(t *testing.T) string {
+	dir, err := os.Getwd()
+	assert.NoError(t, err)
+	return dir
+}
+
+func TestPushPop(t *testing.T) {
+	origDir, _ := os.Getwd()
+	defer os.Chdir(origDir)
+	t.Setenv("PWD", "")
+
+	dirs := makeDirs(t, "a", "b")
+	s := New()
+
+	assert.ErrorIs(t, s.Pop(), ErrEmpty)
+	assert.ErrorIs(t, s.Swap(), ErrNoOther)
+
+	assert.NoError(t, s.Push(dirs[0]))
+	assert.NoError(t, s.Push(dirs[1]))
+	entries, _ := s.Entries()
+	assert.Equal(t, []string{dirs[1], dirs[0], origDir}, entries)
+
+	// Swapping exchanges the top two entries
+	assert.NoError(t, s.Swap())
+	assert.Equal(t, dirs[0], cwd(t))
+	entries, _ = s.Entries()
+	assert.Equal(t, []string{dirs[0], dirs[1], origDir}, entries)
+
+	assert.NoError(t, s.Pop())
+	assert.Equal(t, dirs[1], cwd(t))
+	assert.NoError(t, s.Pop())
+	assert.Equal(t, origDir, cwd(t))
+	assert.Equal(t, 1, s.Len())
+
+	// A failed push leaves the stack alone
+	assert.Error(t, s.Push(filepath.Join(dirs[0], "missing")))
+	assert.Equal(t, 1, s.Len())
+}
+
+func TestRotate(t *testing.T) {
+	origDir, _ := os.Getwd()
+	defer os.Chdir(origDir)
+	t.Setenv("PWD", "")
+
+	dirs := makeDirs(t, "a", "b", "c")
+	s := New()
+	assert.NoError(t, os.Chdir(dirs[0]))
+	assert.NoError(t, s.Push(dirs[1]))
+	assert.NoError(t, s.Push(dirs[2]))
+
+	// Stack is c b a; +1 brings b to the top
+	n, err := s.Index("+1")
+	assert.NoError(t, err)
+	assert.NoError(t, s.Rotate(n))
+	assert.Equal(t, dirs[1], cwd(t))
+	entries, _ := s.Entries()
+	assert.Equal(t, []string{dirs[1], dirs[0], dirs[2]}, entries)
+
+	// Stack is b a c; -1 counts from the bottom, so a comes to the top
+	n, err = s.Index("-1")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.NoError(t, s.Rotate(n))
+	assert.Equal(t, dirs[0], cwd(t))
+	entries, _ = s.Entries()
+	assert.Equal(t, []string{dirs[0], dirs[2], dirs[1]}, entries)
+
+	// -0 is the bottom entry
+	n, _ = s.Index("-0")
+	assert.Equal(t, 2, n)
+
+	_, err = s.Index("+3")
+	assert.EqualError(t, err, "+3: directory stack index out of range")
+	_, err = s.Index("+x")
+	assert.EqualError(t, err, "+x: invalid stack position")
+	assert.Error(t, s.Rotate(3))
+
+	s.Clear()
+	assert.Equal(t, 1, s.Len())
+	assert.Equal(t, dirs[0], cwd(t), "clearing keeps the current directory")
+}
@@ -1,15 +1,160 @@
 package executor
 
 import (
+	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 
 	"github.com/apriljarosz/gosh/internal/builtins"
+	"github.com/apriljarosz/gosh/internal/glob"
 	"github.com/apriljarosz/gosh/internal/input"
+	"github.com/apriljarosz/gosh/internal/jobs"
+	"github.com/apriljarosz/gosh/internal/shell"
 )
 
+// Global job manager instance - will be set by main
+var globalJobManager *jobs.JobManager
+
+// SetJobManager sets the job manager that background commands are added to
+func SetJobManager(jm *jobs.JobManager) {
+	globalJobManager = jm
+}
+
+// reportBackgroundJob registers a started background command with the job
+// manager and prints its job number and PID. As with nohup, they go to
+// stderr so they don't end up in redirected output.
+func reportBackgroundJob(execCmd *exec.Cmd, command string) {
+	if globalJobManager == nil {
+		fmt.Fprintf(shell.Stderr(), "[%d] %d\n", 1, execCmd.Process.Pid)
+		return
+	}
+	job := globalJobManager.AddJob(execCmd, command)
+	fmt.Fprintf(shell.Stderr(), "[%d] %d\n", job.ID, job.PID)
+}
+
+// reserveJobSlot waits for room for another background job under
+// GOSH_MAXJOBS, or reports that there is none
+func reserveJobSlot() bool {
+	if globalJobManager == nil {
+		return true
+	}
+	if err := globalJobManager.ReserveSlot(); err != nil {
+		fmt.Fprintf(shell.Stderr(), "gosh: %v (GOSH_MAXJOBS=%s)\n", err, os.Getenv("GOSH_MAXJOBS"))
+		shell.SetExitStatus(1)
+		return false
+	}
+	return true
+}
+
+// reportCommandError prints an error from running a command. Commands that
+// can't be found get a suggestion for a similarly named command, if any. A
+// command that ran and failed has already had its say, and its status is
+// left for $?.
+func reportCommandError(command string, err error) {
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return
+	}
+	if errors.Is(err, exec.ErrNotFound) {
+		if suggestion := suggestCommand(command); suggestion != "" {
+			fmt.Fprintf(shell.Stderr(), "gosh: command not found: %s — did you mean %s?\n", command, suggestion)
+		} else {
+			fmt.Fprintf(shell.Stderr(), "gosh: command not found: %s\n", command)
+		}
+		return
+	}
+	fmt.Fprintf(shell.Stderr(), "gosh: %s: %v\n", command, err)
+}
+
+// suggestCommand returns the builtin or PATH executable closest to name by
+// edit distance, or "" if nothing is close enough to be a likely typo
+func suggestCommand(name string) string {
+	// Allow one edit for short names and two for longer ones
+	threshold := 1
+	if len(name) > 4 {
+		threshold = 2
+	}
+
+	best := ""
+	bestDistance := threshold + 1
+	consider := func(candidate string) {
+		if candidate == name {
+			return
+		}
+		d := editDistance(name, candidate)
+		if d < bestDistance || (d == bestDistance && candidate < best) {
+			best = candidate
+			bestDistance = d
+		}
+	}
+
+	for _, candidate := range builtins.Names() {
+		consider(candidate)
+	}
+	for _, candidate := range pathExecutables() {
+		consider(candidate)
+	}
+
+	return best
+}
+
+// pathExecutables lists the names of executable files in PATH
+func pathExecutables() []string {
+	var names []string
+	for _, dir := range shell.PathDirs(os.Getenv("PATH")) {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			if info, err := entry.Info(); err == nil && !info.IsDir() && info.Mode()&0111 != 0 {
+				names = append(names, entry.Name())
+			}
+		}
+	}
+	return names
+}
+
+// editDistance returns the Levenshtein distance between a and b, counting a
+// transposition of two adjacent characters as a single edit
+func editDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	d := make([][]int, len(ra)+1)
+	for i := range d {
+		d[i] = make([]int, len(rb)+1)
+		d[i][0] = i
+	}
+	for j := range d[0] {
+		d[0][j] = j
+	}
+
+	for i := 1; i <= len(ra); i++ {
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			d[i][j] = min(d[i-1][j]+1, d[i][j-1]+1, d[i-1][j-1]+cost)
+			if i > 1 && j > 1 && ra[i-1] == rb[j-2] && ra[i-2] == rb[j-1] {
+				d[i][j] = min(d[i][j], d[i-2][j-2]+1)
+			}
+		}
+	}
+	return d[len(ra)][len(rb)]
+}
+
 // Execute runs a command with the given arguments
 // Returns false if the shell should exit
 func Execute(args []string) bool {
@@ -25,10 +170,10 @@ func Execute(args []string) bool {
 	}
 
 	// Execute external command
-	cmd := exec.Command(command, args[1:]...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	cmd.Stdin = os.Stdin
+	cmd := shell.Command(command, args[1:]...)
+	cmd.Stdout = shell.Stdout()
+	cmd.Stderr = shell.Stderr()
+	cmd.Stdin = shell.Stdin()
 
 	// Set up process group so Ctrl+C doesn't kill the shell
 	cmd.SysProcAttr = &syscall.SysProcAttr{
@@ -37,90 +182,653 @@ func Execute(args []string) bool {
 
 	err := cmd.Run()
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "gosh: %s: %v\n", command, err)
+		reportCommandError(command, err)
 	}
+	shell.SetExitStatus(shell.CommandStatus(err))
 	return true
 }
 
-// ExecuteCommand runs a parsed command with redirection support
+// RunList runs each command on a command line in turn. Each command is
+// parsed just before it runs, so it sees the effects of the ones before it.
+// Function definitions are recorded rather than run. A pending return,
+// break or continue stops the rest of the line.
 // Returns false if the shell should exit
-func ExecuteCommand(cmd *input.Command) bool {
-	if len(cmd.Args) == 0 {
+func RunList(line string) bool {
+	return runList(line, "")
+}
+
+// runList runs the commands in line as RunList does. When they were read
+// from a file, file is its name, and parse errors give the file and the
+// line the failing command starts on.
+func runList(line, file string) bool {
+	offset := 0
+	for _, segment := range input.SplitList(line) {
+		// Segments come in order, each after the one before
+		start := offset + strings.Index(line[offset:], segment)
+		offset = start + len(segment)
+		reportError := func(err error) {
+			if file == "" {
+				fmt.Fprintf(shell.Stderr(), "gosh: %v\n", err)
+				return
+			}
+			blanks := len(segment) - len(strings.TrimLeft(segment, " \t\n"))
+			lineNumber := 1 + strings.Count(line[:start+blanks], "\n")
+			fmt.Fprintf(shell.Stderr(), "gosh: %s: line %d: %v\n", file, lineNumber, err)
+		}
+		// A syntax error or unset variable ends a script, but not an
+		// interactive shell
+		parseError := func(err error) bool {
+			reportError(err)
+			if errors.Is(err, input.ErrUnboundVariable) {
+				shell.SetExitStatus(1)
+			} else {
+				shell.SetExitStatus(2)
+			}
+			return shell.Interactive()
+		}
+
+		if name, body, ok := input.ParseFunction(segment); ok {
+			shell.DefineFunction(name, body)
+			continue
+		}
+
+		loop, err := input.ParseLoop(segment)
+		if err != nil {
+			return parseError(err)
+		}
+		if loop != nil {
+			if !runLoop(loop) {
+				return false
+			}
+			if control, _ := shell.PendingControl(); control != shell.ControlNone {
+				return true
+			}
+			continue
+		}
+
+		c, err := input.ParseCase(segment)
+		if err != nil {
+			return parseError(err)
+		}
+		if c != nil {
+			if !runCase(c) {
+				return false
+			}
+			if control, _ := shell.PendingControl(); control != shell.ControlNone {
+				return true
+			}
+			continue
+		}
+
+		pipeline, err := input.ParsePipeline(segment)
+		if err != nil {
+			return parseError(err)
+		}
+		if !ExecutePipeline(pipeline) || errexit(pipeline) {
+			return false
+		}
+		if control, _ := shell.PendingControl(); control != shell.ControlNone {
+			return true
+		}
+	}
+	return true
+}
+
+// Number of loop conditions being run. A command failing in a condition
+// doesn't trigger set -e, since it only decides whether the loop goes on.
+var conditionDepth int
+
+// errexit reports whether a script should stop because pipeline failed
+// with set -e on. Failures in loop conditions and negated pipelines don't
+// count, and an interactive shell carries on regardless.
+func errexit(pipeline *input.Pipeline) bool {
+	return !shell.Interactive() && shell.Option("errexit") && shell.ExitStatus() != 0 &&
+		conditionDepth == 0 && !pipeline.Negate && !pipeline.Background
+}
+
+// Substitute runs command for $(command) and returns what it wrote to
+// stdout. Its exit status, or the status given to exit, is left in $?. Like
+// a subshell, it can't change the shell it runs in: exit only ends the
+// substitution, and the variables, functions, aliases and options it sets
+// and any directory change are undone afterwards.
+func Substitute(command string) string {
+	var output bytes.Buffer
+	saved := shell.CurrentIO()
+	shell.SetIO(shell.IO{In: saved.In, Out: &output, Err: saved.Err})
+	defer shell.SetIO(saved)
+	defer shell.EnterSubshell()()
+
+	RunList(command)
+	// A return or break doesn't reach past the substitution either
+	shell.ClearControl()
+	return output.String()
+}
+
+// RunFile runs the commands in the file at path as if they had been typed
+// on one line per line of the file. A command that can't be parsed is
+// reported with the file name and its line number, and stops the file.
+// Returns false if the shell should exit
+func RunFile(path string) (bool, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return true, err
+	}
+	return runList(string(content), path), nil
+}
+
+// Set when SIGINT arrives while a loop is running, so that Ctrl+C stops
+// the loop as well as the command running in it
+var loopInterrupted atomic.Bool
+
+// watchLoopInterrupt notes SIGINT in loopInterrupted until the returned
+// function is called. The shell normally ignores SIGINT, so its usual
+// handling is put back afterwards.
+func watchLoopInterrupt() func() {
+	loopInterrupted.Store(false)
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGINT)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-ch:
+				loopInterrupted.Store(true)
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		signal.Stop(ch)
+		close(done)
+		shell.ReapplyTrap(syscall.SIGINT)
+	}
+}
+
+// runLoop runs a for, while or until loop. A while loop runs its body for
+// as long as its condition succeeds, and an until loop for as long as it
+// fails.
+// Returns false if the shell should exit
+func runLoop(loop *input.Loop) bool {
+	if shell.LoopDepth() == 0 {
+		defer watchLoopInterrupt()()
+	}
+	shell.EnterLoop()
+	defer shell.LeaveLoop()
+
+	if loop.Keyword == "for" {
+		if len(loop.Words) == 0 {
+			shell.SetExitStatus(0)
+		}
+		for _, word := range loop.Words {
+			if err := shell.SetVar(loop.Var, word); err != nil {
+				fmt.Fprintf(shell.Stderr(), "gosh: %v\n", err)
+				return true
+			}
+			if !RunList(loop.Body) {
+				return false
+			}
+			if endIteration() {
+				break
+			}
+		}
 		return true
 	}
 
-	command := cmd.Args[0]
+	// The loop's status is that of the last body run, or zero if the body
+	// never ran
+	status := 0
+	for {
+		conditionDepth++
+		ok := RunList(loop.Condition)
+		conditionDepth--
+		if !ok {
+			return false
+		}
+		if loopInterrupted.Load() || (shell.ExitStatus() == 0) != (loop.Keyword == "while") {
+			break
+		}
+		if !RunList(loop.Body) {
+			return false
+		}
+		status = shell.ExitStatus()
+		if endIteration() {
+			break
+		}
+	}
+	shell.SetExitStatus(status)
+	return true
+}
 
-	// Check if it's a builtin command
-	if builtins.IsBuiltin(command) {
-		return builtins.Execute(command, cmd.Args[1:])
+// endIteration handles a break, continue or return requested by the body
+// of a loop, and reports whether the loop should stop. A break or continue
+// of more than one level is passed on to the enclosing loop. Loops also
+// stop on SIGINT.
+func endIteration() bool {
+	if loopInterrupted.Load() {
+		return true
 	}
 
-	// Execute external command with redirection
-	execCmd := exec.Command(command, cmd.Args[1:]...)
+	control, levels := shell.PendingControl()
+	switch control {
+	case shell.ControlBreak:
+		if levels > 1 {
+			shell.RequestControl(control, levels-1)
+		} else {
+			shell.ClearControl()
+		}
+		return true
+	case shell.ControlContinue:
+		if levels > 1 {
+			shell.RequestControl(control, levels-1)
+			return true
+		}
+		shell.ClearControl()
+	case shell.ControlReturn:
+		return true
+	}
+	return false
+}
 
-	// Set up process group so we can control signal delivery
-	execCmd.SysProcAttr = &syscall.SysProcAttr{
-		Setpgid: true, // Create new process group
+// runCase runs the body of the first clause of a case statement with a
+// pattern matching its word. The status is that of the body, or zero if no
+// pattern matches.
+// Returns false if the shell should exit
+func runCase(c *input.Case) bool {
+	shell.SetExitStatus(0)
+	for _, clause := range c.Clauses {
+		for _, pattern := range clause.Patterns {
+			if glob.Match(pattern, c.Word) {
+				return RunList(clause.Body)
+			}
+		}
+	}
+	return true
+}
+
+// maxFunctionDepth limits how deeply function calls can nest, so runaway
+// recursion is an error rather than a crash
+const maxFunctionDepth = 1000
+
+// runFunction runs the body of a shell function with args as its positional
+// parameters. Redirections apply to everything the body runs.
+// Returns false if the shell should exit
+func runFunction(name, body string, args []string, stdin io.Reader, stdout, stderr io.Writer) bool {
+	if shell.CallDepth() >= maxFunctionDepth {
+		fmt.Fprintf(shell.Stderr(), "gosh: %s: maximum function nesting level exceeded\n", name)
+		return true
+	}
+
+	// Commands in the body use the shell's own streams, so point those at
+	// the redirected ones for the duration of the call
+	saved := shell.CurrentIO()
+	shell.SetIO(shell.IO{In: stdin, Out: stdout, Err: stderr})
+	defer shell.SetIO(saved)
+
+	shell.PushPositional(args)
+	defer shell.PopPositional()
+	if !RunList(body) {
+		return false
+	}
+
+	// return only unwinds as far as the function it was called in
+	if control, _ := shell.PendingControl(); control == shell.ControlReturn {
+		shell.ClearControl()
+	}
+	return true
+}
+
+// ExecuteCommand runs a parsed command with redirection support
+// Returns false if the shell should exit
+func ExecuteCommand(cmd *input.Command) bool {
+	// A line made up only of NAME=value words sets shell variables
+	if len(cmd.Args) == 0 {
+		for _, assignment := range cmd.Assignments {
+			name, value, _ := shell.ParseAssignment(assignment)
+			if err := shell.SetVar(name, value); err != nil {
+				fmt.Fprintf(shell.Stderr(), "gosh: %v\n", err)
+				shell.SetExitStatus(1)
+				return true
+			}
+		}
+		// Their status is that of the last $(command) in them, if any
+		if !cmd.Substituted {
+			shell.SetExitStatus(0)
+		}
+		return true
 	}
 
+	command := cmd.Args[0]
+
 	// Handle input redirection
+	stdin := shell.Stdin()
 	if cmd.InputFile != "" {
-		inputFile, err := os.Open(cmd.InputFile)
+		inputFile, err := openInputFile(cmd.InputFile)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "gosh: %v\n", err)
+			fmt.Fprintf(shell.Stderr(), "gosh: %v\n", err)
+			shell.SetExitStatus(1)
 			return true
 		}
 		defer inputFile.Close()
-		execCmd.Stdin = inputFile
-	} else {
-		execCmd.Stdin = os.Stdin
+		stdin = inputFile
 	}
 
-	// Handle output redirection
+	// Handle output redirection. &> sends stderr to the same file.
+	stdout, stderr := shell.Stdout(), shell.Stderr()
 	if cmd.OutputFile != "" {
-		var outputFile *os.File
-		var err error
-
-		if cmd.AppendOutput {
-			outputFile, err = os.OpenFile(cmd.OutputFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
-		} else {
-			outputFile, err = os.Create(cmd.OutputFile)
-		}
-
+		outputFile, err := openOutputFile(cmd.OutputFile, cmd.AppendOutput)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "gosh: %v\n", err)
+			fmt.Fprintf(shell.Stderr(), "gosh: %v\n", err)
+			shell.SetExitStatus(1)
 			return true
 		}
 		defer outputFile.Close()
-		execCmd.Stdout = outputFile
-	} else {
-		execCmd.Stdout = os.Stdout
+		stdout = outputFile
+		if cmd.StderrToOutput {
+			stderr = outputFile
+		}
+	}
+
+	// Functions take precedence over builtins and external commands
+	if body, ok := shell.LookupFunction(command); ok {
+		restore := applyTempAssignments(cmd.Assignments)
+		defer restore()
+		return runFunction(command, body, cmd.Args[1:], stdin, stdout, stderr)
+	}
+
+	// Check if it's a builtin command
+	if builtins.IsBuiltin(command) {
+		restore := applyTempAssignments(cmd.Assignments)
+		defer restore()
+		status, ok := builtins.ExecuteIO(command, cmd.Args[1:], shell.IO{In: stdin, Out: stdout, Err: stderr})
+		shell.SetExitStatus(status)
+		return ok
+	}
+
+	if !confirmCommand(cmd.Args) {
+		shell.SetExitStatus(1)
+		return true
+	}
+
+	// Execute external command with redirection
+	execCmd := shell.Command(command, cmd.Args[1:]...)
+	execCmd.Env = commandEnv(cmd.Assignments)
+
+	// Set up process group so we can control signal delivery
+	execCmd.SysProcAttr = &syscall.SysProcAttr{
+		Setpgid: true, // Create new process group
 	}
 
-	execCmd.Stderr = os.Stderr
+	execCmd.Stdin = stdin
+	execCmd.Stdout = stdout
+	execCmd.Stderr = stderr
 
 	// Handle background execution
 	var err error
 	if cmd.Background {
+		if !reserveJobSlot() {
+			return true
+		}
 		err = execCmd.Start()
 		if err == nil {
-			fmt.Printf("[%d] %d\n", 1, execCmd.Process.Pid) // Simple job numbering
+			reportBackgroundJob(execCmd, strings.Join(cmd.Args, " "))
 		}
 	} else {
 		err = execCmd.Run()
 	}
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "gosh: %s: %v\n", command, err)
+		reportCommandError(command, err)
 	}
+	shell.SetExitStatus(shell.CommandStatus(err))
 
 	return true
 }
 
-// ExecutePipeline runs a pipeline of commands connected by pipes
+// defaultDangerList holds the commands that GOSH_CONFIRM_RM=1 asks about
+// unless GOSH_DANGER_LIST replaces them: recursive removal of the root
+// directory, a top-level directory, the home directory or the current or
+// parent directory
+var defaultDangerList = []string{
+	"rm -*[rR]* /*",
+	"rm -*[rR]* ~",
+	"rm -*[rR]* $HOME",
+	"rm -*[rR]* .",
+	"rm -*[rR]* ..",
+}
+
+// dangerList returns the patterns for commands that need confirming, from
+// GOSH_DANGER_LIST, separated by colons, if it is set. Variables such as
+// $HOME in them are expanded.
+func dangerList() []string {
+	patterns := defaultDangerList
+	if value := os.Getenv("GOSH_DANGER_LIST"); value != "" {
+		patterns = strings.Split(value, ":")
+	}
+
+	expanded := make([]string, len(patterns))
+	for i, pattern := range patterns {
+		expanded[i] = input.ExpandVariables(pattern)
+	}
+	return expanded
+}
+
+// isDangerous reports whether a command matches one of patterns. Each
+// argument that isn't an option is checked on its own, after the command
+// name and its options, so "rm -v -rf /usr /tmp/x" is checked as both
+// "rm -v -rf /usr" and "rm -v -rf /tmp/x". Paths are cleaned first, and
+// patterns are matched like file names, where * doesn't match a /.
+func isDangerous(args []string, patterns []string) bool {
+	if len(args) == 0 {
+		return false
+	}
+
+	head := []string{filepath.Base(args[0])}
+	var targets []string
+	for _, arg := range args[1:] {
+		if strings.HasPrefix(arg, "-") && len(arg) > 1 {
+			head = append(head, arg)
+		} else {
+			targets = append(targets, filepath.Clean(arg))
+		}
+	}
+	if len(targets) == 0 {
+		targets = []string{""}
+	}
+
+	prefix := strings.Join(head, " ")
+	for _, target := range targets {
+		line := strings.TrimSpace(prefix + " " + target)
+		for _, pattern := range patterns {
+			if matched, _ := filepath.Match(pattern, line); matched {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// openTerminal opens the terminal to read a confirmation from, even when
+// stdin is redirected; replaceable in tests
+var openTerminal = func() (io.ReadCloser, error) {
+	return os.Open("/dev/tty")
+}
+
+// confirmCommand asks before running a dangerous command when
+// GOSH_CONFIRM_RM=1, and reports whether to go ahead. Anything but y or yes
+// cancels the command, as does having no terminal to ask on.
+func confirmCommand(args []string) bool {
+	if os.Getenv("GOSH_CONFIRM_RM") != "1" || !isDangerous(args, dangerList()) {
+		return true
+	}
+
+	tty, err := openTerminal()
+	if err != nil {
+		fmt.Fprintf(shell.Stderr(), "gosh: %s: not run, no terminal to confirm it on\n", strings.Join(args, " "))
+		return false
+	}
+	defer tty.Close()
+
+	fmt.Fprintf(shell.Stderr(), "gosh: really run '%s'? [y/N] ", strings.Join(args, " "))
+	answer, _ := bufio.NewReader(tty).ReadString('\n')
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return true
+	}
+	fmt.Fprintln(shell.Stderr(), "gosh: cancelled")
+	return false
+}
+
+// defaultRedirMode is the mode output redirection files are created with,
+// before the umask is applied
+const defaultRedirMode os.FileMode = 0666
+
+// redirMode returns the mode for files created by output redirection, taken
+// from GOSH_REDIR_MODE (in octal) if it is set and valid. The umask still
+// applies either way.
+func redirMode() os.FileMode {
+	if value := os.Getenv("GOSH_REDIR_MODE"); value != "" {
+		mode, err := strconv.ParseUint(value, 8, 32)
+		if err == nil && mode <= 0777 {
+			return os.FileMode(mode)
+		}
+	}
+	return defaultRedirMode
+}
+
+// openOutputFile opens the target of a > or >> redirection
+func openOutputFile(path string, appendOutput bool) (*os.File, error) {
+	flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	if appendOutput {
+		flags = os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	}
+	return os.OpenFile(path, flags, redirMode())
+}
+
+// openInputFile opens the file for an input redirection. A directory is an
+// error rather than something whose reads fail later, and errors name the
+// file without the operation, as in "in.txt: permission denied".
+func openInputFile(path string) (*os.File, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		var pathErr *os.PathError
+		if errors.As(err, &pathErr) {
+			return nil, fmt.Errorf("%s: %v", path, pathErr.Err)
+		}
+		return nil, err
+	}
+
+	info, err := file.Stat()
+	if err == nil && info.IsDir() {
+		err = fmt.Errorf("%s: Is a directory", path)
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+// commandEnv returns the environment for a child process with the given
+// NAME=value assignments layered on top. A nil result means the child
+// inherits the shell's environment unchanged.
+func commandEnv(assignments []string) []string {
+	if len(assignments) == 0 {
+		return nil
+	}
+	return append(os.Environ(), assignments...)
+}
+
+// applyTempAssignments sets NAME=value assignments in the environment for
+// the duration of a builtin and returns a function that restores the
+// previous values
+func applyTempAssignments(assignments []string) func() {
+	type saved struct {
+		value  string
+		exists bool
+	}
+	previous := make(map[string]saved)
+
+	for _, assignment := range assignments {
+		name, value, _ := shell.ParseAssignment(assignment)
+		if _, done := previous[name]; !done {
+			old, exists := os.LookupEnv(name)
+			previous[name] = saved{old, exists}
+		}
+		os.Setenv(name, value)
+	}
+
+	return func() {
+		for name, prev := range previous {
+			if prev.exists {
+				os.Setenv(name, prev.value)
+			} else {
+				os.Unsetenv(name)
+			}
+		}
+	}
+}
+
+// lockedWriter serializes writes to a writer that several pipeline stages
+// share, since the stages all run at once
+type lockedWriter struct {
+	mutex sync.Mutex
+	w     io.Writer
+}
+
+func (lw *lockedWriter) Write(p []byte) (int, error) {
+	lw.mutex.Lock()
+	defer lw.mutex.Unlock()
+	return lw.w.Write(p)
+}
+
+// sharedWriter returns w ready to be written by several stages at once. A
+// file is handed to child processes as it is; anything else, such as a
+// buffer, is locked.
+func sharedWriter(w io.Writer) io.Writer {
+	if _, ok := w.(*os.File); ok {
+		return w
+	}
+	return &lockedWriter{w: w}
+}
+
+// pipelineStage is one command in a pipeline. External commands run as
+// child processes; builtins run in the shell itself, on their own goroutine.
+type pipelineStage struct {
+	args    []string
+	execCmd *exec.Cmd // nil for a builtin
+	stdin   io.Reader
+	stdout  io.Writer
+	stderr  io.Writer
+	status  int
+}
+
+// runBuiltin runs a builtin stage, recording its exit status
+func (stage *pipelineStage) runBuiltin() {
+	// A builtin such as exit can't end the shell from inside a pipeline
+	stage.status, _ = builtins.ExecuteIO(stage.args[0], stage.args[1:], shell.IO{In: stage.stdin, Out: stage.stdout, Err: stage.stderr})
+}
+
+// ExecutePipeline runs a pipeline of commands connected by pipes. A
+// negated pipeline that runs in the foreground has its exit status
+// inverted once it finishes.
 // Returns false if the shell should exit
 func ExecutePipeline(pipeline *input.Pipeline) bool {
+	if pipeline.Negate && !pipeline.Background {
+		defer func() {
+			if shell.ExitStatus() == 0 {
+				shell.SetExitStatus(1)
+			} else {
+				shell.SetExitStatus(0)
+			}
+		}()
+	}
+
 	if len(pipeline.Commands) == 0 {
+		// On its own, ! negates an empty pipeline, which succeeds
+		if pipeline.Negate {
+			shell.SetExitStatus(0)
+		}
 		return true
 	}
 
@@ -132,7 +840,9 @@ func ExecutePipeline(pipeline *input.Pipeline) bool {
 	}
 
 	// Multiple commands - set up pipes
-	var cmds []*exec.Cmd
+	var stages []*pipelineStage
+	var pipeStderr []bool
+	stderr := sharedWriter(shell.Stderr())
 
 	for i, cmd := range pipeline.Commands {
 		if len(cmd.Args) == 0 {
@@ -140,93 +850,250 @@ func ExecutePipeline(pipeline *input.Pipeline) bool {
 		}
 
 		command := cmd.Args[0]
-
-		// Check if it's a builtin command - builtins can't be piped easily
-		if builtins.IsBuiltin(command) {
-			fmt.Fprintf(os.Stderr, "gosh: cannot pipe builtin command: %s\n", command)
+		if _, ok := shell.LookupFunction(command); ok {
+			fmt.Fprintf(shell.Stderr(), "gosh: cannot pipe function: %s\n", command)
 			return true
 		}
 
-		execCmd := exec.Command(command, cmd.Args[1:]...)
+		stage := &pipelineStage{args: cmd.Args, stdin: shell.Stdin(), stdout: shell.Stdout(), stderr: stderr}
+		if !builtins.IsBuiltin(command) {
+			if !confirmCommand(cmd.Args) {
+				shell.SetExitStatus(1)
+				return true
+			}
+			stage.execCmd = shell.Command(command, cmd.Args[1:]...)
+			stage.execCmd.Env = commandEnv(cmd.Assignments)
 
-		// Set up process group so Ctrl+C doesn't kill the shell
-		execCmd.SysProcAttr = &syscall.SysProcAttr{
-			Setpgid: true, // Create new process group
+			// Set up process group so Ctrl+C doesn't kill the shell
+			stage.execCmd.SysProcAttr = &syscall.SysProcAttr{
+				Setpgid: true, // Create new process group
+			}
 		}
 
 		// Handle input for first command
-		if i == 0 {
-			if cmd.InputFile != "" {
-				inputFile, err := os.Open(cmd.InputFile)
-				if err != nil {
-					fmt.Fprintf(os.Stderr, "gosh: %v\n", err)
-					return true
-				}
-				defer inputFile.Close()
-				execCmd.Stdin = inputFile
-			} else {
-				execCmd.Stdin = os.Stdin
+		if i == 0 && cmd.InputFile != "" {
+			inputFile, err := openInputFile(cmd.InputFile)
+			if err != nil {
+				fmt.Fprintf(shell.Stderr(), "gosh: %v\n", err)
+				shell.SetExitStatus(1)
+				return true
 			}
+			defer inputFile.Close()
+			stage.stdin = inputFile
 		}
 
 		// Handle output for last command
-		if i == len(pipeline.Commands)-1 {
-			if cmd.OutputFile != "" {
-				var outputFile *os.File
-				var err error
-
-				if cmd.AppendOutput {
-					outputFile, err = os.OpenFile(cmd.OutputFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
-				} else {
-					outputFile, err = os.Create(cmd.OutputFile)
-				}
-
-				if err != nil {
-					fmt.Fprintf(os.Stderr, "gosh: %v\n", err)
-					return true
-				}
-				defer outputFile.Close()
-				execCmd.Stdout = outputFile
-			} else {
-				execCmd.Stdout = os.Stdout
+		if i == len(pipeline.Commands)-1 && cmd.OutputFile != "" {
+			outputFile, err := openOutputFile(cmd.OutputFile, cmd.AppendOutput)
+			if err != nil {
+				fmt.Fprintf(shell.Stderr(), "gosh: %v\n", err)
+				shell.SetExitStatus(1)
+				return true
+			}
+			defer outputFile.Close()
+			stage.stdout = outputFile
+			if cmd.StderrToOutput {
+				stage.stderr = outputFile
 			}
 		}
 
-		execCmd.Stderr = os.Stderr
-		cmds = append(cmds, execCmd)
+		stages = append(stages, stage)
+		pipeStderr = append(pipeStderr, cmd.PipeStderr)
 	}
 
-	// Connect pipes between commands
-	for i := 0; i < len(cmds)-1; i++ {
-		pipe, err := cmds[i].StdoutPipe()
+	last := stages[len(stages)-1]
+	if pipeline.Background && last.execCmd == nil {
+		fmt.Fprintf(shell.Stderr(), "gosh: cannot run builtin in the background: %s\n", last.args[0])
+		return true
+	}
+	if pipeline.Background && !reserveJobSlot() {
+		return true
+	}
+
+	// Connect commands with pipes. Each child is handed its end of the pipe
+	// directly, so data flows between them without passing through the shell.
+	// childEnds[i] holds the shell's copies of the pipe ends given to
+	// stages[i].
+	childEnds := make([][]*os.File, len(stages))
+	for i := 0; i < len(stages)-1; i++ {
+		r, w, err := os.Pipe()
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "gosh: %v\n", err)
+			for _, ends := range childEnds {
+				closeFiles(ends)
+			}
+			fmt.Fprintf(shell.Stderr(), "gosh: %v\n", err)
 			return true
 		}
-		cmds[i+1].Stdin = pipe
+		stages[i].stdout = w
+		if pipeStderr[i] {
+			stages[i].stderr = w
+		}
+		stages[i+1].stdin = r
+		childEnds[i] = append(childEnds[i], w)
+		childEnds[i+1] = append(childEnds[i+1], r)
 	}
 
-	// Start all commands
-	for _, cmd := range cmds {
-		err := cmd.Start()
+	// Start all commands. Pipes are created close-on-exec, so each child
+	// only inherits the ends it was given. Once a child has started, the
+	// shell's copies of its ends are closed straight away: a write end left
+	// open in the shell would stop the next stage from ever seeing EOF.
+	// Builtins use the shell's copies, which are closed when they finish.
+	var builtinsDone sync.WaitGroup
+	for i, stage := range stages {
+		if stage.execCmd == nil {
+			if tty := terminalInput(stage.stdin); tty != nil {
+				stage.stdin = tty
+				childEnds[i] = append(childEnds[i], tty)
+			}
+			builtinsDone.Add(1)
+			go func(stage *pipelineStage, ends []*os.File) {
+				defer builtinsDone.Done()
+				stage.runBuiltin()
+				closeFiles(ends)
+			}(stage, childEnds[i])
+			continue
+		}
+
+		stage.execCmd.Stdin = stage.stdin
+		stage.execCmd.Stdout = stage.stdout
+		stage.execCmd.Stderr = stage.stderr
+		err := stage.execCmd.Start()
+		closeFiles(childEnds[i])
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "gosh: %v\n", err)
+			// Closing the remaining pipes lets the commands already started
+			// finish
+			for _, ends := range childEnds[i+1:] {
+				closeFiles(ends)
+			}
+			for _, started := range stages[:i] {
+				if started.execCmd != nil {
+					started.execCmd.Wait()
+				}
+			}
+			builtinsDone.Wait()
+			reportCommandError(stage.args[0], err)
+			shell.SetExitStatus(shell.CommandStatus(err))
 			return true
 		}
 	}
 
 	// Handle background execution
 	if pipeline.Background {
-		fmt.Printf("[%d] %d\n", 1, cmds[len(cmds)-1].Process.Pid)
+		var parts []string
+		for _, cmd := range pipeline.Commands {
+			parts = append(parts, strings.Join(cmd.Args, " "))
+		}
+		reportBackgroundJob(last.execCmd, strings.Join(parts, " | "))
+		shell.SetExitStatus(0)
 		return true
 	}
 
-	// Wait for all commands to complete
-	for _, cmd := range cmds {
-		err := cmd.Wait()
+	// Wait for all commands to complete. The pipeline's status is that of
+	// the last command, or 130 if it was interrupted.
+	stopWatching := killPipelineOnInterrupt(stages)
+	for _, stage := range stages {
+		if stage.execCmd == nil {
+			continue
+		}
+		err := stage.execCmd.Wait()
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "gosh: %v\n", err)
+			reportCommandError(stage.args[0], err)
 		}
+		stage.status = shell.CommandStatus(err)
+	}
+	builtinsDone.Wait()
+	if stopWatching() {
+		shell.SetExitStatus(128 + int(syscall.SIGINT))
+		return true
 	}
+	shell.SetExitStatus(last.status)
 	return true
 }
+
+// How long the commands in an interrupted pipeline get to exit after
+// SIGINT before they are killed
+var pipelineKillDelay = time.Second
+
+// killPipelineOnInterrupt tears down the pipeline's commands if SIGINT
+// arrives before the returned function is called. Each command runs in
+// its own process group, out of reach of the terminal's Ctrl+C, so SIGINT
+// is passed on to every group, and any group still running
+// pipelineKillDelay later is sent SIGKILL. The commands are left for the
+// caller to reap. The returned function reports whether the pipeline was
+// interrupted. Builtins run in the shell, so instead their reads are cut
+// short, and they see the end of their input.
+func killPipelineOnInterrupt(stages []*pipelineStage) func() bool {
+	var groups []int
+	var inputs []*os.File
+	for _, stage := range stages {
+		if stage.execCmd != nil && stage.execCmd.Process != nil {
+			groups = append(groups, stage.execCmd.Process.Pid)
+		}
+		if file, ok := stage.stdin.(*os.File); ok && stage.execCmd == nil {
+			inputs = append(inputs, file)
+		}
+	}
+
+	var interrupted atomic.Bool
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGINT)
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		select {
+		case <-ch:
+		case <-done:
+			return
+		}
+
+		interrupted.Store(true)
+		for _, pgid := range groups {
+			syscall.Kill(-pgid, syscall.SIGINT)
+		}
+		for _, file := range inputs {
+			file.SetReadDeadline(time.Now())
+		}
+		select {
+		case <-time.After(pipelineKillDelay):
+		case <-done:
+			return
+		}
+		for _, pgid := range groups {
+			syscall.Kill(-pgid, syscall.SIGKILL)
+		}
+	}()
+
+	return func() bool {
+		signal.Stop(ch)
+		close(done)
+		<-finished
+		for _, file := range inputs {
+			file.SetReadDeadline(time.Time{})
+		}
+		shell.ReapplyTrap(syscall.SIGINT)
+		return interrupted.Load()
+	}
+}
+
+// terminalInput opens the terminal for a builtin stage that reads it, or
+// returns nil if in isn't a terminal. Unlike the shell's own stdin, the
+// handle can be waited on, so its reads can be cut short on interrupt.
+func terminalInput(in io.Reader) *os.File {
+	file, ok := in.(*os.File)
+	if !ok || !input.IsTerminal(file) {
+		return nil
+	}
+	tty, err := os.Open("/dev/tty")
+	if err != nil {
+		return nil
+	}
+	return tty
+}
+
+// closeFiles closes each of files, ignoring errors
+func closeFiles(files []*os.File) {
+	for _, f := range files {
+		f.Close()
+	}
+}
@@ -0,0 +1,947 @@
+package executor
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/apriljarosz/gosh/internal/input"
+	"github.com/apriljarosz/gosh/internal/jobs"
+	"github.com/apriljarosz/gosh/internal/shell"
+	"github.com/stretchr/testify/assert"
+)
+
+// parseCommand parses line, failing the test if it doesn't parse
+func parseCommand(t *testing.T, line string) *input.Command {
+	cmd, err := input.ParseCommand(line)
+	assert.NoError(t, err)
+	return cmd
+}
+
+// parsePipeline parses line, failing the test if it doesn't parse
+func parsePipeline(t *testing.T, line string) *input.Pipeline {
+	pipeline, err := input.ParsePipeline(line)
+	assert.NoError(t, err)
+	return pipeline
+}
+
+func TestExecuteCommandAssignmentOnly(t *testing.T) {
+	defer shell.UnsetVar("GOSH_ASSIGN_ONLY")
+
+	result := ExecuteCommand(parseCommand(t, "GOSH_ASSIGN_ONLY=bar"))
+
+	assert.True(t, result)
+	assert.Equal(t, "bar", shell.GetVar("GOSH_ASSIGN_ONLY"))
+	assert.True(t, shell.IsLocal("GOSH_ASSIGN_ONLY"), "plain assignment should not be exported")
+}
+
+func TestExecuteCommandPrefixAssignment(t *testing.T) {
+	outFile := filepath.Join(t.TempDir(), "out.txt")
+
+	result := ExecuteCommand(parseCommand(t, "GOSH_PREFIX_VAR=child printenv GOSH_PREFIX_VAR > "+outFile))
+	assert.True(t, result)
+
+	content, err := os.ReadFile(outFile)
+	assert.NoError(t, err)
+	assert.Equal(t, "child\n", string(content))
+
+	// The assignment only applies to the command's environment
+	_, ok := shell.LookupVar("GOSH_PREFIX_VAR")
+	assert.False(t, ok, "prefix assignment should not persist in the shell")
+}
+
+func TestExecutePipelinePrefixAssignment(t *testing.T) {
+	outFile := filepath.Join(t.TempDir(), "out.txt")
+
+	pipeline := parsePipeline(t, "GOSH_PIPE_VAR=piped printenv GOSH_PIPE_VAR | cat > "+outFile)
+	result := ExecutePipeline(pipeline)
+	assert.True(t, result)
+
+	content, err := os.ReadFile(outFile)
+	assert.NoError(t, err)
+	assert.Equal(t, "piped\n", string(content))
+
+	_, ok := shell.LookupVar("GOSH_PIPE_VAR")
+	assert.False(t, ok)
+}
+
+func TestExecutePipelineBuiltinStatus(t *testing.T) {
+	outFile := filepath.Join(t.TempDir(), "out.txt")
+
+	// Builtin stages run at the same time; each keeps its own status, and
+	// the pipeline's is the last one's
+	for i := 0; i < 20; i++ {
+		ExecutePipeline(parsePipeline(t, "seq 3 | grep nothing"))
+		assert.Equal(t, 1, shell.ExitStatus())
+		ExecutePipeline(parsePipeline(t, "grep nothing /dev/null | seq 3 > "+outFile))
+		assert.Equal(t, 0, shell.ExitStatus())
+	}
+}
+
+func TestEditDistance(t *testing.T) {
+	tests := []struct {
+		a, b     string
+		expected int
+	}{
+		{"git", "git", 0},
+		{"gti", "git", 1},
+		{"gi", "git", 1},
+		{"gitt", "git", 1},
+		{"got", "git", 1},
+		{"", "abc", 3},
+		{"kitten", "sitting", 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.a+"/"+tt.b, func(t *testing.T) {
+			assert.Equal(t, tt.expected, editDistance(tt.a, tt.b))
+		})
+	}
+}
+
+func TestSuggestCommand(t *testing.T) {
+	binDir := t.TempDir()
+	for _, name := range []string{"git", "grep", "python3"} {
+		os.WriteFile(filepath.Join(binDir, name), []byte("#!/bin/sh\n"), 0755)
+	}
+	// Non-executable files aren't suggested
+	os.WriteFile(filepath.Join(binDir, "notes"), nil, 0644)
+	t.Setenv("PATH", binDir)
+
+	tests := []struct {
+		name     string
+		expected string
+	}{
+		{"gti", "git"},
+		{"grpe", "grep"},
+		{"pyhton3", "python3"},
+		{"hisotry", "history"},
+		{"pdw", "pwd"},
+		{"note", ""},
+		{"xyzzyplugh", ""},
+		{"completelydifferent", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, suggestCommand(tt.name))
+		})
+	}
+}
+
+func TestExecutePipelineLargeOutput(t *testing.T) {
+	outFile := filepath.Join(t.TempDir(), "count.txt")
+
+	done := make(chan bool)
+	go func() {
+		done <- ExecutePipeline(parsePipeline(t, "yes | head -c 10485760 | wc -c > "+outFile))
+	}()
+
+	select {
+	case result := <-done:
+		assert.True(t, result)
+	case <-time.After(10 * time.Second):
+		t.Fatal("pipeline did not finish")
+	}
+
+	content, err := os.ReadFile(outFile)
+	assert.NoError(t, err)
+	assert.Equal(t, "10485760", strings.TrimSpace(string(content)))
+}
+
+func TestExecutePipelineEarlyExit(t *testing.T) {
+	// Count the test process's open descriptors to catch leaked pipe ends
+	openFDs := func() int {
+		entries, err := os.ReadDir("/dev/fd")
+		assert.NoError(t, err)
+		return len(entries)
+	}
+	before := openFDs()
+
+	outFile := filepath.Join(t.TempDir(), "count.txt")
+
+	// The first stage exits immediately; the later stages must see EOF
+	done := make(chan bool)
+	go func() {
+		done <- ExecutePipeline(parsePipeline(t, "true | cat | wc -c > "+outFile))
+	}()
+
+	select {
+	case result := <-done:
+		assert.True(t, result)
+	case <-time.After(5 * time.Second):
+		t.Fatal("pipeline did not see EOF")
+	}
+
+	content, err := os.ReadFile(outFile)
+	assert.NoError(t, err)
+	assert.Equal(t, "0", strings.TrimSpace(string(content)))
+	assert.Equal(t, before, openFDs())
+}
+
+func TestRedirectionExpansion(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("GOSH_OUT_DIR", dir)
+	t.Setenv("HOME", dir)
+
+	assert.True(t, RunList("echo hi > $GOSH_OUT_DIR/out.txt; echo there >> ~/out.txt"))
+	content, err := os.ReadFile(filepath.Join(dir, "out.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, "hi\nthere\n", string(content))
+	assert.NoFileExists(t, "$GOSH_OUT_DIR/out.txt")
+}
+
+func TestInputRedirectionErrors(t *testing.T) {
+	dir := t.TempDir()
+	marker := filepath.Join(dir, "ran")
+
+	_, err := openInputFile(dir)
+	assert.EqualError(t, err, dir+": Is a directory")
+	_, err = openInputFile(filepath.Join(dir, "missing"))
+	assert.EqualError(t, err, filepath.Join(dir, "missing")+": no such file or directory")
+
+	// The command isn't started when its input can't be opened
+	assert.True(t, ExecuteCommand(parseCommand(t, "touch "+marker+" < "+dir)))
+	assert.Equal(t, 1, shell.ExitStatus())
+	assert.True(t, ExecutePipeline(parsePipeline(t, "touch "+marker+" < "+dir+" | cat")))
+	assert.Equal(t, 1, shell.ExitStatus())
+	assert.NoFileExists(t, marker)
+
+	// Root can read anything, so permissions can only be checked as others
+	if os.Geteuid() != 0 {
+		unreadable := filepath.Join(dir, "secret")
+		assert.NoError(t, os.WriteFile(unreadable, []byte("x"), 0))
+		_, err = openInputFile(unreadable)
+		assert.EqualError(t, err, unreadable+": permission denied")
+		assert.True(t, ExecuteCommand(parseCommand(t, "touch "+marker+" < "+unreadable)))
+		assert.NoFileExists(t, marker)
+	}
+}
+
+func TestIsDangerous(t *testing.T) {
+	t.Setenv("HOME", "/home/gosh")
+	patterns := dangerList()
+
+	dangerous := []string{
+		"rm -rf /",
+		"rm -r /usr/",
+		"/bin/rm -fr //",
+		"rm -v -R /etc",
+		"rm --recursive /",
+		"rm -rf /tmp/x /home",
+		"rm -rf /home/gosh",
+		"rm -rf ~",
+		"rm -rf .",
+		"rm -rf ../",
+	}
+	for _, line := range dangerous {
+		assert.True(t, isDangerous(strings.Fields(line), patterns), line)
+	}
+
+	safe := []string{
+		"rm -rf /tmp/build",
+		"rm -f /etc",
+		"rm /",
+		"rm -rf build",
+		"rm -rf /home/gosh/project",
+		"ls -R /",
+		"rm",
+	}
+	for _, line := range safe {
+		assert.False(t, isDangerous(strings.Fields(line), patterns), line)
+	}
+
+	// The list can be replaced
+	t.Setenv("GOSH_DANGER_LIST", "chmod -R /*:shutdown*")
+	patterns = dangerList()
+	assert.True(t, isDangerous([]string{"chmod", "-R", "777", "/"}, patterns))
+	assert.True(t, isDangerous([]string{"shutdown", "-h", "now"}, patterns))
+	assert.False(t, isDangerous([]string{"rm", "-rf", "/"}, patterns))
+}
+
+func TestConfirmCommand(t *testing.T) {
+	dir := t.TempDir()
+	victim := filepath.Join(dir, "victim")
+	t.Setenv("GOSH_DANGER_LIST", "rm -*[rR]* "+dir+"/*")
+
+	answer := ""
+	asked := 0
+	origOpen := openTerminal
+	defer func() { openTerminal = origOpen }()
+	openTerminal = func() (io.ReadCloser, error) {
+		asked++
+		return io.NopCloser(strings.NewReader(answer)), nil
+	}
+
+	// Off by default
+	assert.True(t, confirmCommand([]string{"rm", "-rf", victim}))
+	assert.Equal(t, 0, asked)
+
+	t.Setenv("GOSH_CONFIRM_RM", "1")
+
+	// Cancelling leaves the command unrun
+	assert.NoError(t, os.Mkdir(victim, 0755))
+	answer = "n\n"
+	assert.True(t, ExecuteCommand(parseCommand(t, "rm -rf "+victim)))
+	assert.Equal(t, 1, shell.ExitStatus())
+	assert.DirExists(t, victim)
+	answer = "\n"
+	assert.True(t, ExecutePipeline(parsePipeline(t, "rm -rf "+victim+" | cat")))
+	assert.DirExists(t, victim)
+
+	// Confirming runs it
+	answer = "y\n"
+	assert.True(t, ExecuteCommand(parseCommand(t, "rm -rf "+victim)))
+	assert.Equal(t, 0, shell.ExitStatus())
+	assert.NoDirExists(t, victim)
+	assert.Equal(t, 3, asked)
+
+	// Safe commands aren't asked about
+	assert.True(t, confirmCommand([]string{"rm", "-f", victim}))
+	assert.Equal(t, 3, asked)
+}
+
+func TestRedirectionFileMode(t *testing.T) {
+	oldMask := syscall.Umask(027)
+	defer syscall.Umask(oldMask)
+
+	dir := t.TempDir()
+	fileMode := func(name string) os.FileMode {
+		info, err := os.Stat(filepath.Join(dir, name))
+		assert.NoError(t, err)
+		return info.Mode().Perm()
+	}
+
+	// 0666 masked by the umask
+	ExecuteCommand(parseCommand(t, "echo hi > "+filepath.Join(dir, "umask.txt")))
+	assert.Equal(t, os.FileMode(0640), fileMode("umask.txt"))
+
+	ExecuteCommand(parseCommand(t, "echo hi >> "+filepath.Join(dir, "append.txt")))
+	assert.Equal(t, os.FileMode(0640), fileMode("append.txt"))
+
+	ExecutePipeline(parsePipeline(t, "echo hi | cat > "+filepath.Join(dir, "pipe.txt")))
+	assert.Equal(t, os.FileMode(0640), fileMode("pipe.txt"))
+
+	// The override is masked too
+	t.Setenv("GOSH_REDIR_MODE", "600")
+	ExecuteCommand(parseCommand(t, "echo hi > "+filepath.Join(dir, "override.txt")))
+	assert.Equal(t, os.FileMode(0600), fileMode("override.txt"))
+
+	t.Setenv("GOSH_REDIR_MODE", "666")
+	ExecuteCommand(parseCommand(t, "echo hi > "+filepath.Join(dir, "masked.txt")))
+	assert.Equal(t, os.FileMode(0640), fileMode("masked.txt"))
+
+	// Invalid overrides fall back to the default
+	t.Setenv("GOSH_REDIR_MODE", "bogus")
+	assert.Equal(t, os.FileMode(0666), redirMode())
+}
+
+func TestRedirectBoth(t *testing.T) {
+	logFile := filepath.Join(t.TempDir(), "all.log")
+
+	ExecuteCommand(parseCommand(t, "sh -c 'echo out; echo err >&2' &> "+logFile))
+	content, err := os.ReadFile(logFile)
+	assert.NoError(t, err)
+	assert.Equal(t, "out\nerr\n", string(content))
+
+	ExecuteCommand(parseCommand(t, "cd /nonexistent &>> "+logFile))
+	ExecutePipeline(parsePipeline(t, "echo piped | sh -c 'cat; echo err >&2' &>> "+logFile))
+	content, err = os.ReadFile(logFile)
+	assert.NoError(t, err)
+	assert.Equal(t, "out\nerr\ncd: chdir /nonexistent: no such file or directory\npiped\nerr\n", string(content))
+}
+
+func TestBackgroundJobReport(t *testing.T) {
+	oldJobManager := globalJobManager
+	defer SetJobManager(oldJobManager)
+	jm := jobs.NewJobManager()
+	SetJobManager(jm)
+
+	// Files rather than buffers, so the job writes to them directly
+	dir := t.TempDir()
+	stdout, err := os.Create(filepath.Join(dir, "stdout"))
+	assert.NoError(t, err)
+	defer stdout.Close()
+	stderr, err := os.Create(filepath.Join(dir, "stderr"))
+	assert.NoError(t, err)
+	defer stderr.Close()
+	saved := shell.CurrentIO()
+	defer shell.SetIO(saved)
+	shell.SetIO(shell.IO{Out: stdout, Err: stderr})
+
+	assert.True(t, RunList("sleep 0.1 &"))
+	job := jm.GetJob(1)
+	if assert.NotNil(t, job) {
+		content, err := os.ReadFile(stderr.Name())
+		assert.NoError(t, err)
+		assert.Equal(t, fmt.Sprintf("[1] %d\n", job.PID), string(content))
+	}
+	content, err := os.ReadFile(stdout.Name())
+	assert.NoError(t, err)
+	assert.Empty(t, string(content))
+}
+
+func TestOutputRedirectionFailure(t *testing.T) {
+	defer shell.SetInteractive(true)
+	defer shell.SetOption("errexit", false)
+	defer shell.SetExitStatus(0)
+
+	var stdout, stderr bytes.Buffer
+	saved := shell.CurrentIO()
+	defer shell.SetIO(saved)
+	shell.SetIO(shell.IO{Out: &stdout, Err: &stderr})
+	missing := filepath.Join(t.TempDir(), "missing", "out.txt")
+
+	// A file that can't be opened fails the command, alone or in a pipeline
+	assert.True(t, RunList("echo hi > "+missing+"; echo $?"))
+	assert.Equal(t, "1\n", stdout.String())
+	assert.Contains(t, stderr.String(), "no such file or directory")
+
+	stdout.Reset()
+	assert.True(t, RunList("echo hi | cat > "+missing+"; echo $?"))
+	assert.Equal(t, "1\n", stdout.String())
+
+	// So set -e stops a script there
+	stdout.Reset()
+	shell.SetInteractive(false)
+	shell.SetOption("errexit", true)
+	assert.False(t, RunList("echo hi > "+missing+"; echo after"))
+	assert.Empty(t, stdout.String())
+	assert.Equal(t, 1, shell.ExitStatus())
+}
+
+func TestBuiltinRedirection(t *testing.T) {
+	dir := t.TempDir()
+
+	// Anything that reaches the real stdout ends up here
+	terminal, err := os.CreateTemp(dir, "terminal")
+	assert.NoError(t, err)
+	defer terminal.Close()
+	oldStdout := os.Stdout
+	os.Stdout = terminal
+	defer func() { os.Stdout = oldStdout }()
+
+	pwdFile := filepath.Join(dir, "pwd.txt")
+	assert.True(t, ExecuteCommand(parseCommand(t, "pwd > "+pwdFile)))
+
+	t.Setenv("GOSH_REDIRECT_TEST", "redirected")
+	envFile := filepath.Join(dir, "env.txt")
+	assert.True(t, ExecuteCommand(parseCommand(t, "env GOSH_REDIRECT_TEST > "+envFile)))
+	assert.True(t, ExecuteCommand(parseCommand(t, "env GOSH_REDIRECT_TEST >> "+envFile)))
+
+	cwd, _ := os.Getwd()
+	content, err := os.ReadFile(pwdFile)
+	assert.NoError(t, err)
+	assert.Equal(t, cwd+"\n", string(content))
+
+	content, err = os.ReadFile(envFile)
+	assert.NoError(t, err)
+	assert.Equal(t, "GOSH_REDIRECT_TEST=redirected\nGOSH_REDIRECT_TEST=redirected\n", string(content))
+
+	shown, err := os.ReadFile(terminal.Name())
+	assert.NoError(t, err)
+	assert.Empty(t, shown)
+}
+
+func TestBuiltinInputRedirection(t *testing.T) {
+	defer shell.UnsetVar("GOSH_READ_X")
+
+	inFile := filepath.Join(t.TempDir(), "in.txt")
+	assert.NoError(t, os.WriteFile(inFile, []byte("first line\nsecond line\n"), 0644))
+
+	assert.True(t, ExecuteCommand(parseCommand(t, "read GOSH_READ_X < "+inFile)))
+	assert.Equal(t, "first line", shell.GetVar("GOSH_READ_X"))
+}
+
+func TestFunctions(t *testing.T) {
+	defer shell.UnsetFunction("greet")
+	defer shell.UnsetFunction("twice")
+	defer shell.UnsetFunction("forever")
+	dir := t.TempDir()
+	outFile := filepath.Join(dir, "out.txt")
+
+	// Define and call on the same line, with arguments
+	assert.True(t, RunList("greet() { echo hello $1; }; greet world > "+outFile))
+	content, err := os.ReadFile(outFile)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello world\n", string(content))
+
+	// Functions can call other functions, and redirection covers the body
+	assert.True(t, RunList("twice() {\n greet $1\n greet $2\n}"))
+	assert.True(t, RunList("twice a b > "+outFile))
+	content, _ = os.ReadFile(outFile)
+	assert.Equal(t, "hello a\nhello b\n", string(content))
+
+	// Runaway recursion stops with an error instead of crashing
+	assert.True(t, RunList("forever() { forever; }; forever"))
+}
+
+func TestReturn(t *testing.T) {
+	defer shell.UnsetFunction("check")
+	defer shell.SetExitStatus(0)
+	dir := t.TempDir()
+	outFile := filepath.Join(dir, "out.txt")
+
+	// return stops the function early with the given status, and the shell
+	// carries on with the rest of the line
+	assert.True(t, RunList("check() { echo before; return 3; echo after; }"))
+	assert.True(t, RunList("check > "+outFile+"; echo $? >> "+outFile))
+	content, err := os.ReadFile(outFile)
+	assert.NoError(t, err)
+	assert.Equal(t, "before\n3\n", string(content))
+	control, _ := shell.PendingControl()
+	assert.Equal(t, shell.ControlNone, control)
+
+	// Without a status, the function returns that of the last command
+	assert.True(t, RunList("check() { false; return; }; check"))
+	assert.Equal(t, 1, shell.ExitStatus())
+
+	// Outside a function, return is an error rather than exiting the shell
+	assert.True(t, RunList("return 5"))
+	assert.Equal(t, 1, shell.ExitStatus())
+}
+
+func TestBreakContinue(t *testing.T) {
+	defer shell.UnsetVar("i")
+	defer shell.UnsetVar("j")
+	dir := t.TempDir()
+	outFile := filepath.Join(dir, "out.txt")
+	output := func() string {
+		content, err := os.ReadFile(outFile)
+		assert.NoError(t, err)
+		return string(content)
+	}
+
+	// break leaves the loop early
+	assert.True(t, RunList("for i in 1 2 3 4; do\n echo $i >> "+outFile+"\n break\ndone"))
+	assert.Equal(t, "1\n", output())
+	os.Remove(outFile)
+
+	// continue skips the rest of the body for that word
+	assert.True(t, RunList("for i in 1 2 3; do continue; echo $i >> "+outFile+"; done; echo end >> "+outFile))
+	assert.Equal(t, "end\n", output())
+	os.Remove(outFile)
+
+	// With a count, break and continue apply to enclosing loops
+	assert.True(t, RunList("for i in 1 2; do for j in a b; do echo $i$j >> "+outFile+"; continue 2; done; done"))
+	assert.Equal(t, "1a\n2a\n", output())
+	os.Remove(outFile)
+
+	assert.True(t, RunList("for i in 1 2; do for j in a b; do echo $i$j >> "+outFile+"; break 2; done; done"))
+	assert.Equal(t, "1a\n", output())
+
+	control, _ := shell.PendingControl()
+	assert.Equal(t, shell.ControlNone, control)
+	assert.Equal(t, 0, shell.LoopDepth())
+
+	// Outside a loop, break is an error
+	assert.True(t, RunList("break"))
+	assert.Equal(t, 1, shell.ExitStatus())
+}
+
+func TestWhileUntil(t *testing.T) {
+	defer shell.UnsetVar("n")
+	dir := t.TempDir()
+	outFile := filepath.Join(dir, "out.txt")
+	output := func() string {
+		content, err := os.ReadFile(outFile)
+		assert.NoError(t, err)
+		return string(content)
+	}
+
+	// The counter grows by one x per iteration, and test checks its length
+	assert.True(t, RunList("n=x; while test $n != xxxx; do echo $n >> "+outFile+"; n=${n}x; done"))
+	assert.Equal(t, "x\nxx\nxxx\n", output())
+	assert.Equal(t, 0, shell.ExitStatus())
+	os.Remove(outFile)
+
+	assert.True(t, RunList("n=\nuntil test \"$n\" = xx\ndo\n  n=${n}x\n  echo $n >> "+outFile+"\ndone"))
+	assert.Equal(t, "x\nxx\n", output())
+	os.Remove(outFile)
+
+	// A condition that fails straight away never runs the body
+	assert.True(t, RunList("while false; do echo never >> "+outFile+"; done"))
+	assert.NoFileExists(t, outFile)
+
+	// break ends an otherwise endless loop
+	assert.True(t, RunList("n=; while true; do n=${n}x; test $n = xxx; until test $? != 0; do break 2; done; done"))
+	assert.Equal(t, "xxx", shell.GetVar("n"))
+	assert.Equal(t, 0, shell.LoopDepth())
+}
+
+func TestCase(t *testing.T) {
+	defer shell.UnsetVar("branch")
+	run := func(word string) string {
+		shell.UnsetVar("branch")
+		assert.True(t, RunList("case "+word+" in\n  a*|b) branch=ab;;\n  '*') branch=star;;\n  *) branch=default\nesac"))
+		return shell.GetVar("branch")
+	}
+
+	assert.Equal(t, "ab", run("apple"))
+	assert.Equal(t, "ab", run("b"))
+	assert.Equal(t, "star", run("'*'"))
+	assert.Equal(t, "default", run("c"))
+
+	// Only the first matching branch runs, and its status is the case's
+	assert.True(t, RunList("case x in x) branch=first; false;; x) branch=second;; esac"))
+	assert.Equal(t, "first", shell.GetVar("branch"))
+	assert.Equal(t, 1, shell.ExitStatus())
+
+	// No match is a success
+	assert.True(t, RunList("false; case x in y) branch=y;; esac"))
+	assert.Equal(t, 0, shell.ExitStatus())
+
+	// break in a branch ends the loop around the case
+	assert.True(t, RunList("branch=; for i in a b c; do case $i in b) break;; esac; branch=$branch$i; done"))
+	assert.Equal(t, "a", shell.GetVar("branch"))
+}
+
+func TestRunFile(t *testing.T) {
+	dir := t.TempDir()
+	sentinel := filepath.Join(dir, "logged-out")
+	logout := filepath.Join(dir, ".gosh_logout")
+	assert.NoError(t, os.WriteFile(logout, []byte("GOSH_LOGOUT_NAME=sentinel\ntouch "+sentinel+"\n"), 0644))
+	defer shell.UnsetVar("GOSH_LOGOUT_NAME")
+
+	ok, err := RunFile(logout)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.FileExists(t, sentinel)
+	assert.Equal(t, "sentinel", shell.GetVar("GOSH_LOGOUT_NAME"))
+
+	_, err = RunFile(filepath.Join(dir, "missing"))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestRunFileErrorLine(t *testing.T) {
+	var stderr bytes.Buffer
+	saved := shell.CurrentIO()
+	defer shell.SetIO(saved)
+	shell.SetIO(shell.IO{Err: &stderr})
+	defer shell.UnsetVar("GOSH_RC_REACHED")
+
+	dir := t.TempDir()
+	rc := filepath.Join(dir, ".goshrc")
+	content := "cd .\nGOSH_RC_REACHED=1\n\nfor i in 1 2\ndo\n  true\ndone\n  echo oops |\nGOSH_RC_REACHED=2\n"
+	assert.NoError(t, os.WriteFile(rc, []byte(content), 0644))
+
+	// The error names the file and line, and the rest of the file is skipped
+	ok, err := RunFile(rc)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "gosh: "+rc+": line 8: syntax error near unexpected token '|'\n", stderr.String())
+	assert.Equal(t, "1", shell.GetVar("GOSH_RC_REACHED"))
+
+	// Commands typed at the prompt have no line number
+	stderr.Reset()
+	assert.True(t, RunList("echo oops |"))
+	assert.Equal(t, "gosh: syntax error near unexpected token '|'\n", stderr.String())
+}
+
+func TestScriptMode(t *testing.T) {
+	defer shell.SetInteractive(true)
+	defer shell.SetOption("errexit", false)
+	defer shell.SetExitStatus(0)
+
+	var stdout, stderr bytes.Buffer
+	saved := shell.CurrentIO()
+	defer shell.SetIO(saved)
+	shell.SetIO(shell.IO{Out: &stdout, Err: &stderr})
+	run := func(line string) bool {
+		stdout.Reset()
+		stderr.Reset()
+		return RunList(line)
+	}
+
+	// Interactively, the shell carries on after a syntax error or a
+	// failure, even with set -e
+	assert.True(t, run("echo a; echo oops >"))
+	assert.Equal(t, "a\n", stdout.String())
+	assert.Equal(t, 2, shell.ExitStatus())
+	shell.SetOption("errexit", true)
+	assert.True(t, run("false; echo after"))
+	assert.Equal(t, "after\n", stdout.String())
+
+	// A script stops at a syntax error
+	shell.SetInteractive(false)
+	shell.SetOption("errexit", false)
+	assert.False(t, run("echo a; echo oops >; echo after"))
+	assert.Equal(t, "a\n", stdout.String())
+	assert.Equal(t, "gosh: syntax error near unexpected token 'newline'\n", stderr.String())
+	assert.Equal(t, 2, shell.ExitStatus())
+
+	// Without set -e failures don't stop it, and with it they do
+	assert.True(t, run("false; echo after"))
+	assert.Equal(t, "after\n", stdout.String())
+	shell.SetOption("errexit", true)
+	assert.False(t, run("echo a; false; echo after"))
+	assert.Equal(t, "a\n", stdout.String())
+	assert.Equal(t, 1, shell.ExitStatus())
+
+	// Loop conditions and negated pipelines don't count as failures
+	assert.True(t, run("while false\ndo\n  echo loop\ndone; ! true; echo after"))
+	assert.Equal(t, "after\n", stdout.String())
+	// With set -u, an unset variable stops the script too
+	shell.SetOption("errexit", false)
+	shell.SetOption("nounset", true)
+	defer shell.SetOption("nounset", false)
+	os.Unsetenv("GOSH_UNDEFINED")
+	assert.False(t, run("echo a; echo $GOSH_UNDEFINED; echo after"))
+	assert.Equal(t, "a\n", stdout.String())
+	assert.Equal(t, "gosh: GOSH_UNDEFINED: unbound variable\n", stderr.String())
+	assert.Equal(t, 1, shell.ExitStatus())
+}
+
+func TestShellIO(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	saved := shell.CurrentIO()
+	defer shell.SetIO(saved)
+	shell.SetIO(shell.IO{In: strings.NewReader("from stdin\n"), Out: &stdout, Err: &stderr})
+	defer shell.UnsetFunction("greet")
+
+	// Builtins, external commands, pipelines and functions all use the
+	// shell's streams
+	assert.True(t, RunList("pwd"))
+	assert.True(t, RunList("cat"))
+	assert.True(t, RunList("sh -c 'echo out; echo err >&2'"))
+	assert.True(t, RunList("echo piped | tr a-z A-Z"))
+	assert.True(t, RunList("greet() { echo hello $1; }; greet world"))
+	assert.True(t, RunList("gosh-no-such-command"))
+	cwd, _ := os.Getwd()
+	assert.Equal(t, cwd+"\nfrom stdin\nout\nPIPED\nhello world\n", stdout.String())
+	assert.Equal(t, "err\ngosh: command not found: gosh-no-such-command\n", stderr.String())
+
+	// Redirecting a function's output leaves the shell's streams as they were
+	file := filepath.Join(t.TempDir(), "out")
+	stdout.Reset()
+	assert.True(t, RunList("greet there > "+file+"; greet again"))
+	content, _ := os.ReadFile(file)
+	assert.Equal(t, "hello there\n", string(content))
+	assert.Equal(t, "hello again\n", stdout.String())
+}
+
+func TestQuotedWhitespace(t *testing.T) {
+	var stdout bytes.Buffer
+	saved := shell.CurrentIO()
+	defer shell.SetIO(saved)
+	shell.SetIO(shell.IO{Out: &stdout})
+
+	// Commands get quoted blanks exactly as they were typed, whether they
+	// run on their own or in a pipeline
+	assert.True(t, RunList("printf '[%s]' \"a    b\" '\tc\t\td ' \"  \""))
+	assert.True(t, RunList("printf '[%s]' ' x  y ' | cat"))
+	assert.True(t, RunList("echo \"e  \t f\""))
+	assert.Equal(t, "[a    b][\tc\t\td ][  ][ x  y ]e  \t f\n", stdout.String())
+}
+
+func TestSubstitutionStatus(t *testing.T) {
+	input.SetCommandSubstitution(Substitute)
+	defer input.SetCommandSubstitution(nil)
+	defer shell.UnsetVar("x")
+
+	var stdout bytes.Buffer
+	saved := shell.CurrentIO()
+	defer shell.SetIO(saved)
+	shell.SetIO(shell.IO{Out: &stdout})
+
+	// An assignment takes the status of its substitution
+	assert.True(t, RunList("x=$(false)"))
+	assert.Equal(t, 1, shell.ExitStatus())
+	assert.True(t, RunList("false; x=$(echo ok)"))
+	assert.Equal(t, 0, shell.ExitStatus())
+	assert.Equal(t, "ok", shell.GetVar("x"))
+	assert.True(t, RunList("x=$(sh -c 'exit 3')"))
+	assert.Equal(t, 3, shell.ExitStatus())
+
+	// Without one it succeeds, and a command's own status wins
+	assert.True(t, RunList("false; x=plain"))
+	assert.Equal(t, 0, shell.ExitStatus())
+	assert.True(t, RunList("true $(false)"))
+	assert.Equal(t, 0, shell.ExitStatus())
+
+	// The output is captured, with trailing newlines dropped
+	assert.True(t, RunList("x=$(printf 'a\\nb\\n\\n' | sort -r)"))
+	assert.Equal(t, "b\na", shell.GetVar("x"))
+	assert.Empty(t, stdout.String())
+}
+
+func TestSubstitutionIsolated(t *testing.T) {
+	input.SetCommandSubstitution(Substitute)
+	defer input.SetCommandSubstitution(nil)
+	defer shell.UnsetVar("x")
+	defer shell.UnsetVar("inner")
+
+	var stdout bytes.Buffer
+	saved := shell.CurrentIO()
+	defer shell.SetIO(saved)
+	shell.SetIO(shell.IO{Out: &stdout})
+
+	dir := t.TempDir()
+	t.Chdir(dir)
+	t.Setenv("GOSH_SUBST_EXPORTED", "before")
+
+	// Directory changes and variables stay inside
+	assert.True(t, RunList("x=$(cd /; pwd; inner=set; export GOSH_SUBST_EXPORTED=after)"))
+	assert.Equal(t, "/", shell.GetVar("x"))
+	cwd, _ := os.Getwd()
+	assert.Equal(t, dir, cwd)
+	_, ok := shell.LookupVar("inner")
+	assert.False(t, ok)
+	assert.Equal(t, "before", os.Getenv("GOSH_SUBST_EXPORTED"))
+
+	// exit ends only the substitution, with its status
+	assert.True(t, RunList("x=$(echo out; exit 3; echo not run)"))
+	assert.Equal(t, 3, shell.ExitStatus())
+	assert.Equal(t, "out", shell.GetVar("x"))
+	assert.Empty(t, stdout.String())
+}
+
+func TestNegatedPipeline(t *testing.T) {
+	defer shell.UnsetVar("ran")
+
+	assert.True(t, RunList("! true"))
+	assert.Equal(t, 1, shell.ExitStatus())
+
+	assert.True(t, RunList("! false"))
+	assert.Equal(t, 0, shell.ExitStatus())
+
+	// Any failing status becomes 0, and only the last stage's status counts
+	assert.True(t, RunList("! sh -c 'exit 3'"))
+	assert.Equal(t, 0, shell.ExitStatus())
+	assert.True(t, RunList("! false | true"))
+	assert.Equal(t, 1, shell.ExitStatus())
+	assert.True(t, RunList("! true | false"))
+	assert.Equal(t, 0, shell.ExitStatus())
+
+	assert.True(t, RunList("! ! false"))
+	assert.Equal(t, 1, shell.ExitStatus())
+	assert.True(t, RunList("false; !"))
+	assert.Equal(t, 1, shell.ExitStatus())
+
+	// The negation applies to one pipeline, not the rest of the line
+	assert.True(t, RunList("! true; true"))
+	assert.Equal(t, 0, shell.ExitStatus())
+
+	// A negated condition runs the loop until the command succeeds
+	assert.True(t, RunList("ran=; while ! test \"$ran\" = xxx; do ran=x$ran; done"))
+	assert.Equal(t, "xxx", shell.GetVar("ran"))
+}
+
+func TestPipelineInterrupt(t *testing.T) {
+	// The shell ignores SIGINT, and puts that back after watching for it
+	signal.Ignore(syscall.SIGINT)
+	defer signal.Reset(syscall.SIGINT)
+	shell.SetTrapHook(func(sig syscall.Signal) { signal.Ignore(sig) })
+	defer shell.SetTrapHook(nil)
+
+	pipelineKillDelay = 100 * time.Millisecond
+	defer func() { pipelineKillDelay = time.Second }()
+
+	// The middle stage ignores SIGINT, so it has to be killed. cat only sees
+	// EOF once the sleep started by sh has gone too.
+	pipeline, err := input.ParsePipeline("sleep 30 | sh -c \"trap '' INT; sleep 30\" | cat")
+	assert.NoError(t, err)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ExecutePipeline(pipeline)
+	}()
+
+	time.Sleep(200 * time.Millisecond)
+	syscall.Kill(os.Getpid(), syscall.SIGINT)
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("pipeline still running after SIGINT")
+	}
+	assert.Equal(t, 130, shell.ExitStatus())
+
+	// The shell goes on running commands afterwards
+	assert.True(t, RunList("true | true"))
+	assert.Equal(t, 0, shell.ExitStatus())
+}
+
+func TestPipelineInterruptBuiltins(t *testing.T) {
+	signal.Ignore(syscall.SIGINT)
+	defer signal.Reset(syscall.SIGINT)
+	shell.SetTrapHook(func(sig syscall.Signal) { signal.Ignore(sig) })
+	defer shell.SetTrapHook(nil)
+
+	// Both stages are builtins, and the first waits on input that never
+	// comes, as cat does on the terminal
+	r, w, err := os.Pipe()
+	assert.NoError(t, err)
+	defer r.Close()
+	defer w.Close()
+	var stderr bytes.Buffer
+	saved := shell.CurrentIO()
+	defer shell.SetIO(saved)
+	shell.SetIO(shell.IO{In: r, Out: io.Discard, Err: &stderr})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ExecutePipeline(parsePipeline(t, "cat | grep x"))
+	}()
+
+	time.Sleep(200 * time.Millisecond)
+	syscall.Kill(os.Getpid(), syscall.SIGINT)
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("pipeline still running after SIGINT")
+	}
+	assert.Equal(t, 130, shell.ExitStatus())
+	assert.Empty(t, stderr.String())
+
+	// The shell's input can still be read afterwards
+	w.WriteString("more\n")
+	line := make([]byte, 5)
+	_, err = io.ReadFull(r, line)
+	assert.NoError(t, err)
+	assert.Equal(t, "more\n", string(line))
+}
+
+func TestBuiltinInPipeline(t *testing.T) {
+	dir := t.TempDir()
+	logFile := filepath.Join(dir, "log.txt")
+	outFile := filepath.Join(dir, "out.txt")
+
+	// tee passes its input on down the pipeline as well as saving it
+	assert.True(t, RunList("printf 'b\\na\\n' | tee "+logFile+" | sort > "+outFile))
+	content, err := os.ReadFile(logFile)
+	assert.NoError(t, err)
+	assert.Equal(t, "b\na\n", string(content))
+	content, err = os.ReadFile(outFile)
+	assert.NoError(t, err)
+	assert.Equal(t, "a\nb\n", string(content))
+
+	// |& sends stderr down the pipe too
+	assert.True(t, RunList("sh -c 'echo out; echo err >&2' |& tee "+logFile+" > "+outFile))
+	content, _ = os.ReadFile(logFile)
+	assert.ElementsMatch(t, []string{"out", "err"}, strings.Fields(string(content)))
+
+	// The pipeline's status is that of its last command
+	assert.True(t, RunList("echo x | tee | false"))
+	assert.Equal(t, 1, shell.ExitStatus())
+}
+
+func TestSeqInPipeline(t *testing.T) {
+	outFile := filepath.Join(t.TempDir(), "out.txt")
+
+	// seq stops early when the reader goes away instead of counting on
+	assert.True(t, RunList("seq 1000000000 | head -n 2 > "+outFile))
+	content, err := os.ReadFile(outFile)
+	assert.NoError(t, err)
+	assert.Equal(t, "1\n2\n", string(content))
+}
@@ -0,0 +1,270 @@
+package glob
+
+import (
+	"os"
+	"sort"
+	"strings"
+)
+
+// Match reports whether name matches the shell pattern. Patterns support
+// '*' (any sequence), '?' (any single character), bracket expressions such
+// as [abc], [a-z] and [!0-9], and backslash escapes. Unlike filepath.Match,
+// '*' and '?' also match '/', which is what string matching in parameter
+// expansion and similar contexts needs.
+func Match(pattern, name string) bool {
+	return match([]rune(pattern), []rune(name))
+}
+
+// HasMeta reports whether the pattern contains any unescaped special
+// characters
+func HasMeta(pattern string) bool {
+	escaped := false
+	for _, c := range pattern {
+		switch {
+		case escaped:
+			escaped = false
+		case c == '\\':
+			escaped = true
+		case c == '*' || c == '?' || c == '[':
+			return true
+		}
+	}
+	return false
+}
+
+// Options control how Expand matches file names
+type Options struct {
+	// NullGlob makes a pattern that matches nothing expand to no words
+	NullGlob bool
+	// DotGlob lets wildcards match names that start with '.'
+	DotGlob bool
+}
+
+// Expand returns the sorted paths matching pattern. Each '/'-separated
+// component is matched against directory entries, and names starting with
+// '.' only match when the component itself starts with '.' or DotGlob is
+// set. If nothing matches, Expand returns nil; it's up to the caller to keep
+// the word literal unless NullGlob is set.
+func Expand(pattern string, opts Options) []string {
+	if pattern == "" {
+		return nil
+	}
+
+	// Start from the root for absolute patterns, otherwise from "."
+	paths := []string{""}
+	components := strings.Split(pattern, "/")
+	if components[0] == "" {
+		paths = []string{"/"}
+		components = components[1:]
+	}
+
+	for i, component := range components {
+		last := i == len(components)-1
+		if component == "" {
+			// Repeated or trailing slashes
+			if last {
+				paths = withSuffix(paths, "/")
+			}
+			continue
+		}
+
+		var next []string
+		for _, dir := range paths {
+			if !HasMeta(component) {
+				path := dir + Unescape(component)
+				if _, err := os.Lstat(path); err == nil {
+					next = append(next, path)
+				}
+			} else {
+				next = append(next, matchDir(dir, component, opts)...)
+			}
+		}
+		if len(next) == 0 {
+			return nil
+		}
+
+		paths = next
+		if !last {
+			// Only directories can have more components after them
+			paths = withSuffix(onlyDirs(paths), "/")
+			if len(paths) == 0 {
+				return nil
+			}
+		}
+	}
+
+	sort.Strings(paths)
+	return paths
+}
+
+// matchDir returns the entries of dir matching the pattern component,
+// prefixed with dir
+func matchDir(dir, component string, opts Options) []string {
+	readFrom := dir
+	if readFrom == "" {
+		readFrom = "."
+	}
+	entries, err := os.ReadDir(readFrom)
+	if err != nil {
+		return nil
+	}
+
+	hiddenOK := opts.DotGlob || strings.HasPrefix(component, ".")
+	var matches []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasPrefix(name, ".") && !hiddenOK {
+			continue
+		}
+		if Match(component, name) {
+			matches = append(matches, dir+name)
+		}
+	}
+	return matches
+}
+
+// onlyDirs filters paths down to those that are directories
+func onlyDirs(paths []string) []string {
+	var dirs []string
+	for _, path := range paths {
+		if info, err := os.Stat(path); err == nil && info.IsDir() {
+			dirs = append(dirs, path)
+		}
+	}
+	return dirs
+}
+
+// withSuffix appends suffix to each path that doesn't already end with it
+func withSuffix(paths []string, suffix string) []string {
+	for i, path := range paths {
+		if !strings.HasSuffix(path, suffix) {
+			paths[i] = path + suffix
+		}
+	}
+	return paths
+}
+
+// Unescape removes the backslashes that escape characters in a pattern
+func Unescape(pattern string) string {
+	if !strings.Contains(pattern, "\\") {
+		return pattern
+	}
+	var b strings.Builder
+	for i := 0; i < len(pattern); i++ {
+		if pattern[i] == '\\' && i+1 < len(pattern) {
+			i++
+		}
+		b.WriteByte(pattern[i])
+	}
+	return b.String()
+}
+
+// Escape backslash-escapes the special characters in s so that it matches
+// only itself
+func Escape(s string) string {
+	var b strings.Builder
+	for _, c := range s {
+		if strings.ContainsRune("*?[\\", c) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+func match(p, s []rune) bool {
+	for len(p) > 0 {
+		switch p[0] {
+		case '*':
+			// Consecutive stars behave like a single one
+			for len(p) > 0 && p[0] == '*' {
+				p = p[1:]
+			}
+			if len(p) == 0 {
+				return true
+			}
+			for i := 0; i <= len(s); i++ {
+				if match(p, s[i:]) {
+					return true
+				}
+			}
+			return false
+
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+
+		case '[':
+			if len(s) == 0 {
+				return false
+			}
+			matched, rest, ok := matchClass(p, s[0])
+			if ok {
+				if !matched {
+					return false
+				}
+				p = rest
+				s = s[1:]
+				continue
+			}
+			// An unterminated bracket matches itself literally
+			if s[0] != '[' {
+				return false
+			}
+
+		case '\\':
+			if len(p) > 1 {
+				p = p[1:]
+			}
+			fallthrough
+
+		default:
+			if len(s) == 0 || s[0] != p[0] {
+				return false
+			}
+		}
+
+		p = p[1:]
+		s = s[1:]
+	}
+
+	return len(s) == 0
+}
+
+// matchClass matches c against the bracket expression at the start of p.
+// It returns whether c matched, the pattern remaining after the closing
+// bracket, and ok=false if the bracket expression is unterminated.
+func matchClass(p []rune, c rune) (matched bool, rest []rune, ok bool) {
+	i := 1
+	negate := false
+	if i < len(p) && (p[i] == '!' || p[i] == '^') {
+		negate = true
+		i++
+	}
+
+	first := true
+	for i < len(p) {
+		if p[i] == ']' && !first {
+			return matched != negate, p[i+1:], true
+		}
+		first = false
+
+		lo := p[i]
+		if lo == '\\' && i+1 < len(p) {
+			i++
+			lo = p[i]
+		}
+		hi := lo
+		if i+2 < len(p) && p[i+1] == '-' && p[i+2] != ']' {
+			hi = p[i+2]
+			i += 2
+		}
+		if lo <= c && c <= hi {
+			matched = true
+		}
+		i++
+	}
+
+	return false, nil, false
+}
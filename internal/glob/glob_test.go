@@ -0,0 +1,100 @@
+package glob
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		pattern  string
+		name     string
+		expected bool
+	}{
+		{"*.txt", "notes.txt", true},
+		{"*.txt", "notes.md", false},
+		{"*", "", true},
+		{"*", "dir/file", true},
+		{"*/", "dir/", true},
+		{"a*b*c", "aXXbYYc", true},
+		{"a*b*c", "aXXbYY", false},
+		{"?", "a", true},
+		{"?", "", false},
+		{"??", "ab", true},
+		{"file?.go", "file1.go", true},
+		{"[abc]", "b", true},
+		{"[abc]", "d", false},
+		{"[a-z]x", "qx", true},
+		{"[!a-z]", "Q", true},
+		{"[!a-z]", "q", false},
+		{"[^0-9]", "5", false},
+		{"[]]", "]", true},
+		{"[", "[", true},
+		{"[abc", "[abc", true},
+		{`\*`, "*", true},
+		{`\*`, "x", false},
+		{"literal", "literal", true},
+		{"literal", "literals", false},
+		{"", "", true},
+		{"", "x", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.pattern+"~"+tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, Match(tt.pattern, tt.name))
+		})
+	}
+}
+
+func TestHasMeta(t *testing.T) {
+	assert.True(t, HasMeta("*.go"))
+	assert.True(t, HasMeta("file?"))
+	assert.True(t, HasMeta("[ab]"))
+	assert.False(t, HasMeta("plain.txt"))
+	assert.False(t, HasMeta(`\*.go`))
+}
+
+func TestExpand(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a.go", "b.go", ".hidden.go", "notes.txt", "sub/c.go", "sub/.d.go"} {
+		path := filepath.Join(dir, name)
+		assert.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		assert.NoError(t, os.WriteFile(path, nil, 0644))
+	}
+
+	origDir, _ := os.Getwd()
+	defer os.Chdir(origDir)
+	os.Chdir(dir)
+
+	tests := []struct {
+		pattern  string
+		opts     Options
+		expected []string
+	}{
+		{"*.go", Options{}, []string{"a.go", "b.go"}},
+		{"*.go", Options{DotGlob: true}, []string{".hidden.go", "a.go", "b.go"}},
+		{".*.go", Options{}, []string{".hidden.go"}},
+		{"*", Options{}, []string{"a.go", "b.go", "notes.txt", "sub"}},
+		{"*/", Options{}, []string{"sub/"}},
+		{"sub/*.go", Options{}, []string{"sub/c.go"}},
+		{"*/*.go", Options{DotGlob: true}, []string{"sub/.d.go", "sub/c.go"}},
+		{"?.go", Options{}, []string{"a.go", "b.go"}},
+		{`\*.go`, Options{}, nil},
+		{"*.xyz", Options{}, nil},
+		{"missing/*", Options{}, nil},
+		{dir + "/[ab].go", Options{}, []string{dir + "/a.go", dir + "/b.go"}},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.expected, Expand(tt.pattern, tt.opts), "pattern %q", tt.pattern)
+	}
+}
+
+func TestEscape(t *testing.T) {
+	assert.Equal(t, `a\*b\?\[c\\`, Escape(`a*b?[c\`))
+	assert.Equal(t, `a*b?[c\`, Unescape(Escape(`a*b?[c\`)))
+	assert.False(t, HasMeta(Escape("*.go")))
+}
@@ -2,15 +2,33 @@ package history
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
+
+	"github.com/apriljarosz/gosh/internal/glob"
+	"github.com/apriljarosz/gosh/internal/shell"
 )
 
 const (
 	maxHistorySize = 1000
 	historyFile    = ".gosh_history"
+
+	// History can contain sensitive commands, so by default only the
+	// owner can read it
+	defaultHistoryFileMode os.FileMode = 0600
+
+	// Lines in the history file longer than this are skipped when loading
+	maxLineLength = 1 << 20
+
+	// How much of the history file before the point it has been read up to
+	// is kept, to tell when the file has been rewritten
+	tailLength = 64
 )
 
 // History manages command history storage and retrieval
@@ -19,6 +37,18 @@ type History struct {
 	currentPos  int
 	maxSize     int
 	historyPath string
+
+	// fileOffset is how much of the history file has been read, so that
+	// AppendFromFile only reads what was added after that. fileTail holds
+	// the bytes just before it and fileInfo the file they were read from,
+	// so that a file rewritten since can be told apart from one added to.
+	fileOffset int64
+	fileTail   []byte
+	fileInfo   os.FileInfo
+
+	// Commands this session has appended to the history file that
+	// AppendFromFile hasn't read back yet
+	appended []string
 }
 
 // New creates a new History instance
@@ -35,17 +65,24 @@ func New() *History {
 		historyPath: filepath.Join(homeDir, historyFile),
 	}
 
-	h.Load()
+	if err := h.Load(); err != nil {
+		fmt.Fprintf(os.Stderr, "gosh: warning: %v\n", err)
+	}
 	return h
 }
 
-// Add adds a command to history
+// Add adds a command to history, unless it matches a pattern in
+// HISTIGNORE
 func (h *History) Add(command string) {
 	command = strings.TrimSpace(command)
-	if command == "" {
+	if command == "" || ignored(command) {
 		return
 	}
 
+	if os.Getenv("GOSH_DIR_HISTORY") == "1" {
+		h.addToDirHistory(command)
+	}
+
 	// Don't add duplicate consecutive commands
 	if len(h.commands) > 0 && h.commands[len(h.commands)-1] == command {
 		h.currentPos = len(h.commands)
@@ -60,6 +97,239 @@ func (h *History) Add(command string) {
 	}
 
 	h.currentPos = len(h.commands)
+
+	if shareHistory() {
+		if err := h.appendToFile(command); err != nil {
+			fmt.Fprintf(os.Stderr, "gosh: warning: %v\n", err)
+		}
+	}
+}
+
+// shareHistory reports whether GOSH_HISTORY_SHARE=1 asks for sessions to
+// share history through the history file
+func shareHistory() bool {
+	return os.Getenv("GOSH_HISTORY_SHARE") == "1"
+}
+
+// appendToFile adds a command to the end of the history file straight
+// away, for the other sessions sharing it to pick up
+func (h *History) appendToFile(command string) error {
+	file, err := os.OpenFile(h.historyPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, historyFileMode())
+	if err != nil {
+		return fmt.Errorf("failed to write to history file: %v", err)
+	}
+	defer file.Close()
+
+	if _, err := file.WriteString(encodeEntry(command) + "\n"); err != nil {
+		return fmt.Errorf("failed to write to history file: %v", err)
+	}
+	h.appended = append(h.appended, command)
+	return nil
+}
+
+// ignored reports whether command matches one of the colon-separated glob
+// patterns in HISTIGNORE, as in bash, or GOSH_HISTIGNORE if that isn't set.
+// Patterns match the whole command line, so "cd *" ignores cd with
+// arguments but "cd" on its own only ignores a bare cd.
+func ignored(command string) bool {
+	patterns, ok := shell.LookupVar("HISTIGNORE")
+	if !ok {
+		patterns = os.Getenv("GOSH_HISTIGNORE")
+	}
+	for _, pattern := range strings.Split(patterns, ":") {
+		if pattern != "" && glob.Match(pattern, command) {
+			return true
+		}
+	}
+	return false
+}
+
+// dirHistoryPath returns the path of the per-directory history file for dir
+func dirHistoryPath(dir string) string {
+	return filepath.Join(dir, historyFile)
+}
+
+// addToDirHistory appends a command to the history file in the current
+// working directory. Errors are ignored since per-directory history is a
+// best-effort addition to the global history.
+func (h *History) addToDirHistory(command string) {
+	cwd, err := os.Getwd()
+	if err != nil {
+		return
+	}
+
+	path := dirHistoryPath(cwd)
+	// In the home directory the per-directory file is the global one
+	if path == h.historyPath {
+		return
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, historyFileMode())
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	file.WriteString(encodeEntry(command) + "\n")
+}
+
+// GetDirHistory returns the commands recorded in the per-directory history
+// file of dir
+func (h *History) GetDirHistory(dir string) ([]string, error) {
+	file, err := os.Open(dirHistoryPath(dir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []string{}, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+
+	commands := make([]string, 0)
+	scanner := bufio.NewScanner(file)
+	commands = scanEntries(scanner, commands)
+	return commands, scanner.Err()
+}
+
+// CommandFrequency counts how many commands in history were run with each
+// command name, the first word of the command
+func (h *History) CommandFrequency() map[string]int {
+	counts := make(map[string]int)
+	for _, command := range h.commands {
+		if fields := strings.Fields(command); len(fields) > 0 {
+			counts[fields[0]]++
+		}
+	}
+	return counts
+}
+
+// Matches returns the commands in history that start with prefix, most
+// recent first. A command run several times is only listed once.
+func (h *History) Matches(prefix string) []string {
+	var matches []string
+	seen := make(map[string]bool)
+	for i := len(h.commands) - 1; i >= 0; i-- {
+		command := h.commands[i]
+		if strings.HasPrefix(command, prefix) && !seen[command] {
+			seen[command] = true
+			matches = append(matches, command)
+		}
+	}
+	return matches
+}
+
+// Suggest returns the most recent command that starts with prefix and is
+// longer than it, or "" if there is none or prefix is empty. Commands
+// spanning several lines aren't suggested.
+func (h *History) Suggest(prefix string) string {
+	if prefix == "" {
+		return ""
+	}
+	for i := len(h.commands) - 1; i >= 0; i-- {
+		command := h.commands[i]
+		if len(command) > len(prefix) && strings.HasPrefix(command, prefix) &&
+			!strings.Contains(command, "\n") {
+			return command
+		}
+	}
+	return ""
+}
+
+// Chooser picks one of several commands matching a !prefix history
+// expansion. The matches are most recent first.
+type Chooser func(matches []string) (string, error)
+
+// Expand performs history expansion on line. !! is replaced by the previous
+// command, !N by command number N, !-N by the Nth previous command and
+// !prefix by the most recent command starting with prefix. When several
+// commands match a prefix, choose picks between them if it isn't nil.
+// Expansion doesn't happen inside single quotes, after a backslash, in a
+// [!...] bracket expression, or when the ! ends the line or is followed by
+// a blank or one of = ( ) ; | & $ < >, as in $! or hi!).
+// expanded reports whether line was changed.
+func (h *History) Expand(line string, choose Chooser) (result string, expanded bool, err error) {
+	var b strings.Builder
+	var quote byte
+
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case c == '\\' && quote != '\'' && i+1 < len(line):
+			b.WriteByte(c)
+			b.WriteByte(line[i+1])
+			i++
+			continue
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote == 0 && (c == '\'' || c == '"'):
+			quote = c
+		case c == '!' && quote != '\'' && i+1 < len(line) && !strings.ContainsRune(" \t\n=()\";|&$<>", rune(line[i+1])) &&
+			(i == 0 || line[i-1] != '['):
+			event := eventDesignator(line[i+1:])
+			if event == "" {
+				break
+			}
+			command, err := h.event(event, choose)
+			if err != nil {
+				return "", false, err
+			}
+			b.WriteString(command)
+			i += len(event)
+			expanded = true
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String(), expanded, nil
+}
+
+// eventDesignator returns the event designator at the start of s, which
+// follows a !
+func eventDesignator(s string) string {
+	if s[0] == '!' {
+		return "!"
+	}
+	end := 0
+	if s[0] == '-' {
+		end = 1
+	}
+	if end < len(s) && s[end] >= '0' && s[end] <= '9' {
+		for end < len(s) && s[end] >= '0' && s[end] <= '9' {
+			end++
+		}
+		return s[:end]
+	}
+
+	end = strings.IndexAny(s, " \t\n;&|()<>'\"")
+	if end < 0 {
+		end = len(s)
+	}
+	return s[:end]
+}
+
+// event looks up the command an event designator refers to
+func (h *History) event(event string, choose Chooser) (string, error) {
+	if event == "!" {
+		event = "-1"
+	}
+	if n, err := strconv.Atoi(event); err == nil {
+		if n < 0 {
+			n += len(h.commands) + 1
+		}
+		if n < 1 || n > len(h.commands) {
+			return "", fmt.Errorf("!%s: event not found", event)
+		}
+		return h.commands[n-1], nil
+	}
+
+	matches := h.Matches(event)
+	switch {
+	case len(matches) == 0:
+		return "", fmt.Errorf("!%s: event not found", event)
+	case len(matches) > 1 && choose != nil:
+		return choose(matches)
+	}
+	return matches[0], nil
 }
 
 // Previous returns the previous command in history
@@ -127,12 +397,10 @@ func (h *History) Load() error {
 	defer file.Close()
 
 	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		if line != "" {
-			h.commands = append(h.commands, line)
-		}
-	}
+	scanner.Buffer(make([]byte, 0, 64*1024), maxLineLength)
+	skipped := 0
+	scanner.Split(skipLongLines(&skipped))
+	h.commands = scanEntries(scanner, h.commands)
 
 	// Trim to max size if needed
 	if len(h.commands) > h.maxSize {
@@ -140,25 +408,261 @@ func (h *History) Load() error {
 	}
 
 	h.currentPos = len(h.commands)
-	return scanner.Err()
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read history file: %v", err)
+	}
+	h.fileOffset, _ = file.Seek(0, io.SeekCurrent)
+	h.fileTail = readTail(file, h.fileOffset)
+	h.fileInfo, _ = file.Stat()
+	if skipped > 0 {
+		return fmt.Errorf("%s: skipped %d line(s) longer than %d bytes", h.historyPath, skipped, maxLineLength)
+	}
+	return nil
 }
 
-// Save saves history to file
-func (h *History) Save() error {
-	file, err := os.Create(h.historyPath)
+// AppendFromFile adds the commands written to the history file since it
+// was last read, by other sessions for instance, and returns them. The
+// commands this session appended itself are left out. Only whole lines are
+// read, so a command still being written is picked up the next time. If
+// the file has been rewritten, by a session saving its history as it
+// exits, what it now holds can't be matched up with what was read before,
+// so reading starts again from its end.
+func (h *History) AppendFromFile() ([]string, error) {
+	file, err := os.Open(h.historyPath)
 	if err != nil {
-		return fmt.Errorf("failed to create history file: %v", err)
+		if os.IsNotExist(err) {
+			h.fileOffset, h.fileTail, h.fileInfo = 0, nil, nil
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read history file: %v", err)
 	}
 	defer file.Close()
 
-	writer := bufio.NewWriter(file)
-	defer writer.Flush()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read history file: %v", err)
+	}
+	rewritten := !bytes.Equal(readTail(file, h.fileOffset), h.fileTail) ||
+		(h.fileInfo != nil && !os.SameFile(info, h.fileInfo))
+	start := h.fileOffset
+	if rewritten {
+		start = 0
+		h.appended = nil
+	}
+	h.fileInfo = info
+
+	data := make([]byte, max(info.Size()-start, 0))
+	n, err := file.ReadAt(data, start)
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("failed to read history file: %v", err)
+	}
+	data = data[:entriesEnd(data[:n])]
+	h.fileOffset = start + int64(len(data))
+	h.fileTail = readTail(file, h.fileOffset)
+	if rewritten {
+		return nil, nil
+	}
 
-	for _, command := range h.commands {
-		if _, err := writer.WriteString(command + "\n"); err != nil {
-			return fmt.Errorf("failed to write to history file: %v", err)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 64*1024), maxLineLength)
+	skipped := 0
+	scanner.Split(skipLongLines(&skipped))
+	var added []string
+	for _, command := range scanEntries(scanner, nil) {
+		// This session's own commands come back in the order it wrote
+		// them, perhaps with other sessions' in between
+		if len(h.appended) > 0 && command == h.appended[0] {
+			h.appended = h.appended[1:]
+			continue
+		}
+		added = append(added, command)
+	}
+
+	h.commands = append(h.commands, added...)
+	if len(h.commands) > h.maxSize {
+		h.commands = h.commands[len(h.commands)-h.maxSize:]
+	}
+	h.currentPos = len(h.commands)
+	return added, nil
+}
+
+// readTail returns up to tailLength bytes of file from just before offset
+func readTail(file *os.File, offset int64) []byte {
+	start := max(offset-tailLength, 0)
+	tail := make([]byte, offset-start)
+	n, _ := file.ReadAt(tail, start)
+	return tail[:n]
+}
+
+// entriesEnd returns the length of the whole entries at the start of data,
+// leaving out a last line with no newline and the lines of a command that
+// continues past the end
+func entriesEnd(data []byte) int {
+	for end := len(data); end > 0; end-- {
+		if data[end-1] != '\n' {
+			continue
+		}
+		if _, continued := decodeLine(string(data[:end-1])); !continued {
+			return end
+		}
+	}
+	return 0
+}
+
+// encodeEntry returns a command as it is written to a history file. Each
+// newline in a command that spans several lines is preceded by a
+// backslash, so that the lines after it are read back as part of it.
+// Backslashes that end a line of the command itself are doubled, so a
+// line ends in an odd number of backslashes only when it is continued.
+func encodeEntry(command string) string {
+	lines := strings.Split(command, "\n")
+	for i, line := range lines {
+		text := strings.TrimRight(line, "\\")
+		lines[i] = text + strings.Repeat("\\", 2*(len(line)-len(text)))
+	}
+	return strings.Join(lines, "\\\n")
+}
+
+// decodeLine undoes encodeEntry for one line of a history file, reporting
+// whether the command continues on the next line
+func decodeLine(line string) (string, bool) {
+	text := strings.TrimRight(line, "\\")
+	count := len(line) - len(text)
+	return text + strings.Repeat("\\", count/2), count%2 == 1
+}
+
+// scanEntries appends the commands in a history file to commands, joining
+// lines that end in an odd number of backslashes to the line after them
+func scanEntries(scanner *bufio.Scanner, commands []string) []string {
+	var pending strings.Builder
+	add := func() {
+		if command := strings.TrimSpace(pending.String()); command != "" {
+			commands = append(commands, command)
 		}
+		pending.Reset()
 	}
 
+	for scanner.Scan() {
+		line, continued := decodeLine(scanner.Text())
+		if continued {
+			pending.WriteString(line + "\n")
+			continue
+		}
+		pending.WriteString(line)
+		add()
+	}
+	add()
+	return commands
+}
+
+// skipLongLines returns a split function like bufio.ScanLines that drops
+// lines longer than maxLineLength, counting them in skipped, rather than
+// failing with bufio.ErrTooLong
+func skipLongLines(skipped *int) bufio.SplitFunc {
+	skipping := false
+	return func(data []byte, atEOF bool) (int, []byte, error) {
+		if skipping {
+			// Throw away the rest of the long line, up to its newline
+			if i := bytes.IndexByte(data, '\n'); i >= 0 {
+				skipping = false
+				return i + 1, nil, nil
+			}
+			return len(data), nil, nil
+		}
+
+		if len(data) >= maxLineLength && bytes.IndexByte(data, '\n') < 0 {
+			skipping = true
+			*skipped++
+			return len(data), nil, nil
+		}
+		return bufio.ScanLines(data, atEOF)
+	}
+}
+
+// historyFileMode returns the permissions for history files, taken from
+// GOSH_HISTFILE_MODE (in octal) if it is set and valid
+func historyFileMode() os.FileMode {
+	if value := os.Getenv("GOSH_HISTFILE_MODE"); value != "" {
+		mode, err := strconv.ParseUint(value, 8, 32)
+		if err == nil && mode <= 0777 {
+			return os.FileMode(mode)
+		}
+	}
+	return defaultHistoryFileMode
+}
+
+// Save saves history to file. The file's mode is reset on every save so
+// that an existing file with looser permissions is tightened. When history
+// is shared, what other sessions have added to the file is merged in first
+// rather than written over.
+func (h *History) Save() error {
+	if shareHistory() {
+		if _, err := h.AppendFromFile(); err != nil {
+			return err
+		}
+	}
+
+	var content bytes.Buffer
+	for _, command := range h.commands {
+		content.WriteString(encodeEntry(command) + "\n")
+	}
+
+	mode := historyFileMode()
+	file, err := os.OpenFile(h.historyPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+	if err != nil {
+		return fmt.Errorf("failed to create history file: %v", err)
+	}
+	defer file.Close()
+
+	if err := file.Chmod(mode); err != nil {
+		return fmt.Errorf("failed to set history file mode: %v", err)
+	}
+	if _, err := file.Write(content.Bytes()); err != nil {
+		return fmt.Errorf("failed to write to history file: %v", err)
+	}
+
+	h.fileOffset = int64(content.Len())
+	h.fileTail = content.Bytes()[max(content.Len()-tailLength, 0):]
+	h.fileInfo, _ = file.Stat()
+	h.appended = nil
 	return nil
 }
+
+// AuditLog mirrors every command the shell runs to a file of its own, with
+// the time it finished and its exit status. Unlike the history file, the
+// log is only ever appended to, and nothing is left out of it.
+type AuditLog struct {
+	path string
+
+	// Where to warn that the log can't be written, which is only done once
+	warnings io.Writer
+	warned   bool
+
+	// now returns the time an entry is recorded at
+	now func() time.Time
+}
+
+// NewAuditLog returns an audit log that appends to the file at path
+func NewAuditLog(path string) *AuditLog {
+	return &AuditLog{path: path, warnings: os.Stderr, now: time.Now}
+}
+
+// Record appends a "timestamp<TAB>status<TAB>command" line for a command
+// that has finished. A command typed over several lines is written the
+// way the history file writes it. If the log can't be written, Record
+// warns the first time and otherwise carries on without it.
+func (a *AuditLog) Record(command string, status int) {
+	entry := fmt.Sprintf("%s\t%d\t%s\n", a.now().Format(time.RFC3339), status, encodeEntry(command))
+
+	file, err := os.OpenFile(a.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, historyFileMode())
+	if err == nil {
+		_, err = file.WriteString(entry)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil && !a.warned {
+		fmt.Fprintf(a.warnings, "gosh: warning: can't write to audit log: %v\n", err)
+		a.warned = true
+	}
+}
@@ -1,9 +1,14 @@
 package history
 
 import (
+	"bytes"
+	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/apriljarosz/gosh/internal/shell"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -114,6 +119,133 @@ func TestHistorySaveLoad(t *testing.T) {
 	assert.Equal(t, 3, h2.Size())
 }
 
+func TestHistoryMultiline(t *testing.T) {
+	historyPath := filepath.Join(t.TempDir(), ".test_history")
+	h1 := &History{maxSize: 10, historyPath: historyPath}
+
+	loop := "for i in 1 2 3\ndo\n  echo $i\ndone"
+	h1.Add("ls")
+	h1.Add(loop)
+	h1.Add("greet() {\n  echo hello\n}")
+	h1.Add("pwd")
+	assert.NoError(t, h1.Save())
+
+	content, err := os.ReadFile(historyPath)
+	assert.NoError(t, err)
+	assert.Equal(t, "ls\nfor i in 1 2 3\\\ndo\\\n  echo $i\\\ndone\ngreet() {\\\n  echo hello\\\n}\npwd\n", string(content))
+
+	h2 := &History{maxSize: 10, historyPath: historyPath}
+	assert.NoError(t, h2.Load())
+	assert.Equal(t, h1.GetAll(), h2.GetAll())
+
+	// Recalling it brings back the whole command
+	h2.Reset()
+	assert.Equal(t, "pwd", h2.Previous())
+	assert.Equal(t, "greet() {\n  echo hello\n}", h2.Previous())
+	assert.Equal(t, loop, h2.Previous())
+
+	// A continuation cut off at the end of the file keeps what there is
+	assert.NoError(t, os.WriteFile(historyPath, []byte("ls\necho a \\\n"), 0600))
+	h3 := &History{maxSize: 10, historyPath: historyPath}
+	assert.NoError(t, h3.Load())
+	assert.Equal(t, []string{"ls", "echo a"}, h3.GetAll())
+}
+
+func TestHistoryTrailingBackslash(t *testing.T) {
+	historyPath := filepath.Join(t.TempDir(), ".test_history")
+	h1 := &History{maxSize: 10, historyPath: historyPath}
+
+	commands := []string{`echo a\`, "ls", `echo b\\`, "echo c\\\nd\\", "pwd"}
+	for _, command := range commands {
+		h1.Add(command)
+	}
+	assert.NoError(t, h1.Save())
+
+	content, err := os.ReadFile(historyPath)
+	assert.NoError(t, err)
+	assert.Equal(t, "echo a\\\\\nls\necho b\\\\\\\\\necho c\\\\\\\nd\\\\\npwd\n", string(content))
+
+	h2 := &History{maxSize: 10, historyPath: historyPath}
+	assert.NoError(t, h2.Load())
+	assert.Equal(t, commands, h2.GetAll())
+
+	// A session reading new entries keeps them apart too
+	file, err := os.OpenFile(historyPath, os.O_WRONLY|os.O_APPEND, 0600)
+	assert.NoError(t, err)
+	file.WriteString(encodeEntry(`cd \\`) + "\n" + encodeEntry("make") + "\n")
+	file.Close()
+	added, err := h2.AppendFromFile()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{`cd \\`, "make"}, added)
+}
+
+func TestAppendFromFile(t *testing.T) {
+	historyPath := filepath.Join(t.TempDir(), ".test_history")
+	assert.NoError(t, os.WriteFile(historyPath, []byte("ls\npwd\n"), 0600))
+
+	h := &History{maxSize: 10, historyPath: historyPath}
+	assert.NoError(t, h.Load())
+	h.Add("make")
+
+	appendToFile := func(content string) {
+		file, err := os.OpenFile(historyPath, os.O_WRONLY|os.O_APPEND, 0600)
+		assert.NoError(t, err)
+		file.WriteString(content)
+		file.Close()
+	}
+
+	// Nothing new yet
+	added, err := h.AppendFromFile()
+	assert.NoError(t, err)
+	assert.Empty(t, added)
+
+	// Another session writes two commands, the second only partly so far
+	appendToFile("git status\nfor i in 1\\\ndo echo $i\\\n")
+	added, err = h.AppendFromFile()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"git status"}, added)
+	assert.Equal(t, []string{"ls", "pwd", "make", "git status"}, h.GetAll())
+	assert.Equal(t, "git status", h.Previous())
+
+	appendToFile("done\n")
+	added, err = h.AppendFromFile()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"for i in 1\ndo echo $i\ndone"}, added)
+	assert.Equal(t, 5, h.Size())
+
+	// A file rewritten shorter is read from its new end
+	assert.NoError(t, os.WriteFile(historyPath, []byte("ls\n"), 0600))
+	added, err = h.AppendFromFile()
+	assert.NoError(t, err)
+	assert.Empty(t, added)
+	appendToFile("whoami\n")
+	added, err = h.AppendFromFile()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"whoami"}, added)
+
+	// Without a file there is nothing to add
+	assert.NoError(t, os.Remove(historyPath))
+	added, err = h.AppendFromFile()
+	assert.NoError(t, err)
+	assert.Empty(t, added)
+}
+
+func TestHistoryLoadLongLines(t *testing.T) {
+	historyPath := filepath.Join(t.TempDir(), ".test_history")
+
+	// A line well beyond the default bufio.Scanner limit is still loaded,
+	// while one over the hard cap is skipped, in the middle or at the end
+	long := "echo " + strings.Repeat("a", 100*1024)
+	tooLong := strings.Repeat("x", maxLineLength+10)
+	content := "ls\n" + long + "\n" + tooLong + "\npwd\n" + tooLong
+	assert.NoError(t, os.WriteFile(historyPath, []byte(content), 0600))
+
+	h := &History{maxSize: 10, historyPath: historyPath}
+	err := h.Load()
+	assert.EqualError(t, err, historyPath+": skipped 2 line(s) longer than 1048576 bytes")
+	assert.Equal(t, []string{"ls", long, "pwd"}, h.GetAll())
+}
+
 func TestHistoryEmpty(t *testing.T) {
 	h := &History{
 		commands:   make([]string, 0),
@@ -152,3 +284,305 @@ func TestHistoryAddEmpty(t *testing.T) {
 	assert.Equal(t, 0, h.Size())
 	assert.Equal(t, []string{}, h.GetAll())
 }
+
+func TestDirHistory(t *testing.T) {
+	t.Setenv("GOSH_DIR_HISTORY", "1")
+
+	originalDir, _ := os.Getwd()
+	defer os.Chdir(originalDir)
+
+	h := &History{
+		commands:    make([]string, 0),
+		currentPos:  0,
+		maxSize:     10,
+		historyPath: filepath.Join(t.TempDir(), ".test_history"),
+	}
+
+	dirA := t.TempDir()
+	dirB := t.TempDir()
+
+	os.Chdir(dirA)
+	h.Add("make build")
+	h.Add("make test")
+
+	os.Chdir(dirB)
+	h.Add("go test ./...")
+
+	// The global history has everything
+	assert.Equal(t, []string{"make build", "make test", "go test ./..."}, h.GetAll())
+
+	// Each directory only has its own commands
+	cmdsA, err := h.GetDirHistory(dirA)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"make build", "make test"}, cmdsA)
+
+	cmdsB, err := h.GetDirHistory(dirB)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"go test ./..."}, cmdsB)
+
+	content, err := os.ReadFile(filepath.Join(dirA, historyFile))
+	assert.NoError(t, err)
+	assert.Equal(t, "make build\nmake test\n", string(content))
+}
+
+func TestDirHistoryDisabled(t *testing.T) {
+	t.Setenv("GOSH_DIR_HISTORY", "")
+
+	originalDir, _ := os.Getwd()
+	defer os.Chdir(originalDir)
+
+	dir := t.TempDir()
+	os.Chdir(dir)
+
+	h := &History{
+		commands: make([]string, 0),
+		maxSize:  10,
+	}
+	h.Add("echo hello")
+
+	assert.NoFileExists(t, filepath.Join(dir, historyFile))
+
+	cmds, err := h.GetDirHistory(dir)
+	assert.NoError(t, err)
+	assert.Empty(t, cmds)
+}
+
+func TestHistorySaveMode(t *testing.T) {
+	newHistory := func(path string) *History {
+		h := &History{
+			commands:    make([]string, 0),
+			maxSize:     10,
+			historyPath: path,
+		}
+		h.Add("echo secret")
+		return h
+	}
+
+	t.Run("default", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), ".test_history")
+		assert.NoError(t, newHistory(path).Save())
+
+		info, err := os.Stat(path)
+		assert.NoError(t, err)
+		assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	})
+
+	t.Run("existing file is tightened", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), ".test_history")
+		assert.NoError(t, os.WriteFile(path, []byte("old\n"), 0644))
+		assert.NoError(t, os.Chmod(path, 0644))
+
+		assert.NoError(t, newHistory(path).Save())
+
+		info, err := os.Stat(path)
+		assert.NoError(t, err)
+		assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	})
+
+	t.Run("override", func(t *testing.T) {
+		t.Setenv("GOSH_HISTFILE_MODE", "640")
+		path := filepath.Join(t.TempDir(), ".test_history")
+		assert.NoError(t, newHistory(path).Save())
+
+		info, err := os.Stat(path)
+		assert.NoError(t, err)
+		assert.Equal(t, os.FileMode(0640), info.Mode().Perm())
+	})
+
+	t.Run("invalid override", func(t *testing.T) {
+		t.Setenv("GOSH_HISTFILE_MODE", "rw-r--r--")
+		assert.Equal(t, os.FileMode(0600), historyFileMode())
+
+		t.Setenv("GOSH_HISTFILE_MODE", "1777")
+		assert.Equal(t, os.FileMode(0600), historyFileMode())
+	})
+}
+
+func TestMatches(t *testing.T) {
+	h := &History{commands: []string{"git status", "ls", "git commit", "git status", "gofmt"}}
+
+	assert.Equal(t, []string{"git status", "git commit"}, h.Matches("git"))
+	assert.Equal(t, []string{"gofmt", "git status", "git commit"}, h.Matches("g"))
+	assert.Empty(t, h.Matches("make"))
+}
+
+func TestCommandFrequency(t *testing.T) {
+	h := &History{commands: []string{"git status", "ls", "git commit -m x", "  git push", "ls -l", "make", "", "for i in 1\ndo\n  ls\ndone"}}
+
+	assert.Equal(t, map[string]int{"git": 3, "ls": 2, "make": 1, "for": 1}, h.CommandFrequency())
+	assert.Empty(t, (&History{}).CommandFrequency())
+}
+
+func TestSuggest(t *testing.T) {
+	h := &History{commands: []string{"git status", "ls", "git commit", "echo 'a\nb'", "gi"}}
+
+	// The latest command extending the prefix is suggested
+	assert.Equal(t, "git commit", h.Suggest("git"))
+	assert.Equal(t, "git status", h.Suggest("git s"))
+	assert.Equal(t, "git commit", h.Suggest("gi"))
+
+	// Exact matches, multi-line commands and an empty prefix give nothing
+	assert.Equal(t, "", h.Suggest("ls"))
+	assert.Equal(t, "", h.Suggest("echo"))
+	assert.Equal(t, "", h.Suggest(""))
+	assert.Equal(t, "", h.Suggest("make"))
+}
+
+func TestExpand(t *testing.T) {
+	h := &History{commands: []string{"git status", "ls -la", "git commit -m x", "pwd"}}
+
+	tests := []struct {
+		line, want string
+		expanded   bool
+	}{
+		{"!!", "pwd", true},
+		{"sudo !!", "sudo pwd", true},
+		{"!2", "ls -la", true},
+		{"!-2", "git commit -m x", true},
+		// Without a menu, the most recent match wins
+		{"!git && echo", "git commit -m x && echo", true},
+		{"!l | wc", "ls -la | wc", true},
+		{"echo hi!", "echo hi!", false},
+		{"echo '!!' \\!! ! a=!", "echo '!!' \\!! ! a=!", false},
+		{"ls [!a]*", "ls [!a]*", false},
+		{"sleep 5 & pid=$!; wait $pid", "sleep 5 & pid=$!; wait $pid", false},
+		{"echo hi!) x!| y!& !$ !<in !'q'", "echo hi!) x!| y!& !$ !<in !'q'", false},
+		{`echo "!!"`, `echo "pwd"`, true},
+	}
+	for _, tt := range tests {
+		result, expanded, err := h.Expand(tt.line, nil)
+		assert.NoError(t, err, tt.line)
+		assert.Equal(t, tt.want, result, tt.line)
+		assert.Equal(t, tt.expanded, expanded, tt.line)
+	}
+
+	_, _, err := h.Expand("!make", nil)
+	assert.EqualError(t, err, "!make: event not found")
+	_, _, err = h.Expand("!9", nil)
+	assert.EqualError(t, err, "!9: event not found")
+}
+
+func TestExpandChooser(t *testing.T) {
+	h := &History{commands: []string{"git status", "ls -la", "git commit -m x"}}
+
+	var offered []string
+	choose := func(matches []string) (string, error) {
+		offered = matches
+		return matches[1], nil
+	}
+
+	result, _, err := h.Expand("!git", choose)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"git commit -m x", "git status"}, offered)
+	assert.Equal(t, "git status", result)
+
+	// A single match is used without asking
+	offered = nil
+	result, _, err = h.Expand("!ls", choose)
+	assert.NoError(t, err)
+	assert.Nil(t, offered)
+	assert.Equal(t, "ls -la", result)
+}
+
+func TestHistoryIgnore(t *testing.T) {
+	t.Setenv("GOSH_HISTIGNORE", "ls:cd *:clear:git co?mit*")
+
+	h := &History{
+		commands: make([]string, 0),
+		maxSize:  10,
+	}
+	for _, cmd := range []string{"ls", "ls -l", "cd /tmp", "cd", "clear", "git commit -m x", "git status", "  ls  "} {
+		h.Add(cmd)
+	}
+	assert.Equal(t, []string{"ls -l", "cd", "git status"}, h.GetAll())
+
+	t.Setenv("GOSH_HISTIGNORE", "")
+	h.Add("ls")
+	assert.Equal(t, []string{"ls -l", "cd", "git status", "ls"}, h.GetAll())
+
+	// HISTIGNORE, as in bash, takes precedence, and needn't be exported
+	shell.SetVar("HISTIGNORE", "pwd")
+	defer shell.UnsetVar("HISTIGNORE")
+	t.Setenv("GOSH_HISTIGNORE", "make")
+	h.Add("pwd")
+	h.Add("make")
+	assert.Equal(t, []string{"ls -l", "cd", "git status", "ls", "make"}, h.GetAll())
+}
+
+func TestSharedHistory(t *testing.T) {
+	t.Setenv("GOSH_HISTORY_SHARE", "1")
+	historyPath := filepath.Join(t.TempDir(), ".test_history")
+	session := func() *History {
+		h := &History{maxSize: 10, historyPath: historyPath}
+		assert.NoError(t, h.Load())
+		return h
+	}
+	a, b := session(), session()
+
+	// Commands are written to the file as they're added, and other sessions
+	// pick them up without getting their own back
+	a.Add("a-live")
+	b.Add("bb1")
+	added, err := a.AppendFromFile()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"bb1"}, added)
+	added, err = b.AppendFromFile()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a-live"}, added)
+
+	c := session()
+	assert.Equal(t, []string{"a-live", "bb1"}, c.GetAll())
+
+	// Saving merges what's in the file rather than writing over it
+	b.Add("bb2")
+	assert.NoError(t, a.Save())
+	content, err := os.ReadFile(historyPath)
+	assert.NoError(t, err)
+	assert.Equal(t, "a-live\nbb1\nbb2\n", string(content))
+	added, err = c.AppendFromFile()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"bb2"}, added)
+
+	// A file rewritten with other commands isn't read from the old offset,
+	// even when it's no shorter
+	assert.NoError(t, os.WriteFile(historyPath, []byte("x\nfrom-another-session\n"), 0600))
+	b.Add("bb3")
+	for _, h := range []*History{b, c} {
+		added, err = h.AppendFromFile()
+		assert.NoError(t, err)
+		assert.Empty(t, added)
+	}
+	a.Add("a-next")
+	added, err = c.AppendFromFile()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a-next"}, added)
+	assert.Equal(t, []string{"a-live", "bb1", "bb2", "a-next"}, c.GetAll())
+}
+
+func TestAuditLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	assert.NoError(t, os.WriteFile(path, []byte("earlier\n"), 0600))
+
+	log := NewAuditLog(path)
+	log.now = func() time.Time { return time.Date(2024, 5, 1, 12, 30, 0, 0, time.UTC) }
+	log.Record("echo hello", 0)
+	log.Record("false", 1)
+	log.Record("for x in a\ndo\n  echo $x\ndone", 0)
+
+	// Entries are appended to what's already there
+	content, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "earlier\n"+
+		"2024-05-01T12:30:00Z\t0\techo hello\n"+
+		"2024-05-01T12:30:00Z\t1\tfalse\n"+
+		"2024-05-01T12:30:00Z\t0\tfor x in a\\\ndo\\\n  echo $x\\\ndone\n", string(content))
+
+	// A log that can't be written is warned about once
+	var warnings bytes.Buffer
+	log = NewAuditLog(filepath.Join(t.TempDir(), "missing", "audit.log"))
+	log.warnings = &warnings
+	log.Record("echo one", 0)
+	log.Record("echo two", 0)
+	assert.Equal(t, 1, strings.Count(warnings.String(), "\n"))
+	assert.Contains(t, warnings.String(), "gosh: warning: can't write to audit log: ")
+}
@@ -2,32 +2,50 @@ package input
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
+	"io"
 	"os"
+	"os/exec"
+	"os/signal"
+	"os/user"
 	"path/filepath"
-	"regexp"
+	"slices"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"syscall"
+	"time"
+	"unicode/utf8"
 	"unsafe"
 
+	"github.com/apriljarosz/gosh/internal/glob"
 	"github.com/apriljarosz/gosh/internal/history"
+	"github.com/apriljarosz/gosh/internal/jobs"
+	"github.com/apriljarosz/gosh/internal/shell"
 	"github.com/chzyer/readline"
 )
 
 // Command represents a parsed command with potential redirection
 type Command struct {
 	Args         []string
+	Assignments  []string // Leading NAME=value words
 	InputFile    string
 	OutputFile   string
 	AppendOutput bool
 	Background   bool
+	PipeStderr   bool // |& sends stderr down the pipe along with stdout
+	Substituted  bool // Expanding the command ran a $(command)
+
+	StderrToOutput bool // &> and &>> send stderr to OutputFile as well
 }
 
 // Pipeline represents a series of commands connected by pipes
 type Pipeline struct {
 	Commands   []*Command
 	Background bool
+	Negate     bool // A leading ! inverts the exit status
 }
 
 // Terminal control structures for raw mode
@@ -47,18 +65,204 @@ type LineEditor struct {
 	originalTty      termios
 	rawMode          bool
 	completionEngine *CompletionEngine
+
+	// capable is false when the terminal can't handle the escape sequences
+	// used for redrawing, in which case input is read line by line instead
+	capable bool
+
+	// prompt is shown before the line, the shell's usual prompt if empty
+	prompt string
+
+	// History navigation state for the current editing session. Edits made
+	// to a recalled entry are kept per history index until Enter is pressed.
+	historyPos   int
+	historyEdits map[int]string
+
+	// menu holds the completions that repeated Tab presses cycle through,
+	// nil when no cycle is in progress
+	menu *completionMenu
+
+	// tty is the editor's own handle on the terminal, opened by keyInput
+	tty *os.File
+}
+
+// completionMenu is the state of cycling through completions in place
+type completionMenu struct {
+	candidates []string
+	index      int // the candidate on the line, -1 before the first
+	wordStart  int // where the word being completed starts
 }
 
 // CompletionEngine handles tab completion for commands and paths
 type CompletionEngine struct {
-	builtinCommands []string
+	argCompleters map[string]ArgCompleter
+
+	// Executable names found in PATH, scanned lazily and rescanned when
+	// PATH changes or the scan is older than pathCacheTTL
+	pathCache     []string
+	pathCacheFor  string
+	pathCacheTime time.Time
+}
+
+// pathCacheTTL is how long a scan of PATH is reused for completion
+const pathCacheTTL = 30 * time.Second
+
+// readDir reads a directory for completion, replaceable in tests
+var readDir = os.ReadDir
+
+// ArgCompleter completes the arguments of a specific command. It is given
+// the word being completed and returns the candidates for it.
+type ArgCompleter func(prefix string) []string
+
+// Global job manager instance used for job ID completion - set by main
+var globalJobManager *jobs.JobManager
+
+// SetJobManager sets the job manager used for completing job IDs
+func SetJobManager(jm *jobs.JobManager) {
+	globalJobManager = jm
+}
+
+// Descriptions of the builtin commands shown next to completions - set by main
+var builtinDescriptions map[string]string
+
+// SetBuiltinDescriptions sets the builtin commands that complete as command
+// names, with the descriptions shown for them when completions are listed
+// with GOSH_COMPLETE_DESC=1
+func SetBuiltinDescriptions(descriptions map[string]string) {
+	builtinDescriptions = descriptions
+}
+
+// builtinNames returns the names of the builtin commands, sorted
+func builtinNames() []string {
+	names := make([]string, 0, len(builtinDescriptions))
+	for name := range builtinDescriptions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// recentDirs returns recently visited directories, most recent first, for
+// cd completion - set by main
+var recentDirs func() []string
+
+// SetRecentDirs sets where cd completion finds recently visited directories
+func SetRecentDirs(dirs func() []string) {
+	recentDirs = dirs
 }
 
 // NewCompletionEngine creates a new completion engine
 func NewCompletionEngine() *CompletionEngine {
-	return &CompletionEngine{
-		builtinCommands: []string{"cd", "pwd", "exit", "help", "env", "history"},
+	ce := &CompletionEngine{
+		argCompleters: make(map[string]ArgCompleter),
+	}
+
+	// Commands whose arguments aren't file paths
+	ce.RegisterCompleter("history", noCompletion)
+	ce.RegisterCompleter("jobs", noCompletion)
+	ce.RegisterCompleter("fg", completeJobIDs)
+	ce.RegisterCompleter("bg", completeJobIDs)
+	ce.RegisterCompleter("kill", completeJobSpecs)
+	ce.RegisterCompleter("cd", ce.completeDirs)
+
+	return ce
+}
+
+// RegisterCompleter sets the completer used for the arguments of command,
+// replacing the default file path completion
+func (ce *CompletionEngine) RegisterCompleter(command string, completer ArgCompleter) {
+	ce.argCompleters[command] = completer
+}
+
+// noCompletion is an ArgCompleter for commands that take no completable
+// arguments
+func noCompletion(prefix string) []string {
+	return nil
+}
+
+// completeJobIDs completes the IDs of active jobs, or their job specs for a
+// word starting with %
+func completeJobIDs(prefix string) []string {
+	if globalJobManager == nil {
+		return nil
+	}
+	if strings.HasPrefix(prefix, "%") {
+		return completeJobSpecs(prefix)
+	}
+
+	var matches []string
+	for _, job := range globalJobManager.GetActiveJobs() {
+		id := strconv.Itoa(job.ID)
+		if strings.HasPrefix(id, prefix) {
+			matches = append(matches, id)
+		}
+	}
+
+	sort.Slice(matches, func(i, j int) bool {
+		a, _ := strconv.Atoi(matches[i])
+		b, _ := strconv.Atoi(matches[j])
+		return a < b
+	})
+	return matches
+}
+
+// completeJobSpecs completes the job specs of active jobs: %n for each job
+// in order, then %+ and %- for the current and previous jobs. Only a word
+// starting with % is completed, since kill's other arguments are process
+// IDs and signals.
+func completeJobSpecs(prefix string) []string {
+	if !strings.HasPrefix(prefix, "%") {
+		return nil
+	}
+
+	var matches []string
+	for _, spec := range jobSpecs() {
+		if strings.HasPrefix(spec, prefix) {
+			matches = append(matches, spec)
+		}
+	}
+	return matches
+}
+
+// jobSpecs returns the job specs for the active jobs in the order they are
+// completed
+func jobSpecs() []string {
+	if globalJobManager == nil {
+		return nil
+	}
+
+	var ids []int
+	for _, job := range globalJobManager.GetActiveJobs() {
+		ids = append(ids, job.ID)
+	}
+	sort.Ints(ids)
+
+	var specs []string
+	for _, id := range ids {
+		specs = append(specs, "%"+strconv.Itoa(id))
+	}
+	if globalJobManager.CurrentJob() != nil {
+		specs = append(specs, "%+")
+	}
+	if globalJobManager.PreviousJob() != nil {
+		specs = append(specs, "%-")
+	}
+	return specs
+}
+
+// jobSpecDescriptions returns the command each job spec stands for
+func jobSpecDescriptions() map[string]string {
+	descriptions := make(map[string]string)
+	if globalJobManager == nil {
+		return descriptions
+	}
+
+	for _, spec := range jobSpecs() {
+		if job, err := globalJobManager.ResolveSpec(spec); err == nil {
+			descriptions[spec] = job.Command
+		}
 	}
+	return descriptions
 }
 
 // Complete returns possible completions for the given input
@@ -74,13 +278,22 @@ func (ce *CompletionEngine) Complete(line string, cursor int) []string {
 	}
 
 	prefix := line[wordStart:cursor]
-	words := strings.Fields(line[:cursor])
 
 	// If this is the first word, complete commands
-	if len(words) <= 1 {
+	words := strings.Fields(line[:wordStart])
+	if len(words) == 0 {
 		return ce.completeCommand(prefix)
 	}
 
+	// Completions set with the complete builtin come first, then the
+	// command's own completer if it has one
+	if spec, ok := shell.LookupCompletion(words[0]); ok {
+		return ce.completeSpec(spec, prefix)
+	}
+	if completer, ok := ce.argCompleters[words[0]]; ok {
+		return completer(prefix)
+	}
+
 	// Otherwise, complete file paths
 	return ce.completePath(prefix)
 }
@@ -88,69 +301,145 @@ func (ce *CompletionEngine) Complete(line string, cursor int) []string {
 // completeCommand completes built-in commands and executables in PATH
 func (ce *CompletionEngine) completeCommand(prefix string) []string {
 	seen := make(map[string]bool)
-	var matches []string
+	var candidates []string
+
+	// Built-in commands first, then executables in PATH, avoiding duplicates
+	for _, names := range [][]string{builtinNames(), ce.refreshPathCache()} {
+		for _, cmd := range names {
+			if !seen[cmd] {
+				candidates = append(candidates, cmd)
+				seen[cmd] = true
+			}
+		}
+	}
+
+	return matchCandidates(prefix, candidates)
+}
+
+// fuzzyEnabled reports whether fuzzy completion is turned on with
+// GOSH_FUZZY=1
+func fuzzyEnabled() bool {
+	return os.Getenv("GOSH_FUZZY") == "1"
+}
 
-	// Check built-in commands first (they take priority)
-	for _, cmd := range ce.builtinCommands {
-		if strings.HasPrefix(cmd, prefix) {
-			matches = append(matches, cmd)
-			seen[cmd] = true
+// matchCandidates returns the candidates that match the word being
+// completed. Normally a candidate must start with the word and matches are
+// sorted by name; in fuzzy mode the word only has to be a subsequence of the
+// candidate and the best matches come first.
+func matchCandidates(word string, candidates []string) []string {
+	if !fuzzyEnabled() {
+		var matches []string
+		for _, candidate := range candidates {
+			if strings.HasPrefix(candidate, word) {
+				matches = append(matches, candidate)
+			}
 		}
+		sort.Strings(matches)
+		return matches
 	}
 
-	// Check executables in PATH, avoiding duplicates
-	pathMatches := ce.completeExecutables(prefix)
-	for _, cmd := range pathMatches {
-		if !seen[cmd] {
-			matches = append(matches, cmd)
-			seen[cmd] = true
+	type scored struct {
+		name  string
+		score int
+	}
+	var ranked []scored
+	for _, candidate := range candidates {
+		if ok, score := fuzzyMatch(word, candidate); ok {
+			ranked = append(ranked, scored{candidate, score})
 		}
 	}
+	sort.Slice(ranked, func(i, j int) bool {
+		if ranked[i].score != ranked[j].score {
+			return ranked[i].score > ranked[j].score
+		}
+		return ranked[i].name < ranked[j].name
+	})
 
-	sort.Strings(matches)
+	matches := make([]string, len(ranked))
+	for i, r := range ranked {
+		matches[i] = r.name
+	}
 	return matches
 }
 
-// completeExecutables finds executables in PATH that match the prefix
-func (ce *CompletionEngine) completeExecutables(prefix string) []string {
-	var matches []string
+// fuzzyMatch reports whether the characters of pattern appear in order in
+// candidate, along with a score for ranking matches. Higher scores are
+// better: each matched character counts, characters matched right after the
+// previous match count extra, and so does matching from the start of the
+// candidate.
+func fuzzyMatch(pattern, candidate string) (bool, int) {
+	score := 0
+	last := -1
+	pos := 0
+
+	for _, r := range pattern {
+		idx := strings.IndexRune(candidate[pos:], r)
+		if idx < 0 {
+			return false, 0
+		}
+		idx += pos
+
+		score++
+		if idx == 0 {
+			score += 10
+		} else if idx == last+1 {
+			score += 5
+		}
+
+		last = idx
+		pos = idx + utf8.RuneLen(r)
+	}
+
+	return true, score
+}
+
+// refreshPathCache returns the names of the executables in PATH, scanning
+// the PATH directories only if the cache is empty or stale
+func (ce *CompletionEngine) refreshPathCache() []string {
 	pathEnv := os.Getenv("PATH")
-	if pathEnv == "" {
-		return matches
+	if ce.pathCache != nil && ce.pathCacheFor == pathEnv &&
+		time.Since(ce.pathCacheTime) < pathCacheTTL {
+		return ce.pathCache
 	}
 
-	paths := strings.Split(pathEnv, ":")
+	names := []string{}
 	seen := make(map[string]bool)
 
-	for _, dir := range paths {
-		if dir == "" {
-			continue
-		}
-
-		entries, err := os.ReadDir(dir)
+	for _, dir := range shell.PathDirs(pathEnv) {
+		entries, err := readDir(dir)
 		if err != nil {
 			continue
 		}
 
 		for _, entry := range entries {
 			name := entry.Name()
-			if strings.HasPrefix(name, prefix) && !seen[name] {
-				// Check if it's executable
-				if info, err := entry.Info(); err == nil && info.Mode()&0111 != 0 {
-					matches = append(matches, name)
-					seen[name] = true
-				}
+			if seen[name] {
+				continue
+			}
+			// Check if it's executable
+			if info, err := entry.Info(); err == nil && info.Mode()&0111 != 0 {
+				names = append(names, name)
+				seen[name] = true
 			}
 		}
 	}
 
-	return matches
+	ce.pathCache = names
+	ce.pathCacheFor = pathEnv
+	ce.pathCacheTime = time.Now()
+	return names
 }
 
 // completePath completes file and directory paths
 func (ce *CompletionEngine) completePath(prefix string) []string {
 	var matches []string
 
+	// host:path names a file on another machine, for scp or rsync, so
+	// there's nothing to list locally
+	if isRemotePath(prefix) {
+		return matches
+	}
+
 	// Handle absolute vs relative paths
 	dir := "."
 	pattern := prefix
@@ -168,32 +457,111 @@ func (ce *CompletionEngine) completePath(prefix string) []string {
 		return matches
 	}
 
+	isDir := make(map[string]bool)
+	var names []string
 	for _, entry := range entries {
 		name := entry.Name()
 		// Skip hidden files unless the pattern starts with a dot
 		if strings.HasPrefix(name, ".") && !strings.HasPrefix(pattern, ".") {
 			continue
 		}
+		names = append(names, name)
+		isDir[name] = entry.IsDir()
+	}
 
-		if strings.HasPrefix(name, pattern) {
-			fullPath := name
-			if dir != "." {
-				fullPath = filepath.Join(dir, name)
-			}
+	for _, name := range matchCandidates(pattern, names) {
+		fullPath := name
+		if dir != "." {
+			fullPath = filepath.Join(dir, name)
+		}
+
+		// Add trailing slash for directories
+		if isDir[name] {
+			fullPath += "/"
+		}
+
+		matches = append(matches, fullPath)
+	}
+
+	return matches
+}
+
+// completeDirs completes directories for cd. Recently visited directories
+// that match come first, then the other directories on disk. A recent
+// directory below the current one is offered relative to it when prefix is
+// relative, and as an absolute path when prefix is.
+func (ce *CompletionEngine) completeDirs(prefix string) []string {
+	var matches []string
+	seen := make(map[string]bool)
+	add := func(dir string) {
+		if !seen[dir] {
+			seen[dir] = true
+			matches = append(matches, dir)
+		}
+	}
 
-			// Add trailing slash for directories
-			if entry.IsDir() {
-				fullPath += "/"
+	if recentDirs != nil {
+		cwd, _ := os.Getwd()
+		for _, dir := range recentDirs() {
+			candidate := dir
+			if !filepath.IsAbs(prefix) {
+				rel, err := filepath.Rel(cwd, dir)
+				if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, "../") {
+					continue
+				}
+				candidate = rel
+			}
+			if candidate != "/" {
+				candidate += "/"
+			}
+			if strings.HasPrefix(candidate, prefix) {
+				add(candidate)
 			}
+		}
+	}
+
+	for _, path := range ce.completePath(prefix) {
+		if strings.HasSuffix(path, "/") {
+			add(path)
+		}
+	}
+	return matches
+}
 
-			matches = append(matches, fullPath)
+// completeSpec completes an argument as set by the complete builtin: the
+// spec's words that start with prefix, followed by directories or files
+func (ce *CompletionEngine) completeSpec(spec shell.CompletionSpec, prefix string) []string {
+	var matches []string
+	for _, word := range spec.Words {
+		if strings.HasPrefix(word, prefix) && !slices.Contains(matches, word) {
+			matches = append(matches, word)
 		}
 	}
 
-	sort.Strings(matches)
+	switch {
+	case spec.Files:
+		matches = append(matches, ce.completePath(prefix)...)
+	case spec.Dirs:
+		for _, path := range ce.completePath(prefix) {
+			if strings.HasSuffix(path, "/") {
+				matches = append(matches, path)
+			}
+		}
+	}
 	return matches
 }
 
+// isRemotePath reports whether word has the [user@]host:path form used by
+// scp and rsync, with a host before a colon that comes before any slash
+func isRemotePath(word string) bool {
+	colon := strings.IndexByte(word, ':')
+	if colon <= 0 {
+		return false
+	}
+	slash := strings.IndexByte(word, '/')
+	return slash < 0 || colon < slash
+}
+
 // findCommonPrefix finds the longest common prefix among a list of strings
 func findCommonPrefix(strs []string) string {
 	if len(strs) == 0 {
@@ -205,8 +573,10 @@ func findCommonPrefix(strs []string) string {
 
 	prefix := strs[0]
 	for _, s := range strs[1:] {
+		// Trim whole characters, so the prefix never ends partway through one
 		for len(prefix) > 0 && !strings.HasPrefix(s, prefix) {
-			prefix = prefix[:len(prefix)-1]
+			_, size := utf8.DecodeLastRuneInString(prefix)
+			prefix = prefix[:len(prefix)-size]
 		}
 		if prefix == "" {
 			break
@@ -220,17 +590,412 @@ func NewLineEditor(hist *history.History) *LineEditor {
 	return &LineEditor{
 		history:          hist,
 		completionEngine: NewCompletionEngine(),
+		capable:          terminalCapable(os.Getenv("TERM")),
+	}
+}
+
+// promptText returns the prompt shown before the line being edited
+func (le *LineEditor) promptText() string {
+	if le.prompt == "" {
+		return commandPrompt()
+	}
+	return le.prompt
+}
+
+// ErrInterrupted is returned when Ctrl+C abandons the line being edited
+var ErrInterrupted = errors.New("interrupted")
+
+// terminalCapable reports whether a terminal of the given TERM type supports
+// the cursor movement and line clearing sequences used by redrawLine
+func terminalCapable(term string) bool {
+	switch term {
+	case "", "dumb", "unknown":
+		return false
+	}
+	return true
+}
+
+// resetHistoryNavigation starts a new editing session at the end of history,
+// discarding any scratch edits from the previous session
+func (le *LineEditor) resetHistoryNavigation() {
+	le.historyPos = le.history.Size()
+	le.historyEdits = make(map[int]string)
+}
+
+// navigateHistory moves delta entries through history. The current line is
+// saved as the scratch copy for the position being left, and the line for the
+// new position is returned (its scratch copy if one exists, otherwise the
+// history entry itself). The second return value is false if the move would
+// go past either end of history.
+func (le *LineEditor) navigateHistory(line []rune, delta int) ([]rune, bool) {
+	target := le.historyPos + delta
+	if target < 0 || target > le.history.Size() {
+		return line, false
+	}
+
+	le.historyEdits[le.historyPos] = string(line)
+	le.historyPos = target
+
+	if edited, ok := le.historyEdits[target]; ok {
+		return []rune(edited), true
+	}
+	return []rune(le.history.GetAll()[target]), true
+}
+
+// Action is something the line editor does in response to a key
+type Action int
+
+const (
+	ActionNone Action = iota
+	ActionAcceptLine
+	ActionInterrupt
+	ActionBackwardDeleteChar
+	ActionDeleteChar
+	ActionComplete
+	ActionPreviousHistory
+	ActionNextHistory
+	ActionForwardChar
+	ActionBackwardChar
+	ActionBeginningOfLine
+	ActionEndOfLine
+	ActionKillLine
+	ActionUnixLineDiscard
+	ActionEditCommandLine
+	ActionMenuCompleteBackward
+)
+
+// actionNames maps the names used in ~/.gosh_inputrc, which follow
+// readline's, to actions
+var actionNames = map[string]Action{
+	"accept-line":            ActionAcceptLine,
+	"interrupt":              ActionInterrupt,
+	"backward-delete-char":   ActionBackwardDeleteChar,
+	"delete-char":            ActionDeleteChar,
+	"complete":               ActionComplete,
+	"previous-history":       ActionPreviousHistory,
+	"next-history":           ActionNextHistory,
+	"forward-char":           ActionForwardChar,
+	"backward-char":          ActionBackwardChar,
+	"beginning-of-line":      ActionBeginningOfLine,
+	"end-of-line":            ActionEndOfLine,
+	"kill-line":              ActionKillLine,
+	"unix-line-discard":      ActionUnixLineDiscard,
+	"edit-command-line":      ActionEditCommandLine,
+	"menu-complete-backward": ActionMenuCompleteBackward,
+}
+
+// KeyBindings maps key sequences, as the bytes the terminal sends, to the
+// actions they trigger
+type KeyBindings map[string]Action
+
+// DefaultKeyBindings returns the bindings the line editor uses when
+// ~/.gosh_inputrc doesn't override them
+func DefaultKeyBindings() KeyBindings {
+	return KeyBindings{
+		"\r":       ActionAcceptLine,
+		"\n":       ActionAcceptLine,
+		"\x03":     ActionInterrupt,
+		"\x7f":     ActionBackwardDeleteChar,
+		"\b":       ActionBackwardDeleteChar,
+		"\t":       ActionComplete,
+		"\x1b[Z":   ActionMenuCompleteBackward,
+		"\x1b[A":   ActionPreviousHistory,
+		"\x1b[B":   ActionNextHistory,
+		"\x1b[C":   ActionForwardChar,
+		"\x1b[D":   ActionBackwardChar,
+		"\x1b[H":   ActionBeginningOfLine,
+		"\x1b[F":   ActionEndOfLine,
+		eofKey:     ActionDeleteChar,
+		"\x18\x05": ActionEditCommandLine, // Ctrl+X Ctrl+E
+	}
+}
+
+// eofKey is Ctrl+D, which ends input when pressed on an empty line
+const eofKey = "\x04"
+
+// keyBindings are the bindings the line editor dispatches keys through
+var keyBindings = DefaultKeyBindings()
+
+// SetKeyBindings sets the key bindings the line editor uses, normally those
+// loaded from ~/.gosh_inputrc
+func SetKeyBindings(bindings KeyBindings) {
+	keyBindings = bindings
+}
+
+// isPrefix reports whether seq is the start of a longer bound sequence, so
+// more keys should be read before acting on it
+func (kb KeyBindings) isPrefix(seq string) bool {
+	for bound := range kb {
+		if len(bound) > len(seq) && strings.HasPrefix(bound, seq) {
+			return true
+		}
+	}
+	return false
+}
+
+// LoadKeyBindings returns the default key bindings overridden by those in
+// the inputrc-style file at path. A missing file just gives the defaults.
+// Lines that can't be parsed are skipped, and reported together in the
+// error alongside the bindings from the rest of the file.
+func LoadKeyBindings(path string) (KeyBindings, error) {
+	bindings := DefaultKeyBindings()
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return bindings, nil
+	}
+	if err != nil {
+		return bindings, err
+	}
+	defer file.Close()
+
+	var errs []error
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		seq, action, err := parseKeyBinding(scanner.Text())
+		switch {
+		case err != nil:
+			errs = append(errs, fmt.Errorf("%s:%d: %v", path, n, err))
+		case seq != "":
+			bindings[seq] = action
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		errs = append(errs, err)
+	}
+	return bindings, errors.Join(errs...)
+}
+
+// parseKeyBinding parses a line of the form "KEYS": action. Blank lines and
+// lines starting with # give an empty sequence.
+func parseKeyBinding(line string) (string, Action, error) {
+	line = strings.TrimSpace(line)
+	if line == "" || line[0] == '#' {
+		return "", ActionNone, nil
+	}
+
+	keys, name, ok := strings.Cut(line, ":")
+	keys = strings.TrimSpace(keys)
+	if !ok || len(keys) < 2 || keys[0] != '"' || keys[len(keys)-1] != '"' {
+		return "", ActionNone, fmt.Errorf("%s: expected \"KEYS\": action", line)
+	}
+	seq, err := unescapeKeys(keys[1 : len(keys)-1])
+	if err != nil {
+		return "", ActionNone, err
+	}
+	if seq == "" {
+		return "", ActionNone, errors.New("empty key sequence")
+	}
+
+	name = strings.TrimSpace(name)
+	action, ok := actionNames[name]
+	if !ok {
+		return "", ActionNone, fmt.Errorf("%s: unknown action", name)
+	}
+	return seq, action, nil
+}
+
+// unescapeKeys turns a key sequence written inputrc style, such as
+// \C-x\C-e or \e[1~, into the bytes the terminal sends for it. \C-x is
+// Control-x and \M-x is Meta-x, sent as Escape then x.
+func unescapeKeys(keys string) (string, error) {
+	var seq strings.Builder
+	for i := 0; i < len(keys); i++ {
+		c := keys[i]
+		if c != '\\' {
+			seq.WriteByte(c)
+			continue
+		}
+		if i+1 == len(keys) {
+			return "", fmt.Errorf("%s: trailing backslash", keys)
+		}
+		i++
+
+		switch c = keys[i]; c {
+		case 'C', 'M':
+			if i+2 >= len(keys) || keys[i+1] != '-' {
+				return "", fmt.Errorf("%s: incomplete \\%c- sequence", keys, c)
+			}
+			i += 2
+			key := keys[i]
+			if key == '\\' && i+1 < len(keys) {
+				// \C-\\ and the like
+				i++
+				key = keys[i]
+			}
+			if c == 'M' {
+				seq.WriteByte('\x1b')
+				seq.WriteByte(key)
+			} else if key == '?' {
+				seq.WriteByte('\x7f')
+			} else {
+				seq.WriteByte(key & 0x1f)
+			}
+		case 'e':
+			seq.WriteByte('\x1b')
+		case 'a':
+			seq.WriteByte('\a')
+		case 'b':
+			seq.WriteByte('\b')
+		case 'd':
+			seq.WriteByte('\x7f')
+		case 'f':
+			seq.WriteByte('\f')
+		case 'n':
+			seq.WriteByte('\n')
+		case 'r':
+			seq.WriteByte('\r')
+		case 't':
+			seq.WriteByte('\t')
+		case 'v':
+			seq.WriteByte('\v')
+		default:
+			// \\, \" and \' stand for themselves
+			seq.WriteByte(c)
+		}
+	}
+	return seq.String(), nil
+}
+
+// readKey reads the bytes of one key press from in: the longest run that
+// is, or starts, a bound sequence. The action is ActionNone when the bytes
+// aren't bound to anything. At the end of input the error is io.EOF, and
+// any sequence cut off by it is dropped.
+func readKey(in *os.File, bindings KeyBindings) (string, Action, error) {
+	var seq []byte
+	for {
+		var buf [1]byte
+		n, err := in.Read(buf[:])
+		if err != nil {
+			return "", ActionNone, err
+		}
+		if n == 0 {
+			continue
+		}
+		seq = append(seq, buf[0])
+
+		if action, ok := bindings[string(seq)]; ok {
+			return string(seq), action, nil
+		}
+		if !bindings.isPrefix(string(seq)) {
+			return string(seq), ActionNone, nil
+		}
+	}
+}
+
+// Terminal settings are read and written through these so that tests can
+// replace them
+var (
+	getTermios = func(fd int, tty *termios) error {
+		_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.TIOCGETA, uintptr(unsafe.Pointer(tty)))
+		if errno != 0 {
+			return errno
+		}
+		return nil
+	}
+	setTermios = func(fd int, tty *termios) error {
+		_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.TIOCSETA, uintptr(unsafe.Pointer(tty)))
+		if errno != 0 {
+			return errno
+		}
+		return nil
+	}
+)
+
+// The terminal's size, as last read by updateWindowSize. The defaults are
+// used until then, and whenever stdout isn't a terminal.
+var (
+	windowMutex    sync.Mutex
+	windowCols     = defaultCols
+	windowRows     = defaultRows
+	windowWatchers int
+)
+
+const (
+	defaultCols = 80
+	defaultRows = 24
+)
+
+// getWindowSize reads the terminal's size, and can be replaced in tests
+var getWindowSize = func(fd int) (cols, rows int, err error) {
+	var ws struct{ Row, Col, Xpixel, Ypixel uint16 }
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.TIOCGWINSZ, uintptr(unsafe.Pointer(&ws)))
+	if errno != 0 {
+		return 0, 0, errno
+	}
+	return int(ws.Col), int(ws.Row), nil
+}
+
+// WindowSize returns the terminal's width and height in characters. While
+// the line editor is watching for resizes this is the size it last saw;
+// otherwise the terminal is asked again.
+func WindowSize() (cols, rows int) {
+	windowMutex.Lock()
+	watched := windowWatchers > 0
+	windowMutex.Unlock()
+	if !watched {
+		updateWindowSize()
+	}
+
+	windowMutex.Lock()
+	defer windowMutex.Unlock()
+	return windowCols, windowRows
+}
+
+// updateWindowSize reads the terminal's size into WindowSize. A failed read
+// or a zero size, as some terminals report, keeps the previous size.
+func updateWindowSize() {
+	cols, rows, err := getWindowSize(int(os.Stdout.Fd()))
+	if err != nil || cols <= 0 || rows <= 0 {
+		return
+	}
+	windowMutex.Lock()
+	windowCols, windowRows = cols, rows
+	windowMutex.Unlock()
+}
+
+// watchWindowSize reads the terminal's size now and again each time it is
+// resized, until the returned function is called
+func watchWindowSize() func() {
+	updateWindowSize()
+	windowMutex.Lock()
+	windowWatchers++
+	windowMutex.Unlock()
+
+	sigwinch := make(chan os.Signal, 1)
+	signal.Notify(sigwinch, syscall.SIGWINCH)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-sigwinch:
+				updateWindowSize()
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		signal.Stop(sigwinch)
+		close(done)
+		windowMutex.Lock()
+		windowWatchers--
+		windowMutex.Unlock()
 	}
 }
 
+// The line editor that currently has the terminal in raw mode, if any, so
+// that RestoreTerminal can put it back
+var (
+	rawModeMutex  sync.Mutex
+	rawModeEditor *LineEditor
+)
+
 // enableRawMode puts the terminal in raw mode for character-by-character input
 func (le *LineEditor) enableRawMode() error {
-	fd := int(os.Stdin.Fd())
-
 	// Get current terminal settings
-	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.TIOCGETA, uintptr(unsafe.Pointer(&le.originalTty)))
-	if errno != 0 {
-		return errno
+	if err := controlFd(os.Stdin, func(fd int) error { return getTermios(fd, &le.originalTty) }); err != nil {
+		return err
 	}
 
 	// Create raw mode settings
@@ -246,58 +1011,110 @@ func (le *LineEditor) enableRawMode() error {
 	raw.Cc[syscall.VMIN] = 1
 	raw.Cc[syscall.VTIME] = 0
 
+	rawModeMutex.Lock()
+	defer rawModeMutex.Unlock()
+
 	// Apply raw mode settings
-	_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.TIOCSETA, uintptr(unsafe.Pointer(&raw)))
-	if errno != 0 {
-		return errno
+	if err := controlFd(os.Stdin, func(fd int) error { return setTermios(fd, &raw) }); err != nil {
+		return err
 	}
 
 	le.rawMode = true
+	rawModeEditor = le
 	return nil
 }
 
 // disableRawMode restores the original terminal settings
 func (le *LineEditor) disableRawMode() error {
+	rawModeMutex.Lock()
+	defer rawModeMutex.Unlock()
+	return le.restoreTty()
+}
+
+// restoreTty puts back the settings saved by enableRawMode
+// The caller must hold rawModeMutex
+func (le *LineEditor) restoreTty() error {
 	if !le.rawMode {
 		return nil
 	}
 
-	fd := int(os.Stdin.Fd())
-	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.TIOCSETA, uintptr(unsafe.Pointer(&le.originalTty)))
-	if errno != 0 {
-		return errno
+	if err := controlFd(os.Stdin, func(fd int) error { return setTermios(fd, &le.originalTty) }); err != nil {
+		return err
 	}
 
 	le.rawMode = false
+	if rawModeEditor == le {
+		rawModeEditor = nil
+	}
 	return nil
 }
 
-// ReadLineWithArrows reads a line with arrow key support and history navigation
-func (le *LineEditor) ReadLineWithArrows() (string, error) {
-	fmt.Print("gosh> ")
+// RestoreTerminal returns the terminal to cooked mode if line editing left
+// it in raw mode. It's meant for cleanup after a crash or signal, and is
+// safe to call any number of times.
+func RestoreTerminal() {
+	rawModeMutex.Lock()
+	defer rawModeMutex.Unlock()
 
-	if err := le.enableRawMode(); err != nil {
-		// Fallback to simple mode if raw mode fails
+	if rawModeEditor != nil {
+		rawModeEditor.restoreTty()
+	}
+	if globalReadline != nil && !readlineAbandoned {
+		globalReadline.Terminal.ExitRawMode()
+	}
+}
+
+// ReadLineWithArrows reads a line with arrow key support and history navigation
+func (le *LineEditor) ReadLineWithArrows() (string, error) {
+	runIdleHandler()
+	fmt.Print(le.promptText())
+
+	if !le.capable {
+		return le.readLineSimple()
+	}
+
+	if err := le.enableRawMode(); err != nil {
+		// Fallback to simple mode if raw mode fails, and don't try again
+		le.capable = false
 		return le.readLineSimple()
 	}
 	defer le.disableRawMode()
+	defer watchWindowSize()()
+
+	// If Wake can't cut reading a key short, the idle handler waits for
+	// the next prompt
+	keys, wakeable := le.keyInput()
+	if wakeable {
+		startWaiting(le.promptText(), keys)
+		defer stopWaiting()
+	}
 
 	var line []rune
 	cursor := 0
-	historyPos := le.history.Size()
-	originalLine := ""
+	le.resetHistoryNavigation()
 
 	for {
-		var buf [1]byte
-		n, err := os.Stdin.Read(buf[:])
-		if err != nil || n == 0 {
+		seq, action, err := readKey(keys, keyBindings)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			// Woken to run the idle handler
+			le.runWoken(keys, line, cursor)
 			continue
 		}
+		if errors.Is(err, io.EOF) && len(line) > 0 {
+			// Input ended partway through a line, as piped input with no
+			// final newline does, so the line is taken as it is
+			os.Stdout.WriteString("\r\n")
+			le.history.Reset()
+			return string(line), nil
+		}
+		if err != nil {
+			return "", err
+		}
+		le.trackCompletionCycle(action)
 
-		ch := buf[0]
-
-		switch ch {
-		case '\r': // Enter key (in raw mode, Enter sends \r)
+		switch action {
+		case ActionAcceptLine:
+			le.clearSuggestion(line, cursor)
 			// With OPOST disabled, we need to send \r\n manually
 			os.Stdout.WriteString("\r\n")
 			os.Stdout.Sync()
@@ -307,131 +1124,113 @@ func (le *LineEditor) ReadLineWithArrows() (string, error) {
 			}
 			return result, nil
 
-		case '\n': // Handle \n as well just in case
-			os.Stdout.WriteString("\r\n")
-			os.Stdout.Sync()
-			result := string(line)
-			if result != "" {
-				le.history.Reset()
-			}
-			return result, nil
-		case '\x03': // Ctrl+C
+		case ActionInterrupt:
+			le.clearSuggestion(line, cursor)
 			os.Stdout.WriteString("^C\r\n")
 			os.Stdout.Sync()
 			le.history.Reset()
-			return "", fmt.Errorf("interrupted")
+			return "", ErrInterrupted
 
-		case '\x7f', '\b': // Backspace
+		case ActionBackwardDeleteChar:
 			if cursor > 0 {
 				line = append(line[:cursor-1], line[cursor:]...)
 				cursor--
 				le.redrawLine(line, cursor)
 			}
 
-		case '\t': // Tab completion
-			completions := le.completionEngine.Complete(string(line), cursor)
-			if len(completions) == 1 {
-				// Single completion - insert it
-				completion := completions[0]
+		case ActionDeleteChar:
+			// Like the terminal's own EOF handling, Ctrl+D on an empty
+			// line ends input, so that it exits the shell
+			if len(line) == 0 && seq == eofKey {
+				return "", io.EOF
+			}
+			if cursor < len(line) {
+				line = append(line[:cursor], line[cursor+1:]...)
+				le.redrawLine(line, cursor)
+			}
 
-				// Replace the prefix with the completion
-				wordStart := cursor
-				for wordStart > 0 && line[wordStart-1] != ' ' {
-					wordStart--
-				}
+		case ActionComplete:
+			line, cursor = le.complete(line, cursor, 1)
 
-				newLine := append(line[:wordStart], []rune(completion)...)
-				newLine = append(newLine, line[cursor:]...)
+		case ActionMenuCompleteBackward:
+			line, cursor = le.complete(line, cursor, -1)
+
+		case ActionPreviousHistory:
+			if newLine, ok := le.navigateHistory(line, -1); ok {
 				line = newLine
-				cursor = wordStart + len([]rune(completion))
+				cursor = len(line)
 				le.redrawLine(line, cursor)
-			} else if len(completions) > 1 {
-				// Multiple completions - try common prefix completion first
-				commonPrefix := findCommonPrefix(completions)
-
-				// Find current word being completed
-				wordStart := cursor
-				for wordStart > 0 && line[wordStart-1] != ' ' {
-					wordStart--
-				}
-				currentWord := string(line[wordStart:cursor])
-
-				// If common prefix is longer than current word, complete to common prefix
-				if len(commonPrefix) > len(currentWord) {
-					newLine := append(line[:wordStart], []rune(commonPrefix)...)
-					newLine = append(newLine, line[cursor:]...)
-					line = newLine
-					cursor = wordStart + len([]rune(commonPrefix))
-					le.redrawLine(line, cursor)
-				} else {
-					// Show all completions
-					os.Stdout.WriteString("\r\n")
-					os.Stdout.Sync()
-					le.showCompletions(completions)
-					le.redrawLine(line, cursor)
-				}
 			}
 
-		case '\x1b': // Escape sequence (arrow keys)
-			seq, err := le.readEscapeSequence()
-			if err != nil {
-				// If we can't read the escape sequence properly, ignore it
-				// This prevents malformed sequences from being added to the line
-				continue
+		case ActionNextHistory:
+			if newLine, ok := le.navigateHistory(line, 1); ok {
+				line = newLine
+				cursor = len(line)
+				le.redrawLine(line, cursor)
 			}
 
-			switch seq {
-			case "A": // Up arrow - previous history
-				if historyPos > 0 {
-					if historyPos == le.history.Size() {
-						originalLine = string(line)
-					}
-					historyPos--
-					if historyPos < le.history.Size() {
-						histCmd := le.history.GetAll()[historyPos]
-						line = []rune(histCmd)
-						cursor = len(line)
-						le.redrawLine(line, cursor)
-					}
-				}
+		case ActionForwardChar:
+			if cursor < len(line) {
+				cursor++
+				le.redrawLine(line, cursor)
+			} else if newLine, newCursor, ok := le.acceptSuggestion(line, cursor); ok {
+				line, cursor = newLine, newCursor
+				le.redrawLine(line, cursor)
+			}
 
-			case "B": // Down arrow - next history
-				if historyPos < le.history.Size() {
-					historyPos++
-					if historyPos == le.history.Size() {
-						line = []rune(originalLine)
-					} else {
-						histCmd := le.history.GetAll()[historyPos]
-						line = []rune(histCmd)
-					}
-					cursor = len(line)
-					le.redrawLine(line, cursor)
-				}
+		case ActionBackwardChar:
+			if cursor > 0 {
+				cursor--
+				le.redrawLine(line, cursor)
+			}
 
-			case "C": // Right arrow
-				if cursor < len(line) {
-					cursor++
-					le.redrawLine(line, cursor)
-				}
+		case ActionBeginningOfLine:
+			cursor = 0
+			le.redrawLine(line, cursor)
 
-			case "D": // Left arrow
-				if cursor > 0 {
-					cursor--
-					le.redrawLine(line, cursor)
-				}
+		case ActionEndOfLine:
+			// At the end already, End takes the suggested command
+			if newLine, newCursor, ok := le.acceptSuggestion(line, cursor); ok {
+				line, cursor = newLine, newCursor
+			}
+			cursor = len(line)
+			le.redrawLine(line, cursor)
 
-			case "H": // Home key
-				cursor = 0
-				le.redrawLine(line, cursor)
+		case ActionKillLine:
+			line = line[:cursor]
+			le.redrawLine(line, cursor)
 
-			case "F": // End key
-				cursor = len(line)
+		case ActionUnixLineDiscard:
+			line = append([]rune{}, line[cursor:]...)
+			cursor = 0
+			le.redrawLine(line, cursor)
+
+		case ActionEditCommandLine:
+			// The editor needs the terminal in its usual mode
+			os.Stdout.WriteString("\r\n")
+			le.disableRawMode()
+			edited, err := editCommandLine(string(line))
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "gosh: edit-command-line: %v\n", err)
+				if err := le.enableRawMode(); err != nil {
+					le.capable = false
+					return le.readLineSimple()
+				}
 				le.redrawLine(line, cursor)
+				continue
+			}
+
+			// Show what is about to run, as bash does
+			if edited != "" {
+				fmt.Println(edited)
+				le.history.Reset()
 			}
+			return edited, nil
 
 		default:
-			// Regular character input
-			if ch >= 32 && ch < 127 { // Printable ASCII
+			// Unbound keys insert themselves if they're printable ASCII,
+			// and are ignored otherwise
+			if ch := seq[0]; len(seq) == 1 && ch >= 32 && ch < 127 {
 				line = append(line[:cursor], append([]rune{rune(ch)}, line[cursor:]...)...)
 				cursor++
 				le.redrawLine(line, cursor)
@@ -440,302 +1239,2023 @@ func (le *LineEditor) ReadLineWithArrows() (string, error) {
 	}
 }
 
-// readEscapeSequence reads an escape sequence for arrow keys
-func (le *LineEditor) readEscapeSequence() (string, error) {
-	// Read the '[' character
-	var buf [1]byte
-	n, err := os.Stdin.Read(buf[:])
-	if err != nil || n == 0 {
-		return "", fmt.Errorf("incomplete escape sequence")
+// complete handles Tab (delta 1) and Shift+Tab (delta -1). A single
+// completion is inserted. With several, Tab first completes their common
+// prefix, or lists them if there's nothing more in common, and further
+// presses put each one on the line in turn, wrapping around; Shift+Tab
+// goes through them backward.
+func (le *LineEditor) complete(line []rune, cursor, delta int) ([]rune, int) {
+	if le.menu != nil {
+		return le.cycleCompletion(line, cursor, delta)
 	}
 
-	if buf[0] != '[' {
-		return "", fmt.Errorf("unknown escape sequence")
+	completions := le.completionEngine.Complete(string(line), cursor)
+	if len(completions) == 0 {
+		return line, cursor
 	}
 
-	// Read the actual key code
-	n, err = os.Stdin.Read(buf[:])
-	if err != nil || n == 0 {
-		return "", fmt.Errorf("incomplete escape sequence")
+	// Find current word being completed
+	wordStart := cursor
+	for wordStart > 0 && line[wordStart-1] != ' ' {
+		wordStart--
 	}
 
-	return string(buf[0]), nil
-}
+	if len(completions) == 1 {
+		// Single completion - insert it
+		line, cursor = replaceWord(line, wordStart, cursor, completions[0])
+		le.redrawLine(line, cursor)
+		return line, cursor
+	}
 
-// redrawLine redraws the current line and positions the cursor
-func (le *LineEditor) redrawLine(line []rune, cursor int) {
-	// Clear the line and move to beginning
-	os.Stdout.WriteString("\033[2K\r")
-	// Print prompt and line
-	os.Stdout.WriteString("gosh> " + string(line))
-	// Position cursor
-	if cursor < len(line) {
-		os.Stdout.WriteString(fmt.Sprintf("\033[%dD", len(line)-cursor))
+	le.menu = &completionMenu{candidates: completions, index: -1, wordStart: wordStart}
+	if delta < 0 {
+		return le.cycleCompletion(line, cursor, delta)
+	}
+
+	// If common prefix is longer than current word, complete to common prefix
+	commonPrefix := findCommonPrefix(completions)
+	if len([]rune(commonPrefix)) > cursor-wordStart {
+		line, cursor = replaceWord(line, wordStart, cursor, commonPrefix)
+		le.redrawLine(line, cursor)
+		return line, cursor
 	}
-	// Ensure output is flushed
+
+	// Show all completions, asking first if there are a lot of them
+	os.Stdout.WriteString("\r\n")
 	os.Stdout.Sync()
+	if confirmCompletions(len(completions)) {
+		le.showCompletions(completions)
+	}
+	le.redrawLine(line, cursor)
+	return line, cursor
 }
 
-// showCompletions displays available completions in a formatted way
-func (le *LineEditor) showCompletions(completions []string) {
-	const maxCols = 80
-	const minColWidth = 12
+// confirmCompletions asks whether to list n completions if there are more
+// than completionQueryItems, reading a single key as the answer: y or a
+// space lists them and anything else doesn't
+func confirmCompletions(n int) bool {
+	if n <= completionQueryItems {
+		return true
+	}
+	os.Stdout.WriteString(completionQuery(n))
+	var buf [1]byte
+	_, err := os.Stdin.Read(buf[:])
+	os.Stdout.WriteString("\r\n")
+	return err == nil && (buf[0] == 'y' || buf[0] == 'Y' || buf[0] == ' ')
+}
 
-	if len(completions) == 0 {
-		return
+// cycleCompletion replaces the word being completed with the next
+// candidate, or the previous one if delta is negative
+func (le *LineEditor) cycleCompletion(line []rune, cursor, delta int) ([]rune, int) {
+	menu := le.menu
+	n := len(menu.candidates)
+	switch {
+	case menu.index >= 0:
+		menu.index = (menu.index + delta + n) % n
+	case delta > 0:
+		menu.index = 0
+	default:
+		menu.index = n - 1
+	}
+	line, cursor = replaceWord(line, menu.wordStart, cursor, menu.candidates[menu.index])
+	le.redrawLine(line, cursor)
+	return line, cursor
+}
+
+// trackCompletionCycle ends a completion cycle when any key other than Tab
+// or Shift+Tab is pressed
+func (le *LineEditor) trackCompletionCycle(action Action) {
+	if action != ActionComplete && action != ActionMenuCompleteBackward {
+		le.menu = nil
 	}
+}
 
-	// Find the maximum length for column width
-	maxLen := 0
-	for _, comp := range completions {
-		if len(comp) > maxLen {
-			maxLen = len(comp)
+// replaceWord replaces line[start:end] with word, returning the new line and
+// the position just after word
+func replaceWord(line []rune, start, end int, word string) ([]rune, int) {
+	newLine := append([]rune{}, line[:start]...)
+	newLine = append(newLine, []rune(word)...)
+	newLine = append(newLine, line[end:]...)
+	return newLine, start + len([]rune(word))
+}
+
+// redrawLine redraws the current line and positions the cursor. The whole
+// update goes out in a single write so the line doesn't flicker. A line too
+// long for the terminal scrolls sideways to keep the cursor in view, rather
+// than wrapping onto rows that clearing the line wouldn't reach.
+func (le *LineEditor) redrawLine(line []rune, cursor int) {
+	prompt := le.promptText()
+	cols, _ := WindowSize()
+	width := cols - promptWidth(prompt) - 1
+	start, end := scrollWindow(len(line), cursor, width)
+
+	var buf strings.Builder
+	// Clear the line and move to beginning
+	buf.WriteString("\033[2K\r")
+	// Print prompt and line
+	buf.WriteString(prompt)
+	if highlightEnabled() {
+		buf.WriteString(renderHighlighted(highlightLine(line), start, end))
+	} else {
+		buf.WriteString(string(line[start:end]))
+	}
+	// Show the rest of a suggested command, dimmed, in whatever room is
+	// left, then come back to the cursor
+	back := end - cursor
+	if suggestion := []rune(le.suggestion(line, cursor)); len(suggestion) > 0 {
+		suggestion = suggestion[:min(len(suggestion), max(width-(end-start), 0))]
+		if len(suggestion) > 0 {
+			fmt.Fprintf(&buf, "\033[2m%s\033[0m", string(suggestion))
+			back += len(suggestion)
 		}
 	}
+	// Position cursor
+	if back > 0 {
+		fmt.Fprintf(&buf, "\033[%dD", back)
+	}
+	os.Stdout.WriteString(buf.String())
+}
 
-	colWidth := maxLen + 2
-	if colWidth < minColWidth {
-		colWidth = minColWidth
+// autosuggestEnabled reports whether commands from history are suggested
+// while typing, which is turned off with GOSH_AUTOSUGGEST=0
+func autosuggestEnabled() bool {
+	return os.Getenv("GOSH_AUTOSUGGEST") != "0"
+}
+
+// suggestion returns the rest of the latest history command that starts
+// with line, to be offered after the cursor. Suggestions are only made
+// with the cursor at the end of the line.
+func (le *LineEditor) suggestion(line []rune, cursor int) string {
+	if !autosuggestEnabled() || le.history == nil || cursor != len(line) {
+		return ""
+	}
+	typed := string(line)
+	if command := le.history.Suggest(typed); command != "" {
+		return command[len(typed):]
 	}
+	return ""
+}
 
-	cols := maxCols / colWidth
-	if cols < 1 {
-		cols = 1
+// clearSuggestion erases the suggestion shown after the cursor, if any, so
+// that it isn't left on screen once the line is finished
+func (le *LineEditor) clearSuggestion(line []rune, cursor int) {
+	if le.suggestion(line, cursor) != "" {
+		os.Stdout.WriteString("\033[K")
 	}
+}
 
-	// Print completions in columns
-	for i, comp := range completions {
-		fmt.Printf("%-*s", colWidth, comp)
-		if (i+1)%cols == 0 || i == len(completions)-1 {
-			os.Stdout.WriteString("\r\n")
-		}
+// acceptSuggestion adds the suggested command's remaining text to the line,
+// reporting whether there was one
+func (le *LineEditor) acceptSuggestion(line []rune, cursor int) ([]rune, int, bool) {
+	suggestion := le.suggestion(line, cursor)
+	if suggestion == "" {
+		return line, cursor, false
 	}
+	line = append(line, []rune(suggestion)...)
+	return line, len(line), true
 }
 
-// readLineSimple is a fallback for when raw mode is not available
-func (le *LineEditor) readLineSimple() (string, error) {
-	reader := bufio.NewReader(os.Stdin)
-	line, err := reader.ReadString('\n')
-	if err != nil {
-		return "", err
+// scrollWindow returns the part of a line of length runes to show in width
+// columns so that the cursor is on screen
+func scrollWindow(length, cursor, width int) (start, end int) {
+	if width < 1 {
+		width = 1
+	}
+	if length <= width {
+		return 0, length
 	}
-	return strings.TrimSuffix(line, "\n"), nil
+	if cursor >= width {
+		start = cursor - width + 1
+	}
+	return start, min(start+width, length)
 }
 
-// Legacy functions - kept for compatibility but not used
-func SetHistory(hist *history.History) {
-	// No longer needed - history is handled by readline
+// highlightEnabled reports whether the command line is colored as it is
+// typed, which is turned off with GOSH_HIGHLIGHT=0
+func highlightEnabled() bool {
+	return os.Getenv("GOSH_HIGHLIGHT") != "0"
 }
 
-// Global readline instance
-var globalReadline *readline.Instance
+// highlightKind is how a piece of the command line is colored
+type highlightKind int
 
-// customCompleter provides dynamic completion for commands and files
-type customCompleter struct {
-	ce *CompletionEngine
+const (
+	highlightPlain    highlightKind = iota
+	highlightCommand                // a command that can be run
+	highlightUnknown                // a command that can't be found
+	highlightString                 // quoted text
+	highlightOperator               // pipes, separators and redirections
+)
+
+// highlightColors holds the ANSI color for each kind of segment
+var highlightColors = map[highlightKind]string{
+	highlightCommand:  "32",
+	highlightUnknown:  "31",
+	highlightString:   "33",
+	highlightOperator: "36",
 }
 
-func (c *customCompleter) Do(line []rune, pos int) (newLine [][]rune, length int) {
-	// Convert to string for our existing completion engine
-	lineStr := string(line)
-	completions := c.ce.Complete(lineStr, pos)
+// highlightSegment is a run of the command line colored the same way
+type highlightSegment struct {
+	text string
+	kind highlightKind
+}
 
-	if len(completions) == 0 {
-		return nil, 0
-	}
+// Reserved words, and whether the word after one is a command too
+var reservedWords = map[string]bool{
+	"!": true, "if": true, "then": true, "else": true, "elif": true,
+	"while": true, "until": true, "do": true, "{": true,
+	"fi": false, "for": false, "in": false, "done": false,
+	"case": false, "esac": false, "}": false,
+}
 
-	// Find the word being completed
-	wordStart := pos
-	for wordStart > 0 && lineStr[wordStart-1] != ' ' {
-		wordStart--
+// highlightLine splits a command line into the segments it is colored
+// in. The first word of each command is looked up as a command, quoted text
+// in the other words is a string, and control and redirection operators
+// stand out. Assignments before a command are left plain.
+func highlightLine(line []rune) []highlightSegment {
+	var segments []highlightSegment
+	add := func(text []rune, kind highlightKind) {
+		if len(text) == 0 {
+			return
+		}
+		if n := len(segments); n > 0 && segments[n-1].kind == kind {
+			segments[n-1].text += string(text)
+			return
+		}
+		segments = append(segments, highlightSegment{string(text), kind})
 	}
 
-	// Get the current prefix being typed
-	currentPrefix := lineStr[wordStart:pos]
+	commandPosition := true
+	for i := 0; i < len(line); {
+		c := line[i]
+		switch {
+		case c == ' ' || c == '\t':
+			add(line[i:i+1], highlightPlain)
+			i++
+
+		case strings.ContainsRune("|&;<>", c):
+			end := i + 1
+			if end < len(line) && slices.Contains([]string{"||", "&&", "|&", ">>"}, string(line[i:end+1])) {
+				end++
+			}
+			add(line[i:end], highlightOperator)
+			// The word after a redirection is a file, not a command
+			commandPosition = c != '<' && c != '>'
+			i = end
 
-	// Convert completions to the format readline expects (suffixes only)
-	var suggestions [][]rune
-	for _, completion := range completions {
-		if strings.HasPrefix(completion, currentPrefix) {
-			// Return only the suffix that needs to be added
-			suffix := completion[len(currentPrefix):]
-			suggestions = append(suggestions, []rune(suffix))
+		default:
+			end := highlightWordEnd(line, i)
+			word := line[i:end]
+			_, _, assignment := shell.ParseAssignment(string(word))
+			switch {
+			case commandPosition && assignment:
+				addQuoted(word, add)
+			case commandPosition:
+				kind := highlightUnknown
+				if isKnownCommand(string(word)) {
+					kind = highlightCommand
+				}
+				add(word, kind)
+				commandPosition = reservedWords[string(word)]
+			default:
+				addQuoted(word, add)
+			}
+			i = end
 		}
 	}
+	return segments
+}
 
-	// Return the length of the shared prefix among all suggestions
-	if len(suggestions) == 0 {
-		return nil, 0
-	}
-
-	// Find the common prefix length among all suffixes
-	commonPrefixLen := 0
-	if len(suggestions) > 1 {
-		// Find how many characters all suffixes share at the beginning
-		minLen := len(suggestions[0])
-		for _, sugg := range suggestions[1:] {
-			if len(sugg) < minLen {
-				minLen = len(sugg)
+// highlightWordEnd returns the index just past the word starting at start:
+// the next unquoted blank or operator character
+func highlightWordEnd(line []rune, start int) int {
+	var quote rune
+	for i := start; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			} else if c == '\\' && quote == '"' {
+				i++
 			}
+		case c == '\\':
+			i++
+		case c == '\'' || c == '"':
+			quote = c
+		case c == ' ' || c == '\t' || strings.ContainsRune("|&;<>", c):
+			return i
 		}
+	}
+	return len(line)
+}
 
-		for i := 0; i < minLen; i++ {
-			char := suggestions[0][i]
-			allMatch := true
-			for _, sugg := range suggestions[1:] {
-				if sugg[i] != char {
-					allMatch = false
-					break
+// addQuoted adds a word that isn't a command, with its quoted parts, and
+// any unterminated quote at its end, as strings
+func addQuoted(word []rune, add func([]rune, highlightKind)) {
+	start := 0
+	for i := 0; i < len(word); i++ {
+		switch c := word[i]; {
+		case c == '\\':
+			i++
+		case c == '\'' || c == '"':
+			add(word[start:i], highlightPlain)
+			end := i + 1
+			for end < len(word) && word[end] != c {
+				if word[end] == '\\' && c == '"' {
+					end++
 				}
+				end++
 			}
-			if !allMatch {
-				break
-			}
-			commonPrefixLen++
+			end = min(end+1, len(word))
+			add(word[i:end], highlightString)
+			start = end
+			i = end - 1
 		}
-	} else {
-		// Single suggestion - return its full length
-		commonPrefixLen = len(suggestions[0])
 	}
-
-	return suggestions, commonPrefixLen
+	add(word[start:], highlightPlain)
 }
 
-// InitReadline initializes the readline library with history and completion
-func InitReadline(hist *history.History) error {
-	// Create completion engine
-	ce := NewCompletionEngine()
-	completer := &customCompleter{ce: ce}
-
-	// Configure readline with completion and history
-	config := &readline.Config{
-		Prompt:                 "gosh> ",
-		AutoComplete:           completer,
-		InterruptPrompt:        "^C",
-		EOFPrompt:              "exit",
-		HistorySearchFold:      true,
-		DisableAutoSaveHistory: false,
-		// Force color support - might help with highlighting
-		FuncIsTerminal: func() bool { return true },
+// isKnownCommand reports whether name is a reserved word, builtin or
+// function, or an executable found directly or in PATH
+func isKnownCommand(name string) bool {
+	if _, ok := reservedWords[name]; ok {
+		return true
 	}
+	if _, ok := builtinDescriptions[name]; ok {
+		return true
+	}
+	if _, ok := shell.LookupFunction(name); ok {
+		return true
+	}
+	if _, ok := shell.LookupAlias(name); ok {
+		return true
+	}
+	_, err := shell.LookPath(name)
+	return err == nil
+}
 
-	// Set up history file if available
-	if hist != nil {
-		historyPath := hist.GetHistoryPath()
-		if historyPath != "" {
-			config.HistoryFile = historyPath
+// renderHighlighted returns the runes from start to end of the line that
+// segments were made from, wrapped in their colors. The escape sequences
+// take up no columns, so the cursor can be placed as for plain text.
+func renderHighlighted(segments []highlightSegment, start, end int) string {
+	var buf strings.Builder
+	pos := 0
+	for _, segment := range segments {
+		text := []rune(segment.text)
+		from, to := max(start-pos, 0), min(end-pos, len(text))
+		pos += len(text)
+		if from >= to {
+			continue
+		}
+		if color, ok := highlightColors[segment.kind]; ok {
+			fmt.Fprintf(&buf, "\033[%sm%s\033[0m", color, string(text[from:to]))
+		} else {
+			buf.WriteString(string(text[from:to]))
 		}
 	}
+	return buf.String()
+}
 
-	rl, err := readline.NewEx(config)
-	if err != nil {
-		return err
-	}
+// highlightPainter colors the line being edited with readline
+type highlightPainter struct{}
 
-	globalReadline = rl
-	return nil
+func (highlightPainter) Paint(line []rune, _ int) []rune {
+	if !highlightEnabled() {
+		return line
+	}
+	return []rune(renderHighlighted(highlightLine(line), 0, len(line)))
 }
 
-// CloseReadline cleans up the readline instance
-func CloseReadline() {
-	if globalReadline != nil {
-		globalReadline.Close()
+// showCompletions displays available completions in a formatted way
+func (le *LineEditor) showCompletions(completions []string) {
+	if len(completions) == 0 {
+		return
 	}
-}
 
-// ReadLine reads a line of input from stdin with a prompt and arrow key support
-func ReadLine() (string, error) {
-	// Use readline library if available (provides arrow keys, history, tab completion)
-	if globalReadline != nil {
-		line, err := globalReadline.Readline()
-		if err != nil {
-			// Handle Ctrl+C like bash - just return empty string to continue
-			if err == readline.ErrInterrupt {
-				return "", nil
+	// Job specs mean little on their own, so they are always listed with the
+	// command each one stands for
+	if strings.HasPrefix(completions[0], "%") {
+		if lines, ok := describeCompletions(completions, jobSpecDescriptions()); ok {
+			for _, line := range lines {
+				os.Stdout.WriteString(line + "\r\n")
 			}
-			return "", err
+			return
 		}
-		return line, nil
 	}
 
-	// Fallback to simple mode if readline not available
-	fmt.Print("gosh> ")
-	reader := bufio.NewReader(os.Stdin)
-	line, err := reader.ReadString('\n')
-	if err != nil {
-		return "", err
+	// With descriptions turned on, list one completion per line instead
+	if os.Getenv("GOSH_COMPLETE_DESC") == "1" {
+		if lines, ok := describeCompletions(completions, builtinDescriptions); ok {
+			for _, line := range lines {
+				os.Stdout.WriteString(line + "\r\n")
+			}
+			return
+		}
 	}
-	return strings.TrimSuffix(line, "\n"), nil
-}
 
-// ParseLine parses a command line into arguments
-func ParseLine(line string) []string {
-	line = strings.TrimSpace(line)
-	if line == "" {
-		return []string{}
+	width, _ := WindowSize()
+	for _, line := range completionColumns(completions, width) {
+		os.Stdout.WriteString(line + "\r\n")
 	}
-
-	// Simple whitespace splitting for now
-	// TODO: Handle quotes, escaping, etc.
-	args := strings.Fields(line)
-	return args
 }
 
-// ParseCommand parses a command line into a Command struct with redirection
-func ParseCommand(line string) *Command {
-	line = strings.TrimSpace(line)
-	if line == "" {
-		return &Command{}
-	}
+// completionColumns lays completions out in as many columns as fit in
+// width, filling each row from left to right
+func completionColumns(completions []string, width int) []string {
+	const minColWidth = 12
 
+	// Find the maximum length for column width
+	maxLen := 0
+	for _, comp := range completions {
+		if len(comp) > maxLen {
+			maxLen = len(comp)
+		}
+	}
+
+	colWidth := maxLen + 2
+	if colWidth < minColWidth {
+		colWidth = minColWidth
+	}
+
+	cols := width / colWidth
+	if cols < 1 {
+		cols = 1
+	}
+
+	var lines []string
+	for row := 0; row*cols < len(completions); row++ {
+		var line strings.Builder
+		rowEnd := min((row+1)*cols, len(completions))
+		for _, comp := range completions[row*cols : rowEnd] {
+			fmt.Fprintf(&line, "%-*s", colWidth, comp)
+		}
+		lines = append(lines, line.String())
+	}
+	return lines
+}
+
+// describeCompletions formats completions one per line, annotating those
+// that have a description as "name  -- description". It returns false if
+// none of the completions has a description.
+func describeCompletions(completions []string, descriptions map[string]string) ([]string, bool) {
+	described := false
+	maxLen := 0
+	for _, comp := range completions {
+		if _, ok := descriptions[comp]; ok {
+			described = true
+		}
+		if len(comp) > maxLen {
+			maxLen = len(comp)
+		}
+	}
+	if !described {
+		return nil, false
+	}
+
+	lines := make([]string, len(completions))
+	for i, comp := range completions {
+		if description, ok := descriptions[comp]; ok {
+			lines[i] = fmt.Sprintf("%-*s  -- %s", maxLen, comp, description)
+		} else {
+			lines[i] = comp
+		}
+	}
+	return lines, true
+}
+
+// editCommandLine opens line in $EDITOR, or vi if that isn't set, and
+// returns the text that was saved without its trailing newlines. $EDITOR
+// may include arguments, such as "code -w".
+func editCommandLine(line string) (string, error) {
+	file, err := os.CreateTemp("", "gosh-edit-*.sh")
+	if err != nil {
+		return "", err
+	}
+	path := file.Name()
+	defer os.Remove(path)
+
+	_, err = file.WriteString(line + "\n")
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", err
+	}
+
+	editor := strings.Fields(os.Getenv("EDITOR"))
+	if len(editor) == 0 {
+		editor = []string{"vi"}
+	}
+	cmd := exec.Command(editor[0], append(editor[1:], path)...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return "", err
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(content), "\n"), nil
+}
+
+// readLineSimple is a fallback for when raw mode is not available
+func (le *LineEditor) readLineSimple() (string, error) {
+	startWaiting(le.promptText(), nil)
+	defer stopWaiting()
+	return readStdinLine()
+}
+
+// keyInput returns the file the editor reads keys from, and whether Wake
+// can cut a read from it short. Reads from a terminal on stdin can't be,
+// so the editor opens a handle of its own on the terminal for them.
+func (le *LineEditor) keyInput() (*os.File, bool) {
+	if err := os.Stdin.SetReadDeadline(time.Time{}); err == nil || !IsTerminal(os.Stdin) {
+		return os.Stdin, err == nil
+	}
+	if le.tty == nil {
+		tty, err := os.Open("/dev/tty")
+		if err != nil {
+			return os.Stdin, false
+		}
+		le.tty = tty
+	}
+	return le.tty, le.tty.SetReadDeadline(time.Time{}) == nil
+}
+
+// runWoken runs the idle handler when Wake interrupts reading keys, with
+// the terminal in the mode commands expect, and then redraws the line
+func (le *LineEditor) runWoken(keys *os.File, line []rune, cursor int) {
+	keys.SetReadDeadline(time.Time{})
+	os.Stdout.WriteString("\r\033[2K")
+	le.disableRawMode()
+	runIdleHandler()
+	le.enableRawMode()
+	le.redrawLine(line, cursor)
+}
+
+// readStdinLine reads a line from stdin without the newline. A last line
+// with no newline is still returned. Stdin is read a byte at a time, since
+// buffering would swallow input meant for the next read, such as the rest
+// of a script piped in.
+func readStdinLine() (string, error) {
+	var line []byte
+	var buf [1]byte
+	for {
+		n, err := os.Stdin.Read(buf[:])
+		if n == 1 {
+			if buf[0] == '\n' {
+				return string(line), nil
+			}
+			line = append(line, buf[0])
+		}
+		if err != nil {
+			if errors.Is(err, io.EOF) && len(line) > 0 {
+				return string(line), nil
+			}
+			return "", err
+		}
+	}
+}
+
+// The shell's history, which AddHistory adds to - set by main
+var shellHistory *history.History
+
+// SetHistory sets the history that AddHistory records commands in
+func SetHistory(hist *history.History) {
+	shellHistory = hist
+}
+
+// AddHistory records a command in the shell's history, and in readline's,
+// as a single entry even if it was typed over several lines
+func AddHistory(line string) {
+	if shellHistory == nil {
+		return
+	}
+	shellHistory.Add(line)
+
+	// Readline only gets what the history actually kept, so ignored
+	// commands stay out of it too
+	commands := shellHistory.GetAll()
+	if globalReadline != nil && len(commands) > 0 && commands[len(commands)-1] == strings.TrimSpace(line) {
+		globalReadline.SaveHistory(commands[len(commands)-1])
+	}
+}
+
+// mergeSharedHistory picks up the commands other sessions have added to
+// the history file when GOSH_HISTORY_SHARE=1, so that they can be recalled
+// at the next prompt
+func mergeSharedHistory() {
+	if shellHistory == nil || os.Getenv("GOSH_HISTORY_SHARE") != "1" {
+		return
+	}
+	added, err := shellHistory.AppendFromFile()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "gosh: warning: %v\n", err)
+	}
+	if globalReadline != nil {
+		for _, command := range added {
+			globalReadline.SaveHistory(command)
+		}
+	}
+}
+
+// Backend is a way of reading command lines from the user
+type Backend int
+
+const (
+	// BackendSimple reads whole lines from stdin, with no editing beyond
+	// what the terminal itself does
+	BackendSimple Backend = iota
+	// BackendReadline uses the readline library for editing, history and
+	// completion
+	BackendReadline
+	// BackendBuiltin uses gosh's own line editor
+	BackendBuiltin
+)
+
+// backendNames maps the values of GOSH_READLINE to backends
+var backendNames = map[string]Backend{
+	"simple":   BackendSimple,
+	"readline": BackendReadline,
+	"builtin":  BackendBuiltin,
+}
+
+// selectBackend returns the backend named by GOSH_READLINE, readline if it
+// is empty
+func selectBackend(name string) (Backend, error) {
+	if name == "" {
+		return BackendReadline, nil
+	}
+	if backend, ok := backendNames[name]; ok {
+		return backend, nil
+	}
+	return BackendReadline, fmt.Errorf("GOSH_READLINE: unknown line editor '%s', using readline", name)
+}
+
+// The backend that ReadLine reads with, set up by InitReadline. Until then
+// lines are read from stdin as they are. showPrompts is false when stdin
+// isn't a terminal, so that a script piped into the shell doesn't have
+// prompts mixed into its output.
+var (
+	activeBackend = BackendSimple
+	builtinEditor *LineEditor
+	showPrompts   = true
+)
+
+// Global readline instance
+var globalReadline *readline.Instance
+
+// newReadline creates the readline instance, and can be replaced in tests
+var newReadline = readline.NewEx
+
+// readlineAbandoned is set when a read timed out. Readline's terminal
+// goroutine is then still blocked on stdin, so closing it would hang.
+var readlineAbandoned bool
+
+// customCompleter provides dynamic completion for commands and files
+type customCompleter struct {
+	ce *CompletionEngine
+}
+
+func (c *customCompleter) Do(line []rune, pos int) (newLine [][]rune, length int) {
+	// Convert to string for our existing completion engine
+	lineStr := string(line)
+	completions := c.ce.Complete(lineStr, pos)
+
+	if len(completions) == 0 {
+		return nil, 0
+	}
+
+	// Find the word being completed
+	wordStart := pos
+	for wordStart > 0 && lineStr[wordStart-1] != ' ' {
+		wordStart--
+	}
+
+	// Get the current prefix being typed
+	currentPrefix := lineStr[wordStart:pos]
+
+	// Convert completions to the format readline expects (suffixes only)
+	var suggestions [][]rune
+	for _, completion := range completions {
+		if strings.HasPrefix(completion, currentPrefix) {
+			// Return only the suffix that needs to be added
+			suffix := completion[len(currentPrefix):]
+			suggestions = append(suggestions, []rune(suffix))
+		}
+	}
+
+	// Return the length of the shared prefix among all suggestions
+	if len(suggestions) == 0 {
+		return nil, 0
+	}
+
+	// Find the common prefix length among all suffixes
+	commonPrefixLen := 0
+	if len(suggestions) > 1 {
+		// Find how many characters all suffixes share at the beginning
+		minLen := len(suggestions[0])
+		for _, sugg := range suggestions[1:] {
+			if len(sugg) < minLen {
+				minLen = len(sugg)
+			}
+		}
+
+		for i := 0; i < minLen; i++ {
+			char := suggestions[0][i]
+			allMatch := true
+			for _, sugg := range suggestions[1:] {
+				if sugg[i] != char {
+					allMatch = false
+					break
+				}
+			}
+			if !allMatch {
+				break
+			}
+			commonPrefixLen++
+		}
+	} else {
+		// Single suggestion - return its full length
+		commonPrefixLen = len(suggestions[0])
+	}
+
+	return suggestions, commonPrefixLen
+}
+
+// The prompts shown when PS1, PS2 and GOSH_COMPLETION_QUERY aren't set.
+// Each is looked up again every time it is shown, so changes take effect
+// at once.
+const (
+	prompt                    = "gosh> "
+	defaultContinuationPrompt = "> "
+	defaultCompletionQuery    = "Display all %d possibilities? (y or n)"
+)
+
+// completionQueryItems is how many completions the line editor lists
+// without asking first
+const completionQueryItems = 100
+
+// commandPrompt returns the prompt shown when reading a command: PS1 with
+// its escapes expanded, or gosh's usual prompt
+func commandPrompt() string {
+	if ps1 := shell.GetVar("PS1"); ps1 != "" {
+		return formatPrompt(ps1)
+	}
+	return prompt
+}
+
+// continuationPrompt returns the prompt shown when reading more of a
+// command that didn't fit on one line: PS2 with its escapes expanded, or
+// "> "
+func continuationPrompt() string {
+	if ps2 := shell.GetVar("PS2"); ps2 != "" {
+		return formatPrompt(ps2)
+	}
+	return defaultContinuationPrompt
+}
+
+// completionQuery returns the question asked before listing n completions,
+// from GOSH_COMPLETION_QUERY with %d standing for n
+func completionQuery(n int) string {
+	query := os.Getenv("GOSH_COMPLETION_QUERY")
+	if query == "" {
+		query = defaultCompletionQuery
+	}
+	return strings.ReplaceAll(query, "%d", strconv.Itoa(n))
+}
+
+// promptWidth returns how many columns p takes up on screen, leaving out
+// escape sequences such as colors
+func promptWidth(p string) int {
+	width := 0
+	for i := 0; i < len(p); {
+		if p[i] == '\033' && i+1 < len(p) && p[i+1] == '[' {
+			// Skip to the final byte of the control sequence
+			i += 2
+			for i < len(p) && (p[i] < 0x40 || p[i] > 0x7e) {
+				i++
+			}
+			i++
+			continue
+		}
+		_, size := utf8.DecodeRuneInString(p[i:])
+		width++
+		i += size
+	}
+	return width
+}
+
+// formatPrompt expands the escapes in a prompt string, as bash does: \j
+// for the number of running and stopped jobs, \! for the history number of
+// the command about to be typed and \\ for a backslash. Other backslashes
+// are kept as they are.
+func formatPrompt(ps1 string) string {
+	var buf strings.Builder
+	for i := 0; i < len(ps1); i++ {
+		if ps1[i] != '\\' || i+1 == len(ps1) {
+			buf.WriteByte(ps1[i])
+			continue
+		}
+		switch ps1[i+1] {
+		case 'j':
+			jobCount := 0
+			if globalJobManager != nil {
+				jobCount = len(globalJobManager.GetActiveJobs())
+			}
+			buf.WriteString(strconv.Itoa(jobCount))
+		case '!':
+			historySize := 0
+			if shellHistory != nil {
+				historySize = shellHistory.Size()
+			}
+			buf.WriteString(strconv.Itoa(historySize + 1))
+		case '\\':
+			buf.WriteByte('\\')
+		default:
+			buf.WriteByte('\\')
+			continue
+		}
+		i++
+	}
+	return buf.String()
+}
+
+// InitReadline sets up the line editor chosen by GOSH_READLINE: "readline"
+// (the default) for the readline library, "builtin" for gosh's own editor
+// or "simple" for plain line input. If readline can't be set up, the
+// built-in editor is used instead. The error says what went wrong, but
+// input can still be read either way.
+func InitReadline(hist *history.History) error {
+	backend, err := selectBackend(os.Getenv("GOSH_READLINE"))
+
+	// Piped or redirected input can't be edited, so it is read line by
+	// line, without prompts
+	showPrompts = IsTerminal(os.Stdin)
+	if !showPrompts {
+		backend = BackendSimple
+	}
+
+	switch backend {
+	case BackendSimple:
+		activeBackend = BackendSimple
+		return nil
+	case BackendBuiltin:
+		activeBackend = BackendBuiltin
+		builtinEditor = NewLineEditor(hist)
+		return nil
+	}
+
+	if rlErr := initReadlineLibrary(hist); rlErr != nil {
+		activeBackend = BackendBuiltin
+		builtinEditor = NewLineEditor(hist)
+		return fmt.Errorf("%w; using the built-in line editor", rlErr)
+	}
+	activeBackend = BackendReadline
+	return err
+}
+
+// initReadlineLibrary sets up the readline library with history and
+// completion
+func initReadlineLibrary(hist *history.History) error {
+	// Create completion engine
+	ce := NewCompletionEngine()
+	completer := &customCompleter{ce: ce}
+
+	// Configure readline with completion. The history file belongs to
+	// the shell's history, which hands readline whole commands through
+	// AddHistory rather than letting it record each line it reads.
+	config := &readline.Config{
+		Prompt:                 prompt,
+		AutoComplete:           completer,
+		InterruptPrompt:        "^C",
+		EOFPrompt:              "exit",
+		HistorySearchFold:      true,
+		DisableAutoSaveHistory: true,
+		Painter:                highlightPainter{},
+		// Force color support - might help with highlighting
+		FuncIsTerminal: func() bool { return true },
+	}
+
+	rl, err := newReadline(config)
+	if err != nil {
+		return err
+	}
+
+	if hist != nil {
+		for _, command := range hist.GetAll() {
+			rl.SaveHistory(command)
+		}
+	}
+
+	globalReadline = rl
+	return nil
+}
+
+// CloseReadline cleans up the readline instance
+func CloseReadline() {
+	if globalReadline != nil && !readlineAbandoned {
+		globalReadline.Close()
+	}
+}
+
+// ReadLine reads a line of input from stdin with a prompt and arrow key support.
+// If $TMOUT is set and no line arrives within that many seconds, it returns
+// io.EOF so that the shell exits.
+func ReadLine() (string, error) {
+	mergeSharedHistory()
+
+	timeout := idleTimeout()
+	if timeout == 0 {
+		return readLine()
+	}
+
+	type result struct {
+		line string
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		line, err := readLine()
+		done <- result{line, err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.line, r.err
+	case <-time.After(timeout):
+		fmt.Fprintln(os.Stderr, "\ntimed out waiting for input: auto-logout")
+		if globalReadline != nil {
+			// Make the pending read return, which also restores the
+			// terminal mode
+			globalReadline.Operation.Close()
+			<-done
+			readlineAbandoned = true
+		}
+		return "", io.EOF
+	}
+}
+
+// idleTimeout returns how long to wait for input at the prompt before
+// exiting, from $TMOUT in seconds. Zero means wait forever.
+func idleTimeout() time.Duration {
+	seconds, err := strconv.Atoi(os.Getenv("TMOUT"))
+	if err != nil || seconds <= 0 {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// ReadContinuationLine reads another line of a command that continues over
+// several lines, showing the continuation prompt. Ctrl+C gives
+// ErrInterrupted, so that the whole command can be dropped.
+func ReadContinuationLine() (string, error) {
+	return readLinePrompt(continuationPrompt())
+}
+
+// readLine reads a line from readline, or from stdin if readline isn't
+// available
+func readLine() (string, error) {
+	line, err := readLinePrompt(commandPrompt())
+	// Handle Ctrl+C like bash - just return empty string to continue
+	if errors.Is(err, ErrInterrupted) {
+		return "", nil
+	}
+	return line, err
+}
+
+// The function run while the shell waits for a line - set by main
+var idleHandler func()
+
+// SetIdleHandler sets what runs while the shell waits for input: before
+// each prompt, and again whenever Wake is called, such as for traps whose
+// signals have arrived
+func SetIdleHandler(handler func()) {
+	idleHandler = handler
+}
+
+// What a pending read is waiting on, for Wake. Keys is where the built-in
+// editor reads keys from, when it's the one reading. Woken records a Wake
+// that came when no line was being read. The mutex is held while the idle
+// handler runs, so that it never runs alongside the line that was read.
+var (
+	waitMutex  sync.Mutex
+	waiting    bool
+	waitPrompt string
+	waitKeys   *os.File
+	woken      bool
+)
+
+// runIdleHandler runs the idle handler before a prompt is shown
+func runIdleHandler() {
+	waitMutex.Lock()
+	defer waitMutex.Unlock()
+	woken = false
+	if idleHandler != nil {
+		idleHandler()
+	}
+}
+
+// startWaiting marks a line as being read with prompt p, from keys if the
+// built-in editor is reading them. A Wake since the idle handler last ran
+// is acted on straight away.
+func startWaiting(p string, keys *os.File) {
+	waitMutex.Lock()
+	defer waitMutex.Unlock()
+	waiting, waitPrompt, waitKeys = true, p, keys
+	if woken {
+		wake()
+	}
+}
+
+// stopWaiting marks the line as read, once the idle handler is done with
+// it if it's running
+func stopWaiting() {
+	waitMutex.Lock()
+	defer waitMutex.Unlock()
+	waiting, waitKeys = false, nil
+}
+
+// Wake runs the idle handler while a line is being read, rather than
+// waiting for the line to be entered. If no line is being read, it runs
+// before the next prompt.
+func Wake() {
+	waitMutex.Lock()
+	defer waitMutex.Unlock()
+	if !waiting {
+		woken = true
+		return
+	}
+	wake()
+}
+
+// wake does what Wake does for a line being read: the built-in editor is
+// interrupted to run the idle handler between keys, while for the other
+// backends it runs here, with the prompt cleared and then shown again. The
+// caller must hold waitMutex.
+func wake() {
+	woken = false
+	switch {
+	case idleHandler == nil:
+	case waitKeys != nil:
+		waitKeys.SetReadDeadline(time.Now())
+	case activeBackend == BackendReadline && globalReadline != nil:
+		globalReadline.Clean()
+		idleHandler()
+		globalReadline.Refresh()
+	default:
+		if showPrompts {
+			fmt.Println()
+		}
+		idleHandler()
+		if showPrompts {
+			fmt.Print(waitPrompt)
+		}
+	}
+}
+
+// readLinePrompt reads a line like readLine with the active backend,
+// showing p as the prompt. Ctrl+C gives ErrInterrupted.
+func readLinePrompt(p string) (string, error) {
+	switch {
+	case activeBackend == BackendReadline && globalReadline != nil:
+		runIdleHandler()
+		globalReadline.SetPrompt(p)
+		startWaiting(p, nil)
+		line, err := globalReadline.Readline()
+		stopWaiting()
+		if err != nil {
+			if err == readline.ErrInterrupt {
+				return "", ErrInterrupted
+			}
+			return "", err
+		}
+		return sanitizeLine(line), nil
+
+	case activeBackend == BackendBuiltin && builtinEditor != nil:
+		builtinEditor.prompt = p
+		return builtinEditor.ReadLineWithArrows()
+	}
+
+	runIdleHandler()
+	if showPrompts {
+		fmt.Print(p)
+	}
+	startWaiting(p, nil)
+	defer stopWaiting()
+	return readStdinLine()
+}
+
+// IsTerminal reports whether file is a terminal, asking for its settings
+// the way enableRawMode does. /dev/null, for one, is a character device
+// but not a terminal.
+func IsTerminal(file *os.File) bool {
+	var tty termios
+	return controlFd(file, func(fd int) error { return getTermios(fd, &tty) }) == nil
+}
+
+// controlFd calls f with file's descriptor. Unlike Fd, this leaves a file
+// that can be waited on, such as a pipe, in non-blocking mode, so that
+// reads from it can still be cut short by a deadline.
+func controlFd(file *os.File, f func(fd int) error) error {
+	conn, err := file.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var fErr error
+	if err := conn.Control(func(fd uintptr) { fErr = f(int(fd)) }); err != nil {
+		return err
+	}
+	return fErr
+}
+
+// ChooseHistoryMatch lists the commands matching a !prefix history
+// expansion, numbered, and reads the number of the one to run. An empty
+// answer picks the first, most recent, match.
+func ChooseHistoryMatch(matches []string) (string, error) {
+	for i, match := range matches {
+		fmt.Printf("%3d  %s\n", i+1, match)
+	}
+
+	var answer string
+	var err error
+	if globalReadline != nil {
+		// The answer isn't a command, so keep it out of the history
+		globalReadline.SetPrompt("select> ")
+		globalReadline.HistoryDisable()
+		answer, err = globalReadline.Readline()
+		globalReadline.HistoryEnable()
+		globalReadline.SetPrompt(prompt)
+	} else {
+		fmt.Print("select> ")
+		answer, err = bufio.NewReader(os.Stdin).ReadString('\n')
+	}
+	if err != nil {
+		return "", errors.New("history selection cancelled")
+	}
+	return pickMatch(matches, answer)
+}
+
+// pickMatch returns the match numbered by answer
+func pickMatch(matches []string, answer string) (string, error) {
+	answer = strings.TrimSpace(answer)
+	if answer == "" {
+		return matches[0], nil
+	}
+	n, err := strconv.Atoi(answer)
+	if err != nil || n < 1 || n > len(matches) {
+		return "", fmt.Errorf("%s: no such history match", answer)
+	}
+	return matches[n-1], nil
+}
+
+// sanitizeLine removes terminal escape sequences and other control
+// characters from a line, such as ones pasted in or recalled from history,
+// leaving the printable command. Tabs and newlines are kept.
+func sanitizeLine(line string) string {
+	if !strings.ContainsFunc(line, isControlChar) {
+		return line
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case c == '\x1b':
+			i = escapeSequenceEnd(line, i)
+		case isControlChar(rune(c)):
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// isControlChar reports whether r is a control character other than tab
+// and newline
+func isControlChar(r rune) bool {
+	return (r < 0x20 && r != '\t' && r != '\n') || r == 0x7f
+}
+
+// escapeSequenceEnd returns the index of the last byte of the escape
+// sequence starting at line[start]: a CSI sequence such as ESC [ 1 ; 2 H,
+// a string such as an OSC title ended by BEL or ESC \, or ESC and a single
+// character
+func escapeSequenceEnd(line string, start int) int {
+	i := start + 1
+	if i >= len(line) {
+		return start
+	}
+
+	switch line[i] {
+	case '[':
+		// Parameter and intermediate bytes, then a final byte
+		for i++; i < len(line); i++ {
+			if line[i] >= 0x40 && line[i] <= 0x7e {
+				return i
+			}
+			if line[i] < 0x20 || line[i] > 0x3f {
+				return i - 1
+			}
+		}
+		return len(line) - 1
+	case ']', 'P', '_', '^', 'X':
+		for i++; i < len(line); i++ {
+			if line[i] == '\a' {
+				return i
+			}
+			if line[i] == '\x1b' && i+1 < len(line) && line[i+1] == '\\' {
+				return i + 1
+			}
+		}
+		return len(line) - 1
+	case 'O':
+		// SS3, as sent by some terminals for arrow and function keys
+		return min(i+1, len(line)-1)
+	}
+	return i
+}
+
+// ParseLine parses a command line into arguments
+func ParseLine(line string) []string {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return []string{}
+	}
+
+	// Simple whitespace splitting for now
+	// TODO: Handle quotes, escaping, etc.
+	args := strings.Fields(line)
+	return args
+}
+
+// splitUnquoted splits s at every occurrence of sep that is not inside
+// quotes or escaped with a backslash. Quotes and backslashes are left in
+// place. An unterminated quote is an error.
+func splitUnquoted(s string, sep rune) ([]string, error) {
+	var parts []string
+	var quote rune
+	escaped := false
+	start := 0
+	// Nesting of $(...), which is never split, even in double quotes
+	depth := 0
+
+	for i, r := range s {
+		switch {
+		case escaped:
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped = true
+		case r == '$' && quote != '\'' && strings.HasPrefix(s[i+1:], "("):
+			depth++
+		case r == ')' && quote != '\'' && depth > 0:
+			depth--
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '\'' || r == '"':
+			quote = r
+		case depth > 0:
+		case r == sep || (sep == ' ' && (r == '\t' || r == '\n')):
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+
+	if quote != 0 {
+		return nil, fmt.Errorf("unexpected EOF while looking for matching `%c'", quote)
+	}
+	return append(parts, s[start:]), nil
+}
+
+// splitWords splits a line into words on unquoted whitespace. The words keep
+// their quotes so that quoted operators such as '>' aren't mistaken for
+// redirections; expandWord removes them.
+func splitWords(line string) ([]string, error) {
+	parts, err := splitUnquoted(line, ' ')
+	if err != nil {
+		return nil, err
+	}
+
+	words := parts[:0]
+	for _, part := range parts {
+		if part != "" {
+			words = append(words, part)
+		}
+	}
+	return words, nil
+}
+
+// expandAliases replaces the command word of a simple command with the
+// words of its alias, if it has one. When an alias's text ends in a blank,
+// the word after it is expanded too, so that an alias such as sudo='sudo '
+// lets the command it runs be an alias. An alias's text stands for words
+// of a single command; operators such as | in it aren't treated as such.
+func expandAliases(words []string) ([]string, error) {
+	// The command word comes after any leading assignments
+	i := 0
+	for i < len(words) {
+		if _, _, ok := shell.ParseAssignment(words[i]); !ok {
+			break
+		}
+		i++
+	}
+
+	result := append([]string{}, words[:i]...)
+	for ; i < len(words); i++ {
+		expanded, chain, err := aliasWords(words[i], make(map[string]bool))
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, expanded...)
+		if !chain {
+			i++
+			break
+		}
+	}
+	return append(result, words[i:]...), nil
+}
+
+// aliasWords returns the words that word stands for as an alias, or just
+// word if it isn't one. The first word of an alias's text is expanded in
+// turn, except for an alias already being expanded, which stops
+// definitions such as ls='ls -F' from recursing. chain reports whether the
+// text ends in a blank, meaning the next word should be expanded too.
+func aliasWords(word string, expanding map[string]bool) (words []string, chain bool, err error) {
+	value, ok := shell.LookupAlias(word)
+	if !ok || expanding[word] {
+		return []string{word}, false, nil
+	}
+	expanding[word] = true
+
+	words, err = splitWords(strings.TrimSpace(value))
+	if err != nil {
+		return nil, false, fmt.Errorf("alias %s: %v", word, err)
+	}
+	chain = strings.HasSuffix(value, " ") || strings.HasSuffix(value, "\t")
+	if len(words) == 0 {
+		return nil, chain, nil
+	}
+
+	first, firstChain, err := aliasWords(words[0], expanding)
+	if err != nil {
+		return nil, false, err
+	}
+	if len(words) == 1 {
+		// The text is all the expanded alias's, so its blank counts too
+		chain = chain || firstChain
+	}
+	return append(first, words[1:]...), chain, nil
+}
+
+// ParseCommand parses a command line into a Command struct with redirection.
+// An empty line gives an empty Command; malformed input is an error.
+func ParseCommand(line string) (*Command, error) {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return &Command{}, nil
+	}
+
+	tokens, err := splitWords(line)
+	if err != nil {
+		return nil, err
+	}
+	return buildCommand(tokens)
+}
+
+// isOperator reports whether token is an unquoted redirection or control
+// operator
+func isOperator(token string) bool {
+	switch token {
+	case ">", ">>", "<", "&>", "&>>", "|", "&":
+		return true
+	}
+	return false
+}
+
+// buildCommand assembles a Command from the words of a single command,
+// then expands variables in its arguments and assignment values
+func buildCommand(tokens []string) (*Command, error) {
 	cmd := &Command{}
-	tokens := strings.Fields(line)
 
-	for i := 0; i < len(tokens); i++ {
-		token := tokens[i]
+	for i := 0; i < len(tokens); i++ {
+		token := tokens[i]
+
+		switch token {
+		case ">", ">>", "<", "&>", "&>>":
+			if i+1 >= len(tokens) {
+				return nil, syntaxError("newline")
+			}
+			if isOperator(tokens[i+1]) {
+				return nil, syntaxError(tokens[i+1])
+			}
+			target, err := expandRedirectTarget(tokens[i+1])
+			if err != nil {
+				return nil, err
+			}
+			i++ // skip the filename
+
+			if token == "<" {
+				cmd.InputFile = target
+			} else {
+				cmd.OutputFile = target
+				cmd.AppendOutput = strings.HasSuffix(token, ">>")
+				cmd.StderrToOutput = strings.HasPrefix(token, "&")
+			}
+		case "&":
+			cmd.Background = true
+		default:
+			if _, _, ok := shell.ParseAssignment(token); ok && len(cmd.Args) == 0 {
+				cmd.Assignments = append(cmd.Assignments, token)
+			} else {
+				cmd.Args = append(cmd.Args, token)
+			}
+		}
+	}
+
+	// Expand environment variables in arguments and assignment values
+	if err := expandCommandVariables(cmd); err != nil {
+		return nil, err
+	}
+
+	return cmd, nil
+}
+
+// expandRedirectTarget expands the file name after a redirection operator:
+// a leading ~ and variables, with quotes removed. It isn't split or globbed,
+// and a name that expands to nothing is an error.
+func expandRedirectTarget(word string) (string, error) {
+	target, err := expandTilde(word)
+	if err != nil {
+		return "", err
+	}
+	if target == "" {
+		return "", fmt.Errorf("%s: ambiguous redirect", word)
+	}
+	return target, nil
+}
+
+// expandTilde expands word like expandWord, and also replaces an unquoted ~
+// at its start with the home directory: $HOME for ~ alone or before a /,
+// and the named user's home for ~user. A ~user naming no user is left as
+// it is.
+func expandTilde(word string) (string, error) {
+	if !strings.HasPrefix(word, "~") {
+		return expandWord(word)
+	}
+
+	prefix, rest, slash := strings.Cut(word, "/")
+	if strings.ContainsAny(prefix, "'\"\\$`") {
+		return expandWord(word)
+	}
+
+	var home string
+	if name := prefix[1:]; name == "" {
+		home = shell.GetVar("HOME")
+	} else if u, err := user.Lookup(name); err == nil {
+		home = u.HomeDir
+	} else {
+		return expandWord(word)
+	}
+
+	if !slash {
+		return home, nil
+	}
+	expanded, err := expandWord(rest)
+	if err != nil {
+		return "", err
+	}
+	return home + "/" + expanded, nil
+}
+
+// ParseList parses a command line that may hold several pipelines separated
+// by ;, newlines or &. Every pipeline followed by & runs in the background,
+// so "a & b" starts a in the background and then runs b. A syntax error
+// anywhere in the line means none of it runs.
+func ParseList(line string) ([]*Pipeline, error) {
+	var pipelines []*Pipeline
+	for _, segment := range SplitList(line) {
+		pipeline, err := ParsePipeline(segment)
+		if err != nil {
+			return nil, err
+		}
+		if len(pipeline.Commands) > 0 {
+			pipelines = append(pipelines, pipeline)
+		}
+	}
+	return pipelines, nil
+}
+
+// SplitList splits line into the commands it holds, without parsing them.
+// Commands end at each unquoted ; or newline, and after each unquoted &
+// that terminates a command, which is kept on the end of its segment. An &
+// that is part of &&, |& or a redirection such as >& or &> is left alone, as
+// is anything inside braces, such as a function body, or a command
+// substitution, and anything between the start of a loop and its done or a
+// case and its esac.
+func SplitList(line string) []string {
+	var segments []string
+	var quote byte
+	escaped := false
+	depth := 0
+	substitutions := 0
+	start := 0
+
+	// Loops and case statements are found by their reserved words, which
+	// are listed in order
+	words := findReservedWords(line)
+	compounds := 0
+
+	add := func(segment string) {
+		if strings.TrimSpace(segment) != "" {
+			segments = append(segments, segment)
+		}
+	}
+
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		if len(words) > 0 && words[0].start == i {
+			switch {
+			case startsCompound(words[0].word):
+				compounds++
+			case endsCompound(words[0].word):
+				compounds = max(compounds-1, 0)
+			}
+			words = words[1:]
+		}
+
+		switch {
+		case escaped:
+			escaped = false
+		case c == '\\' && quote != '\'':
+			escaped = true
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '$' && strings.HasPrefix(line[i+1:], "("):
+			substitutions++
+		case c == ')' && substitutions > 0:
+			substitutions--
+		case c == '{':
+			depth++
+		case c == '}':
+			if depth > 0 {
+				depth--
+			}
+		case depth > 0 || compounds > 0 || substitutions > 0:
+		case c == ';' || c == '\n':
+			add(line[start:i])
+			start = i + 1
+		case c == '&':
+			if (i > 0 && strings.IndexByte("&<>|", line[i-1]) >= 0) ||
+				(i+1 < len(line) && strings.IndexByte("&<>", line[i+1]) >= 0) {
+				continue
+			}
+			add(line[start : i+1])
+			start = i + 1
+		}
+	}
+
+	add(line[start:])
+	return segments
+}
+
+// ParseFunction recognizes a function definition of the form
+// name() { body }, returning the function's name and the commands between
+// the braces
+func ParseFunction(line string) (name, body string, ok bool) {
+	name, rest, ok := parseFunctionHeader(line)
+	if !ok || !strings.HasSuffix(rest, "}") || matchingBrace(rest, 0) != len(rest)-1 {
+		return "", "", false
+	}
+
+	body = strings.TrimSpace(rest[1 : len(rest)-1])
+	return name, body, true
+}
+
+// NeedsContinuation reports whether line starts a function definition whose
+// body hasn't been closed yet, or a loop without its done or a case without
+// its esac, so more lines should be read to complete it
+func NeedsContinuation(line string) bool {
+	if _, rest, ok := parseFunctionHeader(line); ok && matchingBrace(rest, 0) < 0 {
+		return true
+	}
+
+	open := 0
+	for _, w := range findReservedWords(line) {
+		switch {
+		case startsCompound(w.word):
+			open++
+		case endsCompound(w.word):
+			open--
+		}
+	}
+	return open > 0
+}
+
+// TrimContinuation reports whether line ends with a backslash that
+// continues the command onto the next line, and returns the line without
+// it. The backslash mustn't be escaped itself or inside single quotes,
+// where a backslash is literal.
+func TrimContinuation(line string) (string, bool) {
+	var quote byte
+	escaped := false
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case escaped:
+			escaped = false
+		case c == '\\' && quote != '\'':
+			if i == len(line)-1 {
+				return line[:i], true
+			}
+			escaped = true
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		}
+	}
+	return line, false
+}
+
+// reservedWord is a reserved word such as for or done, and where it appears
+// in a line. The ) ending a case pattern and the ;; ending a case clause
+// are kept as reserved words too.
+type reservedWord struct {
+	word       string
+	start, end int
+}
+
+// States of a case statement while findReservedWords reads it
+const (
+	caseNone    = iota
+	caseSubject // between case and in
+	casePattern // between in or ;; and the ) ending a pattern
+)
+
+// findReservedWords returns the reserved words in line, in order. A word is
+// only reserved where a command could start, and when it isn't quoted, so
+// "echo done" and "'for' x" hold none. Within a case statement, the in after
+// its word is reserved, and the patterns are skipped.
+func findReservedWords(line string) []reservedWord {
+	var words []reservedWord
+	var quote byte
+	escaped := false
+	commandStart := true
+
+	cases := 0
+	state := caseNone
+	subject := false
+
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case escaped:
+			escaped = false
+		case c == '\\' && quote != '\'':
+			escaped = true
+			commandStart = false
+			subject = true
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+			commandStart = false
+			subject = true
+		case state != caseNone && (c == '(' || c == '|' || c == ';' || c == '\n'):
+			// Separators within the header and patterns of a case
+		case c == ';' && cases > 0 && i+1 < len(line) && line[i+1] == ';':
+			words = append(words, reservedWord{";;", i, i + 2})
+			state = casePattern
+			i++
+		case c == ';' || c == '\n' || c == '&' || c == '|' || c == '(':
+			commandStart = true
+		case c == '{':
+			// A brace opening a function body starts a command, but the one
+			// in ${VAR} doesn't
+			commandStart = i == 0 || strings.IndexByte(" \t\n;", line[i-1]) >= 0
+		case c == ' ' || c == '\t':
+		default:
+			end := i
+			for end < len(line) && strings.IndexByte(" \t\n;&|(){}'\"\\", line[end]) < 0 {
+				end++
+			}
+			word := line[i:end]
+			switch {
+			case state == caseSubject:
+				if word == "in" && subject {
+					words = append(words, reservedWord{word, i, end})
+					state = casePattern
+				}
+				subject = true
+			case state == casePattern && word == "esac":
+				words = append(words, reservedWord{word, i, end})
+				cases--
+				state = caseNone
+				commandStart = false
+			case state == casePattern:
+				if c == ')' {
+					words = append(words, reservedWord{")", i, i + 1})
+					state = caseNone
+					commandStart = true
+				}
+			case commandStart && isReservedWord(word):
+				words = append(words, reservedWord{word, i, end})
+				switch word {
+				case "case":
+					cases++
+					state = caseSubject
+					subject = false
+				case "esac":
+					cases = max(cases-1, 0)
+				}
+				// A command follows do, while and until, but for and case
+				// are followed by a word and done and esac by the end of
+				// the statement
+				commandStart = word != "for" && word != "done" && word != "case" && word != "esac"
+			default:
+				commandStart = false
+			}
+			if end > i {
+				i = end - 1
+			}
+		}
+	}
+	return words
+}
+
+// isReservedWord reports whether word is one of the words that make up a
+// loop or case statement
+func isReservedWord(word string) bool {
+	switch word {
+	case "for", "while", "until", "do", "done", "case", "esac":
+		return true
+	}
+	return false
+}
+
+// Loop is a for, while or until loop. The words of a for loop are expanded
+// when it is parsed, while the condition and body are kept as text so that
+// they are parsed afresh on each iteration.
+type Loop struct {
+	Keyword   string   // "for", "while" or "until"
+	Var       string   // for: variable set to each word in turn
+	Words     []string // for: words to loop over
+	Condition string   // while and until: commands whose status is tested
+	Body      string   // commands run on each iteration
+}
+
+// ParseLoop parses a loop of the form for NAME [in WORDS]; do BODY; done,
+// while CONDITION; do BODY; done or until CONDITION; do BODY; done. Without
+// in, a for loop runs over the positional parameters. A nil Loop and nil
+// error mean line isn't a loop.
+func ParseLoop(line string) (*Loop, error) {
+	line = strings.TrimSpace(line)
+	words := findReservedWords(line)
+	if len(words) == 0 || words[0].start != 0 || !startsLoop(words[0].word) {
+		return nil, nil
+	}
+
+	// Find the do and done belonging to this loop, skipping over any loops
+	// nested inside it
+	doWord, doneWord := -1, -1
+	depth := 0
+	for i, w := range words[1:] {
+		switch {
+		case startsLoop(w.word):
+			depth++
+		case w.word == "do" && depth == 0 && doWord < 0:
+			doWord = i + 1
+		case w.word == "done" && depth > 0:
+			depth--
+		case w.word == "done":
+			if doWord < 0 {
+				return nil, syntaxError("done")
+			}
+			doneWord = i + 1
+		}
+		if doneWord >= 0 {
+			break
+		}
+	}
+	if doneWord < 0 {
+		return nil, errors.New("syntax error: unexpected end of file")
+	}
+	if rest := strings.TrimSpace(line[words[doneWord].end:]); rest != "" {
+		return nil, syntaxError(strings.Fields(rest)[0])
+	}
+
+	body := strings.TrimSpace(line[words[doWord].end:words[doneWord].start])
+	body = strings.TrimSpace(strings.TrimSuffix(body, ";"))
+	if body == "" {
+		return nil, syntaxError("done")
+	}
+
+	header := strings.TrimSpace(line[words[0].end:words[doWord].start])
+	header = strings.TrimSpace(strings.TrimSuffix(header, ";"))
+	loop := &Loop{Keyword: words[0].word, Body: body}
+	if loop.Keyword != "for" {
+		if header == "" {
+			return nil, syntaxError("do")
+		}
+		loop.Condition = header
+		return loop, nil
+	}
+
+	tokens, err := splitWords(strings.NewReplacer("\n", " ", "\t", " ").Replace(header))
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 || !shell.IsValidName(tokens[0]) {
+		return nil, syntaxError("do")
+	}
+
+	loop.Var = tokens[0]
+	switch {
+	case len(tokens) == 1:
+		loop.Words = shell.Positional()
+	case tokens[1] == "in":
+		if loop.Words, err = expandArgs(tokens[2:]); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, syntaxError(tokens[1])
+	}
+	return loop, nil
+}
+
+// Case is a case statement. Its word and patterns are expanded when it is
+// parsed, and each pattern is kept as a glob pattern in which only unquoted
+// wildcards are special. The bodies are kept as text, to be parsed when
+// they run.
+type Case struct {
+	Word    string
+	Clauses []CaseClause
+}
 
-		switch token {
-		case ">":
-			if i+1 < len(tokens) {
-				cmd.OutputFile = tokens[i+1]
-				cmd.AppendOutput = false
-				i++ // skip the filename
-			}
-		case ">>":
-			if i+1 < len(tokens) {
-				cmd.OutputFile = tokens[i+1]
-				cmd.AppendOutput = true
-				i++ // skip the filename
-			}
-		case "<":
-			if i+1 < len(tokens) {
-				cmd.InputFile = tokens[i+1]
-				i++ // skip the filename
+// CaseClause is one branch of a case statement: the commands to run when
+// the word matches any of the patterns
+type CaseClause struct {
+	Patterns []string
+	Body     string
+}
+
+// ParseCase parses a case statement of the form
+// case WORD in PATTERN[|PATTERN]...) COMMANDS;; ... esac, where a pattern may
+// have a ( before it and the last clause needn't end with ;;. A nil Case and
+// nil error mean line isn't a case statement.
+func ParseCase(line string) (*Case, error) {
+	line = strings.TrimSpace(line)
+	words := findReservedWords(line)
+	if len(words) == 0 || words[0].start != 0 || words[0].word != "case" {
+		return nil, nil
+	}
+
+	// Keep the words belonging to this case statement, leaving out those of
+	// any case statements nested inside its clauses
+	var own []reservedWord
+	depth := 0
+	for _, w := range words[1:] {
+		switch {
+		case w.word == "case":
+			depth++
+		case w.word == "esac" && depth > 0:
+			depth--
+		case depth == 0 && (w.word == "in" || w.word == ")" || w.word == ";;" || w.word == "esac"):
+			own = append(own, w)
+		}
+		if len(own) > 0 && own[len(own)-1].word == "esac" {
+			break
+		}
+	}
+	if len(own) == 0 || own[len(own)-1].word != "esac" {
+		return nil, errors.New("syntax error: unexpected end of file")
+	}
+	if own[0].word != "in" {
+		return nil, syntaxError(own[0].word)
+	}
+	esac := own[len(own)-1]
+	if rest := strings.TrimSpace(line[esac.end:]); rest != "" {
+		return nil, syntaxError(strings.Fields(rest)[0])
+	}
+
+	tokens, err := splitWords(strings.TrimSpace(line[words[0].end:own[0].start]))
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) != 1 {
+		return nil, syntaxError("in")
+	}
+	c := &Case{}
+	if c.Word, err = expandWord(tokens[0]); err != nil {
+		return nil, err
+	}
+
+	// What's left alternates between patterns, ended by ), and bodies,
+	// ended by ;; or esac
+	prev := own[0]
+	for _, w := range own[1:] {
+		text := strings.TrimSpace(line[prev.end:w.start])
+		switch {
+		case w.word == ")" && prev.word != ")":
+			clause, err := parseCasePatterns(text)
+			if err != nil {
+				return nil, err
 			}
-		case "&":
-			cmd.Background = true
-		default:
-			cmd.Args = append(cmd.Args, token)
+			c.Clauses = append(c.Clauses, clause)
+		case prev.word == ")":
+			body := strings.TrimSpace(strings.TrimSuffix(text, ";"))
+			c.Clauses[len(c.Clauses)-1].Body = body
+		case text != "" || w.word != "esac":
+			return nil, syntaxError(w.word)
+		}
+		prev = w
+	}
+	return c, nil
+}
+
+// parseCasePatterns parses the |-separated patterns before the ) of a case
+// clause into a clause without a body
+func parseCasePatterns(text string) (CaseClause, error) {
+	text = strings.TrimSpace(strings.TrimPrefix(text, "("))
+	alternatives, err := splitUnquoted(text, '|')
+	if err != nil {
+		return CaseClause{}, err
+	}
+
+	var clause CaseClause
+	for _, alternative := range alternatives {
+		alternative = strings.TrimSpace(alternative)
+		if alternative == "" {
+			return CaseClause{}, syntaxError(")")
 		}
+		_, pattern, err := expandWordPattern(alternative)
+		if err != nil {
+			return CaseClause{}, err
+		}
+		clause.Patterns = append(clause.Patterns, pattern)
 	}
+	return clause, nil
+}
+
+// startsLoop reports whether word is a reserved word that begins a loop
+func startsLoop(word string) bool {
+	return word == "for" || word == "while" || word == "until"
+}
 
-	// Expand environment variables in arguments
-	cmd.Args = expandArgsVariables(cmd.Args)
+// startsCompound reports whether word begins a loop or case statement
+func startsCompound(word string) bool {
+	return startsLoop(word) || word == "case"
+}
 
-	return cmd
+// endsCompound reports whether word ends a loop or case statement
+func endsCompound(word string) bool {
+	return word == "done" || word == "esac"
 }
 
-// ParsePipeline parses a command line into a Pipeline with potential pipes
-func ParsePipeline(line string) *Pipeline {
+// parseFunctionHeader splits a line starting with "name() {" into the name
+// and the rest of the line from the opening brace on
+func parseFunctionHeader(line string) (name, rest string, ok bool) {
 	line = strings.TrimSpace(line)
-	if line == "" {
-		return &Pipeline{}
+	i := 0
+	for i < len(line) && isNameChar(line[i], i == 0) {
+		i++
+	}
+	if i == 0 {
+		return "", "", false
 	}
 
-	// Filter out any escape sequences that might have gotten through
-	// This prevents malformed input from causing panics
-	if strings.Contains(line, "\x1b") || strings.Contains(line, "^[") {
-		return &Pipeline{}
+	rest = strings.TrimSpace(line[i:])
+	if !strings.HasPrefix(rest, "()") {
+		return "", "", false
+	}
+	rest = strings.TrimSpace(rest[2:])
+	if !strings.HasPrefix(rest, "{") {
+		return "", "", false
+	}
+	return line[:i], rest, true
+}
+
+// ParsePipeline parses a command line into a Pipeline with potential pipes.
+// An empty line gives an empty Pipeline; malformed input is an error.
+func ParsePipeline(line string) (*Pipeline, error) {
+	// Escape sequences that got through from a paste or from history would
+	// otherwise end up in the command's arguments
+	line = strings.TrimSpace(sanitizeLine(line))
+	if line == "" {
+		return &Pipeline{}, nil
 	}
 
 	pipeline := &Pipeline{}
@@ -747,78 +3267,655 @@ func ParsePipeline(line string) *Pipeline {
 		line = strings.TrimSpace(line)
 	}
 
-	// Split by pipes
-	pipeSegments := strings.Split(line, "|")
+	// A ! on its own before the pipeline negates it. Each one toggles, so
+	// "! ! cmd" is the same as "cmd". A ! joined to a word, as in !grep, is
+	// left alone.
+	for line == "!" || strings.HasPrefix(line, "! ") || strings.HasPrefix(line, "!\t") {
+		pipeline.Negate = !pipeline.Negate
+		line = strings.TrimSpace(line[1:])
+	}
+	if line == "" {
+		return pipeline, nil
+	}
+
+	// Split by unquoted pipes. A pipe written |& leaves the & at the start
+	// of the next segment.
+	pipeSegments, err := splitUnquoted(line, '|')
+	if err != nil {
+		return nil, err
+	}
+	pipeStderr := make([]bool, len(pipeSegments))
+	for i := 1; i < len(pipeSegments); i++ {
+		if strings.HasPrefix(pipeSegments[i], "&") {
+			pipeStderr[i-1] = true
+			pipeSegments[i] = pipeSegments[i][1:]
+		}
+	}
+	if err := checkPipeSegments(pipeSegments); err != nil {
+		return nil, err
+	}
+
+	for i, segment := range pipeSegments {
+		tokens, err := splitWords(strings.TrimSpace(segment))
+		if err != nil {
+			return nil, err
+		}
+		tokens, err = expandAliases(tokens)
+		if err != nil {
+			return nil, err
+		}
+
+		cmd, err := buildCommand(tokens)
+		if err != nil {
+			return nil, err
+		}
+		cmd.PipeStderr = pipeStderr[i]
+		pipeline.Commands = append(pipeline.Commands, cmd)
+	}
+
+	return pipeline, nil
+}
+
+// checkPipeSegments reports a syntax error if any segment between pipes is
+// empty, as in "| ls", "ls |" or "ls | | wc"
+func checkPipeSegments(segments []string) error {
+	for _, segment := range segments {
+		if strings.TrimSpace(segment) == "" {
+			return syntaxError("|")
+		}
+	}
+	return nil
+}
+
+// syntaxError returns the error for an unexpected token in a command line
+func syntaxError(token string) error {
+	return fmt.Errorf("syntax error near unexpected token '%s'", token)
+}
+
+// expandCommandVariables expands variables in a command's arguments and
+// assignment values in place, and file name patterns in its arguments
+func expandCommandVariables(cmd *Command) error {
+	ran := substitutions
+	defer func() { cmd.Substituted = substitutions != ran }()
+
+	args, err := expandArgs(cmd.Args)
+	if err != nil {
+		return err
+	}
+	cmd.Args = args
+
+	if cmd.Assignments != nil {
+		assignments, err := expandArgsVariables(cmd.Assignments)
+		if err != nil {
+			return err
+		}
+		cmd.Assignments = assignments
+	}
+	return nil
+}
+
+// substitute runs a command for $(command) and returns its output, leaving
+// its exit status in $? - set by main
+var substitute func(command string) string
+
+// substitutions counts the commands run by $(command), so that expanding a
+// command can tell whether it ran any
+var substitutions int
+
+// SetCommandSubstitution sets how the command in $(command) is run. Until
+// it is set, $(command) is left as it is.
+func SetCommandSubstitution(run func(command string) string) {
+	substitute = run
+}
+
+// ExpandVariables expands shell and environment variables in a string.
+// Supports both $VAR and ${VAR} syntax, as well as the ${VAR:-word},
+// ${VAR:=word}, ${VAR:+word}, ${VAR:?word}, ${VAR#pat}, ${VAR%pat} and
+// ${VAR/pat/repl} operators, $(command) for a command's output and $(<file)
+// for a file's contents. Shell-local variables take precedence over the
+// environment. A backslash before $ leaves it literal. Expansion errors,
+// such as ${VAR:?msg} on an unset variable or any unset variable with
+// set -u, are reported on stderr.
+func ExpandVariables(s string) string {
+	result, err := expandVariables(s)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "gosh: %v\n", err)
+	}
+	return result
+}
+
+// expandVariables is ExpandVariables but returns expansion errors to the
+// caller. The string is scanned once from left to right, so text that was
+// substituted in is never expanded again.
+func expandVariables(s string) (string, error) {
+	var result strings.Builder
+	var expandErr error
+
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '\\' && i+1 < len(s) && s[i+1] == '$':
+			// Escaped dollar sign
+			result.WriteByte('$')
+			i++
+
+		case c == '$' && i+1 < len(s) && s[i+1] == '{':
+			// ${...}, which may contain nested ${...} in its word
+			end := matchingBrace(s, i+1)
+			if end < 0 || end == i+2 {
+				result.WriteByte(c)
+				continue
+			}
+			value, err := expandParameter(s[i+2 : end])
+			if err != nil && expandErr == nil {
+				expandErr = err
+			}
+			result.WriteString(value)
+			i = end
+
+		case c == '$' && strings.HasPrefix(s[i:], "$(<"):
+			// $(<file), which reads the file rather than running a command
+			end := strings.IndexByte(s[i:], ')')
+			if end < 0 {
+				result.WriteByte(c)
+				continue
+			}
+			result.WriteString(readFileSubstitution(s[i+3 : i+end]))
+			i += end
+
+		case c == '$' && strings.HasPrefix(s[i:], "$(") && substitute != nil:
+			// $(command), replaced by the command's output
+			end := matchingParen(s, i+1)
+			if end < 0 {
+				result.WriteByte(c)
+				continue
+			}
+			substitutions++
+			result.WriteString(strings.TrimRight(substitute(s[i+2:end]), "\n"))
+			i = end
+
+		case c == '$' && i+1 < len(s) && isSpecialParam(s[i+1]):
+			// $?, and $1, $#, $@ and the like inside a function
+			value, err := lookupVariable(s[i+1 : i+2])
+			if err != nil && expandErr == nil {
+				expandErr = err
+			}
+			result.WriteString(value)
+			i++
+
+		case c == '$' && i+1 < len(s) && isNameChar(s[i+1], true):
+			// $VAR
+			end := i + 2
+			for end < len(s) && isNameChar(s[end], false) {
+				end++
+			}
+			value, err := lookupVariable(s[i+1 : end])
+			if err != nil && expandErr == nil {
+				expandErr = err
+			}
+			result.WriteString(value)
+			i = end - 1
+
+		default:
+			result.WriteByte(c)
+		}
+	}
+
+	return result.String(), expandErr
+}
+
+// ErrUnboundVariable is the error for expanding a variable that isn't set
+// while set -u is on
+var ErrUnboundVariable = errors.New("unbound variable")
+
+// lookupVariable returns the value of a variable being expanded. With
+// set -u, a variable that isn't set is an error rather than empty, except
+// for the special parameters $?, $#, $@, $* and $0.
+func lookupVariable(name string) (string, error) {
+	value, ok := shell.LookupVar(name)
+	if !ok && shell.Option("nounset") {
+		switch name {
+		case "?", "#", "@", "*", "0":
+		default:
+			return "", fmt.Errorf("%s: %w", name, ErrUnboundVariable)
+		}
+	}
+	return value, nil
+}
+
+// readFileSubstitution expands $(<file), given the file name after the <,
+// to the contents of the file without its trailing newlines. The name may
+// use ~ and variables. A file that can't be read expands to nothing, with
+// the error reported on stderr.
+func readFileSubstitution(name string) string {
+	name, err := expandTilde(strings.TrimSpace(name))
+	if err != nil {
+		fmt.Fprintf(shell.Stderr(), "gosh: %v\n", err)
+		return ""
+	}
+	content, err := os.ReadFile(name)
+	if err != nil {
+		fmt.Fprintf(shell.Stderr(), "gosh: %v\n", err)
+		return ""
+	}
+	return strings.TrimRight(string(content), "\n")
+}
+
+// matchingParen returns the index of the ) that closes the ( at open, or -1
+// if there is none. Parentheses in quotes don't count.
+func matchingParen(s string, open int) int {
+	depth := 0
+	var quote byte
+	for i := open; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '\\' && quote != '\'':
+			i++
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// matchingBrace returns the index of the } that closes the { at open, or -1
+// if there is none
+func matchingBrace(s string, open int) int {
+	depth := 0
+	for i := open; i < len(s); i++ {
+		switch s[i] {
+		case '{':
+			depth++
+		case '}':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// expandParameter expands the contents of a ${...} expression. With a colon,
+// the -, =, + and ? operators treat an empty variable the same as an unset
+// one; without it they only test whether the variable is set. The # and %
+// operators remove a matching prefix or suffix (## and %% for the longest
+// match), and / substitutes matches of a pattern.
+func expandParameter(expr string) (string, error) {
+	nameLen := 0
+	if expr[0] >= '0' && expr[0] <= '9' {
+		// Positional parameters, which can have more than one digit here
+		for nameLen < len(expr) && expr[nameLen] >= '0' && expr[nameLen] <= '9' {
+			nameLen++
+		}
+	} else {
+		for nameLen < len(expr) && isNameChar(expr[nameLen], nameLen == 0) {
+			nameLen++
+		}
+	}
+	name, op := expr[:nameLen], expr[nameLen:]
+	if name == "" {
+		return shell.GetVar(expr), nil
+	}
+	if op == "" {
+		return lookupVariable(name)
+	}
+
+	value, set := shell.LookupVar(name)
+	if !set && strings.ContainsRune("#%/", rune(op[0])) {
+		// Only the operators that supply a value can be used on an
+		// unset variable with set -u
+		if _, err := lookupVariable(name); err != nil {
+			return "", err
+		}
+	}
+
+	// Prefix and suffix removal
+	switch op[0] {
+	case '#', '%':
+		longest := len(op) > 1 && op[1] == op[0]
+		pattern := op[1:]
+		if longest {
+			pattern = op[2:]
+		}
+		pattern, err := expandVariables(pattern)
+		if err != nil {
+			return "", err
+		}
+		if op[0] == '#' {
+			return removePrefix(value, pattern, longest), nil
+		}
+		return removeSuffix(value, pattern, longest), nil
+	}
+
+	// Pattern substitution
+	if op[0] == '/' {
+		return substitutePattern(value, op[1:])
+	}
+
+	checkEmpty := false
+	if strings.HasPrefix(op, ":") && len(op) > 1 {
+		checkEmpty = true
+		op = op[1:]
+	}
+	missing := !set || (checkEmpty && value == "")
+	word := op[1:]
+
+	switch op[0] {
+	case '-':
+		if missing {
+			return expandVariables(word)
+		}
+	case '=':
+		if missing {
+			expanded, err := expandVariables(word)
+			if err != nil {
+				return "", err
+			}
+			if err := shell.SetVar(name, expanded); err != nil {
+				return "", err
+			}
+			return expanded, nil
+		}
+	case '+':
+		if missing {
+			return "", nil
+		}
+		return expandVariables(word)
+	case '?':
+		if missing {
+			msg, err := expandVariables(word)
+			if err != nil {
+				return "", err
+			}
+			if msg == "" {
+				msg = "parameter null or not set"
+			}
+			return "", fmt.Errorf("%s: %s", name, msg)
+		}
+	default:
+		return shell.GetVar(expr), nil
+	}
+
+	return value, nil
+}
+
+// removePrefix removes the shortest (or longest) prefix of value matching
+// the glob pattern. The value is returned unchanged if nothing matches.
+func removePrefix(value, pattern string, longest bool) string {
+	runes := []rune(value)
+	if longest {
+		for i := len(runes); i >= 0; i-- {
+			if glob.Match(pattern, string(runes[:i])) {
+				return string(runes[i:])
+			}
+		}
+	} else {
+		for i := 0; i <= len(runes); i++ {
+			if glob.Match(pattern, string(runes[:i])) {
+				return string(runes[i:])
+			}
+		}
+	}
+	return value
+}
+
+// removeSuffix removes the shortest (or longest) suffix of value matching
+// the glob pattern. The value is returned unchanged if nothing matches.
+func removeSuffix(value, pattern string, longest bool) string {
+	runes := []rune(value)
+	if longest {
+		for i := 0; i <= len(runes); i++ {
+			if glob.Match(pattern, string(runes[i:])) {
+				return string(runes[:i])
+			}
+		}
+	} else {
+		for i := len(runes); i >= 0; i-- {
+			if glob.Match(pattern, string(runes[i:])) {
+				return string(runes[:i])
+			}
+		}
+	}
+	return value
+}
+
+// substitutePattern implements ${VAR/pat/repl}. spec is everything after
+// the first slash: a leading '/' replaces every match, '#' anchors the match
+// at the start of the value and '%' at the end. A missing replacement
+// deletes the matched text.
+func substitutePattern(value, spec string) (string, error) {
+	mode := byte(0)
+	if spec != "" && (spec[0] == '/' || spec[0] == '#' || spec[0] == '%') {
+		mode = spec[0]
+		spec = spec[1:]
+	}
 
-	for _, segment := range pipeSegments {
-		segment = strings.TrimSpace(segment)
-		if segment == "" {
+	pattern, replacement := spec, ""
+	for i := 0; i < len(spec); i++ {
+		if spec[i] == '\\' {
+			i++
 			continue
 		}
+		if spec[i] == '/' {
+			pattern, replacement = spec[:i], spec[i+1:]
+			break
+		}
+	}
 
-		cmd := &Command{}
-		tokens := strings.Fields(segment)
+	pattern, err := expandVariables(pattern)
+	if err != nil {
+		return "", err
+	}
+	replacement, err = expandVariables(replacement)
+	if err != nil {
+		return "", err
+	}
+	if pattern == "" {
+		return value, nil
+	}
 
-		for i := 0; i < len(tokens); i++ {
-			token := tokens[i]
+	runes := []rune(value)
+	n := len(runes)
 
-			switch token {
-			case ">":
-				if i+1 < len(tokens) {
-					cmd.OutputFile = tokens[i+1]
-					cmd.AppendOutput = false
-					i++ // skip the filename
-				}
-			case ">>":
-				if i+1 < len(tokens) {
-					cmd.OutputFile = tokens[i+1]
-					cmd.AppendOutput = true
-					i++ // skip the filename
-				}
-			case "<":
-				if i+1 < len(tokens) {
-					cmd.InputFile = tokens[i+1]
-					i++ // skip the filename
-				}
-			default:
-				cmd.Args = append(cmd.Args, token)
+	switch mode {
+	case '#':
+		for j := n; j > 0; j-- {
+			if glob.Match(pattern, string(runes[:j])) {
+				return replacement + string(runes[j:]), nil
+			}
+		}
+		return value, nil
+	case '%':
+		for i := 0; i < n; i++ {
+			if glob.Match(pattern, string(runes[i:])) {
+				return string(runes[:i]) + replacement, nil
 			}
 		}
+		return value, nil
+	}
 
-		// Expand environment variables in arguments
-		cmd.Args = expandArgsVariables(cmd.Args)
+	// Replace the longest match at the leftmost position, then continue
+	// after it when replacing globally
+	var result strings.Builder
+	i := 0
+	for i < n {
+		end := -1
+		for j := n; j > i; j-- {
+			if glob.Match(pattern, string(runes[i:j])) {
+				end = j
+				break
+			}
+		}
+		if end < 0 {
+			result.WriteRune(runes[i])
+			i++
+			continue
+		}
 
-		pipeline.Commands = append(pipeline.Commands, cmd)
+		result.WriteString(replacement)
+		i = end
+		if mode != '/' {
+			result.WriteString(string(runes[i:]))
+			return result.String(), nil
+		}
 	}
+	return result.String(), nil
+}
 
-	return pipeline
+// isSpecialParam reports whether c names a one-character special parameter
+// such as $? or $1. Positional parameters only exist while a function runs.
+func isSpecialParam(c byte) bool {
+	if c == '?' {
+		return true
+	}
+	return shell.CallDepth() > 0 && ((c >= '0' && c <= '9') || c == '#' || c == '@' || c == '*')
 }
 
-// ExpandVariables expands environment variables in a string
-// Supports both $VAR and ${VAR} syntax
-func ExpandVariables(s string) string {
-	// Handle ${VAR} syntax
-	re := regexp.MustCompile(`\$\{([^}]+)\}`)
-	s = re.ReplaceAllStringFunc(s, func(match string) string {
-		varName := match[2 : len(match)-1] // Remove ${ and }
-		return os.Getenv(varName)
-	})
+// isNameChar reports whether c can appear in a variable name. Digits are
+// not allowed as the first character.
+func isNameChar(c byte, first bool) bool {
+	if c == '_' || (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') {
+		return true
+	}
+	return !first && c >= '0' && c <= '9'
+}
 
-	// Handle $VAR syntax (word boundaries)
-	re = regexp.MustCompile(`\$([A-Za-z_][A-Za-z0-9_]*)`)
-	s = re.ReplaceAllStringFunc(s, func(match string) string {
-		varName := match[1:] // Remove $
-		return os.Getenv(varName)
-	})
+// expandWord expands variables in a word produced by splitWords and removes
+// its quotes. Text in single quotes is taken literally, text in double quotes
+// is expanded, and a backslash escapes the next character (inside double
+// quotes only $, `, " and \ can be escaped).
+func expandWord(word string) (string, error) {
+	value, _, err := expandWordPattern(word)
+	return value, err
+}
+
+// expandWordPattern expands a word like expandWord, and also returns it as
+// a glob pattern in which quoted and escaped text is escaped, so that only
+// unquoted wildcards are special
+func expandWordPattern(word string) (value, pattern string, err error) {
+	var result, globPattern, chunk strings.Builder
+
+	// literal adds text that is never treated as a wildcard
+	literal := func(text string) {
+		result.WriteString(text)
+		globPattern.WriteString(glob.Escape(text))
+	}
+
+	// flush expands the unquoted or double-quoted text collected so far
+	flush := func(quoted bool) error {
+		if chunk.Len() == 0 {
+			return nil
+		}
+		value, err := expandVariables(chunk.String())
+		chunk.Reset()
+		if quoted {
+			literal(value)
+		} else {
+			result.WriteString(value)
+			globPattern.WriteString(value)
+		}
+		return err
+	}
+
+	var quote byte
+	for i := 0; i < len(word); i++ {
+		c := word[i]
+		switch {
+		case quote == '\'':
+			if c == '\'' {
+				quote = 0
+			} else {
+				literal(string(c))
+			}
+		case c == '$' && strings.HasPrefix(word[i:], "$(") && matchingParen(word, i+1) > 0:
+			// A command substitution is expanded whole, whatever quotes
+			// are inside it
+			end := matchingParen(word, i+1)
+			chunk.WriteString(word[i : end+1])
+			i = end
+		case c == '\\' && i+1 < len(word) &&
+			(quote == 0 || strings.IndexByte("$`\"\\", word[i+1]) >= 0):
+			if err := flush(quote == '"'); err != nil {
+				return "", "", err
+			}
+			i++
+			literal(string(word[i]))
+		case c == '"':
+			if err := flush(quote == '"'); err != nil {
+				return "", "", err
+			}
+			if quote == '"' {
+				quote = 0
+			} else {
+				quote = '"'
+			}
+		case c == '\'' && quote == 0:
+			if err := flush(false); err != nil {
+				return "", "", err
+			}
+			quote = '\''
+		default:
+			chunk.WriteByte(c)
+		}
+	}
 
-	return s
+	if err := flush(quote == '"'); err != nil {
+		return "", "", err
+	}
+	return result.String(), globPattern.String(), nil
 }
 
-// expandArgsVariables expands environment variables in all arguments
-func expandArgsVariables(args []string) []string {
+// expandArgsVariables expands environment variables in all arguments,
+// stopping at the first expansion error
+func expandArgsVariables(args []string) ([]string, error) {
 	expanded := make([]string, len(args))
 	for i, arg := range args {
-		expanded[i] = ExpandVariables(arg)
+		value, err := expandWord(arg)
+		if err != nil {
+			return nil, err
+		}
+		expanded[i] = value
+	}
+	return expanded, nil
+}
+
+// expandArgs expands variables in all arguments, then replaces each one
+// with unquoted wildcards by the file names it matches. A pattern that
+// matches nothing is kept as it is, or dropped with the nullglob option.
+func expandArgs(args []string) ([]string, error) {
+	opts := glob.Options{
+		NullGlob: shell.Option("nullglob"),
+		DotGlob:  shell.Option("dotglob"),
+	}
+
+	expanded := make([]string, 0, len(args))
+	for _, arg := range args {
+		value, pattern, err := expandWordPattern(arg)
+		if err != nil {
+			return nil, err
+		}
+
+		if !glob.HasMeta(pattern) {
+			expanded = append(expanded, value)
+			continue
+		}
+		if matches := glob.Expand(pattern, opts); len(matches) > 0 {
+			expanded = append(expanded, matches...)
+		} else if !opts.NullGlob {
+			expanded = append(expanded, value)
+		}
 	}
-	return expanded
+	return expanded, nil
 }
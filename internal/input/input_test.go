@@ -1,10 +1,23 @@
 package input
 
 import (
+	"bytes"
+	"errors"
+	"io"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
 
+	"github.com/apriljarosz/gosh/internal/builtins"
 	"github.com/apriljarosz/gosh/internal/history"
+	"github.com/apriljarosz/gosh/internal/jobs"
+	"github.com/apriljarosz/gosh/internal/shell"
+	"github.com/chzyer/readline"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -14,14 +27,6 @@ func TestParseCommand(t *testing.T) {
 		input    string
 		expected *Command
 	}{
-		{
-			name:  "only redirection operators",
-			input: "> < >>",
-			expected: &Command{
-				Args:       []string{},
-				OutputFile: "<", // Current parsing behavior - last token becomes output
-			},
-		},
 		{
 			name:  "append redirection",
 			input: "echo world >> file.txt",
@@ -70,7 +75,8 @@ func TestParseCommand(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			result := ParseCommand(tt.input)
+			result, err := ParseCommand(tt.input)
+			assert.NoError(t, err)
 			assert.Equal(t, tt.expected, result)
 		})
 	}
@@ -127,7 +133,7 @@ func TestParsePipeline(t *testing.T) {
 			input: "find . -name '*.go' | wc -l &",
 			expected: &Pipeline{
 				Commands: []*Command{
-					{Args: []string{"find", ".", "-name", "'*.go'"}},
+					{Args: []string{"find", ".", "-name", "*.go"}},
 					{Args: []string{"wc", "-l"}},
 				},
 				Background: true,
@@ -138,11 +144,44 @@ func TestParsePipeline(t *testing.T) {
 			input:    "",
 			expected: &Pipeline{},
 		},
+		{
+			name:  "negated pipeline",
+			input: "! grep foo file | wc -l",
+			expected: &Pipeline{
+				Commands: []*Command{
+					{Args: []string{"grep", "foo", "file"}},
+					{Args: []string{"wc", "-l"}},
+				},
+				Negate: true,
+			},
+		},
+		{
+			name:  "double negation",
+			input: "! ! true",
+			expected: &Pipeline{
+				Commands: []*Command{{Args: []string{"true"}}},
+			},
+		},
+		{
+			name:  "bang joined to a word",
+			input: "!grep foo",
+			expected: &Pipeline{
+				Commands: []*Command{{Args: []string{"!grep", "foo"}}},
+			},
+		},
+		{
+			name:  "quoted bang",
+			input: "echo '!' !",
+			expected: &Pipeline{
+				Commands: []*Command{{Args: []string{"echo", "!", "!"}}},
+			},
+		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			result := ParsePipeline(tt.input)
+			result, err := ParsePipeline(tt.input)
+			assert.NoError(t, err)
 			assert.Equal(t, tt.expected, result)
 		})
 	}
@@ -219,6 +258,256 @@ func TestExpandVariables(t *testing.T) {
 	}
 }
 
+func TestExpandVariablesLocals(t *testing.T) {
+	t.Setenv("GOSH_SHADOWED", "from_env")
+	shell.SetVar("GOSH_LOCAL_ONLY", "local")
+	defer shell.UnsetVar("GOSH_LOCAL_ONLY")
+
+	// Locals expand but stay out of the environment
+	assert.Equal(t, "local/x", ExpandVariables("$GOSH_LOCAL_ONLY/x"))
+	assert.Equal(t, "local", ExpandVariables("${GOSH_LOCAL_ONLY}"))
+	for _, env := range os.Environ() {
+		assert.NotContains(t, env, "GOSH_LOCAL_ONLY=")
+	}
+
+	// Exported variables still expand from the environment
+	assert.Equal(t, "from_env", ExpandVariables("$GOSH_SHADOWED"))
+}
+
+func TestExpandFileSubstitution(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "motd")
+	assert.NoError(t, os.WriteFile(file, []byte("hello\nworld\n\n"), 0644))
+	t.Setenv("GOSH_MOTD_DIR", dir)
+
+	// Trailing newlines are trimmed, and the name may use variables
+	assert.Equal(t, "hello\nworld", ExpandVariables("$(<"+file+")"))
+	assert.Equal(t, "[hello\nworld]", ExpandVariables("[$(< $GOSH_MOTD_DIR/motd)]"))
+
+	pipeline, err := ParsePipeline("echo \"$(<" + file + ")\"")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"echo", "hello\nworld"}, pipeline.Commands[0].Args)
+
+	// A missing file expands to nothing, with an error on stderr
+	var stderr bytes.Buffer
+	shell.SetIO(shell.IO{Err: &stderr})
+	defer shell.SetIO(shell.IO{})
+	assert.Equal(t, "", ExpandVariables("$(<"+dir+"/missing)"))
+	assert.Contains(t, stderr.String(), "gosh: open "+dir+"/missing: no such file or directory")
+
+	// Other commands need a runner, which isn't set here
+	assert.Equal(t, "$(cat motd)", ExpandVariables("$(cat motd)"))
+}
+
+func TestCommandSubstitution(t *testing.T) {
+	// Without a runner, $(command) is left alone
+	assert.Equal(t, "$(echo hi)", ExpandVariables("$(echo hi)"))
+
+	var ran []string
+	SetCommandSubstitution(func(command string) string {
+		ran = append(ran, command)
+		return "<" + command + ">\n\n"
+	})
+	defer SetCommandSubstitution(nil)
+
+	// Trailing newlines are dropped, and parentheses inside are matched
+	assert.Equal(t, "a<echo (x) ')'>b", ExpandVariables("a$(echo (x) ')')b"))
+	assert.Equal(t, []string{"echo (x) ')'"}, ran)
+
+	// A substitution is one word, whatever blanks and quotes are in it
+	cmd, err := ParseCommand(`echo $(echo a  b) "$(printf "%s" 'x y')" '$(not run)'`)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"echo", "<echo a  b>", `<printf "%s" 'x y'>`, "$(not run)"}, cmd.Args)
+	assert.True(t, cmd.Substituted)
+
+	cmd, err = ParseCommand("x=$(false)")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"x=<false>"}, cmd.Assignments)
+	assert.True(t, cmd.Substituted)
+	cmd, _ = ParseCommand("x=plain")
+	assert.False(t, cmd.Substituted)
+
+	// Separators and pipes inside it don't split the line
+	assert.Equal(t, []string{"x=$(a; b)", " c"}, SplitList("x=$(a; b); c"))
+	pipeline, err := ParsePipeline("echo $(a | b) | wc")
+	assert.NoError(t, err)
+	assert.Len(t, pipeline.Commands, 2)
+	assert.Equal(t, []string{"echo", "<a | b>"}, pipeline.Commands[0].Args)
+}
+
+func TestParsePipelineAssignments(t *testing.T) {
+	t.Setenv("GOSH_ASSIGN_SRC", "expanded")
+
+	pipeline, err := ParsePipeline("A=1 B=$GOSH_ASSIGN_SRC cmd arg C=3 | other")
+	assert.NoError(t, err)
+
+	assert.Len(t, pipeline.Commands, 2)
+	assert.Equal(t, []string{"A=1", "B=expanded"}, pipeline.Commands[0].Assignments)
+	assert.Equal(t, []string{"cmd", "arg", "C=3"}, pipeline.Commands[0].Args)
+	assert.Nil(t, pipeline.Commands[1].Assignments)
+}
+
+func TestExpandParameterOperators(t *testing.T) {
+	t.Setenv("GOSH_SET", "value")
+	t.Setenv("GOSH_EMPTY", "")
+	os.Unsetenv("GOSH_UNSET")
+
+	tests := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{"default when unset", "${GOSH_UNSET:-fallback}", "fallback"},
+		{"default when empty", "${GOSH_EMPTY:-fallback}", "fallback"},
+		{"default not used when set", "${GOSH_SET:-fallback}", "value"},
+		{"default without colon keeps empty", "${GOSH_EMPTY-fallback}", ""},
+		{"default without colon when unset", "${GOSH_UNSET-fallback}", "fallback"},
+		{"default word is expanded", "${GOSH_UNSET:-$GOSH_SET/x}", "value/x"},
+		{"alternate when set", "${GOSH_SET:+alt}", "alt"},
+		{"alternate when unset", "${GOSH_UNSET:+alt}", ""},
+		{"alternate when empty", "${GOSH_EMPTY:+alt}", ""},
+		{"error operator when set", "${GOSH_SET:?missing}", "value"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := expandVariables(tt.input)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, result)
+		})
+	}
+}
+
+func TestExpandParameterAssignDefault(t *testing.T) {
+	defer shell.UnsetVar("GOSH_ASSIGN_DEFAULT")
+
+	result, err := expandVariables("${GOSH_ASSIGN_DEFAULT:=assigned}")
+	assert.NoError(t, err)
+	assert.Equal(t, "assigned", result)
+
+	// The default is assigned to the variable as a side effect
+	assert.Equal(t, "assigned", shell.GetVar("GOSH_ASSIGN_DEFAULT"))
+
+	// Once set, the default is ignored
+	result, _ = expandVariables("${GOSH_ASSIGN_DEFAULT:=other}")
+	assert.Equal(t, "assigned", result)
+}
+
+func TestExpandParameterError(t *testing.T) {
+	os.Unsetenv("GOSH_REQUIRED")
+
+	_, err := expandVariables("${GOSH_REQUIRED:?must be set}")
+	assert.EqualError(t, err, "GOSH_REQUIRED: must be set")
+
+	_, err = expandVariables("${GOSH_REQUIRED:?}")
+	assert.EqualError(t, err, "GOSH_REQUIRED: parameter null or not set")
+
+	// A failed expansion aborts the parsed pipeline
+	_, err = ParsePipeline("echo ${GOSH_REQUIRED:?required}")
+	assert.EqualError(t, err, "GOSH_REQUIRED: required")
+}
+
+func TestExpandVariablesNounset(t *testing.T) {
+	defer shell.SetOption("nounset", false)
+	os.Unsetenv("GOSH_UNDEFINED")
+
+	// By default an unset variable is empty
+	result, err := expandVariables("[$GOSH_UNDEFINED]")
+	assert.NoError(t, err)
+	assert.Equal(t, "[]", result)
+
+	shell.SetOption("nounset", true)
+	for _, s := range []string{"$GOSH_UNDEFINED", "${GOSH_UNDEFINED}", "${GOSH_UNDEFINED#x}"} {
+		_, err = expandVariables(s)
+		assert.EqualError(t, err, "GOSH_UNDEFINED: unbound variable", s)
+		assert.ErrorIs(t, err, ErrUnboundVariable)
+	}
+
+	// Defaults still work, and special parameters are always set
+	result, err = expandVariables("${GOSH_UNDEFINED:-default} $?")
+	assert.NoError(t, err)
+	assert.Equal(t, "default 0", result)
+
+	shell.PushPositional(nil)
+	result, err = expandVariables("[$@$*] $#")
+	shell.PopPositional()
+	assert.NoError(t, err)
+	assert.Equal(t, "[] 0", result)
+
+	shell.PushPositional([]string{"a"})
+	defer shell.PopPositional()
+	result, err = expandVariables("$1 $@")
+	assert.NoError(t, err)
+	assert.Equal(t, "a a", result)
+	_, err = expandVariables("$2")
+	assert.EqualError(t, err, "2: unbound variable")
+
+	_, err = ParsePipeline("echo $GOSH_UNDEFINED")
+	assert.ErrorIs(t, err, ErrUnboundVariable)
+}
+
+func TestExpandParameterPatternRemoval(t *testing.T) {
+	t.Setenv("GOSH_FILE", "/home/user/archive.tar.gz")
+	t.Setenv("GOSH_TXT", "notes.txt")
+	t.Setenv("GOSH_EXT", ".txt")
+
+	tests := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{"shortest prefix", "${GOSH_FILE#*/}", "home/user/archive.tar.gz"},
+		{"longest prefix", "${GOSH_FILE##*/}", "archive.tar.gz"},
+		{"shortest suffix", "${GOSH_FILE%.*}", "/home/user/archive.tar"},
+		{"longest suffix", "${GOSH_FILE%%.*}", "/home/user/archive"},
+		{"literal suffix", "${GOSH_TXT%.txt}", "notes"},
+		{"pattern from variable", "${GOSH_TXT%$GOSH_EXT}", "notes"},
+		{"no prefix match", "${GOSH_TXT#xyz}", "notes.txt"},
+		{"no suffix match", "${GOSH_TXT%.md}", "notes.txt"},
+		{"unset variable", "${GOSH_UNSET_PATTERN#*}", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := expandVariables(tt.input)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, result)
+		})
+	}
+}
+
+func TestExpandParameterSubstitution(t *testing.T) {
+	t.Setenv("GOSH_SUB", "foo.bar.foo")
+	t.Setenv("GOSH_REPL", "baz")
+
+	tests := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{"replace first", "${GOSH_SUB/foo/x}", "x.bar.foo"},
+		{"replace all", "${GOSH_SUB//foo/x}", "x.bar.x"},
+		{"glob pattern", "${GOSH_SUB/b*r/x}", "foo.x.foo"},
+		{"longest match", "${GOSH_SUB/f*o/x}", "x"},
+		{"no match", "${GOSH_SUB/qux/x}", "foo.bar.foo"},
+		{"empty replacement deletes", "${GOSH_SUB//./}", "foobarfoo"},
+		{"missing replacement deletes", "${GOSH_SUB/.bar}", "foo.foo"},
+		{"replacement from variable", "${GOSH_SUB/bar/$GOSH_REPL}", "foo.baz.foo"},
+		{"anchored prefix", "${GOSH_SUB/#foo/x}", "x.bar.foo"},
+		{"anchored prefix no match", "${GOSH_SUB/#bar/x}", "foo.bar.foo"},
+		{"anchored suffix", "${GOSH_SUB/%foo/x}", "foo.bar.x"},
+		{"anchored suffix no match", "${GOSH_SUB/%bar/x}", "foo.bar.foo"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := expandVariables(tt.input)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, result)
+		})
+	}
+}
+
 func TestParseLineBasic(t *testing.T) {
 	tests := []struct {
 		name     string
@@ -303,7 +592,8 @@ func TestExpandArgsVariables(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			result := expandArgsVariables(tt.input)
+			result, err := expandArgsVariables(tt.input)
+			assert.NoError(t, err)
 			assert.Equal(t, tt.expected, result)
 		})
 	}
@@ -324,13 +614,6 @@ func TestParseCommandEdgeCases(t *testing.T) {
 				OutputFile: "file2.txt",
 			},
 		},
-		{
-			name:  "redirection without filename",
-			input: "echo hello >",
-			expected: &Command{
-				Args: []string{"echo", "hello"},
-			},
-		},
 		{
 			name:  "background with other operators",
 			input: "echo hello > file.txt &",
@@ -341,25 +624,41 @@ func TestParseCommandEdgeCases(t *testing.T) {
 			},
 		},
 		{
-			name:  "only redirection operators",
-			input: "> < >>",
+			name:  "command with equals sign",
+			input: "env VAR=value",
 			expected: &Command{
-				Args:       []string{},
-				OutputFile: "<", // Current parsing behavior - last token becomes output
+				Args: []string{"env", "VAR=value"},
 			},
 		},
 		{
-			name:  "command with equals sign",
-			input: "env VAR=value",
+			name:  "assignment only",
+			input: "FOO=bar BAZ=qux",
 			expected: &Command{
-				Args: []string{"env", "VAR=value"},
+				Args:        []string{},
+				Assignments: []string{"FOO=bar", "BAZ=qux"},
+			},
+		},
+		{
+			name:  "assignment before command",
+			input: "FOO=bar printenv FOO",
+			expected: &Command{
+				Args:        []string{"printenv", "FOO"},
+				Assignments: []string{"FOO=bar"},
+			},
+		},
+		{
+			name:  "invalid assignment name is an argument",
+			input: "1FOO=bar",
+			expected: &Command{
+				Args: []string{"1FOO=bar"},
 			},
 		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			result := ParseCommand(tt.input)
+			result, err := ParseCommand(tt.input)
+			assert.NoError(t, err)
 			assert.Equal(t, tt.expected, result)
 		})
 	}
@@ -367,6 +666,8 @@ func TestParseCommandEdgeCases(t *testing.T) {
 
 // Tab completion tests
 func TestCompletionEngine_Complete(t *testing.T) {
+	SetBuiltinDescriptions(builtins.Descriptions())
+	defer SetBuiltinDescriptions(nil)
 	ce := NewCompletionEngine()
 
 	tests := []struct {
@@ -430,6 +731,8 @@ func TestCompletionEngine_Complete(t *testing.T) {
 	}
 }
 func TestCompletionEngine_CompleteCommand(t *testing.T) {
+	SetBuiltinDescriptions(builtins.Descriptions())
+	defer SetBuiltinDescriptions(nil)
 	ce := NewCompletionEngine()
 
 	tests := []struct {
@@ -477,7 +780,7 @@ func TestCompletionEngine_CompleteCommand(t *testing.T) {
 			// Filter to only builtin commands for predictable testing
 			var builtinResults []string
 			for _, cmd := range result {
-				for _, builtin := range ce.builtinCommands {
+				for _, builtin := range builtinNames() {
 					if cmd == builtin {
 						builtinResults = append(builtinResults, cmd)
 						break
@@ -497,17 +800,249 @@ func TestCompletionEngine_CompleteCommand(t *testing.T) {
 		})
 	}
 }
+func TestCompletionEngine_JobIDCompletion(t *testing.T) {
+	jm := jobs.NewJobManager()
+	for i := 0; i < 2; i++ {
+		cmd := exec.Command("sleep", "5")
+		assert.NoError(t, cmd.Start())
+		defer cmd.Process.Kill()
+		jm.AddJob(cmd, "sleep 5")
+	}
+	SetJobManager(jm)
+	defer SetJobManager(nil)
+
+	ce := NewCompletionEngine()
+
+	assert.Equal(t, []string{"1", "2"}, ce.Complete("fg ", 3))
+	assert.Equal(t, []string{"2"}, ce.Complete("bg 2", 4))
+	assert.Empty(t, ce.Complete("fg 9", 4))
+}
+
+func TestFormatPrompt(t *testing.T) {
+	jm := jobs.NewJobManager()
+	for _, seconds := range []string{"5", "6"} {
+		cmd := exec.Command("sleep", seconds)
+		assert.NoError(t, cmd.Start())
+		defer cmd.Process.Kill()
+		jm.AddJob(cmd, "sleep "+seconds)
+	}
+	SetJobManager(jm)
+	defer SetJobManager(nil)
+
+	t.Setenv("HOME", t.TempDir())
+	hist := history.New()
+	hist.Add("echo one")
+	hist.Add("echo two")
+	hist.Add("echo three")
+	SetHistory(hist)
+	defer SetHistory(nil)
+
+	assert.Equal(t, "[2 jobs] 4$ ", formatPrompt("[\\j jobs] \\!$ "))
+	assert.Equal(t, "a\\b \\w\\", formatPrompt("a\\\\b \\w\\"))
+
+	// Without a job manager or history the counts start from nothing
+	SetJobManager(nil)
+	SetHistory(nil)
+	assert.Equal(t, "0 1", formatPrompt("\\j \\!"))
+
+	// PS1 replaces the usual prompt
+	assert.Equal(t, "gosh> ", commandPrompt())
+	t.Setenv("PS1", "\\!> ")
+	assert.Equal(t, "1> ", commandPrompt())
+	assert.Equal(t, "1> ", (&LineEditor{}).promptText())
+}
+
+func TestContinuationPrompt(t *testing.T) {
+	defer resetBackend()
+	t.Setenv("PS2", "")
+
+	read := func(input string) (string, string) {
+		stdinR, stdinW, _ := os.Pipe()
+		stdoutR, stdoutW, _ := os.Pipe()
+		oldStdin, oldStdout := os.Stdin, os.Stdout
+		os.Stdin, os.Stdout = stdinR, stdoutW
+		defer func() {
+			os.Stdin, os.Stdout = oldStdin, oldStdout
+			stdinR.Close()
+		}()
+
+		stdinW.WriteString(input)
+		stdinW.Close()
+		line, err := ReadContinuationLine()
+		assert.NoError(t, err)
+		stdoutW.Close()
+		output, _ := io.ReadAll(stdoutR)
+		stdoutR.Close()
+		return line, string(output)
+	}
+
+	line, output := read("done\n")
+	assert.Equal(t, "done", line)
+	assert.Equal(t, "> ", output)
+
+	// PS2 is looked up each time, with its escapes expanded
+	t.Setenv("PS2", "\\...\\ ")
+	_, output = read("done\n")
+	assert.Equal(t, "\\...\\ ", output)
+	t.Setenv("PS2", "\033[2mmore>\033[0m ")
+	_, output = read("done\n")
+	assert.Equal(t, "\033[2mmore>\033[0m ", output)
+
+	// Only what shows on screen counts towards the prompt's width
+	assert.Equal(t, 6, promptWidth(continuationPrompt()))
+	assert.Equal(t, 3, promptWidth("λ> "))
+}
+
+func TestCompletionQuery(t *testing.T) {
+	t.Setenv("GOSH_COMPLETION_QUERY", "")
+	assert.Equal(t, "Display all 250 possibilities? (y or n)", completionQuery(250))
+	t.Setenv("GOSH_COMPLETION_QUERY", "Show %d matches? ")
+	assert.Equal(t, "Show 250 matches? ", completionQuery(250))
+
+	answer := func(key string) bool {
+		stdinR, stdinW, _ := os.Pipe()
+		devNull, _ := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+		oldStdin, oldStdout := os.Stdin, os.Stdout
+		os.Stdin, os.Stdout = stdinR, devNull
+		defer func() {
+			os.Stdin, os.Stdout = oldStdin, oldStdout
+			stdinR.Close()
+			devNull.Close()
+		}()
+
+		stdinW.WriteString(key)
+		stdinW.Close()
+		return confirmCompletions(completionQueryItems + 1)
+	}
+
+	assert.True(t, answer("y"))
+	assert.True(t, answer(" "))
+	assert.False(t, answer("n"))
+	assert.False(t, answer(""))
+
+	// A short list is shown without asking
+	assert.True(t, confirmCompletions(completionQueryItems))
+}
+
+func TestCompletionEngine_JobSpecCompletion(t *testing.T) {
+	jm := jobs.NewJobManager()
+	for _, seconds := range []string{"5", "6", "7"} {
+		cmd := exec.Command("sleep", seconds)
+		assert.NoError(t, cmd.Start())
+		defer cmd.Process.Kill()
+		jm.AddJob(cmd, "sleep "+seconds)
+	}
+	SetJobManager(jm)
+	defer SetJobManager(nil)
+
+	ce := NewCompletionEngine()
+
+	all := []string{"%1", "%2", "%3", "%+", "%-"}
+	assert.Equal(t, all, ce.Complete("fg %", 4))
+	assert.Equal(t, all, ce.Complete("bg %", 4))
+	assert.Equal(t, all, ce.Complete("kill %", 6))
+	assert.Equal(t, []string{"%2"}, ce.Complete("kill -9 %2", 10))
+	assert.Equal(t, []string{"%-"}, ce.Complete("fg %-", 5))
+
+	// kill's other arguments are process IDs and signals
+	assert.Empty(t, ce.Complete("kill ", 5))
+
+	assert.Equal(t, map[string]string{
+		"%1": "sleep 5",
+		"%2": "sleep 6",
+		"%3": "sleep 7",
+		"%+": "sleep 7",
+		"%-": "sleep 6",
+	}, jobSpecDescriptions())
+
+	// Listed, each spec shows the command it stands for
+	r, w, _ := os.Pipe()
+	oldStdout := os.Stdout
+	os.Stdout = w
+	(&LineEditor{}).showCompletions([]string{"%1", "%+"})
+	os.Stdout = oldStdout
+	w.Close()
+	output, _ := io.ReadAll(r)
+	r.Close()
+	assert.Equal(t, "%1  -- sleep 5\r\n%+  -- sleep 7\r\n", string(output))
+
+	// Without jobs there's nothing to complete
+	SetJobManager(jobs.NewJobManager())
+	assert.Empty(t, ce.Complete("fg %", 4))
+}
+
+func TestCompletionEngine_CompleteBuiltin(t *testing.T) {
+	defer shell.RemoveCompletion("myservice")
+	defer shell.RemoveCompletion("history")
+
+	dir := t.TempDir()
+	os.Mkdir(filepath.Join(dir, "static"), 0755)
+	os.WriteFile(filepath.Join(dir, "setup.sh"), nil, 0644)
+	originalDir, _ := os.Getwd()
+	os.Chdir(dir)
+	defer os.Chdir(originalDir)
+
+	ce := NewCompletionEngine()
+	builtins.ExecuteIO("complete", []string{"-W", "start stop restart", "myservice"}, shell.IO{})
+
+	assert.Equal(t, []string{"start", "stop", "restart"}, ce.Complete("myservice ", 10))
+	assert.Equal(t, []string{"start", "stop"}, ce.Complete("myservice st", 12))
+	assert.Equal(t, []string{"restart"}, ce.Complete("myservice -v re", 15))
+
+	// Directories and files can be offered after the words
+	builtins.ExecuteIO("complete", []string{"-d", "-W", "serve", "myservice"}, shell.IO{})
+	assert.Equal(t, []string{"serve"}, ce.Complete("myservice se", 12))
+	assert.Equal(t, []string{"serve", "static/"}, ce.Complete("myservice s", 11))
+	builtins.ExecuteIO("complete", []string{"-f", "-W", "serve", "myservice"}, shell.IO{})
+	assert.Equal(t, []string{"serve", "setup.sh", "static/"}, ce.Complete("myservice s", 11))
+
+	// A spec overrides a command's own completer, until it is removed
+	builtins.ExecuteIO("complete", []string{"-W", "-c -w", "history"}, shell.IO{})
+	assert.Equal(t, []string{"-c", "-w"}, ce.Complete("history -", 9))
+	builtins.ExecuteIO("complete", []string{"-r", "history"}, shell.IO{})
+	assert.Empty(t, ce.Complete("history -", 9))
+}
+
+func TestCompletionEngine_SuppressedPathCompletion(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "somefile"), nil, 0644)
+	originalDir, _ := os.Getwd()
+	os.Chdir(dir)
+	defer os.Chdir(originalDir)
+
+	ce := NewCompletionEngine()
+
+	// Regular commands still complete paths
+	assert.Equal(t, []string{"somefile"}, ce.Complete("cat s", 5))
+
+	// history and jobs take no file arguments
+	assert.Empty(t, ce.Complete("history ", 8))
+	assert.Empty(t, ce.Complete("history s", 9))
+	assert.Empty(t, ce.Complete("jobs ", 5))
+}
+
+func TestCompletionEngine_RegisterCompleter(t *testing.T) {
+	ce := NewCompletionEngine()
+	ce.RegisterCompleter("mycmd", func(prefix string) []string {
+		return []string{prefix + "-done"}
+	})
+
+	assert.Equal(t, []string{"x-done"}, ce.Complete("mycmd x", 7))
+}
+
 func TestNewCompletionEngine(t *testing.T) {
+	SetBuiltinDescriptions(builtins.Descriptions())
+	defer SetBuiltinDescriptions(nil)
 	ce := NewCompletionEngine()
 
 	assert.NotNil(t, ce)
-	assert.NotNil(t, ce.builtinCommands)
-	assert.Contains(t, ce.builtinCommands, "cd")
-	assert.Contains(t, ce.builtinCommands, "pwd")
-	assert.Contains(t, ce.builtinCommands, "exit")
-	assert.Contains(t, ce.builtinCommands, "help")
-	assert.Contains(t, ce.builtinCommands, "env")
-	assert.Contains(t, ce.builtinCommands, "history")
+	names := builtinNames()
+	for _, name := range []string{"cd", "pwd", "exit", "help", "env", "history", "jobs", "trap", "tee", "timeout"} {
+		assert.Contains(t, names, name)
+	}
+	// Every builtin completes as a command name
+	assert.Contains(t, ce.completeCommand("tr"), "trap")
+	assert.Contains(t, ce.completeCommand("pus"), "pushd")
 }
 
 // Test common prefix functionality
@@ -557,6 +1092,11 @@ func TestFindCommonPrefix(t *testing.T) {
 			strings:  []string{"file.txt", "file.log", "file.md"},
 			expected: "file.",
 		},
+		{
+			name:     "accented letters",
+			strings:  []string{"café", "cafè"},
+			expected: "caf",
+		},
 	}
 
 	for _, tt := range tests {
@@ -580,8 +1120,63 @@ func TestNewLineEditor(t *testing.T) {
 	assert.False(t, le.rawMode)
 }
 
+func TestTerminalCapable(t *testing.T) {
+	tests := []struct {
+		term     string
+		expected bool
+	}{
+		{"xterm-256color", true},
+		{"screen", true},
+		{"vt100", true},
+		{"dumb", false},
+		{"unknown", false},
+		{"", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.term, func(t *testing.T) {
+			assert.Equal(t, tt.expected, terminalCapable(tt.term))
+		})
+	}
+}
+
+func TestNewLineEditorCapability(t *testing.T) {
+	t.Setenv("TERM", "dumb")
+	assert.False(t, NewLineEditor(&history.History{}).capable)
+
+	t.Setenv("TERM", "xterm")
+	assert.True(t, NewLineEditor(&history.History{}).capable)
+}
+
+func TestReadLineWithArrowsRawModeFailure(t *testing.T) {
+	t.Setenv("TERM", "xterm")
+	le := NewLineEditor(&history.History{})
+
+	// A pipe isn't a terminal, so enabling raw mode fails
+	r, w, _ := os.Pipe()
+	oldStdin, oldStdout := os.Stdin, os.Stdout
+	os.Stdin = r
+	devNull, _ := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	os.Stdout = devNull
+	defer func() {
+		os.Stdin, os.Stdout = oldStdin, oldStdout
+		devNull.Close()
+	}()
+
+	w.WriteString("echo fallback\n")
+	w.Close()
+
+	line, err := le.ReadLineWithArrows()
+	assert.NoError(t, err)
+	assert.Equal(t, "echo fallback", line)
+	assert.False(t, le.capable, "editor should stop trying raw mode after a failure")
+	assert.False(t, le.rawMode)
+}
+
 // Test completion engine integration with common prefix
 func TestCompletionEngine_CommonPrefixCompletion(t *testing.T) {
+	SetBuiltinDescriptions(builtins.Descriptions())
+	defer SetBuiltinDescriptions(nil)
 	ce := NewCompletionEngine()
 
 	// Test that commands starting with 'h' have common prefix 'h'
@@ -590,7 +1185,7 @@ func TestCompletionEngine_CommonPrefixCompletion(t *testing.T) {
 	// Filter to only builtin commands for predictable testing
 	var builtinCompletions []string
 	for _, cmd := range completions {
-		for _, builtin := range ce.builtinCommands {
+		for _, builtin := range builtinNames() {
 			if cmd == builtin {
 				builtinCompletions = append(builtinCompletions, cmd)
 				break
@@ -656,3 +1251,1653 @@ func TestReadEscapeSequence_Concept(t *testing.T) {
 		})
 	}
 }
+
+func TestLineEditor_CompletionCycle(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("GOSH_HIGHLIGHT", "0")
+	t.Setenv("GOSH_AUTOSUGGEST", "0")
+	devNull, err := os.Open(os.DevNull)
+	assert.NoError(t, err)
+	defer devNull.Close()
+	oldStdout := os.Stdout
+	os.Stdout = devNull
+	defer func() { os.Stdout = oldStdout }()
+
+	le := NewLineEditor(history.New())
+	le.completionEngine.RegisterCompleter("deploy", func(prefix string) []string {
+		var matches []string
+		for _, env := range []string{"prod", "preview", "staging"} {
+			if strings.HasPrefix(env, prefix) {
+				matches = append(matches, env)
+			}
+		}
+		return matches
+	})
+
+	line, cursor := []rune("deploy p --now"), 8
+	press := func(action Action) string {
+		le.trackCompletionCycle(action)
+		switch action {
+		case ActionComplete:
+			line, cursor = le.complete(line, cursor, 1)
+		case ActionMenuCompleteBackward:
+			line, cursor = le.complete(line, cursor, -1)
+		}
+		return string(line[:cursor]) + "|" + string(line[cursor:])
+	}
+
+	// The first Tab completes the common prefix, then each press puts the
+	// next candidate on the line, wrapping around
+	assert.Equal(t, "deploy pr| --now", press(ActionComplete))
+	assert.Equal(t, "deploy prod| --now", press(ActionComplete))
+	assert.Equal(t, "deploy preview| --now", press(ActionComplete))
+	assert.Equal(t, "deploy prod| --now", press(ActionComplete))
+	assert.Equal(t, "deploy preview| --now", press(ActionMenuCompleteBackward))
+	assert.Equal(t, "deploy prod| --now", press(ActionMenuCompleteBackward))
+
+	// Any other key ends the cycle, so Tab completes the new word afresh
+	assert.Equal(t, "deploy prod| --now", press(ActionBackwardChar))
+	assert.Nil(t, le.menu)
+	assert.Equal(t, "deploy prod| --now", press(ActionComplete))
+	assert.Nil(t, le.menu)
+
+	// Shift+Tab starts from the last candidate
+	line, cursor = []rune("deploy "), 7
+	assert.Equal(t, "deploy staging|", press(ActionMenuCompleteBackward))
+	assert.Equal(t, "deploy preview|", press(ActionMenuCompleteBackward))
+	press(ActionNone)
+
+	// With nothing in common, the first Tab lists the candidates
+	line, cursor = []rune("deploy "), 7
+	assert.Equal(t, "deploy |", press(ActionComplete))
+	assert.Equal(t, "deploy prod|", press(ActionComplete))
+	assert.Equal(t, "deploy preview|", press(ActionComplete))
+	assert.Equal(t, "deploy staging|", press(ActionComplete))
+	assert.Equal(t, "deploy prod|", press(ActionComplete))
+	press(ActionNone)
+
+	// A word already as long as the common prefix is measured in
+	// characters, not bytes, so Tab lists the candidates
+	le.completionEngine.RegisterCompleter("greet", func(prefix string) []string {
+		return []string{"été", "étude"}
+	})
+	listing, err := os.CreateTemp(t.TempDir(), "listing")
+	assert.NoError(t, err)
+	defer listing.Close()
+	os.Stdout = listing
+	line, cursor = []rune("greet ét"), 8
+	assert.Equal(t, "greet ét|", press(ActionComplete))
+	os.Stdout = devNull
+	listed, _ := os.ReadFile(listing.Name())
+	assert.Contains(t, string(listed), "étude")
+}
+
+func TestLineEditor_Autosuggest(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("GOSH_HIGHLIGHT", "0")
+	hist := history.New()
+	hist.Add("git status")
+	hist.Add("git commit -m x")
+	le := NewLineEditor(hist)
+
+	assert.Equal(t, " commit -m x", le.suggestion([]rune("git"), 3))
+	assert.Equal(t, "tatus", le.suggestion([]rune("git s"), 5))
+	assert.Equal(t, "", le.suggestion([]rune("git"), 1))
+	assert.Equal(t, "", le.suggestion([]rune("make"), 4))
+
+	// Right arrow or End at the end of the line takes the suggestion
+	line, cursor, ok := le.acceptSuggestion([]rune("git s"), 5)
+	assert.True(t, ok)
+	assert.Equal(t, "git status", string(line))
+	assert.Equal(t, 10, cursor)
+	_, _, ok = le.acceptSuggestion([]rune("git s"), 2)
+	assert.False(t, ok)
+
+	// The suggestion is drawn dimmed after the cursor, which stays put
+	r, w, _ := os.Pipe()
+	oldStdout := os.Stdout
+	os.Stdout = w
+	le.redrawLine([]rune("git s"), 5)
+	os.Stdout = oldStdout
+	w.Close()
+	output, _ := io.ReadAll(r)
+	r.Close()
+	assert.Equal(t, "\033[2K\rgosh> git s\033[2mtatus\033[0m\033[5D", string(output))
+
+	t.Setenv("GOSH_AUTOSUGGEST", "0")
+	assert.Equal(t, "", le.suggestion([]rune("git"), 3))
+}
+
+// Test that edits to recalled history entries survive navigation
+func TestLineEditor_HistoryEditsPreserved(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	hist := history.New()
+	hist.Add("echo one")
+	hist.Add("echo two")
+
+	le := NewLineEditor(hist)
+	le.resetHistoryNavigation()
+
+	// Start typing a new line, then go up to the most recent entry
+	line, ok := le.navigateHistory([]rune("draft"), -1)
+	assert.True(t, ok)
+	assert.Equal(t, "echo two", string(line))
+
+	// Edit the recalled entry and move further up
+	line, ok = le.navigateHistory([]rune("echo two edited"), -1)
+	assert.True(t, ok)
+	assert.Equal(t, "echo one", string(line))
+
+	// Can't go past the oldest entry
+	_, ok = le.navigateHistory(line, -1)
+	assert.False(t, ok)
+
+	// Coming back down restores the edited copy
+	line, ok = le.navigateHistory(line, 1)
+	assert.True(t, ok)
+	assert.Equal(t, "echo two edited", string(line))
+
+	// And the in-progress line at the end of history
+	line, ok = le.navigateHistory(line, 1)
+	assert.True(t, ok)
+	assert.Equal(t, "draft", string(line))
+
+	_, ok = le.navigateHistory(line, 1)
+	assert.False(t, ok)
+
+	// History itself is untouched
+	assert.Equal(t, []string{"echo one", "echo two"}, hist.GetAll())
+
+	// A new editing session discards the scratch edits
+	le.resetHistoryNavigation()
+	line, _ = le.navigateHistory(nil, -1)
+	assert.Equal(t, "echo two", string(line))
+}
+
+func TestParseCommandQuoting(t *testing.T) {
+	os.Setenv("GOSH_QUOTE_TEST", "x y")
+	defer os.Unsetenv("GOSH_QUOTE_TEST")
+	t.Setenv("GOSH_QUOTE_SPACES", " a   b ")
+
+	tests := []struct {
+		name     string
+		input    string
+		expected []string
+	}{
+		{"single quotes", "echo 'a b' c", []string{"echo", "a b", "c"}},
+		{"single quotes are literal", "echo '$GOSH_QUOTE_TEST'", []string{"echo", "$GOSH_QUOTE_TEST"}},
+		{"double quotes expand", `echo "v=$GOSH_QUOTE_TEST"`, []string{"echo", "v=x y"}},
+		{"escaped dollar", `echo "\$GOSH_QUOTE_TEST" \$HOME`, []string{"echo", "$GOSH_QUOTE_TEST", "$HOME"}},
+		{"escaped space", `echo a\ b`, []string{"echo", "a b"}},
+		{"adjacent quotes", `echo 'a'"b"c`, []string{"echo", "abc"}},
+		{"quoted operator", "echo '>' out", []string{"echo", ">", "out"}},
+		{"empty quotes", `echo ''`, []string{"echo", ""}},
+		{"runs of spaces kept", `echo "a    b" 'c   d'`, []string{"echo", "a    b", "c   d"}},
+		{"tabs kept", "echo \"a\t\tb\" 'c\td'", []string{"echo", "a\t\tb", "c\td"}},
+		{"leading and trailing blanks kept", "echo '  a  ' \" \tb\t \"", []string{"echo", "  a  ", " \tb\t "}},
+		{"only blanks", `echo "   " '	'`, []string{"echo", "   ", "\t"}},
+		{"blanks in part of a word", `echo x"  "y`, []string{"echo", "x  y"}},
+		{"blanks in an expanded variable", `echo "[$GOSH_QUOTE_SPACES]"`, []string{"echo", "[ a   b ]"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd, err := ParseCommand(tt.input)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, cmd.Args)
+			assert.Empty(t, cmd.OutputFile)
+		})
+	}
+
+	// Unterminated quotes are an error
+	_, err := ParseCommand("echo 'oops")
+	assert.EqualError(t, err, "unexpected EOF while looking for matching `''")
+	_, err = ParsePipeline(`echo "oops | wc`)
+	assert.EqualError(t, err, "unexpected EOF while looking for matching `\"'")
+
+	// Quoted pipes don't split the pipeline
+	pipeline, err := ParsePipeline("echo 'a|b' | wc -c")
+	assert.NoError(t, err)
+	assert.Len(t, pipeline.Commands, 2)
+	assert.Equal(t, []string{"echo", "a|b"}, pipeline.Commands[0].Args)
+}
+
+func TestParseRedirectionExpansion(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("GOSH_REDIR_DIR", dir)
+	t.Setenv("HOME", "/home/gosh")
+
+	tests := []struct {
+		input     string
+		output    string
+		inputFile string
+	}{
+		{"echo hi > $GOSH_REDIR_DIR/out.txt", dir + "/out.txt", ""},
+		{"echo hi >> ${GOSH_REDIR_DIR}/out.txt", dir + "/out.txt", ""},
+		{`cat < "$GOSH_REDIR_DIR/my file"`, "", dir + "/my file"},
+		{"echo hi > ~/out.txt", "/home/gosh/out.txt", ""},
+		{"cat < ~", "", "/home/gosh"},
+		{"echo hi > '~/out.txt'", "~/out.txt", ""},
+		{"echo hi > '$GOSH_REDIR_DIR'", "$GOSH_REDIR_DIR", ""},
+		{"echo hi > a~", "a~", ""},
+	}
+	for _, tt := range tests {
+		cmd, err := ParseCommand(tt.input)
+		assert.NoError(t, err, tt.input)
+		assert.Equal(t, tt.output, cmd.OutputFile, tt.input)
+		assert.Equal(t, tt.inputFile, cmd.InputFile, tt.input)
+	}
+
+	_, err := ParseCommand("echo hi > $GOSH_REDIR_UNSET")
+	assert.EqualError(t, err, "$GOSH_REDIR_UNSET: ambiguous redirect")
+}
+
+func TestPathCache(t *testing.T) {
+	makeExecutable := func(dir, name string) {
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte("#!/bin/sh\n"), 0755))
+	}
+
+	dirA, dirB := t.TempDir(), t.TempDir()
+	makeExecutable(dirA, "goshtool-a")
+	makeExecutable(dirB, "goshtool-b")
+	t.Setenv("PATH", dirA)
+
+	// Count directory reads
+	reads := 0
+	oldReadDir := readDir
+	readDir = func(dir string) ([]os.DirEntry, error) {
+		reads++
+		return oldReadDir(dir)
+	}
+	defer func() { readDir = oldReadDir }()
+
+	ce := NewCompletionEngine()
+	assert.Nil(t, ce.pathCache, "PATH should be scanned lazily")
+
+	// First completion populates the cache
+	assert.Equal(t, []string{"goshtool-a"}, ce.completeCommand("goshtool"))
+	assert.Equal(t, 1, reads)
+	assert.Equal(t, []string{"goshtool-a"}, ce.pathCache)
+
+	// Later completions reuse it
+	ce.completeCommand("goshtool")
+	ce.completeCommand("gosh")
+	assert.Equal(t, 1, reads)
+
+	// Changing PATH invalidates it
+	t.Setenv("PATH", dirA+":"+dirB)
+	assert.Equal(t, []string{"goshtool-a", "goshtool-b"}, ce.completeCommand("goshtool"))
+	assert.Equal(t, 3, reads)
+
+	// So does the TTL expiring
+	makeExecutable(dirA, "goshtool-c")
+	assert.Len(t, ce.completeCommand("goshtool"), 2)
+	ce.pathCacheTime = time.Now().Add(-pathCacheTTL)
+	assert.Len(t, ce.completeCommand("goshtool"), 3)
+	assert.Equal(t, 5, reads)
+}
+
+func TestFuzzyMatch(t *testing.T) {
+	tests := []struct {
+		pattern   string
+		candidate string
+		match     bool
+	}{
+		{"gi", "git", true},
+		{"gi", "grep", false},
+		{"gi", "login", true},
+		{"gt", "git", true},
+		{"tg", "git", false},
+		{"", "anything", true},
+		{"abc", "ab", false},
+	}
+
+	for _, tt := range tests {
+		ok, _ := fuzzyMatch(tt.pattern, tt.candidate)
+		assert.Equal(t, tt.match, ok, "%q in %q", tt.pattern, tt.candidate)
+	}
+
+	// Prefix matches beat contiguous matches, which beat scattered ones
+	_, prefix := fuzzyMatch("gi", "git")
+	_, contiguous := fuzzyMatch("gi", "login")
+	_, scattered := fuzzyMatch("gt", "gist")
+	_, gap := fuzzyMatch("gt", "logout")
+	assert.Greater(t, prefix, contiguous)
+	assert.Greater(t, contiguous, gap)
+	assert.Greater(t, scattered, gap)
+}
+
+func TestFuzzyCompletion(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"git", "login", "grep", "digit"} {
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte("#!/bin/sh\n"), 0755))
+	}
+	t.Setenv("PATH", dir)
+
+	ce := NewCompletionEngine()
+
+	// Prefix matching by default
+	assert.Equal(t, []string{"git"}, ce.completeCommand("gi"))
+
+	t.Setenv("GOSH_FUZZY", "1")
+	assert.Equal(t, []string{"git", "digit", "login"}, ce.completeCommand("gi"))
+
+	// File paths are matched the same way
+	origDir, _ := os.Getwd()
+	defer os.Chdir(origDir)
+	os.Chdir(dir)
+	assert.Equal(t, []string{"git", "digit"}, ce.completePath("gt"))
+}
+
+func TestCdCompletionRecentDirs(t *testing.T) {
+	dir, _ := filepath.EvalSymlinks(t.TempDir())
+	for _, name := range []string{"project-new", "project-old", "other", "elsewhere/deep"} {
+		assert.NoError(t, os.MkdirAll(filepath.Join(dir, name), 0755))
+	}
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "project-notes.txt"), nil, 0644))
+	origDir, _ := os.Getwd()
+	defer os.Chdir(origDir)
+	t.Setenv("PWD", os.Getenv("PWD"))
+	t.Setenv("OLDPWD", os.Getenv("OLDPWD"))
+
+	// Visit a few directories, ending up back at the top
+	SetRecentDirs(builtins.RecentDirs)
+	defer SetRecentDirs(nil)
+	for _, name := range []string{"project-old", "elsewhere/deep", ""} {
+		builtins.ExecuteIO("cd", []string{filepath.Join(dir, name)}, shell.IO{Out: io.Discard, Err: io.Discard})
+	}
+
+	ce := NewCompletionEngine()
+
+	// The recently visited directory comes ahead of the fresh one, and files
+	// aren't offered
+	line := "cd proj"
+	assert.Equal(t, []string{"project-old/", "project-new/"}, ce.Complete(line, len(line)))
+
+	// Recent directories further down are offered too, and absolute
+	// prefixes get absolute paths
+	line = "cd e"
+	assert.Equal(t, []string{"elsewhere/deep/", "elsewhere/"}, ce.Complete(line, len(line)))
+	line = "cd " + dir + "/p"
+	assert.Equal(t, []string{dir + "/project-old/", dir + "/project-new/"}, ce.Complete(line, len(line)))
+
+	// Without any history it's plain directory completion
+	SetRecentDirs(nil)
+	line = "cd proj"
+	assert.Equal(t, []string{"project-new/", "project-old/"}, ce.Complete(line, len(line)))
+}
+
+func TestRemotePathCompletion(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, os.MkdirAll(filepath.Join(dir, "host:", "pages"), 0755))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "file.txt"), nil, 0644))
+	origDir, _ := os.Getwd()
+	defer os.Chdir(origDir)
+	os.Chdir(dir)
+
+	ce := NewCompletionEngine()
+
+	// The remote part isn't looked for locally, even if it happens to exist
+	line := "scp file.txt host:/pa"
+	assert.Empty(t, ce.Complete(line, len(line)))
+	line = "rsync -a user@host:pa"
+	assert.Empty(t, ce.Complete(line, len(line)))
+
+	// Local paths still complete, including ones with a colon after a slash
+	line = "scp fi"
+	assert.Equal(t, []string{"file.txt"}, ce.Complete(line, len(line)))
+	line = "scp ./host:/pa"
+	assert.Equal(t, []string{"host:/pages/"}, ce.Complete(line, len(line)))
+
+	assert.True(t, isRemotePath("host:"))
+	assert.False(t, isRemotePath(":path"))
+	assert.False(t, isRemotePath("dir/a:b"))
+}
+
+func TestParseList(t *testing.T) {
+	pipelines, err := ParseList("sleep 1 & echo done")
+	assert.NoError(t, err)
+	assert.Len(t, pipelines, 2)
+	assert.Equal(t, []string{"sleep", "1"}, pipelines[0].Commands[0].Args)
+	assert.True(t, pipelines[0].Background)
+	assert.Equal(t, []string{"echo", "done"}, pipelines[1].Commands[0].Args)
+	assert.False(t, pipelines[1].Background)
+
+	// Every pipeline followed by & is backgrounded
+	pipelines, _ = ParseList("a | b & c &")
+	assert.Len(t, pipelines, 2)
+	assert.Len(t, pipelines[0].Commands, 2)
+	assert.True(t, pipelines[0].Background)
+	assert.True(t, pipelines[1].Background)
+
+	// Quoted and escaped ampersands don't split the line
+	pipelines, _ = ParseList(`echo 'a & b' \& c`)
+	assert.Len(t, pipelines, 1)
+	assert.Equal(t, []string{"echo", "a & b", "&", "c"}, pipelines[0].Commands[0].Args)
+	assert.False(t, pipelines[0].Background)
+
+	// A single pipeline parses the same as ParsePipeline
+	single, _ := ParsePipeline("ls -l | wc -l")
+	pipelines, _ = ParseList("ls -l | wc -l")
+	assert.Equal(t, []*Pipeline{single}, pipelines)
+
+	pipelines, err = ParseList("   ")
+	assert.NoError(t, err)
+	assert.Empty(t, pipelines)
+
+	// An error in any pipeline rejects the whole line
+	pipelines, err = ParseList("sleep 1 & ls |")
+	assert.Error(t, err)
+	assert.Empty(t, pipelines)
+}
+
+func TestExpandVariablesSinglePass(t *testing.T) {
+	os.Setenv("GOSH_DOLLAR_VALUE", "cost $GOSH_DOLLAR_OTHER")
+	os.Setenv("GOSH_DOLLAR_OTHER", "expanded")
+	defer os.Unsetenv("GOSH_DOLLAR_VALUE")
+	defer os.Unsetenv("GOSH_DOLLAR_OTHER")
+
+	tests := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{"value with dollar not re-expanded", "$GOSH_DOLLAR_VALUE", "cost $GOSH_DOLLAR_OTHER"},
+		{"braced value not re-expanded", "${GOSH_DOLLAR_VALUE}", "cost $GOSH_DOLLAR_OTHER"},
+		{"default with dollar not re-expanded", "${GOSH_DOLLAR_UNSET:-$GOSH_DOLLAR_VALUE}", "cost $GOSH_DOLLAR_OTHER"},
+		{"nested braces", "${GOSH_DOLLAR_UNSET:-${GOSH_DOLLAR_OTHER}}", "expanded"},
+		{"escaped dollar", `\$GOSH_DOLLAR_OTHER`, "$GOSH_DOLLAR_OTHER"},
+		{"escaped braces", `\${GOSH_DOLLAR_OTHER}`, "${GOSH_DOLLAR_OTHER}"},
+		{"escaped then expanded", `\$GOSH_DOLLAR_OTHER $GOSH_DOLLAR_OTHER`, "$GOSH_DOLLAR_OTHER expanded"},
+		{"lone dollar", "costs $ 5", "costs $ 5"},
+		{"trailing dollar", "end$", "end$"},
+		{"empty braces", "${}", "${}"},
+		{"unterminated braces", "${GOSH_DOLLAR_OTHER", "${GOSH_DOLLAR_OTHER"},
+		{"adjacent", "$GOSH_DOLLAR_OTHER${GOSH_DOLLAR_OTHER}", "expandedexpanded"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, ExpandVariables(tt.input))
+		})
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	tests := []struct {
+		tmout    string
+		expected time.Duration
+	}{
+		{"", 0},
+		{"0", 0},
+		{"-5", 0},
+		{"abc", 0},
+		{"1", time.Second},
+		{"90", 90 * time.Second},
+	}
+
+	for _, tt := range tests {
+		t.Setenv("TMOUT", tt.tmout)
+		assert.Equal(t, tt.expected, idleTimeout(), "TMOUT=%q", tt.tmout)
+	}
+}
+
+func TestParsePipelineEmptySegments(t *testing.T) {
+	for _, line := range []string{"| wc -l", "ls |", "ls | | wc -l", "ls || wc -l", "|", "ls | &"} {
+		pipeline, err := ParsePipeline(line)
+		assert.EqualError(t, err, "syntax error near unexpected token '|'", line)
+		assert.Nil(t, pipeline)
+	}
+
+	// Pipes inside quotes don't separate commands
+	assert.NoError(t, checkPipeSegments([]string{"echo '|'", " cat"}))
+	pipeline, err := ParsePipeline("echo '|' | cat")
+	assert.NoError(t, err)
+	assert.Len(t, pipeline.Commands, 2)
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		err   string
+	}{
+		{"redirection without filename", "echo hello >", "syntax error near unexpected token 'newline'"},
+		{"append without filename", "echo hello >>", "syntax error near unexpected token 'newline'"},
+		{"input without filename", "wc -l <", "syntax error near unexpected token 'newline'"},
+		{"redirection into operator", "> < >>", "syntax error near unexpected token '<'"},
+		{"redirection before background", "echo hi > & x", "syntax error near unexpected token '&'"},
+		{"unterminated quote", "echo 'oops", "unexpected EOF while looking for matching `''"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd, err := ParseCommand(tt.input)
+			assert.EqualError(t, err, tt.err)
+			assert.Nil(t, cmd)
+
+			pipeline, err := ParsePipeline("true | " + tt.input)
+			assert.EqualError(t, err, tt.err)
+			assert.Nil(t, pipeline)
+		})
+	}
+
+	// Escape sequences are stripped, leaving the command
+	pipeline, err := ParsePipeline("ls \x1b[A-l")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"ls", "-l"}, pipeline.Commands[0].Args)
+}
+
+func TestSanitizeLine(t *testing.T) {
+	tests := []struct {
+		name, line, want string
+	}{
+		{"plain", "echo hello", "echo hello"},
+		{"arrow key", "ls\x1b[A -la", "ls -la"},
+		{"colors", "\x1b[1;31mecho\x1b[0m red", "echo red"},
+		{"bracketed paste", "\x1b[200~git status\x1b[201~", "git status"},
+		{"title", "\x1b]0;my title\aecho hi", "echo hi"},
+		{"title ended by ST", "\x1b]2;title\x1b\\pwd", "pwd"},
+		{"SS3", "\x1bOAecho", "echo"},
+		{"two-byte escape", "\x1b7echo", "echo"},
+		{"control characters", "ec\x00ho\x7f\r", "echo"},
+		{"tabs and newlines kept", "echo\ta\necho b", "echo\ta\necho b"},
+		{"trailing escape", "echo \x1b", "echo "},
+		{"caret text kept", "grep '^[a-z]'", "grep '^[a-z]'"},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, sanitizeLine(tt.line), tt.name)
+	}
+}
+
+func TestRestoreTerminal(t *testing.T) {
+	origGet, origSet := getTermios, setTermios
+	defer func() { getTermios, setTermios = origGet, origSet }()
+
+	// Fake terminal that starts out in cooked mode
+	cooked := termios{Iflag: syscall.ICRNL, Oflag: syscall.OPOST, Lflag: syscall.ECHO | syscall.ICANON}
+	current := cooked
+	sets := 0
+	getTermios = func(fd int, tty *termios) error {
+		*tty = current
+		return nil
+	}
+	setTermios = func(fd int, tty *termios) error {
+		current = *tty
+		sets++
+		return nil
+	}
+
+	le := &LineEditor{}
+	assert.NoError(t, le.enableRawMode())
+	assert.True(t, le.rawMode)
+	assert.Zero(t, current.Lflag&(syscall.ECHO|syscall.ICANON))
+
+	RestoreTerminal()
+	assert.Equal(t, cooked, current)
+	assert.False(t, le.rawMode)
+
+	// Further cleanup calls don't touch the terminal
+	RestoreTerminal()
+	assert.NoError(t, le.disableRawMode())
+	assert.Equal(t, 2, sets)
+	assert.Equal(t, cooked, current)
+}
+
+func TestParseKeyBinding(t *testing.T) {
+	tests := []struct {
+		line   string
+		seq    string
+		action Action
+	}{
+		{`"\C-a": beginning-of-line`, "\x01", ActionBeginningOfLine},
+		{`  "\e[1~" : beginning-of-line  `, "\x1b[1~", ActionBeginningOfLine},
+		{`"\C-x\C-k": kill-line`, "\x18\x0b", ActionKillLine},
+		{`"\M-d": delete-char`, "\x1bd", ActionDeleteChar},
+		{`"\C-?": backward-delete-char`, "\x7f", ActionBackwardDeleteChar},
+		{`"\"": complete`, `"`, ActionComplete},
+		{"", "", ActionNone},
+		{"# a comment", "", ActionNone},
+	}
+	for _, tt := range tests {
+		seq, action, err := parseKeyBinding(tt.line)
+		assert.NoError(t, err, tt.line)
+		assert.Equal(t, tt.seq, seq, tt.line)
+		assert.Equal(t, tt.action, action, tt.line)
+	}
+
+	errorCases := map[string]string{
+		`"\C-a" beginning-of-line`: `"\C-a" beginning-of-line: expected "KEYS": action`,
+		`C-a: beginning-of-line`:   `C-a: beginning-of-line: expected "KEYS": action`,
+		`"\C-a": launch-rockets`:   "launch-rockets: unknown action",
+		`"": complete`:             "empty key sequence",
+		`"\C": complete`:           `\C: incomplete \C- sequence`,
+	}
+	for line, want := range errorCases {
+		_, _, err := parseKeyBinding(line)
+		assert.EqualError(t, err, want, line)
+	}
+}
+
+func TestLoadKeyBindings(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "inputrc")
+
+	// A missing file gives the defaults
+	bindings, err := LoadKeyBindings(path)
+	assert.NoError(t, err)
+	assert.Equal(t, DefaultKeyBindings(), bindings)
+
+	// Bindings in the file override the defaults, and bad lines are
+	// reported without losing the rest
+	content := "# my bindings\n\"\\C-a\": beginning-of-line\n\"\\e[A\": next-history\nnonsense\n"
+	assert.NoError(t, os.WriteFile(path, []byte(content), 0644))
+	bindings, err = LoadKeyBindings(path)
+	assert.EqualError(t, err, path+`:4: nonsense: expected "KEYS": action`)
+	assert.Equal(t, ActionBeginningOfLine, bindings["\x01"])
+	assert.Equal(t, ActionNextHistory, bindings["\x1b[A"])
+	assert.Equal(t, ActionAcceptLine, bindings["\r"])
+}
+
+func TestKeyBindingDispatch(t *testing.T) {
+	t.Setenv("TERM", "xterm")
+	origGet, origSet, origBindings := getTermios, setTermios, keyBindings
+	defer func() { getTermios, setTermios, keyBindings = origGet, origSet, origBindings }()
+	getTermios = func(fd int, tty *termios) error { return nil }
+	setTermios = func(fd int, tty *termios) error { return nil }
+
+	bindings := DefaultKeyBindings()
+	bindings["\x01"] = ActionBeginningOfLine
+	bindings["\x18\x0b"] = ActionKillLine
+	SetKeyBindings(bindings)
+
+	read := func(keys string) string {
+		r, w, _ := os.Pipe()
+		oldStdin, oldStdout := os.Stdin, os.Stdout
+		os.Stdin = r
+		devNull, _ := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+		os.Stdout = devNull
+		defer func() {
+			os.Stdin, os.Stdout = oldStdin, oldStdout
+			devNull.Close()
+			r.Close()
+		}()
+
+		w.WriteString(keys)
+		w.Close()
+		line, err := NewLineEditor(&history.History{}).ReadLineWithArrows()
+		assert.NoError(t, err)
+		return line
+	}
+
+	// Ctrl+A, bound above, moves to the start of the line
+	assert.Equal(t, "xecho", read("echo\x01x\r"))
+	// A two-key binding acts once both keys arrive
+	assert.Equal(t, "ec", read("echo\x1b[D\x1b[D\x18\x0b\r"))
+	// Unbound control keys and escape sequences are ignored
+	assert.Equal(t, "echo", read("ec\x02\x1b[Eho\r"))
+}
+
+func TestWakeRunsIdleHandlerWhileEditing(t *testing.T) {
+	t.Setenv("TERM", "xterm")
+	origGet, origSet := getTermios, setTermios
+	defer func() { getTermios, setTermios = origGet, origSet }()
+	getTermios = func(fd int, tty *termios) error { return nil }
+	setTermios = func(fd int, tty *termios) error { return nil }
+
+	r, w, _ := os.Pipe()
+	oldStdin, oldStdout := os.Stdin, os.Stdout
+	os.Stdin = r
+	devNull, _ := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	os.Stdout = devNull
+	defer func() {
+		os.Stdin, os.Stdout = oldStdin, oldStdout
+		devNull.Close()
+		r.Close()
+		w.Close()
+	}()
+
+	ran := make(chan struct{}, 1)
+	SetIdleHandler(func() {
+		select {
+		case ran <- struct{}{}:
+		default:
+		}
+	})
+	defer SetIdleHandler(nil)
+
+	type result struct {
+		line string
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		line, err := NewLineEditor(&history.History{}).ReadLineWithArrows()
+		done <- result{line, err}
+	}()
+
+	// The handler runs before the prompt, and again when woken partway
+	// through the line, which is kept
+	<-ran
+	w.WriteString("ech")
+	assert.Eventually(t, func() bool {
+		Wake()
+		select {
+		case <-ran:
+			return true
+		default:
+			return false
+		}
+	}, time.Second, 20*time.Millisecond)
+	w.WriteString("o\r")
+
+	res := <-done
+	assert.NoError(t, res.err)
+	assert.Equal(t, "echo", res.line)
+}
+
+func TestCtrlD(t *testing.T) {
+	t.Setenv("TERM", "xterm")
+	origGet, origSet := getTermios, setTermios
+	defer func() { getTermios, setTermios = origGet, origSet }()
+	getTermios = func(fd int, tty *termios) error { return nil }
+	setTermios = func(fd int, tty *termios) error { return nil }
+
+	read := func(keys string) (string, error) {
+		r, w, _ := os.Pipe()
+		oldStdin, oldStdout := os.Stdin, os.Stdout
+		os.Stdin = r
+		devNull, _ := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+		os.Stdout = devNull
+		defer func() {
+			os.Stdin, os.Stdout = oldStdin, oldStdout
+			devNull.Close()
+			r.Close()
+		}()
+
+		w.WriteString(keys)
+		w.Close()
+		return NewLineEditor(&history.History{}).ReadLineWithArrows()
+	}
+
+	// On an empty line it ends input
+	line, err := read("\x04")
+	assert.Equal(t, io.EOF, err)
+	assert.Empty(t, line)
+
+	// Otherwise it deletes the character under the cursor, and does nothing
+	// at the end of the line
+	line, err = read("ecxho\x1b[D\x1b[D\x1b[D\x04\x1b[F\x04\r")
+	assert.NoError(t, err)
+	assert.Equal(t, "echo", line)
+
+	// A line emptied by editing still ends input
+	line, err = read("x\x7f\x04")
+	assert.Equal(t, io.EOF, err)
+	assert.Empty(t, line)
+}
+
+func TestReadLineEOF(t *testing.T) {
+	t.Setenv("TERM", "xterm")
+	origGet, origSet := getTermios, setTermios
+	defer func() { getTermios, setTermios = origGet, origSet }()
+
+	read := func(capable bool, keys string) (string, error) {
+		getTermios = func(fd int, tty *termios) error { return nil }
+		if !capable {
+			getTermios = func(fd int, tty *termios) error { return syscall.ENOTTY }
+		}
+		setTermios = func(fd int, tty *termios) error { return nil }
+
+		r, w, _ := os.Pipe()
+		oldStdin, oldStdout := os.Stdin, os.Stdout
+		os.Stdin = r
+		devNull, _ := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+		os.Stdout = devNull
+		defer func() {
+			os.Stdin, os.Stdout = oldStdin, oldStdout
+			devNull.Close()
+			r.Close()
+		}()
+
+		w.WriteString(keys)
+		w.Close()
+		return NewLineEditor(&history.History{}).ReadLineWithArrows()
+	}
+
+	for _, capable := range []bool{true, false} {
+		// A last line without a newline is still returned
+		line, err := read(capable, "echo hi")
+		assert.NoError(t, err)
+		assert.Equal(t, "echo hi", line)
+
+		// At the end of input with nothing typed, input ends
+		line, err = read(capable, "")
+		assert.Equal(t, io.EOF, err)
+		assert.Empty(t, line)
+	}
+
+	// A key sequence cut off by the end of input is dropped
+	line, err := read(true, "ls\x1b[")
+	assert.NoError(t, err)
+	assert.Equal(t, "ls", line)
+}
+
+func TestEditCommandLine(t *testing.T) {
+	dir := t.TempDir()
+	editor := filepath.Join(dir, "editor")
+	script := "#!/bin/sh\nsed 's/hello/goodbye/' \"$2\" > \"$2.new\" && mv \"$2.new\" \"$2\"\n"
+	assert.NoError(t, os.WriteFile(editor, []byte(script), 0755))
+
+	// $EDITOR can carry arguments before the file name
+	t.Setenv("EDITOR", editor+" --wait")
+	line, err := editCommandLine("echo hello")
+	assert.NoError(t, err)
+	assert.Equal(t, "echo goodbye", line)
+
+	// Saving an empty file gives an empty line
+	empty := filepath.Join(dir, "empty")
+	assert.NoError(t, os.WriteFile(empty, []byte("#!/bin/sh\n: > \"$1\"\n"), 0755))
+	t.Setenv("EDITOR", empty)
+	line, err = editCommandLine("echo hello")
+	assert.NoError(t, err)
+	assert.Equal(t, "", line)
+
+	t.Setenv("EDITOR", filepath.Join(dir, "missing"))
+	_, err = editCommandLine("echo hello")
+	assert.Error(t, err)
+}
+
+func TestRedrawLine(t *testing.T) {
+	t.Setenv("GOSH_HIGHLIGHT", "0")
+	le := &LineEditor{}
+
+	tests := []struct {
+		name     string
+		line     string
+		cursor   int
+		expected string
+	}{
+		{"cursor at end", "ls -la", 6, "\033[2K\rgosh> ls -la"},
+		{"cursor in middle", "ls -la", 2, "\033[2K\rgosh> ls -la\033[4D"},
+		{"cursor at start", "echo", 0, "\033[2K\rgosh> echo\033[4D"},
+		{"empty line", "", 0, "\033[2K\rgosh> "},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, w, _ := os.Pipe()
+			oldStdout := os.Stdout
+			os.Stdout = w
+			le.redrawLine([]rune(tt.line), tt.cursor)
+			os.Stdout = oldStdout
+			w.Close()
+
+			output, _ := io.ReadAll(r)
+			r.Close()
+			assert.Equal(t, tt.expected, string(output))
+		})
+	}
+}
+
+func TestRedrawLineScrolls(t *testing.T) {
+	t.Setenv("GOSH_HIGHLIGHT", "0")
+	defer setWindowSize(t, 20, 24)()
+	le := &LineEditor{}
+
+	redraw := func(line string, cursor int) string {
+		r, w, _ := os.Pipe()
+		oldStdout := os.Stdout
+		os.Stdout = w
+		le.redrawLine([]rune(line), cursor)
+		os.Stdout = oldStdout
+		w.Close()
+		output, _ := io.ReadAll(r)
+		r.Close()
+		return string(output)
+	}
+
+	// 13 columns are left after the prompt and room for the cursor
+	assert.Equal(t, "\033[2K\rgosh> abcdefghijklm", redraw("abcdefghijklm", 13))
+	assert.Equal(t, "\033[2K\rgosh> defghijklmno", redraw("abcdefghijklmno", 15))
+	assert.Equal(t, "\033[2K\rgosh> abcdefghijklm\033[13D", redraw("abcdefghijklmno", 0))
+}
+
+func TestHighlightLine(t *testing.T) {
+	SetBuiltinDescriptions(map[string]string{"cd": "Change directory"})
+	defer SetBuiltinDescriptions(nil)
+
+	cmd := func(text string) highlightSegment { return highlightSegment{text, highlightCommand} }
+	plain := func(text string) highlightSegment { return highlightSegment{text, highlightPlain} }
+	str := func(text string) highlightSegment { return highlightSegment{text, highlightString} }
+	op := func(text string) highlightSegment { return highlightSegment{text, highlightOperator} }
+
+	tests := []struct {
+		line     string
+		expected []highlightSegment
+	}{
+		{"ls -la", []highlightSegment{cmd("ls"), plain(" -la")}},
+		{"gosh-no-such-command x", []highlightSegment{{"gosh-no-such-command", highlightUnknown}, plain(" x")}},
+		{"cd /tmp && ls", []highlightSegment{cmd("cd"), plain(" /tmp "), op("&&"), plain(" "), cmd("ls")}},
+		{"echo 'a | b' \"$HOME\">out", []highlightSegment{cmd("echo"), plain(" "), str("'a | b'"), plain(" "), str("\"$HOME\""), op(">"), plain("out")}},
+		{"ls|grep x;cat", []highlightSegment{cmd("ls"), op("|"), cmd("grep"), plain(" x"), op(";"), cmd("cat")}},
+		{"X=1 echo a=\"b", []highlightSegment{plain("X=1 "), cmd("echo"), plain(" a="), str("\"b")}},
+		{"while true; do ls; done", []highlightSegment{cmd("while"), plain(" "), cmd("true"), op(";"), plain(" "), cmd("do"), plain(" "), cmd("ls"), op(";"), plain(" "), cmd("done")}},
+		{"", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.line, func(t *testing.T) {
+			assert.Equal(t, tt.expected, highlightLine([]rune(tt.line)))
+		})
+	}
+}
+
+func TestRenderHighlighted(t *testing.T) {
+	segments := highlightLine([]rune("ls 'é'"))
+	assert.Equal(t, "\033[32mls\033[0m \033[33m'é'\033[0m", renderHighlighted(segments, 0, 6))
+
+	// Only the visible part of a scrolled line is drawn
+	assert.Equal(t, "\033[32ms\033[0m \033[33m'\033[0m", renderHighlighted(segments, 1, 4))
+}
+
+func TestRedrawLineHighlights(t *testing.T) {
+	le := &LineEditor{}
+	r, w, _ := os.Pipe()
+	oldStdout := os.Stdout
+	os.Stdout = w
+	le.redrawLine([]rune("ls | wc"), 2)
+	os.Stdout = oldStdout
+	w.Close()
+	output, _ := io.ReadAll(r)
+	r.Close()
+
+	// The colors don't move the cursor
+	assert.Equal(t, "\033[2K\rgosh> \033[32mls\033[0m \033[36m|\033[0m \033[32mwc\033[0m\033[5D", string(output))
+}
+
+func TestScrollWindow(t *testing.T) {
+	tests := []struct {
+		length, cursor, width int
+		start, end            int
+	}{
+		{5, 5, 10, 0, 5},
+		{20, 0, 10, 0, 10},
+		{20, 9, 10, 0, 10},
+		{20, 10, 10, 1, 11},
+		{20, 20, 10, 11, 20},
+		{20, 5, 0, 5, 6},
+	}
+	for _, tt := range tests {
+		start, end := scrollWindow(tt.length, tt.cursor, tt.width)
+		assert.Equal(t, tt.start, start, "%+v", tt)
+		assert.Equal(t, tt.end, end, "%+v", tt)
+	}
+}
+
+func TestCompletionColumns(t *testing.T) {
+	completions := []string{"cat", "cd", "chmod", "chown", "cp", "curl"}
+
+	// Short names get the 12 column minimum width
+	assert.Equal(t, []string{
+		"cat         cd          chmod       chown       cp          curl        ",
+	}, completionColumns(completions, 80))
+	assert.Equal(t, []string{
+		"cat         cd          chmod       ",
+		"chown       cp          curl        ",
+	}, completionColumns(completions, 40))
+	assert.Equal(t, []string{
+		"cat         cd          ",
+		"chmod       chown       ",
+		"cp          curl        ",
+	}, completionColumns(completions, 24))
+
+	// Too narrow for even one column still gets one per line
+	assert.Len(t, completionColumns(completions, 5), 6)
+
+	// Long names widen the columns
+	assert.Equal(t, []string{
+		"a_very_long_name  b                 ",
+	}, completionColumns([]string{"a_very_long_name", "b"}, 40))
+}
+
+// setWindowSize makes WindowSize report the given size until the returned
+// function is called
+func setWindowSize(t *testing.T, cols, rows int) func() {
+	t.Helper()
+	oldGetWindowSize := getWindowSize
+	getWindowSize = func(fd int) (int, int, error) { return cols, rows, nil }
+	windowMutex.Lock()
+	oldCols, oldRows := windowCols, windowRows
+	windowCols, windowRows = cols, rows
+	windowMutex.Unlock()
+	return func() {
+		getWindowSize = oldGetWindowSize
+		windowMutex.Lock()
+		windowCols, windowRows = oldCols, oldRows
+		windowMutex.Unlock()
+	}
+}
+
+func TestWatchWindowSize(t *testing.T) {
+	defer setWindowSize(t, defaultCols, defaultRows)()
+	oldGetWindowSize := getWindowSize
+	defer func() { getWindowSize = oldGetWindowSize }()
+
+	var mu sync.Mutex
+	size := [2]int{100, 30}
+	getWindowSize = func(fd int) (int, int, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return size[0], size[1], nil
+	}
+
+	stop := watchWindowSize()
+	cols, rows := WindowSize()
+	assert.Equal(t, 100, cols)
+	assert.Equal(t, 30, rows)
+
+	mu.Lock()
+	size = [2]int{132, 50}
+	mu.Unlock()
+	assert.NoError(t, syscall.Kill(os.Getpid(), syscall.SIGWINCH))
+	assert.Eventually(t, func() bool {
+		cols, rows := WindowSize()
+		return cols == 132 && rows == 50
+	}, time.Second, 10*time.Millisecond)
+	stop()
+
+	// Without the editor watching, the terminal is asked each time
+	size = [2]int{90, 40}
+	cols, rows = WindowSize()
+	assert.Equal(t, 90, cols)
+	assert.Equal(t, 40, rows)
+
+	// A terminal that can't report its size keeps the last one
+	getWindowSize = func(fd int) (int, int, error) { return 0, 0, syscall.ENOTTY }
+	updateWindowSize()
+	cols, _ = WindowSize()
+	assert.Equal(t, 90, cols)
+}
+
+func TestDescribeCompletions(t *testing.T) {
+	descriptions := map[string]string{
+		"cd":   "Change directory",
+		"help": "Show this help",
+	}
+
+	lines, ok := describeCompletions([]string{"cd", "chmod", "help"}, descriptions)
+	assert.True(t, ok)
+	assert.Equal(t, []string{
+		"cd     -- Change directory",
+		"chmod",
+		"help   -- Show this help",
+	}, lines)
+
+	// Without any builtins there's nothing to describe
+	_, ok = describeCompletions([]string{"chmod", "chown"}, descriptions)
+	assert.False(t, ok)
+}
+
+func TestShowCompletionsDescriptions(t *testing.T) {
+	defer SetBuiltinDescriptions(nil)
+	SetBuiltinDescriptions(map[string]string{"cd": "Change directory"})
+	le := &LineEditor{}
+
+	show := func() string {
+		r, w, _ := os.Pipe()
+		oldStdout := os.Stdout
+		os.Stdout = w
+		le.showCompletions([]string{"cd", "chmod"})
+		os.Stdout = oldStdout
+		w.Close()
+		output, _ := io.ReadAll(r)
+		r.Close()
+		return string(output)
+	}
+
+	t.Setenv("GOSH_COMPLETE_DESC", "")
+	assert.NotContains(t, show(), "--")
+
+	t.Setenv("GOSH_COMPLETE_DESC", "1")
+	assert.Equal(t, "cd     -- Change directory\r\nchmod\r\n", show())
+}
+
+func TestGlobExpansion(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a.go", "b.go", ".hidden"} {
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, name), nil, 0644))
+	}
+	origDir, _ := os.Getwd()
+	defer os.Chdir(origDir)
+	os.Chdir(dir)
+	defer shell.SetOption("nullglob", false)
+	defer shell.SetOption("dotglob", false)
+
+	args := func(line string) []string {
+		cmd, err := ParseCommand(line)
+		assert.NoError(t, err)
+		return cmd.Args
+	}
+
+	assert.Equal(t, []string{"ls", "a.go", "b.go"}, args("ls *.go"))
+	assert.Equal(t, []string{"ls", "*.go", `*.go`}, args(`ls '*.go' \*.go`))
+
+	// By default a pattern that matches nothing stays literal
+	assert.Equal(t, []string{"ls", "*.xyz"}, args("ls *.xyz"))
+	shell.SetOption("nullglob", true)
+	assert.Equal(t, []string{"ls"}, args("ls *.xyz"))
+
+	// * only matches dotfiles with dotglob
+	assert.Equal(t, []string{"ls", "a.go", "b.go"}, args("ls *"))
+	shell.SetOption("dotglob", true)
+	assert.Equal(t, []string{"ls", ".hidden", "a.go", "b.go"}, args("ls *"))
+}
+
+func TestParseFunction(t *testing.T) {
+	tests := []struct {
+		line string
+		name string
+		body string
+		ok   bool
+	}{
+		{"greet() { echo hello $1; }", "greet", "echo hello $1;", true},
+		{"  f(){ ls }  ", "f", "ls", true},
+		{"f () {\n  echo a\n  echo b\n}", "f", "echo a\n  echo b", true},
+		{"f() { echo ${X:-x}; }", "f", "echo ${X:-x};", true},
+		{"f() { echo a", "", "", false},
+		{"f() { a; } extra", "", "", false},
+		{"echo hello", "", "", false},
+		{"1f() { ls; }", "", "", false},
+		{"f( { ls; }", "", "", false},
+	}
+
+	for _, tt := range tests {
+		name, body, ok := ParseFunction(tt.line)
+		assert.Equal(t, tt.ok, ok, tt.line)
+		assert.Equal(t, tt.name, name, tt.line)
+		assert.Equal(t, tt.body, body, tt.line)
+	}
+
+	assert.True(t, NeedsContinuation("f() {"))
+	assert.True(t, NeedsContinuation("f() { echo a\n echo ${B}"))
+	assert.False(t, NeedsContinuation("f() { echo a; }"))
+	assert.False(t, NeedsContinuation("echo {"))
+}
+
+func TestSplitList(t *testing.T) {
+	assert.Equal(t, []string{"echo a", " echo b", " c &", " d"}, SplitList("echo a; echo b\n c & d"))
+	assert.Equal(t, []string{"f() { a; b & }", " f"}, SplitList("f() { a; b & }; f"))
+	assert.Equal(t, []string{`echo 'a;b' \; c`}, SplitList(`echo 'a;b' \; c`))
+	assert.Empty(t, SplitList(" ; ;\n"))
+	assert.Equal(t, []string{"make |& tee log"}, SplitList("make |& tee log"))
+}
+
+func TestParsePipelineStderr(t *testing.T) {
+	pipeline, err := ParsePipeline("make |& tee log | wc -l")
+	assert.NoError(t, err)
+	assert.Len(t, pipeline.Commands, 3)
+	assert.True(t, pipeline.Commands[0].PipeStderr)
+	assert.Equal(t, []string{"tee", "log"}, pipeline.Commands[1].Args)
+	assert.False(t, pipeline.Commands[1].PipeStderr)
+
+	_, err = ParsePipeline("make |&")
+	assert.EqualError(t, err, "syntax error near unexpected token '|'")
+}
+
+func TestExpandAliases(t *testing.T) {
+	for _, name := range []string{"sudo", "ll", "ls", "root", "nothing"} {
+		defer shell.UnsetAlias(name)
+	}
+	shell.SetAlias("ll", "ls -l")
+	shell.SetAlias("ls", "ls -F")
+	shell.SetAlias("nothing", "")
+
+	args := func(line string) []string {
+		pipeline, err := ParsePipeline(line)
+		assert.NoError(t, err, line)
+		return pipeline.Commands[len(pipeline.Commands)-1].Args
+	}
+
+	// Only the command word is expanded, and an alias isn't expanded again
+	// within its own text
+	assert.Equal(t, []string{"ls", "-F", "-l", "ll"}, args("ll ll"))
+	assert.Equal(t, []string{"cat", "ll"}, args("echo x | cat ll"))
+	assert.Equal(t, []string{"ls", "-F", "-l"}, args("echo x | ll"))
+	assert.Equal(t, []string{"ll"}, args("'ll'"), "quoted words aren't aliases")
+	pipeline, err := ParsePipeline("GOSH_X=1 ll")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"GOSH_X=1"}, pipeline.Commands[0].Assignments)
+	assert.Equal(t, []string{"ls", "-F", "-l"}, pipeline.Commands[0].Args)
+
+	// Without a trailing space the next word is left alone
+	shell.SetAlias("sudo", "sudo")
+	assert.Equal(t, []string{"sudo", "ll", "/tmp"}, args("sudo ll /tmp"))
+
+	// With one, it is expanded too, and so on along the chain
+	shell.SetAlias("sudo", "sudo ")
+	assert.Equal(t, []string{"sudo", "ls", "-F", "-l", "/tmp"}, args("sudo ll /tmp"))
+	assert.Equal(t, []string{"sudo", "sudo", "ls", "-F", "-l"}, args("sudo sudo ll"))
+	assert.Equal(t, []string{"sudo", "-u", "ll"}, args("sudo -u ll"))
+
+	// An alias for one that ends in a space carries its space along
+	shell.SetAlias("root", "sudo")
+	assert.Equal(t, []string{"sudo", "ls", "-F", "-l"}, args("root ll"))
+
+	// An empty alias leaves the rest of the command
+	assert.Equal(t, []string{"ll"}, args("nothing ll"))
+}
+
+func TestParseRedirectBoth(t *testing.T) {
+	cmd, err := ParseCommand("make &> build.log")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"make"}, cmd.Args)
+	assert.Equal(t, "build.log", cmd.OutputFile)
+	assert.True(t, cmd.StderrToOutput)
+	assert.False(t, cmd.AppendOutput)
+	assert.False(t, cmd.Background)
+
+	cmd, err = ParseCommand("make &>> build.log")
+	assert.NoError(t, err)
+	assert.Equal(t, "build.log", cmd.OutputFile)
+	assert.True(t, cmd.StderrToOutput)
+	assert.True(t, cmd.AppendOutput)
+
+	// A background & followed by > only redirects stdout
+	cmd, err = ParseCommand("make & > build.log")
+	assert.NoError(t, err)
+	assert.Equal(t, "build.log", cmd.OutputFile)
+	assert.True(t, cmd.Background)
+	assert.False(t, cmd.StderrToOutput)
+
+	pipeline, err := ParsePipeline("make | tee out &> build.log")
+	assert.NoError(t, err)
+	assert.True(t, pipeline.Commands[1].StderrToOutput)
+	assert.False(t, pipeline.Background)
+
+	_, err = ParseCommand("make &>")
+	assert.EqualError(t, err, "syntax error near unexpected token 'newline'")
+}
+
+func TestPositionalParameters(t *testing.T) {
+	// Outside a function, $1 is left alone
+	result, _ := expandVariables("$1")
+	assert.Equal(t, "$1", result)
+
+	shell.PushPositional([]string{"world", "b", "c", "d", "e", "f", "g", "h", "i", "tenth"})
+	defer shell.PopPositional()
+
+	tests := map[string]string{
+		"hello $1":    "hello world",
+		"$#":          "10",
+		"${10}":       "tenth",
+		"$10":         "world0",
+		"${11:-none}": "none",
+		"$@":          "world b c d e f g h i tenth",
+		"$0":          "gosh",
+	}
+	for input, expected := range tests {
+		result, err := expandVariables(input)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, result, input)
+	}
+}
+
+func TestParseLoop(t *testing.T) {
+	defer shell.UnsetVar("LOOP_WORDS")
+	shell.SetVar("LOOP_WORDS", "x y")
+
+	loop, err := ParseLoop("for i in a $LOOP_WORDS 'b c'; do echo $i; done")
+	assert.NoError(t, err)
+	assert.Equal(t, &Loop{Keyword: "for", Var: "i", Words: []string{"a", "x y", "b c"}, Body: "echo $i"}, loop)
+
+	loop, err = ParseLoop("while test -f $FILE; do rm $FILE; done")
+	assert.NoError(t, err)
+	assert.Equal(t, &Loop{Keyword: "while", Condition: "test -f $FILE", Body: "rm $FILE"}, loop)
+
+	loop, err = ParseLoop("until\n  false\ndo\n  while true; do break; done\ndone")
+	assert.NoError(t, err)
+	assert.Equal(t, &Loop{Keyword: "until", Condition: "false", Body: "while true; do break; done"}, loop)
+
+	// Across several lines, with a nested loop in the body
+	loop, err = ParseLoop("for i in 1 2\ndo\n  for j in a; do echo $i$j; done\ndone")
+	assert.NoError(t, err)
+	assert.Equal(t, "for j in a; do echo $i$j; done", loop.Body)
+
+	// Not loops
+	for _, line := range []string{"echo for i in a; do x; done", "'for' i", "forx"} {
+		loop, err := ParseLoop(line)
+		assert.NoError(t, err, line)
+		assert.Nil(t, loop, line)
+	}
+
+	errorCases := map[string]string{
+		"for i in a; do echo $i":         "syntax error: unexpected end of file",
+		"for i in a; do done":            "syntax error near unexpected token 'done'",
+		"for i in a; done":               "syntax error near unexpected token 'done'",
+		"for 1x in a; do echo; done":     "syntax error near unexpected token 'do'",
+		"for i on a; do echo; done":      "syntax error near unexpected token 'on'",
+		"for i in a; do echo; done junk": "syntax error near unexpected token 'junk'",
+		"while; do echo; done":           "syntax error near unexpected token 'do'",
+	}
+	for line, want := range errorCases {
+		_, err := ParseLoop(line)
+		assert.EqualError(t, err, want, line)
+	}
+}
+
+func TestSplitListLoops(t *testing.T) {
+	assert.Equal(t, []string{"for i in a b; do echo $i; done", " echo done"},
+		SplitList("for i in a b; do echo $i; done; echo done"))
+	assert.Equal(t, []string{"for i in a; do for j in b; do echo; done; done"},
+		SplitList("for i in a; do for j in b; do echo; done; done"))
+
+	assert.True(t, NeedsContinuation("for i in a b; do"))
+	assert.True(t, NeedsContinuation("for i in a b; do\n  echo $i"))
+	assert.False(t, NeedsContinuation("for i in a b; do\n  echo $i\ndone"))
+	assert.False(t, NeedsContinuation("echo for"))
+	assert.True(t, NeedsContinuation("while true"))
+	assert.False(t, NeedsContinuation("until true; do echo; done"))
+}
+
+func TestParseCase(t *testing.T) {
+	defer shell.UnsetVar("CASE_WORD")
+	shell.SetVar("CASE_WORD", "a b")
+
+	c, err := ParseCase("case $CASE_WORD in a*) echo a;; 'x*'|y) echo xy;; *) echo other;; esac")
+	assert.NoError(t, err)
+	assert.Equal(t, &Case{Word: "a b", Clauses: []CaseClause{
+		{Patterns: []string{"a*"}, Body: "echo a"},
+		{Patterns: []string{`x\*`, "y"}, Body: "echo xy"},
+		{Patterns: []string{"*"}, Body: "echo other"},
+	}}, c)
+
+	// Across several lines, with a ( before a pattern, an empty body, a
+	// nested case and no ;; after the last clause
+	c, err = ParseCase("case x in\n  (a) ;;\n  x)\n    case y in y) echo y;; esac\n    echo x\nesac")
+	assert.NoError(t, err)
+	assert.Equal(t, &Case{Word: "x", Clauses: []CaseClause{
+		{Patterns: []string{"a"}, Body: ""},
+		{Patterns: []string{"x"}, Body: "case y in y) echo y;; esac\n    echo x"},
+	}}, c)
+
+	// Not case statements
+	for _, line := range []string{"echo case x in x) esac", "'case' x", "cases"} {
+		c, err := ParseCase(line)
+		assert.NoError(t, err, line)
+		assert.Nil(t, c, line)
+	}
+
+	errorCases := map[string]string{
+		"case x in x) echo":            "syntax error: unexpected end of file",
+		"case x y in x) echo;; esac":   "syntax error near unexpected token 'in'",
+		"case x in |x) echo;; esac":    "syntax error near unexpected token ')'",
+		"case x in x echo;; esac":      "syntax error near unexpected token 'esac'",
+		"case x in x) echo;; esac now": "syntax error near unexpected token 'now'",
+	}
+	for line, want := range errorCases {
+		_, err := ParseCase(line)
+		assert.EqualError(t, err, want, line)
+	}
+
+	assert.Equal(t, []string{"case x in x) echo; echo;; esac", " echo esac"},
+		SplitList("case x in x) echo; echo;; esac; echo esac"))
+	assert.True(t, NeedsContinuation("case x in"))
+	assert.True(t, NeedsContinuation("case x in\n  x) echo x;;"))
+	assert.False(t, NeedsContinuation("case x in\n  x) echo x;;\nesac"))
+}
+
+func TestTrimContinuation(t *testing.T) {
+	// A command split over two lines
+	line, ok := TrimContinuation("echo hello \\")
+	assert.True(t, ok)
+	assert.Equal(t, "echo hello ", line)
+	cmd, err := ParseCommand(line + "world")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"echo", "hello", "world"}, cmd.Args)
+
+	// A word can be split too, and double quotes don't stop it
+	line, ok = TrimContinuation(`echo "hel\`)
+	assert.True(t, ok)
+	cmd, err = ParseCommand(line + `lo"`)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"echo", "hello"}, cmd.Args)
+
+	// Backslashes anywhere else are left alone
+	for _, line := range []string{`echo a\b`, `echo a\\`, `echo 'a\'`, `echo \ `, ""} {
+		trimmed, ok := TrimContinuation(line)
+		assert.False(t, ok, line)
+		assert.Equal(t, line, trimmed)
+	}
+	cmd, err = ParseCommand(`echo a\b`)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"echo", "ab"}, cmd.Args)
+}
+
+func TestPickMatch(t *testing.T) {
+	matches := []string{"git commit", "git status"}
+
+	match, err := pickMatch(matches, "2\n")
+	assert.NoError(t, err)
+	assert.Equal(t, "git status", match)
+
+	// Just pressing enter picks the most recent
+	match, err = pickMatch(matches, "\n")
+	assert.NoError(t, err)
+	assert.Equal(t, "git commit", match)
+
+	_, err = pickMatch(matches, "3")
+	assert.EqualError(t, err, "3: no such history match")
+	_, err = pickMatch(matches, "x")
+	assert.EqualError(t, err, "x: no such history match")
+}
+
+func TestSelectBackend(t *testing.T) {
+	tests := []struct {
+		name    string
+		backend Backend
+		wantErr bool
+	}{
+		{"", BackendReadline, false},
+		{"readline", BackendReadline, false},
+		{"builtin", BackendBuiltin, false},
+		{"simple", BackendSimple, false},
+		{"libedit", BackendReadline, true},
+	}
+	for _, tt := range tests {
+		backend, err := selectBackend(tt.name)
+		assert.Equal(t, tt.backend, backend, tt.name)
+		if tt.wantErr {
+			assert.EqualError(t, err, "GOSH_READLINE: unknown line editor '"+tt.name+"', using readline")
+		} else {
+			assert.NoError(t, err, tt.name)
+		}
+	}
+}
+
+// resetBackend puts the line editor back as it was before InitReadline
+func resetBackend() {
+	activeBackend = BackendSimple
+	builtinEditor = nil
+	globalReadline = nil
+	showPrompts = true
+}
+
+func TestInitReadlineBackends(t *testing.T) {
+	defer resetBackend()
+	origGet := getTermios
+	defer func() { getTermios = origGet }()
+	getTermios = func(fd int, tty *termios) error { return nil }
+	hist := &history.History{}
+
+	t.Setenv("GOSH_READLINE", "simple")
+	assert.NoError(t, InitReadline(hist))
+	assert.Equal(t, BackendSimple, activeBackend)
+	assert.Nil(t, globalReadline)
+
+	resetBackend()
+	t.Setenv("GOSH_READLINE", "builtin")
+	assert.NoError(t, InitReadline(hist))
+	assert.Equal(t, BackendBuiltin, activeBackend)
+	assert.NotNil(t, builtinEditor)
+	assert.Nil(t, globalReadline)
+
+	// When readline can't be set up, the built-in editor takes over
+	origNewReadline := newReadline
+	defer func() { newReadline = origNewReadline }()
+	newReadline = func(*readline.Config) (*readline.Instance, error) {
+		return nil, errors.New("no terminal")
+	}
+	for _, name := range []string{"", "readline"} {
+		resetBackend()
+		t.Setenv("GOSH_READLINE", name)
+		err := InitReadline(hist)
+		assert.EqualError(t, err, "no terminal; using the built-in line editor")
+		assert.Equal(t, BackendBuiltin, activeBackend)
+		assert.NotNil(t, builtinEditor)
+	}
+}
+
+func TestReadLineBuiltinBackend(t *testing.T) {
+	defer resetBackend()
+	t.Setenv("TERM", "xterm")
+	t.Setenv("TMOUT", "")
+	origGet, origSet := getTermios, setTermios
+	defer func() { getTermios, setTermios = origGet, origSet }()
+	getTermios = func(fd int, tty *termios) error { return nil }
+	setTermios = func(fd int, tty *termios) error { return nil }
+
+	read := func(keys string, readFn func() (string, error)) (string, string, error) {
+		stdinR, stdinW, _ := os.Pipe()
+		stdoutR, stdoutW, _ := os.Pipe()
+		oldStdin, oldStdout := os.Stdin, os.Stdout
+		os.Stdin, os.Stdout = stdinR, stdoutW
+		defer func() {
+			os.Stdin, os.Stdout = oldStdin, oldStdout
+			stdinR.Close()
+		}()
+
+		stdinW.WriteString(keys)
+		stdinW.Close()
+		line, err := readFn()
+		stdoutW.Close()
+		output, _ := io.ReadAll(stdoutR)
+		stdoutR.Close()
+		return line, string(output), err
+	}
+
+	t.Setenv("GOSH_READLINE", "builtin")
+	assert.NoError(t, InitReadline(&history.History{}))
+
+	line, output, err := read("echo hi\r", ReadLine)
+	assert.NoError(t, err)
+	assert.Equal(t, "echo hi", line)
+	assert.True(t, strings.HasPrefix(output, "gosh> "))
+
+	// Continuation lines show their own prompt, and the next line goes
+	// back to the usual one
+	line, output, err = read("done\r", ReadContinuationLine)
+	assert.NoError(t, err)
+	assert.Equal(t, "done", line)
+	assert.True(t, strings.HasPrefix(output, "> "))
+	_, output, _ = read("\r", ReadLine)
+	assert.True(t, strings.HasPrefix(output, "gosh> "))
+
+	// Ctrl+C abandons the line without an error, as with readline
+	line, _, err = read("abc\x03", ReadLine)
+	assert.NoError(t, err)
+	assert.Empty(t, line)
+
+	// At the continuation prompt it says so, so the command can be dropped
+	_, _, err = read("abc\x03", ReadContinuationLine)
+	assert.ErrorIs(t, err, ErrInterrupted)
+
+	_, _, err = read("", ReadLine)
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestReadLineSimpleBackend(t *testing.T) {
+	defer resetBackend()
+	t.Setenv("TMOUT", "")
+	t.Setenv("GOSH_READLINE", "simple")
+	assert.NoError(t, InitReadline(&history.History{}))
+
+	r, w, _ := os.Pipe()
+	oldStdin, oldStdout := os.Stdin, os.Stdout
+	devNull, _ := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	os.Stdin, os.Stdout = r, devNull
+	defer func() {
+		os.Stdin, os.Stdout = oldStdin, oldStdout
+		devNull.Close()
+		r.Close()
+	}()
+
+	// Every line written at once is read in turn, the last without a newline
+	w.WriteString("echo one\necho two\necho three")
+	w.Close()
+	for _, want := range []string{"echo one", "echo two", "echo three"} {
+		line, err := ReadLine()
+		assert.NoError(t, err)
+		assert.Equal(t, want, line)
+	}
+	_, err := ReadLine()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestReadLineNotTerminal(t *testing.T) {
+	defer resetBackend()
+	t.Setenv("TMOUT", "")
+	t.Setenv("GOSH_HISTORY_SHARE", "")
+
+	stdinR, stdinW, _ := os.Pipe()
+	stdoutR, stdoutW, _ := os.Pipe()
+	oldStdin, oldStdout := os.Stdin, os.Stdout
+	os.Stdin, os.Stdout = stdinR, stdoutW
+	defer func() {
+		os.Stdin, os.Stdout = oldStdin, oldStdout
+		stdinR.Close()
+	}()
+
+	// Whatever editor is asked for, piped input is read plainly
+	for _, name := range []string{"", "builtin"} {
+		t.Setenv("GOSH_READLINE", name)
+		assert.NoError(t, InitReadline(&history.History{}))
+		assert.Equal(t, BackendSimple, activeBackend)
+		assert.Nil(t, globalReadline)
+	}
+
+	stdinW.WriteString("for i in 1\ndone\n")
+	stdinW.Close()
+	line, err := ReadLine()
+	assert.NoError(t, err)
+	assert.Equal(t, "for i in 1", line)
+	line, err = ReadContinuationLine()
+	assert.NoError(t, err)
+	assert.Equal(t, "done", line)
+
+	// No prompts were written
+	stdoutW.Close()
+	output, _ := io.ReadAll(stdoutR)
+	stdoutR.Close()
+	assert.Empty(t, string(output))
+}
+
+func TestAddHistory(t *testing.T) {
+	defer SetHistory(nil)
+	t.Setenv("HOME", t.TempDir())
+	hist := history.New()
+	SetHistory(hist)
+	t.Setenv("GOSH_DIR_HISTORY", "")
+	t.Setenv("GOSH_HISTIGNORE", "ls")
+
+	AddHistory("for i in 1 2\ndo\n  echo $i\ndone\n")
+	AddHistory("ls")
+	assert.Equal(t, []string{"for i in 1 2\ndo\n  echo $i\ndone"}, hist.GetAll())
+
+	// The line editor recalls the whole command
+	le := NewLineEditor(hist)
+	le.resetHistoryNavigation()
+	line, ok := le.navigateHistory(nil, -1)
+	assert.True(t, ok)
+	assert.Equal(t, "for i in 1 2\ndo\n  echo $i\ndone", string(line))
+}
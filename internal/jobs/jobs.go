@@ -1,9 +1,16 @@
 package jobs
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
@@ -31,6 +38,11 @@ func (s JobState) String() string {
 	}
 }
 
+// MarshalText makes a JobState appear as its name in JSON
+func (s JobState) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
 // Job represents a background job
 type Job struct {
 	ID        int
@@ -41,6 +53,9 @@ type Job struct {
 	Process   *os.Process
 	ExitCode  int
 	StartTime time.Time
+
+	reaped bool          // The process has been waited for
+	done   chan struct{} // Closed once the process has been reaped
 }
 
 // JobManager manages background jobs
@@ -48,13 +63,84 @@ type JobManager struct {
 	jobs   map[int]*Job
 	nextID int
 	mutex  sync.RWMutex
+
+	// Disowned jobs are no longer reported but are still reaped so they
+	// don't linger as zombies
+	disowned map[int]*Job
+
+	// Job IDs ordered from least to most recently backgrounded or stopped,
+	// used to find the current (%+) and previous (%-) jobs
+	recent []int
+
+	// Broadcast when jobs finish or are removed, for ReserveSlot
+	slotFreed *sync.Cond
+
+	// Broadcast when the reaper has seen jobs exit, stop or continue, for
+	// BringToForeground
+	stateChanged *sync.Cond
+
+	// Whether jobs that stop are announced, and the announcements waiting
+	// for PrintNotifications
+	notify  bool
+	notices []string
 }
 
-// NewJobManager creates a new job manager
+// ErrTooManyJobs is returned by ReserveSlot when GOSH_MAXJOBS jobs are
+// already running
+var ErrTooManyJobs = errors.New("too many background jobs")
+
+// NewJobManager creates a new job manager and starts reaping finished jobs
+// whenever a SIGCHLD arrives
 func NewJobManager() *JobManager {
-	return &JobManager{
-		jobs:   make(map[int]*Job),
-		nextID: 1,
+	jm := &JobManager{
+		jobs:     make(map[int]*Job),
+		nextID:   1,
+		disowned: make(map[int]*Job),
+	}
+	jm.slotFreed = sync.NewCond(&jm.mutex)
+	jm.stateChanged = sync.NewCond(&jm.mutex)
+
+	sigchld := make(chan os.Signal, 1)
+	signal.Notify(sigchld, syscall.SIGCHLD)
+	go func() {
+		for range sigchld {
+			jm.reapJobs()
+		}
+	}()
+
+	return jm
+}
+
+// SetNotifications turns on or off announcing each job that stops, the way
+// jobs would list it. The announcements wait for PrintNotifications, so that
+// they don't break into a line being edited.
+func (jm *JobManager) SetNotifications(enabled bool) {
+	jm.mutex.Lock()
+	defer jm.mutex.Unlock()
+	jm.notify = enabled
+	if !enabled {
+		jm.notices = nil
+	}
+}
+
+// PrintNotifications prints the announcements of jobs that have stopped
+// since it was last called
+func (jm *JobManager) PrintNotifications(w io.Writer) {
+	jm.mutex.Lock()
+	notices := jm.notices
+	jm.notices = nil
+	jm.mutex.Unlock()
+
+	for _, notice := range notices {
+		fmt.Fprint(w, notice)
+	}
+}
+
+// notifyStopped queues the announcement of a job that has just stopped,
+// which is now the current job. The caller must hold the mutex.
+func (jm *JobManager) notifyStopped(job *Job) {
+	if jm.notify {
+		jm.notices = append(jm.notices, jobLine(job, "+"))
 	}
 }
 
@@ -71,17 +157,62 @@ func (jm *JobManager) AddJob(cmd *exec.Cmd, command string) *Job {
 		State:     JobRunning,
 		Process:   cmd.Process,
 		StartTime: time.Now(),
+		done:      make(chan struct{}),
 	}
 
 	jm.jobs[jm.nextID] = job
 	jm.nextID++
+	jm.touch(job.ID)
 
-	// Start monitoring the job
-	go jm.monitorJob(job)
+	// The job may have exited before it was registered, in which case its
+	// SIGCHLD has already been handled
+	go jm.reapJobs()
 
 	return job
 }
 
+// maxJobs returns the limit on background jobs set by GOSH_MAXJOBS, or 0
+// if there is none
+func maxJobs() int {
+	n, err := strconv.Atoi(os.Getenv("GOSH_MAXJOBS"))
+	if err != nil || n < 0 {
+		return 0
+	}
+	return n
+}
+
+// ReserveSlot is called before starting a background job. It returns
+// ErrTooManyJobs if GOSH_MAXJOBS jobs are already running or stopped, or
+// with GOSH_MAXJOBS_WAIT=1 waits until one of them finishes instead.
+func (jm *JobManager) ReserveSlot() error {
+	limit := maxJobs()
+	if limit == 0 {
+		return nil
+	}
+
+	jm.mutex.Lock()
+	defer jm.mutex.Unlock()
+	for jm.activeCount() >= limit {
+		if os.Getenv("GOSH_MAXJOBS_WAIT") != "1" {
+			return ErrTooManyJobs
+		}
+		jm.slotFreed.Wait()
+	}
+	return nil
+}
+
+// activeCount returns the number of running and stopped jobs. The caller
+// must hold the mutex.
+func (jm *JobManager) activeCount() int {
+	count := 0
+	for _, job := range jm.jobs {
+		if job.State == JobRunning || job.State == JobStopped {
+			count++
+		}
+	}
+	return count
+}
+
 // GetJob returns a job by ID
 func (jm *JobManager) GetJob(id int) *Job {
 	jm.mutex.RLock()
@@ -89,6 +220,19 @@ func (jm *JobManager) GetJob(id int) *Job {
 	return jm.jobs[id]
 }
 
+// JobState returns the state of a job by ID, and whether there is one. Jobs
+// change state as the reaper sees them, so their State field can only be
+// read safely here.
+func (jm *JobManager) JobState(id int) (JobState, bool) {
+	jm.mutex.RLock()
+	defer jm.mutex.RUnlock()
+	job, exists := jm.jobs[id]
+	if !exists {
+		return 0, false
+	}
+	return job.State, true
+}
+
 // GetJobs returns all jobs
 func (jm *JobManager) GetJobs() []*Job {
 	jm.mutex.RLock()
@@ -120,12 +264,148 @@ func (jm *JobManager) RemoveJob(id int) {
 	jm.mutex.Lock()
 	defer jm.mutex.Unlock()
 	delete(jm.jobs, id)
+	jm.slotFreed.Broadcast()
+}
+
+// Disown removes a job from the manager without signaling its process, so
+// the shell no longer tracks or reports it
+func (jm *JobManager) Disown(id int) error {
+	jm.mutex.Lock()
+	defer jm.mutex.Unlock()
+
+	job, exists := jm.jobs[id]
+	if !exists {
+		return fmt.Errorf("job %d not found", id)
+	}
+	delete(jm.jobs, id)
+	if !job.reaped {
+		jm.disowned[id] = job
+	}
+	jm.slotFreed.Broadcast()
+	return nil
+}
+
+// DisownAll removes every job from the manager without signaling them
+func (jm *JobManager) DisownAll() {
+	jm.mutex.Lock()
+	defer jm.mutex.Unlock()
+
+	for id, job := range jm.jobs {
+		if !job.reaped {
+			jm.disowned[id] = job
+		}
+	}
+	jm.jobs = make(map[int]*Job)
+	jm.slotFreed.Broadcast()
+}
+
+// touch marks a job as the most recently used one, making it the current
+// job. The caller must hold the mutex.
+func (jm *JobManager) touch(id int) {
+	for i, recentID := range jm.recent {
+		if recentID == id {
+			jm.recent = append(jm.recent[:i], jm.recent[i+1:]...)
+			break
+		}
+	}
+	jm.recent = append(jm.recent, id)
+}
+
+// recentActiveJobs returns active jobs from most to least recently used
+func (jm *JobManager) recentActiveJobs() []*Job {
+	jm.mutex.RLock()
+	defer jm.mutex.RUnlock()
+
+	var jobs []*Job
+	for i := len(jm.recent) - 1; i >= 0; i-- {
+		job, exists := jm.jobs[jm.recent[i]]
+		if exists && (job.State == JobRunning || job.State == JobStopped) {
+			jobs = append(jobs, job)
+		}
+	}
+	return jobs
+}
+
+// CurrentJob returns the current job (%+): the most recently backgrounded
+// or stopped active job, or nil if there are no active jobs
+func (jm *JobManager) CurrentJob() *Job {
+	jobs := jm.recentActiveJobs()
+	if len(jobs) == 0 {
+		return nil
+	}
+	return jobs[0]
+}
+
+// PreviousJob returns the previous job (%-): the job that was current
+// before the current one, or nil if there is no such job
+func (jm *JobManager) PreviousJob() *Job {
+	jobs := jm.recentActiveJobs()
+	if len(jobs) < 2 {
+		return nil
+	}
+	return jobs[1]
 }
 
-// BringToForeground brings a job to the foreground
+// ResolveSpec finds the job referred to by a job spec. Supported forms are
+// %n or n (job number), %+ or %% (current job), %- (previous job), %prefix
+// (job whose command starts with prefix) and %?text (job whose command
+// contains text).
+func (jm *JobManager) ResolveSpec(spec string) (*Job, error) {
+	noSuchJob := fmt.Errorf("%s: no such job", spec)
+
+	switch spec {
+	case "%", "%+", "%%":
+		if job := jm.CurrentJob(); job != nil {
+			return job, nil
+		}
+		return nil, noSuchJob
+	case "%-":
+		if job := jm.PreviousJob(); job != nil {
+			return job, nil
+		}
+		return nil, noSuchJob
+	}
+
+	body := strings.TrimPrefix(spec, "%")
+	if id, err := strconv.Atoi(body); err == nil {
+		if job := jm.GetJob(id); job != nil {
+			return job, nil
+		}
+		return nil, noSuchJob
+	}
+
+	if !strings.HasPrefix(spec, "%") || body == "" {
+		return nil, noSuchJob
+	}
+
+	match := func(job *Job) bool { return strings.HasPrefix(job.Command, body) }
+	if text, ok := strings.CutPrefix(body, "?"); ok {
+		match = func(job *Job) bool { return strings.Contains(job.Command, text) }
+	}
+
+	var found *Job
+	for _, job := range jm.recentActiveJobs() {
+		if match(job) {
+			if found != nil {
+				return nil, fmt.Errorf("%s: ambiguous job spec", spec)
+			}
+			found = job
+		}
+	}
+	if found == nil {
+		return nil, noSuchJob
+	}
+	return found, nil
+}
+
+// BringToForeground brings a job to the foreground and waits until it
+// finishes or stops again
 func (jm *JobManager) BringToForeground(id int) error {
-	job := jm.GetJob(id)
-	if job == nil {
+	jm.mutex.Lock()
+	defer jm.mutex.Unlock()
+
+	job, exists := jm.jobs[id]
+	if !exists {
 		return fmt.Errorf("job %d not found", id)
 	}
 
@@ -140,31 +420,23 @@ func (jm *JobManager) BringToForeground(id int) error {
 			return fmt.Errorf("failed to continue job %d: %v", id, err)
 		}
 	}
-
-	// Set job state to running
-	jm.mutex.Lock()
 	job.State = JobRunning
-	jm.mutex.Unlock()
 
-	// Wait for the job to complete
-	state, err := job.Process.Wait()
-	if err != nil {
-		return fmt.Errorf("failed to wait for job %d: %v", id, err)
+	// Wait for the reaper to see the job finish or stop
+	for job.State == JobRunning {
+		jm.stateChanged.Wait()
 	}
 
-	// Update job state
-	jm.mutex.Lock()
-	job.State = JobDone
-	job.ExitCode = state.ExitCode()
-	jm.mutex.Unlock()
-
 	return nil
 }
 
 // SendToBackground sends a job to the background
 func (jm *JobManager) SendToBackground(id int) error {
-	job := jm.GetJob(id)
-	if job == nil {
+	jm.mutex.Lock()
+	defer jm.mutex.Unlock()
+
+	job, exists := jm.jobs[id]
+	if !exists {
 		return fmt.Errorf("job %d not found", id)
 	}
 
@@ -178,10 +450,7 @@ func (jm *JobManager) SendToBackground(id int) error {
 		if err != nil {
 			return fmt.Errorf("failed to continue job %d: %v", id, err)
 		}
-
-		jm.mutex.Lock()
 		job.State = JobRunning
-		jm.mutex.Unlock()
 	}
 
 	return nil
@@ -189,8 +458,11 @@ func (jm *JobManager) SendToBackground(id int) error {
 
 // StopJob stops a running job
 func (jm *JobManager) StopJob(id int) error {
-	job := jm.GetJob(id)
-	if job == nil {
+	jm.mutex.Lock()
+	defer jm.mutex.Unlock()
+
+	job, exists := jm.jobs[id]
+	if !exists {
 		return fmt.Errorf("job %d not found", id)
 	}
 
@@ -204,17 +476,22 @@ func (jm *JobManager) StopJob(id int) error {
 		return fmt.Errorf("failed to stop job %d: %v", id, err)
 	}
 
-	jm.mutex.Lock()
+	// The reaper can't see the stop until the mutex is released, so it's
+	// announced here
 	job.State = JobStopped
-	jm.mutex.Unlock()
+	jm.touch(job.ID)
+	jm.notifyStopped(job)
 
 	return nil
 }
 
 // KillJob terminates a job
 func (jm *JobManager) KillJob(id int) error {
-	job := jm.GetJob(id)
-	if job == nil {
+	jm.mutex.Lock()
+	defer jm.mutex.Unlock()
+
+	job, exists := jm.jobs[id]
+	if !exists {
 		return fmt.Errorf("job %d not found", id)
 	}
 
@@ -227,27 +504,78 @@ func (jm *JobManager) KillJob(id int) error {
 	if err != nil {
 		return fmt.Errorf("failed to kill job %d: %v", id, err)
 	}
+	// A stopped job only acts on the signal once it's continued
+	if job.State == JobStopped {
+		syscall.Kill(-job.PGID, syscall.SIGCONT)
+	}
 
-	jm.mutex.Lock()
 	job.State = JobDone
-	job.ExitCode = -1
-	jm.mutex.Unlock()
+	job.ExitCode = 128 + int(syscall.SIGTERM)
+	jm.slotFreed.Broadcast()
 
 	return nil
 }
 
-// monitorJob monitors a job for completion
-func (jm *JobManager) monitorJob(job *Job) {
-	state, err := job.Process.Wait()
-	if err != nil {
+// reapJobs collects the status of any jobs that have exited, stopped or
+// continued without blocking. Only the PIDs of known jobs are waited for so
+// that foreground commands can still be waited for by their own callers.
+func (jm *JobManager) reapJobs() {
+	jm.mutex.Lock()
+	defer jm.mutex.Unlock()
+
+	for _, job := range jm.jobs {
+		jm.reapJob(job)
+	}
+	for id, job := range jm.disowned {
+		jm.reapJob(job)
+		if job.reaped {
+			delete(jm.disowned, id)
+		}
+	}
+	jm.slotFreed.Broadcast()
+	jm.stateChanged.Broadcast()
+}
+
+// reapJob updates a single job's state from a non-blocking wait. The caller
+// must hold the mutex.
+func (jm *JobManager) reapJob(job *Job) {
+	if job.reaped {
 		return
 	}
 
-	jm.mutex.Lock()
-	defer jm.mutex.Unlock()
+	var status syscall.WaitStatus
+	pid, err := syscall.Wait4(job.PID, &status, syscall.WNOHANG|syscall.WUNTRACED|syscall.WCONTINUED, nil)
+	if err == syscall.ECHILD {
+		// Someone else already waited for it
+		job.State = JobDone
+		job.reaped = true
+		close(job.done)
+		return
+	}
+	if err != nil || pid != job.PID {
+		return
+	}
 
-	job.State = JobDone
-	job.ExitCode = state.ExitCode()
+	switch {
+	case status.Exited() || status.Signaled():
+		job.State = JobDone
+		job.ExitCode = status.ExitStatus()
+		if status.Signaled() {
+			// Like $?, a job killed by a signal exits with 128 plus the signal
+			job.ExitCode = 128 + int(status.Signal())
+		}
+		job.reaped = true
+		close(job.done)
+	case status.Stopped():
+		wasStopped := job.State == JobStopped
+		job.State = JobStopped
+		jm.touch(job.ID)
+		if !wasStopped {
+			jm.notifyStopped(job)
+		}
+	case status.Continued():
+		job.State = JobRunning
+	}
 }
 
 // CleanupDoneJobs removes completed jobs from the manager
@@ -256,26 +584,97 @@ func (jm *JobManager) CleanupDoneJobs() {
 	defer jm.mutex.Unlock()
 
 	for id, job := range jm.jobs {
-		if job.State == JobDone {
+		// Killed jobs are marked done before they have been reaped
+		if job.State == JobDone && job.reaped {
 			delete(jm.jobs, id)
 		}
 	}
+
+	recent := jm.recent[:0]
+	for _, id := range jm.recent {
+		if _, exists := jm.jobs[id]; exists {
+			recent = append(recent, id)
+		}
+	}
+	jm.recent = recent
 }
 
-// PrintJobs prints all active jobs
-func (jm *JobManager) PrintJobs() {
+// PrintOptions controls what PrintJobs shows for each job
+type PrintOptions struct {
+	// Elapsed adds how long each job has been running
+	Elapsed bool
+}
+
+// PrintJobs prints all active jobs to w, marking the current job with + and the
+// previous job with -
+func (jm *JobManager) PrintJobs(w io.Writer, opts PrintOptions) {
 	jobs := jm.GetActiveJobs()
 	if len(jobs) == 0 {
 		return
 	}
 
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].ID < jobs[j].ID })
+	current, previous := jm.CurrentJob(), jm.PreviousJob()
+
+	// The reaper may be changing a job's state
+	jm.mutex.RLock()
+	defer jm.mutex.RUnlock()
 	for _, job := range jobs {
-		status := job.State.String()
-		if job.State == JobRunning {
-			status = "Running"
-		} else if job.State == JobStopped {
-			status = "Stopped"
+		marker := " "
+		if job == current {
+			marker = "+"
+		} else if job == previous {
+			marker = "-"
+		}
+		if opts.Elapsed {
+			fmt.Fprintf(w, "[%d]%s %s\t%s\t%s\n", job.ID, marker, job.State, formatElapsed(time.Since(job.StartTime)), job.Command)
+		} else {
+			fmt.Fprint(w, jobLine(job, marker))
 		}
-		fmt.Printf("[%d]  %s\t\t%s\n", job.ID, status, job.Command)
 	}
 }
+
+// jobLine formats a job as jobs lists it, with marker showing whether it's
+// the current or previous job
+func jobLine(job *Job, marker string) string {
+	return fmt.Sprintf("[%d]%s %s\t\t%s\n", job.ID, marker, job.State, job.Command)
+}
+
+// jobJSON is how MarshalJobs describes a job
+type jobJSON struct {
+	ID        int       `json:"id"`
+	PID       int       `json:"pid"`
+	PGID      int       `json:"pgid"`
+	Command   string    `json:"command"`
+	State     JobState  `json:"state"`
+	ExitCode  int       `json:"exit_code"`
+	StartTime time.Time `json:"start_time"`
+}
+
+// MarshalJobs returns all jobs, including finished ones that haven't been
+// cleaned up yet, as a JSON array ordered by job ID
+func (jm *JobManager) MarshalJobs() ([]byte, error) {
+	jm.mutex.RLock()
+	list := make([]jobJSON, 0, len(jm.jobs))
+	for _, job := range jm.jobs {
+		list = append(list, jobJSON{
+			ID:        job.ID,
+			PID:       job.PID,
+			PGID:      job.PGID,
+			Command:   job.Command,
+			State:     job.State,
+			ExitCode:  job.ExitCode,
+			StartTime: job.StartTime,
+		})
+	}
+	jm.mutex.RUnlock()
+
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return json.Marshal(list)
+}
+
+// formatElapsed formats a duration as minutes and seconds, such as 0m03s
+func formatElapsed(d time.Duration) string {
+	seconds := int(d / time.Second)
+	return fmt.Sprintf("%dm%02ds", seconds/60, seconds%60)
+}
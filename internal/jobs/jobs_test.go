@@ -0,0 +1,353 @@
+package jobs
+
+import (
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// startJob starts a shell command and adds it to the manager as a job
+func startJob(t *testing.T, jm *JobManager, script string) *Job {
+	cmd := exec.Command("sh", "-c", script)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	assert.NoError(t, cmd.Start())
+	t.Cleanup(func() { cmd.Process.Kill() })
+	return jm.AddJob(cmd, script)
+}
+
+func TestDisown(t *testing.T) {
+	jm := NewJobManager()
+	sentinel := filepath.Join(t.TempDir(), "sentinel")
+
+	job := startJob(t, jm, "sleep 0.3; touch "+sentinel)
+	other := startJob(t, jm, "sleep 5")
+
+	assert.NoError(t, jm.Disown(job.ID))
+
+	// The job is gone from the table but the other one is untouched
+	jobs := jm.GetJobs()
+	assert.Len(t, jobs, 1)
+	assert.Equal(t, other.ID, jobs[0].ID)
+	assert.Nil(t, jm.GetJob(job.ID))
+
+	// The disowned process wasn't signaled and runs to completion
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(sentinel)
+		return err == nil
+	}, 3*time.Second, 50*time.Millisecond)
+
+	assert.Error(t, jm.Disown(job.ID))
+}
+
+func TestDisownAll(t *testing.T) {
+	jm := NewJobManager()
+	startJob(t, jm, "sleep 5")
+	startJob(t, jm, "sleep 5")
+
+	jm.DisownAll()
+
+	assert.Empty(t, jm.GetJobs())
+}
+
+func TestCurrentJob(t *testing.T) {
+	jm := NewJobManager()
+	assert.Nil(t, jm.CurrentJob())
+
+	startJob(t, jm, "sleep 5")
+	second := startJob(t, jm, "sleep 5")
+
+	assert.Equal(t, second.ID, jm.CurrentJob().ID)
+}
+
+func TestReaperMarksJobsDone(t *testing.T) {
+	jm := NewJobManager()
+
+	var jobs []*Job
+	for _, script := range []string{"exit 0", "sleep 0.1; exit 3", "sleep 0.2", "kill -KILL $$"} {
+		jobs = append(jobs, startJob(t, jm, script))
+	}
+
+	assert.Eventually(t, func() bool {
+		return len(jm.GetActiveJobs()) == 0
+	}, 3*time.Second, 20*time.Millisecond, "all jobs should be reaped after exiting")
+
+	jm.mutex.RLock()
+	defer jm.mutex.RUnlock()
+	for _, job := range jobs {
+		assert.Equal(t, JobDone, job.State)
+		assert.True(t, job.reaped)
+	}
+	assert.Equal(t, 0, jobs[0].ExitCode)
+	assert.Equal(t, 3, jobs[1].ExitCode)
+	assert.Equal(t, 128+int(syscall.SIGKILL), jobs[3].ExitCode)
+}
+
+func TestReaperIgnoresOtherChildren(t *testing.T) {
+	jm := NewJobManager()
+	startJob(t, jm, "exit 0")
+
+	// A foreground command that isn't a job must still be waitable by its
+	// owner while the reaper runs
+	cmd := exec.Command("sh", "-c", "sleep 0.1; exit 2")
+	err := cmd.Run()
+
+	exitErr, ok := err.(*exec.ExitError)
+	assert.True(t, ok, "expected an exit error, got %v", err)
+	if ok {
+		assert.Equal(t, 2, exitErr.ExitCode())
+	}
+}
+
+func TestBringToForegroundWaitsForReaper(t *testing.T) {
+	jm := NewJobManager()
+	job := startJob(t, jm, "sleep 0.1; exit 4")
+
+	assert.NoError(t, jm.BringToForeground(job.ID))
+
+	jm.mutex.RLock()
+	defer jm.mutex.RUnlock()
+	assert.Equal(t, JobDone, job.State)
+	assert.Equal(t, 4, job.ExitCode)
+}
+
+func TestBringToForegroundReturnsWhenJobStops(t *testing.T) {
+	jm := NewJobManager()
+	job := startJob(t, jm, "kill -STOP $$; kill -STOP $$")
+	assert.Eventually(t, func() bool {
+		return jobState(jm, job) == JobStopped
+	}, 3*time.Second, 20*time.Millisecond)
+
+	// The job stops itself again once it's continued
+	returned := make(chan error, 1)
+	go func() { returned <- jm.BringToForeground(job.ID) }()
+	select {
+	case err := <-returned:
+		assert.NoError(t, err)
+	case <-time.After(3 * time.Second):
+		t.Fatal("BringToForeground didn't return when the job stopped")
+	}
+	assert.Equal(t, JobStopped, jobState(jm, job))
+}
+
+// jobState reads a job's state the way the reaper writes it, under the lock
+func jobState(jm *JobManager, job *Job) JobState {
+	jm.mutex.RLock()
+	defer jm.mutex.RUnlock()
+	return job.State
+}
+
+func TestResolveSpec(t *testing.T) {
+	jm := NewJobManager()
+	first := startJob(t, jm, "sleep 5 # first")
+	second := startJob(t, jm, "sleep 6 # second")
+	third := startJob(t, jm, "echo hi; sleep 5")
+
+	tests := []struct {
+		spec     string
+		expected *Job
+	}{
+		{"%1", first},
+		{"2", second},
+		{"%+", third},
+		{"%%", third},
+		{"%", third},
+		{"%-", second},
+		{"%echo", third},
+		{"%?second", second},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			job, err := jm.ResolveSpec(tt.spec)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, job)
+		})
+	}
+
+	errorSpecs := []string{"%9", "9", "%nomatch", "%sleep", "bogus", "%?"}
+	for _, spec := range errorSpecs {
+		t.Run("error "+spec, func(t *testing.T) {
+			_, err := jm.ResolveSpec(spec)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestCurrentJobTracksStops(t *testing.T) {
+	jm := NewJobManager()
+	first := startJob(t, jm, "sleep 5")
+	second := startJob(t, jm, "sleep 5")
+
+	assert.Equal(t, second, jm.CurrentJob())
+	assert.Equal(t, first, jm.PreviousJob())
+
+	// Stopping a job makes it current
+	assert.NoError(t, jm.StopJob(first.ID))
+	assert.Equal(t, first, jm.CurrentJob())
+	assert.Equal(t, second, jm.PreviousJob())
+
+	// When the current job goes away the previous one takes over
+	jm.Disown(first.ID)
+	assert.Equal(t, second, jm.CurrentJob())
+	assert.Nil(t, jm.PreviousJob())
+}
+
+func TestStoppedJobNotification(t *testing.T) {
+	jm := NewJobManager()
+	jm.SetNotifications(true)
+	notifications := func() string {
+		var out strings.Builder
+		jm.PrintNotifications(&out)
+		return out.String()
+	}
+
+	first := startJob(t, jm, "sleep 5")
+	second := startJob(t, jm, "sleep 6")
+
+	// Stopping a job announces it once, though the reaper sees it too
+	assert.NoError(t, jm.StopJob(first.ID))
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, "[1]+ Stopped\t\tsleep 5\n", notifications())
+	assert.Empty(t, notifications())
+
+	// So is a job stopped by a signal from elsewhere, once the reaper
+	// has seen it
+	assert.NoError(t, syscall.Kill(-second.PGID, syscall.SIGSTOP))
+	assert.Eventually(t, func() bool {
+		state, _ := jm.JobState(second.ID)
+		return state == JobStopped
+	}, 3*time.Second, 20*time.Millisecond)
+	assert.Equal(t, "[2]+ Stopped\t\tsleep 6\n", notifications())
+
+	// Stopped jobs stay listed until they're resumed or killed
+	var listing strings.Builder
+	jm.PrintJobs(&listing, PrintOptions{})
+	assert.Equal(t, "[1]- Stopped\t\tsleep 5\n[2]+ Stopped\t\tsleep 6\n", listing.String())
+
+	assert.NoError(t, jm.SendToBackground(second.ID))
+	assert.NoError(t, jm.KillJob(first.ID))
+	listing.Reset()
+	jm.PrintJobs(&listing, PrintOptions{})
+	assert.Equal(t, "[2]+ Running\t\tsleep 6\n", listing.String())
+	<-first.done
+
+	state, ok := jm.JobState(first.ID)
+	assert.True(t, ok)
+	assert.Equal(t, JobDone, state)
+	_, ok = jm.JobState(99)
+	assert.False(t, ok)
+
+	// Nothing is queued while announcements are off
+	jm.SetNotifications(false)
+	assert.NoError(t, jm.StopJob(second.ID))
+	assert.Empty(t, notifications())
+	assert.NoError(t, jm.KillJob(second.ID))
+
+	jm.mutex.RLock()
+	defer jm.mutex.RUnlock()
+	assert.Equal(t, 128+int(syscall.SIGTERM), first.ExitCode)
+}
+
+func TestPrintJobsElapsed(t *testing.T) {
+	jm := NewJobManager()
+	first := startJob(t, jm, "sleep 5")
+	second := startJob(t, jm, "sleep 5")
+	first.StartTime = time.Now().Add(-3 * time.Second)
+	second.StartTime = time.Now().Add(-65 * time.Second)
+
+	var out strings.Builder
+	jm.PrintJobs(&out, PrintOptions{Elapsed: true})
+	assert.Equal(t, "[1]- Running\t0m03s\tsleep 5\n[2]+ Running\t1m05s\tsleep 5\n", out.String())
+
+	// Without the option the elapsed column is left out
+	out.Reset()
+	jm.PrintJobs(&out, PrintOptions{})
+	assert.Equal(t, "[1]- Running\t\tsleep 5\n[2]+ Running\t\tsleep 5\n", out.String())
+}
+
+func TestFormatElapsed(t *testing.T) {
+	assert.Equal(t, "0m00s", formatElapsed(0))
+	assert.Equal(t, "0m03s", formatElapsed(3500*time.Millisecond))
+	assert.Equal(t, "1m05s", formatElapsed(65*time.Second))
+	assert.Equal(t, "61m01s", formatElapsed(time.Hour+61*time.Second))
+}
+
+func TestMarshalJobs(t *testing.T) {
+	jm := NewJobManager()
+	running := startJob(t, jm, "sleep 5")
+	stopped := startJob(t, jm, "sleep 5")
+	done := startJob(t, jm, "exit 3")
+	assert.NoError(t, jm.StopJob(stopped.ID))
+	assert.Eventually(t, func() bool {
+		return jm.GetJob(done.ID).State == JobDone
+	}, 3*time.Second, 20*time.Millisecond)
+
+	data, err := jm.MarshalJobs()
+	assert.NoError(t, err)
+
+	var decoded []map[string]any
+	assert.NoError(t, json.Unmarshal(data, &decoded))
+	assert.Len(t, decoded, 3)
+
+	for i, job := range []*Job{running, stopped, done} {
+		assert.Equal(t, float64(job.ID), decoded[i]["id"])
+		assert.Equal(t, float64(job.PID), decoded[i]["pid"])
+		assert.Equal(t, float64(job.PGID), decoded[i]["pgid"])
+		assert.Equal(t, job.Command, decoded[i]["command"])
+		assert.Equal(t, job.StartTime.Format(time.RFC3339Nano), decoded[i]["start_time"])
+	}
+	assert.Equal(t, "Running", decoded[0]["state"])
+	assert.Equal(t, "Stopped", decoded[1]["state"])
+	assert.Equal(t, "Done", decoded[2]["state"])
+	assert.Equal(t, float64(0), decoded[0]["exit_code"])
+	assert.Equal(t, float64(3), decoded[2]["exit_code"])
+
+	// No jobs is an empty array rather than null
+	data, err = NewJobManager().MarshalJobs()
+	assert.NoError(t, err)
+	assert.Equal(t, "[]", string(data))
+}
+
+func TestReserveSlot(t *testing.T) {
+	jm := NewJobManager()
+	t.Setenv("GOSH_MAXJOBS", "2")
+
+	assert.NoError(t, jm.ReserveSlot())
+	short := startJob(t, jm, "sleep 0.3")
+	assert.NoError(t, jm.ReserveSlot())
+	long := startJob(t, jm, "sleep 5")
+
+	// With the limit reached, another job is refused
+	assert.ErrorIs(t, jm.ReserveSlot(), ErrTooManyJobs)
+
+	// A slot frees up when a job finishes
+	assert.Eventually(t, func() bool { return jm.ReserveSlot() == nil }, 3*time.Second, 20*time.Millisecond)
+	assert.Equal(t, JobDone, jm.GetJob(short.ID).State)
+
+	// With GOSH_MAXJOBS_WAIT=1 the caller waits for a job to finish instead
+	startJob(t, jm, "sleep 0.3")
+	t.Setenv("GOSH_MAXJOBS_WAIT", "1")
+	start := time.Now()
+	assert.NoError(t, jm.ReserveSlot())
+	assert.GreaterOrEqual(t, time.Since(start), 100*time.Millisecond)
+
+	// Killing a job frees its slot too
+	startJob(t, jm, "sleep 5")
+	t.Setenv("GOSH_MAXJOBS_WAIT", "")
+	assert.ErrorIs(t, jm.ReserveSlot(), ErrTooManyJobs)
+	assert.NoError(t, jm.KillJob(long.ID))
+	assert.NoError(t, jm.ReserveSlot())
+
+	// No limit is the default
+	t.Setenv("GOSH_MAXJOBS", "")
+	startJob(t, jm, "sleep 5")
+	startJob(t, jm, "sleep 5")
+	assert.NoError(t, jm.ReserveSlot())
+}
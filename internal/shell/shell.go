@@ -0,0 +1,703 @@
+package shell
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+// Shell-local variables. These are visible to expansion but, unlike the
+// process environment, are not passed on to child processes.
+var locals = make(map[string]string)
+
+var validName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// IsValidName reports whether name is a valid shell variable name
+func IsValidName(name string) bool {
+	return validName.MatchString(name)
+}
+
+// ParseAssignment splits a NAME=value word into its name and value.
+// ok is false if the word is not a valid assignment.
+func ParseAssignment(word string) (name, value string, ok bool) {
+	idx := strings.Index(word, "=")
+	if idx <= 0 {
+		return "", "", false
+	}
+	name = word[:idx]
+	if !IsValidName(name) {
+		return "", "", false
+	}
+	return name, word[idx+1:], true
+}
+
+// SetVar assigns a variable the way a plain NAME=value assignment does.
+// Variables that are already exported are updated in the environment;
+// everything else is stored as a shell-local variable.
+func SetVar(name, value string) error {
+	if _, exported := os.LookupEnv(name); exported {
+		return os.Setenv(name, value)
+	}
+	locals[name] = value
+	return nil
+}
+
+// LookupVar looks up a variable, consulting shell-local variables before
+// falling back to the environment. Positional parameters such as 1 and #
+// are looked up in the arguments of the running function, and ? is the exit
+// status of the last command.
+func LookupVar(name string) (string, bool) {
+	if value, ok, special := lookupSpecial(name); special {
+		return value, ok
+	}
+	if value, ok := locals[name]; ok {
+		return value, true
+	}
+	return os.LookupEnv(name)
+}
+
+// GetVar returns the value of a variable, or "" if it is unset
+func GetVar(name string) string {
+	value, _ := LookupVar(name)
+	return value
+}
+
+// IsLocal reports whether name is a shell-local (unexported) variable
+func IsLocal(name string) bool {
+	_, ok := locals[name]
+	return ok
+}
+
+// Export promotes a shell-local variable to the environment. Exporting a
+// name with no local value is a no-op.
+func Export(name string) error {
+	value, ok := locals[name]
+	if !ok {
+		return nil
+	}
+	if err := os.Setenv(name, value); err != nil {
+		return err
+	}
+	delete(locals, name)
+	return nil
+}
+
+// UnsetVar removes a variable from both the shell-local variables and the
+// environment
+func UnsetVar(name string) error {
+	delete(locals, name)
+	return os.Unsetenv(name)
+}
+
+// LocalNames returns the names of all shell-local variables, sorted
+func LocalNames() []string {
+	names := make([]string, 0, len(locals))
+	for name := range locals {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Shell functions, keyed by name, holding the body to run
+var functions = make(map[string]string)
+
+// DefineFunction defines a shell function, replacing any existing one
+func DefineFunction(name, body string) {
+	functions[name] = body
+}
+
+// LookupFunction returns the body of a shell function
+func LookupFunction(name string) (string, bool) {
+	body, ok := functions[name]
+	return body, ok
+}
+
+// UnsetFunction removes a shell function
+func UnsetFunction(name string) {
+	delete(functions, name)
+}
+
+// FunctionNames returns the names of all shell functions, sorted
+func FunctionNames() []string {
+	names := make([]string, 0, len(functions))
+	for name := range functions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Aliases defined with the alias builtin, keyed by name, holding the text
+// that replaces the name
+var aliases = make(map[string]string)
+
+// SetAlias defines an alias, replacing any existing one
+func SetAlias(name, value string) {
+	aliases[name] = value
+}
+
+// LookupAlias returns the text an alias stands for
+func LookupAlias(name string) (string, bool) {
+	value, ok := aliases[name]
+	return value, ok
+}
+
+// UnsetAlias removes an alias, reporting whether there was one
+func UnsetAlias(name string) bool {
+	_, ok := aliases[name]
+	delete(aliases, name)
+	return ok
+}
+
+// AliasNames returns the names of all aliases, sorted
+func AliasNames() []string {
+	names := make([]string, 0, len(aliases))
+	for name := range aliases {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// CompletionSpec says what to offer when completing a command's arguments,
+// as set with the complete builtin
+type CompletionSpec struct {
+	Words []string // Words to offer, from -W
+	Dirs  bool     // Offer directories, from -d
+	Files bool     // Offer files and directories, from -f
+}
+
+// Completion specs, keyed by command name. Completion runs on the line
+// editor's goroutine, so they are guarded by a mutex.
+var (
+	completionsMutex sync.Mutex
+	completions      = make(map[string]CompletionSpec)
+)
+
+// SetCompletion sets how the arguments of command are completed, replacing
+// any existing spec
+func SetCompletion(command string, spec CompletionSpec) {
+	completionsMutex.Lock()
+	defer completionsMutex.Unlock()
+	completions[command] = spec
+}
+
+// LookupCompletion returns the completion spec for command
+func LookupCompletion(command string) (CompletionSpec, bool) {
+	completionsMutex.Lock()
+	defer completionsMutex.Unlock()
+	spec, ok := completions[command]
+	return spec, ok
+}
+
+// RemoveCompletion removes the completion spec for command
+func RemoveCompletion(command string) {
+	completionsMutex.Lock()
+	defer completionsMutex.Unlock()
+	delete(completions, command)
+}
+
+// CompletionCommands returns the commands that have a completion spec,
+// sorted
+func CompletionCommands() []string {
+	completionsMutex.Lock()
+	defer completionsMutex.Unlock()
+	names := make([]string, 0, len(completions))
+	for name := range completions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// IO holds the streams that commands use when nothing redirects them. A nil
+// stream means the process's own, looked up each time it is used.
+type IO struct {
+	In  io.Reader
+	Out io.Writer
+	Err io.Writer
+}
+
+var (
+	stdioMutex sync.RWMutex
+	stdio      IO
+)
+
+// SetIO sets the streams that commands use by default. Pass the result of
+// CurrentIO to put back the ones before.
+func SetIO(streams IO) {
+	stdioMutex.Lock()
+	defer stdioMutex.Unlock()
+	stdio = streams
+}
+
+// CurrentIO returns the streams set by SetIO
+func CurrentIO() IO {
+	stdioMutex.RLock()
+	defer stdioMutex.RUnlock()
+	return stdio
+}
+
+// Stdin returns the shell's standard input
+func Stdin() io.Reader {
+	if in := CurrentIO().In; in != nil {
+		return in
+	}
+	return os.Stdin
+}
+
+// Stdout returns the shell's standard output
+func Stdout() io.Writer {
+	if out := CurrentIO().Out; out != nil {
+		return out
+	}
+	return os.Stdout
+}
+
+// Stderr returns the shell's standard error
+func Stderr() io.Writer {
+	if err := CurrentIO().Err; err != nil {
+		return err
+	}
+	return os.Stderr
+}
+
+// Exit status of the last command run, for $?. Builtins in a pipeline run
+// concurrently, so it is accessed atomically.
+var exitStatus atomic.Int32
+
+// SetExitStatus records the exit status of the last command
+func SetExitStatus(status int) {
+	exitStatus.Store(int32(status))
+}
+
+// ExitStatus returns the exit status of the last command
+func ExitStatus() int {
+	return int(exitStatus.Load())
+}
+
+// Control is a request from return, break or continue to stop running
+// commands normally. The request is left pending until the function or
+// loop it applies to sees it and clears it.
+type Control int
+
+const (
+	ControlNone Control = iota
+	ControlReturn
+	ControlBreak
+	ControlContinue
+)
+
+var (
+	pendingControl Control
+	pendingLevels  int
+)
+
+// RequestControl makes a control flow request. levels is how many
+// enclosing loops break and continue apply to.
+func RequestControl(control Control, levels int) {
+	pendingControl = control
+	pendingLevels = levels
+}
+
+// PendingControl returns the pending control flow request, if any
+func PendingControl() (Control, int) {
+	return pendingControl, pendingLevels
+}
+
+// ClearControl drops the pending control flow request
+func ClearControl() {
+	pendingControl = ControlNone
+	pendingLevels = 0
+}
+
+// Number of loops currently running, so that break and continue know how
+// many loops they can apply to
+var loopDepth int
+
+// EnterLoop records that a loop has started running
+func EnterLoop() {
+	loopDepth++
+}
+
+// LeaveLoop records that the innermost running loop has finished
+func LeaveLoop() {
+	if loopDepth > 0 {
+		loopDepth--
+	}
+}
+
+// LoopDepth returns the number of loops currently running
+func LoopDepth() int {
+	return loopDepth
+}
+
+// Whether the shell is reading commands typed at a terminal, as opposed to
+// running a script piped to it or given with -c. A script stops at its
+// first syntax error, and with set -e at the first command that fails.
+var interactive = true
+
+// SetInteractive records whether the shell is interactive
+func SetInteractive(on bool) {
+	interactive = on
+}
+
+// Interactive reports whether the shell is interactive
+func Interactive() bool {
+	return interactive
+}
+
+// Number of command substitutions running, each on a copy of the shell's
+// state that is thrown away when it finishes
+var subshellDepth int
+
+// Subshell reports whether commands are running in a command substitution
+func Subshell() bool {
+	return subshellDepth > 0
+}
+
+// EnterSubshell saves the shell's variables, functions, aliases, options
+// and working directory so that a command substitution can change them
+// without affecting the shell, and returns a function that puts them back
+func EnterSubshell() (leave func()) {
+	savedLocals := maps.Clone(locals)
+	savedEnv := os.Environ()
+	savedFunctions := maps.Clone(functions)
+	savedAliases := maps.Clone(aliases)
+	savedOptions := maps.Clone(options)
+	savedDir, dirErr := os.Getwd()
+	subshellDepth++
+
+	return func() {
+		subshellDepth--
+		locals, functions, aliases, options = savedLocals, savedFunctions, savedAliases, savedOptions
+		os.Clearenv()
+		for _, entry := range savedEnv {
+			name, value, _ := strings.Cut(entry, "=")
+			os.Setenv(name, value)
+		}
+		if dirErr == nil {
+			os.Chdir(savedDir)
+		}
+	}
+}
+
+// Positional parameters of each function call in progress, innermost last
+var positionalStack [][]string
+
+// PushPositional sets the positional parameters for a function call
+func PushPositional(args []string) {
+	positionalStack = append(positionalStack, args)
+}
+
+// PopPositional restores the positional parameters from before the last
+// PushPositional
+func PopPositional() {
+	if len(positionalStack) > 0 {
+		positionalStack = positionalStack[:len(positionalStack)-1]
+	}
+}
+
+// Positional returns the current positional parameters
+func Positional() []string {
+	if len(positionalStack) == 0 {
+		return nil
+	}
+	return positionalStack[len(positionalStack)-1]
+}
+
+// CallDepth returns how many function calls are in progress
+func CallDepth() int {
+	return len(positionalStack)
+}
+
+// lookupSpecial looks up the special parameters 0, 1, 2, ..., #, @, * and ?.
+// special is false if name isn't one of them.
+func lookupSpecial(name string) (value string, ok, special bool) {
+	args := Positional()
+	switch name {
+	case "?":
+		return strconv.Itoa(ExitStatus()), true, true
+	case "#":
+		return strconv.Itoa(len(args)), true, true
+	case "@", "*":
+		return strings.Join(args, " "), true, true
+	case "0":
+		return "gosh", true, true
+	}
+
+	n, err := strconv.Atoi(name)
+	if err != nil || n < 0 || name[0] == '+' || name[0] == '-' {
+		return "", false, false
+	}
+	if n > len(args) {
+		return "", false, true
+	}
+	return args[n-1], true, true
+}
+
+// Names of the shell options that can be changed with set -o
+var optionNames = []string{"dotglob", "errexit", "nounset", "nullglob"}
+
+// Shell options that have been set explicitly with set -o or set +o
+var options = make(map[string]bool)
+
+// SetOption turns a shell option on or off
+func SetOption(name string, on bool) error {
+	if !isOptionName(name) {
+		return fmt.Errorf("%s: invalid option name", name)
+	}
+	options[name] = on
+	return nil
+}
+
+// Option reports whether a shell option is on. Options that haven't been
+// set explicitly can be turned on by setting GOSH_<NAME>=1, such as
+// GOSH_NULLGLOB=1.
+func Option(name string) bool {
+	if on, ok := options[name]; ok {
+		return on
+	}
+	return os.Getenv("GOSH_"+strings.ToUpper(name)) == "1"
+}
+
+// OptionNames returns the names of all shell options, sorted
+func OptionNames() []string {
+	return append([]string(nil), optionNames...)
+}
+
+func isOptionName(name string) bool {
+	for _, option := range optionNames {
+		if option == name {
+			return true
+		}
+	}
+	return false
+}
+
+// ExitTrap is the pseudo-signal under which the EXIT trap is registered
+const ExitTrap syscall.Signal = 0
+
+// Trap commands keyed by signal. Traps are run from signal handlers, so the
+// registry is guarded by a mutex.
+var (
+	trapMutex sync.Mutex
+	traps     = make(map[syscall.Signal]string)
+	trapHook  func(sig syscall.Signal)
+)
+
+// SetTrapHook sets a function that is called whenever the trap for a signal
+// is set or cleared, so that signal handlers can be installed to match
+func SetTrapHook(hook func(sig syscall.Signal)) {
+	trapMutex.Lock()
+	trapHook = hook
+	trapMutex.Unlock()
+}
+
+// SetTrap registers command to run when sig is received. An empty command
+// means the signal is ignored.
+func SetTrap(sig syscall.Signal, command string) {
+	trapMutex.Lock()
+	traps[sig] = command
+	hook := trapHook
+	trapMutex.Unlock()
+
+	if hook != nil {
+		hook(sig)
+	}
+}
+
+// ClearTrap removes the trap for sig
+func ClearTrap(sig syscall.Signal) {
+	trapMutex.Lock()
+	delete(traps, sig)
+	hook := trapHook
+	trapMutex.Unlock()
+
+	if hook != nil {
+		hook(sig)
+	}
+}
+
+// UnignoreSignal returns sig to its default handling after signal.Ignore.
+// signal.Reset alone leaves an ignored signal ignored, so the Go handler is
+// installed with Notify first.
+func UnignoreSignal(sig syscall.Signal) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, sig)
+	signal.Reset(sig)
+}
+
+// ReapplyTrap calls the trap hook for sig so that its signal handling is
+// installed again, after something has changed it temporarily
+func ReapplyTrap(sig syscall.Signal) {
+	trapMutex.Lock()
+	hook := trapHook
+	trapMutex.Unlock()
+
+	if hook != nil {
+		hook(sig)
+	}
+}
+
+// GetTrap returns the command registered for sig
+func GetTrap(sig syscall.Signal) (string, bool) {
+	trapMutex.Lock()
+	defer trapMutex.Unlock()
+	command, ok := traps[sig]
+	return command, ok
+}
+
+// TrapSignals returns the signals that have traps registered, sorted
+func TrapSignals() []syscall.Signal {
+	trapMutex.Lock()
+	defer trapMutex.Unlock()
+
+	sigs := make([]syscall.Signal, 0, len(traps))
+	for sig := range traps {
+		sigs = append(sigs, sig)
+	}
+	sort.Slice(sigs, func(i, j int) bool { return sigs[i] < sigs[j] })
+	return sigs
+}
+
+// pathEntry is a directory searched for commands
+type pathEntry struct {
+	dir      string // absolute and cleaned
+	relative bool   // named in PATH relative to the current directory
+}
+
+// pathEntries returns the directories that a PATH value names, in order.
+// Empty entries and . stand for the current directory, other relative
+// entries are taken from it, and ~ at the start is the home directory.
+// Entries that aren't directories are dropped, and a directory named more
+// than once, through a symlink or another spelling, is kept the first time.
+func pathEntries(path string) []pathEntry {
+	var entries []pathEntry
+	seen := make(map[string]bool)
+	for _, dir := range filepath.SplitList(path) {
+		if dir == "~" || strings.HasPrefix(dir, "~/") {
+			home, err := os.UserHomeDir()
+			if err != nil {
+				continue
+			}
+			dir = home + dir[1:]
+		}
+
+		relative := !filepath.IsAbs(dir)
+		if relative {
+			cwd, err := os.Getwd()
+			if err != nil {
+				continue
+			}
+			dir = filepath.Join(cwd, dir)
+		}
+		dir = filepath.Clean(dir)
+
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			continue
+		}
+		key := dir
+		if resolved, err := filepath.EvalSymlinks(dir); err == nil {
+			key = resolved
+		}
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		entries = append(entries, pathEntry{dir, relative})
+	}
+	return entries
+}
+
+// PathDirs returns the directories that a PATH value names, as they are
+// searched for commands: absolute, cleaned, without duplicates and without
+// entries that aren't directories
+func PathDirs(path string) []string {
+	var dirs []string
+	for _, entry := range pathEntries(path) {
+		dirs = append(dirs, entry.dir)
+	}
+	return dirs
+}
+
+// lookPath finds name in the PATH directories, returning the entry it was
+// found in
+func lookPath(name string) (string, pathEntry, error) {
+	if strings.Contains(name, "/") {
+		return name, pathEntry{}, nil
+	}
+	for _, entry := range pathEntries(os.Getenv("PATH")) {
+		path := filepath.Join(entry.dir, name)
+		if info, err := os.Stat(path); err == nil && !info.IsDir() && info.Mode()&0111 != 0 {
+			return path, entry, nil
+		}
+	}
+	return "", pathEntry{}, &exec.Error{Name: name, Err: exec.ErrNotFound}
+}
+
+// LookPath returns the file that running name would run: name itself if it
+// contains a slash, and otherwise the first executable called name in the
+// directories from PathDirs. An error for a command that can't be found
+// wraps exec.ErrNotFound.
+func LookPath(name string) (string, error) {
+	path, _, err := lookPath(name)
+	return path, err
+}
+
+// Command returns an exec.Cmd that runs name, found with LookPath, with
+// args. If name can't be found, starting the command fails with the error.
+// With GOSH_STRICT_PATH=1, running a command found through a relative PATH
+// entry, such as ., in a directory anyone can write to gives a warning.
+func Command(name string, args ...string) *exec.Cmd {
+	path, entry, err := lookPath(name)
+	if err != nil {
+		cmd := exec.Command(name, args...)
+		cmd.Err = err
+		return cmd
+	}
+
+	if entry.relative && os.Getenv("GOSH_STRICT_PATH") == "1" {
+		if info, err := os.Stat(entry.dir); err == nil && info.Mode().Perm()&0002 != 0 {
+			fmt.Fprintf(Stderr(), "gosh: warning: %s is in %s, which is in PATH and writable by anyone\n", name, entry.dir)
+		}
+	}
+
+	cmd := exec.Command(path, args...)
+	cmd.Args[0] = name
+	return cmd
+}
+
+// CommandStatus converts the error from running a command, as returned by
+// its Run, Start or Wait, into its exit status: the command's own status if
+// it ran, or 128 plus the signal that killed it, 127 if it couldn't be
+// found and 126 if it couldn't be started for any other reason
+func CommandStatus(err error) int {
+	if err == nil || errors.Is(err, exec.ErrWaitDelay) {
+		return 0
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			return 128 + int(status.Signal())
+		}
+		return exitErr.ExitCode()
+	}
+	if errors.Is(err, exec.ErrNotFound) {
+		return 127
+	}
+	return 126
+}
@@ -0,0 +1,320 @@
+package shell
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseAssignment(t *testing.T) {
+	tests := []struct {
+		word  string
+		name  string
+		value string
+		ok    bool
+	}{
+		{"FOO=bar", "FOO", "bar", true},
+		{"FOO=", "FOO", "", true},
+		{"_x1=a=b", "_x1", "a=b", true},
+		{"=bar", "", "", false},
+		{"1FOO=bar", "", "", false},
+		{"FO-O=bar", "", "", false},
+		{"FOO", "", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.word, func(t *testing.T) {
+			name, value, ok := ParseAssignment(tt.word)
+			assert.Equal(t, tt.ok, ok)
+			assert.Equal(t, tt.name, name)
+			assert.Equal(t, tt.value, value)
+		})
+	}
+}
+
+func TestLocalVariables(t *testing.T) {
+	defer UnsetVar("GOSH_TEST_LOCAL")
+
+	assert.NoError(t, SetVar("GOSH_TEST_LOCAL", "value"))
+
+	value, ok := LookupVar("GOSH_TEST_LOCAL")
+	assert.True(t, ok)
+	assert.Equal(t, "value", value)
+	assert.True(t, IsLocal("GOSH_TEST_LOCAL"))
+	assert.Contains(t, LocalNames(), "GOSH_TEST_LOCAL")
+
+	_, inEnv := os.LookupEnv("GOSH_TEST_LOCAL")
+	assert.False(t, inEnv, "local variable should not be in the environment")
+}
+
+func TestSetVarUpdatesExported(t *testing.T) {
+	t.Setenv("GOSH_TEST_EXPORTED", "old")
+
+	assert.NoError(t, SetVar("GOSH_TEST_EXPORTED", "new"))
+
+	assert.False(t, IsLocal("GOSH_TEST_EXPORTED"))
+	assert.Equal(t, "new", os.Getenv("GOSH_TEST_EXPORTED"))
+}
+
+func TestExport(t *testing.T) {
+	defer UnsetVar("GOSH_TEST_EXPORT")
+
+	SetVar("GOSH_TEST_EXPORT", "value")
+	assert.NoError(t, Export("GOSH_TEST_EXPORT"))
+
+	assert.False(t, IsLocal("GOSH_TEST_EXPORT"))
+	assert.Equal(t, "value", os.Getenv("GOSH_TEST_EXPORT"))
+	assert.Equal(t, "value", GetVar("GOSH_TEST_EXPORT"))
+}
+
+func TestUnsetVar(t *testing.T) {
+	SetVar("GOSH_TEST_UNSET", "value")
+	assert.NoError(t, UnsetVar("GOSH_TEST_UNSET"))
+
+	_, ok := LookupVar("GOSH_TEST_UNSET")
+	assert.False(t, ok)
+}
+
+func TestTraps(t *testing.T) {
+	var hooked []syscall.Signal
+	SetTrapHook(func(sig syscall.Signal) { hooked = append(hooked, sig) })
+	defer SetTrapHook(nil)
+
+	SetTrap(syscall.SIGHUP, "echo hup")
+	SetTrap(ExitTrap, "echo bye")
+
+	command, ok := GetTrap(syscall.SIGHUP)
+	assert.True(t, ok)
+	assert.Equal(t, "echo hup", command)
+	assert.Equal(t, []syscall.Signal{ExitTrap, syscall.SIGHUP}, TrapSignals())
+
+	ClearTrap(syscall.SIGHUP)
+	_, ok = GetTrap(syscall.SIGHUP)
+	assert.False(t, ok)
+
+	ClearTrap(ExitTrap)
+	assert.Empty(t, TrapSignals())
+	assert.Equal(t, []syscall.Signal{syscall.SIGHUP, ExitTrap, syscall.SIGHUP, ExitTrap}, hooked)
+}
+
+func TestUnignoreSignal(t *testing.T) {
+	signal.Ignore(syscall.SIGUSR2)
+	assert.True(t, signal.Ignored(syscall.SIGUSR2))
+
+	UnignoreSignal(syscall.SIGUSR2)
+	assert.False(t, signal.Ignored(syscall.SIGUSR2))
+}
+
+func TestOptions(t *testing.T) {
+	defer delete(options, "nullglob")
+
+	t.Setenv("GOSH_NULLGLOB", "")
+	assert.False(t, Option("nullglob"))
+	t.Setenv("GOSH_NULLGLOB", "1")
+	assert.True(t, Option("nullglob"))
+
+	// An explicit setting overrides the environment
+	assert.NoError(t, SetOption("nullglob", false))
+	assert.False(t, Option("nullglob"))
+
+	assert.EqualError(t, SetOption("bogus", true), "bogus: invalid option name")
+	assert.Equal(t, []string{"dotglob", "errexit", "nounset", "nullglob"}, OptionNames())
+}
+
+func TestEnterSubshell(t *testing.T) {
+	dir := t.TempDir()
+	t.Chdir(dir)
+	t.Setenv("GOSH_TEST_SUBSHELL_ENV", "before")
+	defer UnsetVar("GOSH_TEST_SUBSHELL")
+	SetVar("GOSH_TEST_SUBSHELL", "before")
+
+	leave := EnterSubshell()
+	assert.True(t, Subshell())
+	SetVar("GOSH_TEST_SUBSHELL", "after")
+	SetVar("GOSH_TEST_SUBSHELL_ENV", "after")
+	DefineFunction("subshellfn", "echo hi")
+	SetAlias("subshellalias", "ls")
+	SetOption("nullglob", true)
+	os.Chdir("/")
+	leave()
+
+	// Everything is as it was before
+	assert.False(t, Subshell())
+	assert.Equal(t, "before", GetVar("GOSH_TEST_SUBSHELL"))
+	assert.Equal(t, "before", os.Getenv("GOSH_TEST_SUBSHELL_ENV"))
+	_, ok := LookupFunction("subshellfn")
+	assert.False(t, ok)
+	_, ok = LookupAlias("subshellalias")
+	assert.False(t, ok)
+	_, ok = options["nullglob"]
+	assert.False(t, ok)
+	cwd, _ := os.Getwd()
+	assert.Equal(t, dir, cwd)
+}
+
+func TestFunctions(t *testing.T) {
+	defer UnsetFunction("greet")
+
+	_, ok := LookupFunction("greet")
+	assert.False(t, ok)
+
+	DefineFunction("greet", "echo hello $1")
+	body, ok := LookupFunction("greet")
+	assert.True(t, ok)
+	assert.Equal(t, "echo hello $1", body)
+	assert.Contains(t, FunctionNames(), "greet")
+
+	// Positional parameters nest with function calls
+	assert.Equal(t, 0, CallDepth())
+	PushPositional([]string{"a", "b"})
+	assert.Equal(t, "a", GetVar("1"))
+	assert.Equal(t, "2", GetVar("#"))
+	PushPositional([]string{"inner"})
+	assert.Equal(t, "inner", GetVar("1"))
+	_, ok = LookupVar("2")
+	assert.False(t, ok)
+	PopPositional()
+	assert.Equal(t, "b", GetVar("2"))
+	PopPositional()
+	assert.Equal(t, 0, CallDepth())
+}
+
+func TestExitStatus(t *testing.T) {
+	defer SetExitStatus(0)
+	defer ClearControl()
+
+	SetExitStatus(42)
+	value, ok := LookupVar("?")
+	assert.True(t, ok)
+	assert.Equal(t, "42", value)
+
+	RequestControl(ControlReturn, 0)
+	control, _ := PendingControl()
+	assert.Equal(t, ControlReturn, control)
+	ClearControl()
+	control, _ = PendingControl()
+	assert.Equal(t, ControlNone, control)
+}
+
+func TestCompletions(t *testing.T) {
+	defer RemoveCompletion("myservice")
+
+	_, ok := LookupCompletion("myservice")
+	assert.False(t, ok)
+
+	SetCompletion("myservice", CompletionSpec{Words: []string{"start", "stop"}, Dirs: true})
+	spec, ok := LookupCompletion("myservice")
+	assert.True(t, ok)
+	assert.Equal(t, CompletionSpec{Words: []string{"start", "stop"}, Dirs: true}, spec)
+	assert.Contains(t, CompletionCommands(), "myservice")
+
+	RemoveCompletion("myservice")
+	_, ok = LookupCompletion("myservice")
+	assert.False(t, ok)
+}
+
+func TestIO(t *testing.T) {
+	defer SetIO(IO{})
+
+	// Unset streams are the process's own
+	assert.Equal(t, os.Stdin, Stdin())
+	assert.Equal(t, os.Stdout, Stdout())
+	assert.Equal(t, os.Stderr, Stderr())
+
+	var out, errOut bytes.Buffer
+	SetIO(IO{Out: &out, Err: &errOut})
+	assert.Equal(t, os.Stdin, Stdin())
+	assert.Same(t, &out, Stdout())
+	assert.Same(t, &errOut, Stderr())
+	assert.Nil(t, CurrentIO().In)
+}
+
+func TestPathDirs(t *testing.T) {
+	root := t.TempDir()
+	for _, dir := range []string{"bin", "home/bin", "work/tools"} {
+		assert.NoError(t, os.MkdirAll(filepath.Join(root, dir), 0755))
+	}
+	assert.NoError(t, os.Symlink(filepath.Join(root, "bin"), filepath.Join(root, "linked")))
+	assert.NoError(t, os.WriteFile(filepath.Join(root, "file"), nil, 0644))
+	t.Setenv("HOME", filepath.Join(root, "home"))
+	t.Chdir(filepath.Join(root, "work"))
+
+	bin := filepath.Join(root, "bin")
+	work := filepath.Join(root, "work")
+	tests := []struct {
+		name     string
+		path     string
+		expected []string
+	}{
+		{"trailing slashes cleaned", bin + "/", []string{bin}},
+		{"duplicates dropped", bin + ":" + bin + "/.:" + root + "/linked", []string{bin}},
+		{"empty entry is the current directory", ":" + bin, []string{work, bin}},
+		{"dot is the current directory", bin + ":.", []string{bin, work}},
+		{"relative entries", "tools:../bin", []string{filepath.Join(work, "tools"), bin}},
+		{"home directory", "~/bin:~", []string{filepath.Join(root, "home/bin"), filepath.Join(root, "home")}},
+		{"missing entries and files dropped", root + "/missing:" + root + "/file:" + bin, []string{bin}},
+		{"nothing usable", root + "/missing", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, PathDirs(tt.path))
+		})
+	}
+}
+
+func TestCommand(t *testing.T) {
+	dir := t.TempDir()
+	script := filepath.Join(dir, "gosh-path-test")
+	assert.NoError(t, os.WriteFile(script, []byte("#!/bin/sh\necho ran\n"), 0755))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "not-executable"), nil, 0644))
+	t.Chdir(dir)
+	t.Setenv("PATH", ".:"+os.Getenv("PATH"))
+
+	// Commands are found through relative entries, and keep their name
+	path, err := LookPath("gosh-path-test")
+	assert.NoError(t, err)
+	assert.Equal(t, script, path)
+	cmd := Command("gosh-path-test", "x")
+	assert.Equal(t, []string{"gosh-path-test", "x"}, cmd.Args)
+	output, err := cmd.Output()
+	assert.NoError(t, err)
+	assert.Equal(t, "ran\n", string(output))
+
+	_, err = LookPath("not-executable")
+	assert.ErrorIs(t, err, exec.ErrNotFound)
+	err = Command("gosh-no-such-command").Run()
+	assert.ErrorIs(t, err, exec.ErrNotFound)
+	path, err = LookPath("./not-executable")
+	assert.NoError(t, err)
+	assert.Equal(t, "./not-executable", path)
+
+	// Strict mode warns about a world-writable directory found through .
+	var stderr bytes.Buffer
+	SetIO(IO{Err: &stderr})
+	defer SetIO(IO{})
+	assert.NoError(t, os.Chmod(dir, 0777))
+	Command("gosh-path-test")
+	assert.Empty(t, stderr.String())
+	t.Setenv("GOSH_STRICT_PATH", "1")
+	Command("gosh-path-test")
+	assert.Equal(t, "gosh: warning: gosh-path-test is in "+dir+", which is in PATH and writable by anyone\n", stderr.String())
+}
+
+func TestCommandStatus(t *testing.T) {
+	assert.Equal(t, 0, CommandStatus(nil))
+	assert.Equal(t, 127, CommandStatus(exec.ErrNotFound))
+	assert.Equal(t, 127, CommandStatus(Command("gosh-no-such-command").Start()))
+	assert.Equal(t, 126, CommandStatus(exec.Command(os.DevNull).Start()))
+
+	err := exec.Command("sh", "-c", "exit 4").Run()
+	assert.Equal(t, 4, CommandStatus(err))
+	err = exec.Command("sh", "-c", "kill -TERM $$").Run()
+	assert.Equal(t, 128+int(syscall.SIGTERM), CommandStatus(err))
+}
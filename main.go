@@ -1,9 +1,15 @@
 package main
 
 import (
+	"errors"
+	"flag"
 	"fmt"
+	"io/fs"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"runtime/debug"
+	"sync"
 	"syscall"
 
 	"github.com/apriljarosz/gosh/internal/builtins"
@@ -11,41 +17,287 @@ import (
 	"github.com/apriljarosz/gosh/internal/history"
 	"github.com/apriljarosz/gosh/internal/input"
 	"github.com/apriljarosz/gosh/internal/jobs"
+	"github.com/apriljarosz/gosh/internal/shell"
 )
 
+// Build information, set with -ldflags "-X main.version=... -X main.commit=..."
+var (
+	version = "dev"
+	commit  = "unknown"
+)
+
+// Channels for signals that currently have a trap installed
+var trapChannels = make(map[syscall.Signal]chan os.Signal)
+
+// Signals that end the shell when they aren't trapped. They're caught so the
+// terminal can be restored before exiting.
+var (
+	fatalSignals       = []syscall.Signal{syscall.SIGHUP, syscall.SIGTERM}
+	fatalSignalChannel = make(chan os.Signal, 1)
+)
+
+// watchFatalSignals restores the terminal, runs the EXIT trap and exits when
+// an untrapped fatal signal arrives
+func watchFatalSignals() {
+	for _, sig := range fatalSignals {
+		signal.Notify(fatalSignalChannel, sig)
+	}
+
+	go func() {
+		for sig := range fatalSignalChannel {
+			sig := sig.(syscall.Signal)
+			if _, ok := shell.GetTrap(sig); ok {
+				continue
+			}
+			input.RestoreTerminal()
+			runExitTrap()
+			os.Exit(128 + int(sig))
+		}
+	}()
+}
+
+// isFatalSignal reports whether sig is one of fatalSignals
+func isFatalSignal(sig syscall.Signal) bool {
+	for _, fatal := range fatalSignals {
+		if sig == fatal {
+			return true
+		}
+	}
+	return false
+}
+
+// updateTrap installs or removes the os/signal handler for sig so that it
+// matches the trap registered for it
+func updateTrap(sig syscall.Signal) {
+	if sig == shell.ExitTrap {
+		return
+	}
+
+	if ch, ok := trapChannels[sig]; ok {
+		signal.Stop(ch)
+		close(ch)
+		delete(trapChannels, sig)
+	}
+
+	command, ok := shell.GetTrap(sig)
+	switch {
+	case !ok && sig == syscall.SIGINT:
+		// The shell itself always ignores SIGINT
+		signal.Ignore(sig)
+	case !ok:
+		if signal.Ignored(sig) {
+			shell.UnignoreSignal(sig)
+		}
+		if isFatalSignal(sig) {
+			signal.Notify(fatalSignalChannel, sig)
+		}
+	case command == "":
+		signal.Ignore(sig)
+	default:
+		ch := make(chan os.Signal, 1)
+		signal.Notify(ch, sig)
+		trapChannels[sig] = ch
+		go func() {
+			for range ch {
+				queueTrap(sig)
+			}
+		}()
+	}
+}
+
+// Signals whose traps are waiting to run. Traps use the same variables and
+// functions as the commands the shell runs, so rather than running as the
+// signal arrives, they run between commands, while the shell waits for
+// input.
+var (
+	pendingTraps      []syscall.Signal
+	pendingTrapsMutex sync.Mutex
+)
+
+// queueTrap arranges for sig's trap to run once the current command is done,
+// or straight away if the shell is waiting for input
+func queueTrap(sig syscall.Signal) {
+	pendingTrapsMutex.Lock()
+	pendingTraps = append(pendingTraps, sig)
+	pendingTrapsMutex.Unlock()
+	input.Wake()
+}
+
+// runPendingTraps runs the traps for any signals that have arrived, in the
+// order they arrived, leaving $? as it was
+func runPendingTraps() {
+	pendingTrapsMutex.Lock()
+	signals := pendingTraps
+	pendingTraps = nil
+	pendingTrapsMutex.Unlock()
+
+	status := shell.ExitStatus()
+	for _, sig := range signals {
+		if command, ok := shell.GetTrap(sig); ok && command != "" {
+			runLine(command)
+		}
+	}
+	shell.SetExitStatus(status)
+}
+
+// runLine parses and executes each command on a command line
+// Returns false if the shell should exit
+func runLine(line string) bool {
+	return executor.RunList(line)
+}
+
+// auditLog is where commands are mirrored with their exit status, if
+// GOSH_AUDIT_LOG names a file
+var auditLog *history.AuditLog
+
+// runAudited runs a command line, recording it in the audit log afterwards
+// Returns false if the shell should exit
+func runAudited(line string) bool {
+	ok := runLine(line)
+	if auditLog != nil {
+		auditLog.Record(line, shell.ExitStatus())
+	}
+	return ok
+}
+
+// historyChooser returns how to pick between several commands matching a
+// !prefix history expansion: from a menu if GOSH_HISTMENU=1 and the shell is
+// interactive, and otherwise nil, meaning the most recent
+func historyChooser() history.Chooser {
+	if os.Getenv("GOSH_HISTMENU") == "1" && input.IsTerminal(os.Stdin) {
+		return input.ChooseHistoryMatch
+	}
+	return nil
+}
+
+// loadKeyBindings sets up the line editor's key bindings from
+// ~/.gosh_inputrc, warning about any lines it can't use
+func loadKeyBindings() {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return
+	}
+	bindings, err := input.LoadKeyBindings(filepath.Join(homeDir, ".gosh_inputrc"))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "gosh: warning: %v\n", err)
+	}
+	input.SetKeyBindings(bindings)
+}
+
+// runLogoutFile runs ~/.gosh_logout, if there is one, as the shell exits
+func runLogoutFile() {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return
+	}
+	if _, err := executor.RunFile(filepath.Join(homeDir, ".gosh_logout")); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		fmt.Fprintf(os.Stderr, "gosh: warning: %v\n", err)
+	}
+}
+
 func main() {
+	// Never leave the terminal in raw mode, even if the shell crashes
+	defer func() {
+		input.RestoreTerminal()
+		if r := recover(); r != nil {
+			fmt.Fprintf(os.Stderr, "gosh: internal error: %v\n%s", r, debug.Stack())
+			os.Exit(2)
+		}
+	}()
+
+	showVersion := flag.Bool("version", false, "print version information and exit")
+	command := flag.String("c", "", "run `command` and exit")
+	var quiet bool
+	flag.BoolVar(&quiet, "q", false, "don't print the greeting or reset the terminal")
+	flag.BoolVar(&quiet, "quiet", false, "same as -q")
+	flag.Parse()
+
+	builtins.SetVersion(version, commit)
+	if *showVersion {
+		fmt.Println(builtins.VersionString())
+		return
+	}
+
 	// Set up signal handling - ignore SIGINT for the shell itself
 	// Child processes will handle their own signals
 	signal.Ignore(syscall.SIGINT)
+	watchFatalSignals()
+	shell.SetTrapHook(updateTrap)
+
+	// Commands typed at a terminal are run interactively, while a script
+	// piped in or given with -c stops at its first syntax error
+	commandGiven := false
+	flag.Visit(func(f *flag.Flag) {
+		commandGiven = commandGiven || f.Name == "c"
+	})
+	shell.SetInteractive(input.IsTerminal(os.Stdin) && !commandGiven)
+
+	// Stay quiet when asked to, or when the shell isn't interactive
+	if os.Getenv("GOSH_QUIET") == "1" || !shell.Interactive() {
+		quiet = true
+	}
+
+	if !quiet {
+		// Set terminal to cooked mode to handle line endings properly
+		fmt.Print("\033[?1049l") // Exit alternate screen if in it
+		fmt.Print("\033[0m")     // Reset all attributes
 
-	// Set terminal to cooked mode to handle line endings properly
-	fmt.Print("\033[?1049l") // Exit alternate screen if in it
-	fmt.Print("\033[0m")     // Reset all attributes
+		fmt.Println("Welcome to gosh - Go Shell")
+	}
 
-	fmt.Println("Welcome to gosh - Go Shell")
 	// Initialize history
 	hist := history.New()
 	builtins.SetHistory(hist)
 	input.SetHistory(hist)
+	input.SetBuiltinDescriptions(builtins.Descriptions())
+	input.SetRecentDirs(builtins.RecentDirs)
+	builtins.SetWindowSize(input.WindowSize)
+	builtins.SetTerminalCheck(input.IsTerminal)
+	input.SetCommandSubstitution(executor.Substitute)
+	input.SetIdleHandler(runPendingTraps)
+	loadKeyBindings()
+	if path := os.Getenv("GOSH_AUDIT_LOG"); path != "" {
+		auditLog = history.NewAuditLog(path)
+	}
 
-	// Initialize readline with history
+	// Set up the line editor chosen by GOSH_READLINE
 	if err := input.InitReadline(hist); err != nil {
-		fmt.Printf("Warning: Could not initialize readline: %v\n", err)
+		fmt.Fprintf(os.Stderr, "gosh: warning: %v\n", err)
 	}
 	defer input.CloseReadline()
 
 	// Initialize job manager
 	jobManager := jobs.NewJobManager()
 	builtins.SetJobManager(jobManager)
+	input.SetJobManager(jobManager)
+	executor.SetJobManager(jobManager)
+	jobManager.SetNotifications(true)
+
+	// With -c, run the command instead of reading any
+	if commandGiven {
+		runAudited(*command)
+		runPendingTraps()
+		runExitTrap()
+		os.Exit(shell.ExitStatus())
+	}
 
 	// Save history on exit
 	defer hist.Save()
 
 	for {
+		// Jobs that have stopped since the last prompt are announced
+		// before the next one, rather than into a line being edited
+		jobManager.PrintNotifications(os.Stdout)
+
+		// Traps for signals that arrive while the shell waits here, or
+		// arrived while the last command ran, are run by ReadLine
 		line, err := input.ReadLine()
 		if err != nil {
 			if err.Error() == "EOF" {
-				fmt.Println()
+				// Finish the line the prompt was on
+				if shell.Interactive() {
+					fmt.Println()
+				}
 				break
 			}
 			fmt.Fprintf(os.Stderr, "Error reading input: %v\n", err)
@@ -56,16 +308,80 @@ func main() {
 			continue
 		}
 
-		// Add command to history
-		hist.Add(line)
+		// Keep reading while the line ends in a backslash, or until a
+		// multi-line function definition, loop or case statement is
+		// complete
+		for {
+			joined, continued := input.TrimContinuation(line)
+			if !continued && !input.NeedsContinuation(line) {
+				break
+			}
+			more, err := input.ReadContinuationLine()
+			if errors.Is(err, input.ErrInterrupted) {
+				// Ctrl+C drops the whole command, as at the prompt
+				line = ""
+				break
+			}
+			if err != nil {
+				break
+			}
+			if continued {
+				// The backslash and newline disappear
+				line = joined + more
+			} else {
+				line += "\n" + more
+			}
+		}
 
-		pipeline := input.ParsePipeline(line)
-		if len(pipeline.Commands) == 0 {
+		if line == "" {
 			continue
 		}
 
-		if !executor.ExecutePipeline(pipeline) {
+		// Expand !! and friends, showing the command that will run. As in
+		// bash, a script's lines are run as they are.
+		if shell.Interactive() {
+			expanded, changed, err := hist.Expand(line, historyChooser())
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "gosh: %v\n", err)
+				continue
+			}
+			if changed {
+				fmt.Println(expanded)
+				line = expanded
+			}
+		}
+
+		// Add command to history
+		input.AddHistory(line)
+
+		if !runAudited(line) {
 			break
 		}
 	}
+
+	// A hangup ends the input, and its trap still has to run
+	runPendingTraps()
+	runLogoutFile()
+	runExitTrap()
+
+	// A script exits with the status of the last command it ran, or of the
+	// one that stopped it
+	if !shell.Interactive() {
+		hist.Save()
+		input.RestoreTerminal()
+		os.Exit(shell.ExitStatus())
+	}
+}
+
+// exitTrapOnce makes sure the EXIT trap runs only once, even if a fatal
+// signal arrives as the shell is exiting anyway
+var exitTrapOnce sync.Once
+
+// runExitTrap runs the EXIT trap, if one is set, before the shell exits
+func runExitTrap() {
+	exitTrapOnce.Do(func() {
+		if command, ok := shell.GetTrap(shell.ExitTrap); ok {
+			runLine(command)
+		}
+	})
 }
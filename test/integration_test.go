@@ -1,10 +1,14 @@
 package main
 
 import (
+	"bufio"
+	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
+	"syscall"
 	"testing"
 	"time"
 
@@ -45,6 +49,26 @@ func TestShellIntegration(t *testing.T) {
 			input:          "echo $USER\nexit\n",
 			expectedOutput: "april", // Use existing USER env var
 		},
+		{
+			name:           "exit trap",
+			input:          "trap 'echo bye from trap' EXIT\nexit\n",
+			expectedOutput: "bye from trap",
+		},
+		{
+			name:           "quoted arguments",
+			input:          "echo 'a | b' \"$USER\"\nexit\n",
+			expectedOutput: "a | b april",
+		},
+		{
+			name:           "background then foreground",
+			input:          "sleep 0.1 & echo done\nexit\n",
+			expectedOutput: "done",
+		},
+		{
+			name:           "shell function",
+			input:          "greet() {\n  echo hello $1\n}\ngreet world\nexit\n",
+			expectedOutput: "hello world",
+		},
 		{
 			name:           "pipe commands",
 			input:          "echo 'line1' | wc -l\nexit\n",
@@ -113,6 +137,279 @@ func TestShellBackgroundJobs(t *testing.T) {
 	assert.Less(t, duration, 2*time.Second)
 }
 
+func TestShellVersionFlag(t *testing.T) {
+	// Build the shell with version information
+	buildCmd := exec.Command("go", "build", "-o", "../gosh_test",
+		"-ldflags", "-X main.version=1.2.3 -X main.commit=abc1234", "../")
+	err := buildCmd.Run()
+	assert.NoError(t, err, "Failed to build shell")
+	defer os.Remove("../gosh_test")
+
+	output, err := exec.Command("../gosh_test", "--version").CombinedOutput()
+	assert.NoError(t, err)
+	assert.Regexp(t, `^gosh version 1\.2\.3 \(commit abc1234, go[^)]+\)\n$`, string(output))
+}
+
+func TestShellQuietStartup(t *testing.T) {
+	// Build the shell first
+	buildCmd := exec.Command("go", "build", "-o", "../gosh_test", "../")
+	err := buildCmd.Run()
+	assert.NoError(t, err, "Failed to build shell")
+	defer os.Remove("../gosh_test")
+
+	for _, args := range [][]string{{}, {"-q"}, {"--quiet"}} {
+		// Input is piped in, so the shell is quiet even without a flag
+		cmd := exec.Command("../gosh_test", args...)
+		cmd.Stdin = strings.NewReader("echo hello\nexit\n")
+
+		output, err := cmd.CombinedOutput()
+		assert.NoError(t, err)
+		assert.Contains(t, string(output), "hello")
+		assert.NotContains(t, string(output), "Welcome to gosh")
+		assert.NotContains(t, string(output), "\033[?1049l")
+	}
+
+	// /dev/null is a character device, but not a terminal
+	devNull, err := os.Open(os.DevNull)
+	assert.NoError(t, err)
+	defer devNull.Close()
+	cmd := exec.Command("../gosh_test")
+	cmd.Stdin = devNull
+	output, err := cmd.CombinedOutput()
+	assert.NoError(t, err)
+	assert.NotContains(t, string(output), "Welcome to gosh")
+}
+
+func TestShellPipedInputHasNoPrompt(t *testing.T) {
+	// Build the shell first
+	buildCmd := exec.Command("go", "build", "-o", "../gosh_test", "../")
+	err := buildCmd.Run()
+	assert.NoError(t, err, "Failed to build shell")
+	defer os.Remove("../gosh_test")
+
+	// Whichever line editor is asked for, piped input gives clean output
+	for _, editor := range []string{"", "builtin", "simple"} {
+		cmd := exec.Command("../gosh_test")
+		cmd.Env = append(os.Environ(), "GOSH_READLINE="+editor, "TERM=xterm")
+		cmd.Stdin = strings.NewReader("echo hello\nfor i in 1 2\ndo\necho $i\ndone\nexit\n")
+
+		output, err := cmd.Output()
+		assert.NoError(t, err)
+		assert.Equal(t, "hello\n1\n2\nGoodbye!\n", string(output), editor)
+		assert.NotContains(t, string(output), "gosh> ")
+	}
+}
+
+func TestShellTrapRunsBetweenCommands(t *testing.T) {
+	// Build the shell first
+	buildCmd := exec.Command("go", "build", "-o", "../gosh_test", "../")
+	err := buildCmd.Run()
+	assert.NoError(t, err, "Failed to build shell")
+	defer os.Remove("../gosh_test")
+
+	// The trap runs once the command the signal arrived during is done,
+	// leaving $? alone
+	cmd := exec.Command("../gosh_test")
+	cmd.Env = append(os.Environ(), "HOME="+t.TempDir())
+	cmd.Stdin = strings.NewReader("trap 'echo caught' USR1\nsh -c 'kill -USR1 $PPID; sleep 0.2; exit 3'\necho status $?\n")
+
+	output, _ := cmd.CombinedOutput()
+	assert.Equal(t, "caught\nstatus 3\n", string(output))
+}
+
+func TestShellTrapRunsWhileWaitingForInput(t *testing.T) {
+	// Build the shell first
+	buildCmd := exec.Command("go", "build", "-o", "../gosh_test", "../")
+	err := buildCmd.Run()
+	assert.NoError(t, err, "Failed to build shell")
+	defer os.Remove("../gosh_test")
+
+	cmd := exec.Command("../gosh_test")
+	cmd.Env = append(os.Environ(), "HOME="+t.TempDir())
+	stdin, err := cmd.StdinPipe()
+	assert.NoError(t, err)
+	defer stdin.Close()
+	stdout, err := cmd.StdoutPipe()
+	assert.NoError(t, err)
+	assert.NoError(t, cmd.Start())
+	defer cmd.Process.Kill()
+
+	lines := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(stdout)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+		close(lines)
+	}()
+	expectLine := func(want string) {
+		t.Helper()
+		select {
+		case line := <-lines:
+			assert.Equal(t, want, line)
+		case <-time.After(3 * time.Second):
+			t.Fatalf("no %q from the shell", want)
+		}
+	}
+
+	io.WriteString(stdin, "trap 'echo caught' USR1\necho ready\n")
+	expectLine("ready")
+
+	// The shell is waiting for its next line, which doesn't hold up the trap
+	assert.NoError(t, cmd.Process.Signal(syscall.SIGUSR1))
+	expectLine("caught")
+}
+
+func TestShellTrapsRunAsTheShellExits(t *testing.T) {
+	// Build the shell first
+	buildCmd := exec.Command("go", "build", "-o", "../gosh_test", "../")
+	err := buildCmd.Run()
+	assert.NoError(t, err, "Failed to build shell")
+	defer os.Remove("../gosh_test")
+
+	tests := []struct {
+		name   string
+		input  string
+		output string
+		status int
+	}{
+		{"hangup at the end of input", "trap 'echo hup' HUP\ntrap 'echo bye' EXIT\nsh -c 'kill -HUP $PPID; sleep 0.2'\n", "hup\nbye\n", 0},
+		{"untrapped fatal signal", "trap 'echo bye' EXIT\nsh -c 'kill -TERM $PPID; sleep 1'\necho after\n", "bye\n", 143},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd := exec.Command("../gosh_test")
+			cmd.Env = append(os.Environ(), "HOME="+t.TempDir())
+			cmd.Stdin = strings.NewReader(tt.input)
+
+			output, _ := cmd.CombinedOutput()
+			assert.Equal(t, tt.output, string(output))
+			assert.Equal(t, tt.status, cmd.ProcessState.ExitCode())
+		})
+	}
+}
+
+func TestShellNohupToDevNull(t *testing.T) {
+	// Build the shell first
+	buildCmd := exec.Command("go", "build", "-o", "../gosh_test", "../")
+	err := buildCmd.Run()
+	assert.NoError(t, err, "Failed to build shell")
+	defer os.Remove("../gosh_test")
+	shellPath, err := filepath.Abs("../gosh_test")
+	assert.NoError(t, err)
+
+	// /dev/null is a character device, but not the terminal, so the
+	// output stays there rather than going to nohup.out
+	dir := t.TempDir()
+	cmd := exec.Command(shellPath, "-c", "nohup echo hi > /dev/null")
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "HOME="+dir)
+	output, err := cmd.CombinedOutput()
+	assert.NoError(t, err)
+	assert.NotContains(t, string(output), "nohup.out")
+	_, err = os.Stat(filepath.Join(dir, "nohup.out"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestShellScriptErrors(t *testing.T) {
+	// Build the shell first
+	buildCmd := exec.Command("go", "build", "-o", "../gosh_test", "../")
+	err := buildCmd.Run()
+	assert.NoError(t, err, "Failed to build shell")
+	defer os.Remove("../gosh_test")
+
+	tests := []struct {
+		name   string
+		args   []string
+		input  string
+		output string
+		status int
+	}{
+		{"syntax error stops a script", nil, "echo before\necho hi >\necho after\n", "before\ngosh: syntax error near unexpected token 'newline'\n", 2},
+		{"failures don't", nil, "false\necho after\n", "after\n", 0},
+		{"set -e stops at a failure", nil, "set -e\necho before\nfalse\necho after\n", "before\n", 1},
+		{"status of the last command", nil, "echo before\nfalse\n", "before\n", 1},
+		{"no history expansion", nil, "echo one\necho !!\n", "one\n!!\n", 0},
+		{"-c", []string{"-c", "echo one; false"}, "", "one\n", 1},
+		{"-c syntax error", []string{"-c", "echo hi >; echo after"}, "", "gosh: syntax error near unexpected token 'newline'\n", 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd := exec.Command("../gosh_test", tt.args...)
+			cmd.Stdin = strings.NewReader(tt.input)
+
+			output, _ := cmd.CombinedOutput()
+			assert.Equal(t, tt.output, string(output))
+			assert.Equal(t, tt.status, cmd.ProcessState.ExitCode())
+		})
+	}
+}
+
+func TestShellAuditLog(t *testing.T) {
+	// Build the shell first
+	buildCmd := exec.Command("go", "build", "-o", "../gosh_test", "../")
+	err := buildCmd.Run()
+	assert.NoError(t, err, "Failed to build shell")
+	defer os.Remove("../gosh_test")
+
+	logPath := t.TempDir() + "/audit.log"
+	cmd := exec.Command("../gosh_test")
+	cmd.Env = append(os.Environ(), "GOSH_AUDIT_LOG="+logPath, "HOME="+t.TempDir())
+	cmd.Stdin = strings.NewReader("echo hello\nfalse\n")
+	cmd.Run()
+	assert.Equal(t, 1, cmd.ProcessState.ExitCode())
+
+	// Each command is logged as timestamp, exit status and command
+	content, err := os.ReadFile(logPath)
+	assert.NoError(t, err)
+	lines := strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+	assert.Len(t, lines, 2)
+	for i, expected := range []string{"0\techo hello", "1\tfalse"} {
+		timestamp, rest, _ := strings.Cut(lines[i], "\t")
+		_, err := time.Parse(time.RFC3339, timestamp)
+		assert.NoError(t, err, lines[i])
+		assert.Equal(t, expected, rest)
+	}
+}
+
+func TestShellIdleTimeout(t *testing.T) {
+	// Build the shell first
+	buildCmd := exec.Command("go", "build", "-o", "../gosh_test", "../")
+	err := buildCmd.Run()
+	assert.NoError(t, err, "Failed to build shell")
+	defer os.Remove("../gosh_test")
+
+	cmd := exec.Command("../gosh_test")
+	cmd.Env = append(os.Environ(), "TMOUT=1")
+
+	// Keep stdin open without ever sending input
+	stdin, err := cmd.StdinPipe()
+	assert.NoError(t, err)
+	defer stdin.Close()
+
+	var output strings.Builder
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+
+	start := time.Now()
+	assert.NoError(t, cmd.Start())
+
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+		assert.GreaterOrEqual(t, time.Since(start), time.Second)
+		assert.Contains(t, output.String(), "auto-logout")
+	case <-time.After(5 * time.Second):
+		cmd.Process.Kill()
+		t.Fatal("shell did not exit after TMOUT")
+	}
+}
+
 func TestShellErrorHandling(t *testing.T) {
 	// Build the shell first
 	buildCmd := exec.Command("go", "build", "-o", "../gosh_test", "../")